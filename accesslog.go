@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Access log formats, selected with -access-log-format.
+const (
+	accessCommon   = "common"
+	accessCombined = "combined"
+	accessJSON     = "json"
+)
+
+// clfTime is the time layout of the Common Log Format.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// accessEntry is a line of the JSON access log.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Duration  float64   `json:"duration_ms"`
+}
+
+// openAccessLog opens the access log fpath for appending, or returns
+// stdout for "-".
+func openAccessLog(fpath string) (io.Writer, error) {
+	if fpath == "-" {
+		return os.Stdout, nil
+	}
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("openAccessLog: %w", err)
+	}
+	return f, nil
+}
+
+// newAccessLog returns the middleware writing a line about every request
+// to w in format: Common or Combined Log Format, or JSON.
+func newAccessLog(w io.Writer, format string) (Middleware, error) {
+	if format != accessCommon && format != accessCombined && format != accessJSON {
+		return nil, fmt.Errorf("newAccessLog: unknown format %q", format)
+	}
+	var mutex sync.Mutex
+	return func(h http.Handler) http.Handler {
+		return accessLog(h, w, format, &mutex)
+	}, nil
+}
+
+// accessLog writes a line about every request to h to w in format, taking
+// mutex for every write.
+func accessLog(h http.Handler, w io.Writer, format string, mutex *sync.Mutex) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: rw}
+		h.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		user, _, _ := r.BasicAuth()
+		var line []byte
+		if format == accessJSON {
+			line, _ = json.Marshal(accessEntry{
+				Time:      start,
+				Remote:    clientIP(r),
+				User:      user,
+				Method:    r.Method,
+				URI:       r.RequestURI,
+				Proto:     r.Proto,
+				Status:    sw.status,
+				Bytes:     sw.size,
+				Referer:   r.Referer(),
+				UserAgent: r.UserAgent(),
+				Duration:  float64(time.Since(start)) / float64(time.Millisecond),
+			})
+		} else {
+			size := "-"
+			if sw.size > 0 {
+				size = strconv.FormatInt(sw.size, 10)
+			}
+			line = fmt.Appendf(nil, "%s - %s [%s] %q %d %s", clientIP(r), orDash(user), start.Format(clfTime),
+				r.Method+" "+r.RequestURI+" "+r.Proto, sw.status, size)
+			if format == accessCombined {
+				line = fmt.Appendf(line, " %q %q", orDash(r.Referer()), orDash(r.UserAgent()))
+			}
+		}
+		line = append(line, '\n')
+		mutex.Lock()
+		w.Write(line)
+		mutex.Unlock()
+	})
+}
+
+// orDash returns s, or "-" for an empty field of the Common Log Format.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	activityStreams = "https://www.w3.org/ns/activitystreams"
+	publicAudience  = activityStreams + "#Public"
+	activityJSON    = "application/activity+json"
+)
+
+// Limits of the ActivityPub endpoints: the size of activities and actors
+// read and how often delivering an activity to an inbox is tried.
+const (
+	maxActivitySize = 1 << 20
+	apAttempts      = 3
+)
+
+// follower is a fediverse account following the blog, keyed by its actor
+// id in the followers file.
+type follower struct {
+	Inbox       string    `json:"inbox"`
+	SharedInbox string    `json:"sharedInbox,omitempty"`
+	Since       time.Time `json:"since"`
+}
+
+// apDelivery is an activity to be posted to an inbox.
+type apDelivery struct {
+	inbox string
+	body  []byte
+}
+
+// activityPub is the blog's ActivityPub actor: it signs its requests with
+// key, keeps its followers in the JSON file fpath and delivers activities
+// to their inboxes in the background.
+type activityPub struct {
+	key       *rsa.PrivateKey
+	client    *http.Client
+	fpath     string
+	mutex     sync.Mutex
+	followers map[string]follower
+	queue     chan apDelivery
+	done      chan struct{}
+}
+
+// federation is the ActivityPub actor; nil disables federation. It is set
+// up in main with -activitypub.
+var federation *activityPub
+
+func newActivityPub(keyFile, followersFile string) (*activityPub, error) {
+	key, err := loadSigningKey(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("newActivityPub: %w", err)
+	}
+	ap := &activityPub{
+		key:       key,
+		client:    publicClient(10 * time.Second),
+		fpath:     followersFile,
+		followers: map[string]follower{},
+		queue:     make(chan apDelivery, 1000),
+		done:      make(chan struct{}),
+	}
+	b, err := os.ReadFile(followersFile)
+	if err == nil {
+		err = json.Unmarshal(b, &ap.followers)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("newActivityPub: %w", err)
+	}
+	go ap.run()
+	return ap, nil
+}
+
+// actorID returns the id of the blog's actor.
+func actorID() string {
+	return absURL("/ap/actor")
+}
+
+// objectID returns the id of the Article of the post p.
+func objectID(p Page) string {
+	return absURL("/ap/post/" + p.Name)
+}
+
+// webfingerAccount returns the account of the actor, user@host.
+func webfingerAccount() string {
+	host := ""
+	if u, err := url.Parse(*flagBaseURL); err == nil {
+		host = u.Host
+	}
+	return *flagAPUser + "@" + host
+}
+
+// actor returns the document of the blog's actor.
+func (ap *activityPub) actor() map[string]interface{} {
+	id := actorID()
+	a := map[string]interface{}{
+		"@context":                  []string{activityStreams, "https://w3id.org/security/v1"},
+		"id":                        id,
+		"type":                      "Person",
+		"preferredUsername":         *flagAPUser,
+		"name":                      *flagSiteName,
+		"summary":                   *flagDescription,
+		"url":                       absURL("/"),
+		"inbox":                     absURL("/ap/inbox"),
+		"outbox":                    absURL("/ap/outbox"),
+		"followers":                 absURL("/ap/followers"),
+		"manuallyApprovesFollowers": false,
+		"discoverable":              true,
+		"endpoints":                 map[string]string{"sharedInbox": absURL("/ap/inbox")},
+		"publicKey": map[string]string{
+			"id":           id + "#main-key",
+			"owner":        id,
+			"publicKeyPem": publicKeyPEM(ap.key),
+		},
+	}
+	if *flagSiteImage != "" {
+		a["icon"] = map[string]string{"type": "Image", "url": absURL(*flagSiteImage)}
+	}
+	return a
+}
+
+// article returns the post p as an ActivityStreams Article.
+func article(p Page) map[string]interface{} {
+	o := map[string]interface{}{
+		"id":           objectID(p),
+		"type":         "Article",
+		"attributedTo": actorID(),
+		"name":         p.Title,
+		"content":      string(feedHTML(p)),
+		"url":          absURL(p.URL()),
+		"published":    p.PublishedAt().UTC().Format(time.RFC3339),
+		"updated":      postUpdated(p).UTC().Format(time.RFC3339),
+		"to":           []string{publicAudience},
+		"cc":           []string{absURL("/ap/followers")},
+	}
+	if p.Summary != "" {
+		o["summary"] = p.Summary
+	}
+	var tags []map[string]string
+	for _, t := range p.Tags {
+		tags = append(tags, map[string]string{
+			"type": "Hashtag",
+			"name": "#" + strings.ReplaceAll(t, " ", ""),
+			"href": absURL("/tag/" + url.PathEscape(t)),
+		})
+	}
+	if tags != nil {
+		o["tag"] = tags
+	}
+	if p.Image != "" {
+		o["image"] = map[string]string{"type": "Image", "url": absURL(p.Image)}
+	}
+	return o
+}
+
+// createActivity returns the activity publishing p.
+func createActivity(p Page) map[string]interface{} {
+	o := article(p)
+	return map[string]interface{}{
+		"id":        objectID(p) + "#create",
+		"type":      "Create",
+		"actor":     actorID(),
+		"published": o["published"],
+		"to":        o["to"],
+		"cc":        o["cc"],
+		"object":    o,
+	}
+}
+
+// withContext returns the activity or object v with the ActivityStreams
+// context, which the nested objects don't repeat.
+func withContext(v map[string]interface{}) map[string]interface{} {
+	v["@context"] = activityStreams
+	return v
+}
+
+// publish delivers the Create activity of p to all followers, once per
+// shared inbox.
+func (ap *activityPub) publish(p Page) {
+	body, err := json.Marshal(withContext(createActivity(p)))
+	if err != nil {
+		slog.Error("encoding activity failed", "post", p.Name, "err", err)
+		return
+	}
+	seen := map[string]bool{}
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+	for _, f := range ap.followers {
+		inbox := f.Inbox
+		if f.SharedInbox != "" {
+			inbox = f.SharedInbox
+		}
+		if !seen[inbox] {
+			seen[inbox] = true
+			ap.deliver(inbox, body)
+		}
+	}
+}
+
+// deliver queues body for inbox.
+func (ap *activityPub) deliver(inbox string, body []byte) {
+	select {
+	case ap.queue <- apDelivery{inbox: inbox, body: body}:
+	default:
+		slog.Warn("activity queue full, dropping activity", "inbox", inbox)
+	}
+}
+
+func (ap *activityPub) run() {
+	defer close(ap.done)
+	for d := range ap.queue {
+		var err error
+		for i := 0; i < apAttempts; i++ {
+			if i > 0 {
+				time.Sleep(time.Duration(i*i) * time.Second)
+			}
+			err = ap.post(d.inbox, d.body)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			slog.Error("delivering activity failed", "inbox", d.inbox, "err", err)
+		}
+	}
+}
+
+// close delivers the queued activities and stops ap. Nothing must be
+// delivered afterwards.
+func (ap *activityPub) close() {
+	close(ap.queue)
+	<-ap.done
+}
+
+// do sends the signed request of method for u with body, which is nil for
+// a GET, and returns the response if its status is 2xx.
+func (ap *activityPub) do(method, u string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", activityJSON)
+	req.Header.Set("User-Agent", "goblog")
+	if body != nil {
+		req.Header.Set("Content-Type", activityJSON)
+	}
+	err = signRequest(req, actorID()+"#main-key", ap.key, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ap.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, u, resp.Status)
+	}
+	return resp, nil
+}
+
+func (ap *activityPub) post(inbox string, body []byte) error {
+	resp, err := ap.do(http.MethodPost, inbox, body)
+	if err != nil {
+		return fmt.Errorf("activityPub.post: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// remoteActor is what the blog needs to know of another actor.
+type remoteActor struct {
+	ID        string `json:"id"`
+	Inbox     string `json:"inbox"`
+	Endpoints struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+	PublicKey struct {
+		ID           string `json:"id"`
+		Owner        string `json:"owner"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+// fetchActor returns the actor owning the key keyID, which is the URL of
+// the actor document with a fragment. The document has to be the actor of
+// that URL, own the key and have its inboxes on the host of that URL, so
+// no actor can make the blog deliver to the inboxes of another host.
+func (ap *activityPub) fetchActor(keyID string) (remoteActor, error) {
+	var a remoteActor
+	u, err := url.Parse(keyID)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return a, fmt.Errorf("activityPub.fetchActor: invalid key id %q", keyID)
+	}
+	u.Fragment = ""
+	resp, err := ap.do(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return a, fmt.Errorf("activityPub.fetchActor: %w", err)
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxActivitySize)).Decode(&a)
+	if err != nil {
+		return a, fmt.Errorf("activityPub.fetchActor: %w", err)
+	}
+	if a.ID != u.String() || a.PublicKey.ID != keyID || a.PublicKey.Owner != a.ID {
+		return a, fmt.Errorf("activityPub.fetchActor: %s does not own %s", u, keyID)
+	}
+	if !onHost(a.Inbox, u.Host) || (a.Endpoints.SharedInbox != "" && !onHost(a.Endpoints.SharedInbox, u.Host)) {
+		return a, fmt.Errorf("activityPub.fetchActor: inboxes of %s are not on its host", u)
+	}
+	return a, nil
+}
+
+// onHost reports whether s is an http or https URL on host.
+func onHost(s, host string) bool {
+	u, err := webURL(s)
+	return err == nil && u.Host == host
+}
+
+// follow adds a as a follower and saves the followers.
+func (ap *activityPub) follow(a remoteActor) error {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+	f, ok := ap.followers[a.ID]
+	if !ok {
+		f.Since = time.Now().UTC()
+	}
+	f.Inbox, f.SharedInbox = a.Inbox, a.Endpoints.SharedInbox
+	ap.followers[a.ID] = f
+	return ap.save()
+}
+
+// unfollow removes the follower id and saves the followers.
+func (ap *activityPub) unfollow(id string) error {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+	if _, ok := ap.followers[id]; !ok {
+		return nil
+	}
+	delete(ap.followers, id)
+	return ap.save()
+}
+
+// count returns the number of followers.
+func (ap *activityPub) count() int {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+	return len(ap.followers)
+}
+
+// save writes the followers to their file. The mutex has to be held.
+func (ap *activityPub) save() error {
+	b, err := json.MarshalIndent(ap.followers, "", "  ")
+	if err != nil {
+		return fmt.Errorf("activityPub.save: %w", err)
+	}
+	err = writeFileAtomic(ap.fpath, b, time.Now())
+	if err != nil {
+		return fmt.Errorf("activityPub.save: %w", err)
+	}
+	return nil
+}
+
+// inboxActivity is an activity posted to the inbox. Only the activities
+// managing followers are handled, everything else is ignored.
+type inboxActivity struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+// objectRef returns the id of the object of act, which is either given
+// as its id or embedded.
+func (act inboxActivity) objectRef() string {
+	var id string
+	if json.Unmarshal(act.Object, &id) == nil {
+		return id
+	}
+	var o struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(act.Object, &o)
+	return o.ID
+}
+
+// writeActivity replies with v as ActivityStreams JSON.
+func writeActivity(w http.ResponseWriter, r *http.Request, contentType string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("writeActivity: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(b)
+}
+
+// makeWebfingerHandlerFunc serves /.well-known/webfinger, which resolves
+// @user@host of -ap-user and -baseurl to the actor.
+func makeWebfingerHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if federation == nil {
+			notFound(w, r)
+			return
+		}
+		acct := webfingerAccount()
+		res := r.URL.Query().Get("resource")
+		if !strings.EqualFold(res, "acct:"+acct) && res != actorID() && res != absURL("/") {
+			notFound(w, r)
+			return
+		}
+		writeActivity(w, r, "application/jrd+json", map[string]interface{}{
+			"subject": "acct:" + acct,
+			"aliases": []string{actorID(), absURL("/")},
+			"links": []map[string]string{
+				{"rel": "self", "type": activityJSON, "href": actorID()},
+				{"rel": "http://webfinger.net/rel/profile-page", "type": "text/html", "href": absURL("/")},
+			},
+		})
+	}
+}
+
+// makeActorHandlerFunc serves /ap/, the actor at /ap/actor, its outbox of
+// the -feed-items newest posts at /ap/outbox, the number of its followers
+// at /ap/followers, the posts as Articles at /ap/post/<file> and the inbox
+// at /ap/inbox.
+func makeActorHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if federation == nil {
+			notFound(w, r)
+			return
+		}
+		route := r.URL.Path[len("/ap/"):]
+		if route == "inbox" {
+			federation.receive(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		switch {
+		case route == "actor":
+			writeActivity(w, r, activityJSON, federation.actor())
+		case route == "outbox":
+			all := posts.published()
+			items := []interface{}{}
+			for _, p := range feedPages(all) {
+				items = append(items, createActivity(p))
+			}
+			writeActivity(w, r, activityJSON, map[string]interface{}{
+				"@context":     activityStreams,
+				"id":           absURL("/ap/outbox"),
+				"type":         "OrderedCollection",
+				"totalItems":   len(all),
+				"orderedItems": items,
+			})
+		case route == "followers":
+			writeActivity(w, r, activityJSON, map[string]interface{}{
+				"@context":   activityStreams,
+				"id":         absURL("/ap/followers"),
+				"type":       "OrderedCollection",
+				"totalItems": federation.count(),
+			})
+		case strings.HasPrefix(route, "post/"):
+			name := route[len("post/"):]
+			p, _, ok := findPage(posts.published(), name)
+			if !ok || p.Name != name {
+				notFound(w, r)
+				return
+			}
+			writeActivity(w, r, activityJSON, withContext(article(p)))
+		default:
+			notFound(w, r)
+		}
+	}
+}
+
+// receive handles an activity posted to the inbox. Its HTTP signature has
+// to be made with the key of its actor. Follows are accepted right away,
+// undone follows and deleted accounts remove the follower.
+func (ap *activityPub) receive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		renderError(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxActivitySize))
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest)
+		return
+	}
+	var act inboxActivity
+	err = json.Unmarshal(body, &act)
+	if err != nil || act.Actor == "" {
+		renderError(w, r, http.StatusBadRequest)
+		return
+	}
+	sig, err := parseSignature(r)
+	var a remoteActor
+	if err == nil {
+		a, err = ap.fetchActor(sig.keyID)
+		if err != nil && act.Type == "Delete" {
+			// Deleted accounts can't be fetched any more; with nothing
+			// to check the signature against the activity is dropped.
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	}
+	if err == nil {
+		var key *rsa.PublicKey
+		key, err = parsePublicKeyPEM(a.PublicKey.PublicKeyPem)
+		if err == nil {
+			err = verifySignature(r, sig, key, body)
+		}
+	}
+	if err == nil && a.ID != act.Actor {
+		err = fmt.Errorf("activity of %s signed by %s", act.Actor, a.ID)
+	}
+	if err != nil {
+		reqLogger(r).Warn("rejected activity", "type", act.Type, "actor", act.Actor, "err", err)
+		renderError(w, r, http.StatusUnauthorized)
+		return
+	}
+	switch act.Type {
+	case "Follow":
+		if act.objectRef() != actorID() {
+			break
+		}
+		err = ap.follow(a)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("activityPub.receive: %w", err))
+			return
+		}
+		sum := sha256.Sum256(body)
+		accept, err := json.Marshal(map[string]interface{}{
+			"@context": activityStreams,
+			"id":       actorID() + "#accepts/" + hex.EncodeToString(sum[:8]),
+			"type":     "Accept",
+			"actor":    actorID(),
+			"object":   json.RawMessage(body),
+		})
+		if err != nil {
+			serverError(w, r, fmt.Errorf("activityPub.receive: %w", err))
+			return
+		}
+		ap.deliver(a.Inbox, accept)
+		reqLogger(r).Info("new follower", "actor", a.ID)
+	case "Undo":
+		var undone inboxActivity
+		json.Unmarshal(act.Object, &undone)
+		if undone.Type != "Follow" {
+			break
+		}
+		err = ap.unfollow(a.ID)
+	case "Delete":
+		if act.objectRef() != a.ID {
+			break
+		}
+		err = ap.unfollow(a.ID)
+	}
+	if err != nil {
+		serverError(w, r, fmt.Errorf("activityPub.receive: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,758 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminPopular is the number of most viewed posts on the dashboard.
+const adminPopular = 5
+
+// newPostSkeleton is the source the editor starts a new post with.
+const newPostSkeleton = "---\ntitle: \ndraft: true\ntags: []\n---\n"
+
+// adminPage is the data every page of the admin area gets besides its
+// own. Admin tells whether the user may manage posts, Writable whether
+// the content store takes edits.
+type adminPage struct {
+	Title    string
+	User     string
+	CSRF     string
+	Admin    bool
+	Writable bool
+}
+
+// newAdminPage returns the adminPage titled title for the session of r.
+func newAdminPage(r *http.Request, title string) adminPage {
+	as := currentSession(r)
+	_, writable := contentStore.(writableStore)
+	return adminPage{
+		Title:    title,
+		User:     as.User.Name,
+		CSRF:     as.CSRF,
+		Admin:    as.User.may(roleAdmin),
+		Writable: writable,
+	}
+}
+
+// adminPost is a post listed in the admin area.
+type adminPost struct {
+	Page     Page
+	Status   string
+	Comments int
+	Views    int64
+}
+
+// adminStats are the numbers shown on the dashboard. Views, Subscribers
+// and Followers are only shown for the features that are on.
+type adminStats struct {
+	Posts       int
+	Drafts      int
+	Scheduled   int
+	Comments    int
+	Moderation  int
+	Views       int64
+	Counting    bool
+	Newsletter  bool
+	Subscribers int
+	Federation  bool
+	Followers   int
+}
+
+// postStatus returns whether p is a draft, scheduled or published at now.
+func postStatus(p Page, now time.Time) string {
+	switch {
+	case p.Draft:
+		return "draft"
+	case !p.published(now):
+		return "scheduled"
+	}
+	return "published"
+}
+
+// adminPosts returns all posts of the content store including drafts and
+// scheduled ones, newest first, with their comment and view counts.
+func adminPosts() ([]adminPost, error) {
+	ps, err := readAllPages(contentStore)
+	if err != nil && !errors.Is(err, errBadPages) {
+		return nil, fmt.Errorf("adminPosts: %w", err)
+	}
+	sort.SliceStable(ps, func(i, j int) bool { return ps[i].PublishedAt().After(ps[j].PublishedAt()) })
+	now := time.Now()
+	counter := counters()
+	list := make([]adminPost, 0, len(ps))
+	for _, p := range ps {
+		cs, err := commentStore.Load(p.Name)
+		if err != nil {
+			return nil, fmt.Errorf("adminPosts: %w", err)
+		}
+		ap := adminPost{Page: p, Status: postStatus(p, now), Comments: len(cs)}
+		if counter != nil {
+			ap.Views, err = counter.views(p.Name)
+			if err != nil {
+				return nil, fmt.Errorf("adminPosts: %w", err)
+			}
+		}
+		list = append(list, ap)
+	}
+	return list, nil
+}
+
+// collectStats sums up list for the dashboard.
+func collectStats(list []adminPost) (adminStats, error) {
+	st := adminStats{
+		Counting:   counters() != nil,
+		Newsletter: newsletter != nil,
+		Federation: federation != nil,
+	}
+	for _, ap := range list {
+		switch ap.Status {
+		case "draft":
+			st.Drafts++
+		case "scheduled":
+			st.Scheduled++
+		default:
+			st.Posts++
+		}
+		st.Comments += ap.Comments
+		st.Views += ap.Views
+	}
+	items, err := moderationQueue(contentStore)
+	if err != nil {
+		return st, fmt.Errorf("collectStats: %w", err)
+	}
+	st.Moderation = len(items)
+	if newsletter != nil {
+		st.Subscribers = newsletter.count()
+	}
+	if federation != nil {
+		st.Followers = federation.count()
+	}
+	return st, nil
+}
+
+// adminNext returns next if it is a page of the admin area to go to after
+// logging in, else the dashboard.
+func adminNext(next string) string {
+	if !strings.HasPrefix(next, "/admin/") || strings.HasPrefix(next, "/admin/login") || strings.ContainsAny(next, "\\\r\n") {
+		return "/admin/"
+	}
+	return next
+}
+
+// requireAdmin lets only requests of a logged in session through to h and
+// sends all others to the login page. POSTs also need the CSRF token of
+// the session; multipart forms, which only uploads send, may be as large
+// as -upload-max. Without users and -moderation-password every request
+// gets a 404.
+func requireAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		us, err := loadUsers(*flagUsers)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("requireAdmin: %w", err))
+			return
+		}
+		if len(us) == 0 && *flagModPassword == "" {
+			notFound(w, r)
+			return
+		}
+		token, as, ok := requestSession(r)
+		if ok && !as.valid(us) {
+			adminSessions.remove(token)
+			ok = false
+		}
+		if !ok {
+			http.Redirect(w, r, "/admin/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		if r.Method == http.MethodPost {
+			if !parseAdminForm(w, r) {
+				return
+			}
+			if !hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(as.CSRF)) {
+				renderError(w, r, http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, withSession(r, as))
+	})
+}
+
+// parseAdminForm parses the form posted with r like parseFormMax, taking
+// multipart forms with uploads up to uploadLimit.
+func parseAdminForm(w http.ResponseWriter, r *http.Request) bool {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct != "multipart/form-data" {
+		return parseFormMax(w, r, maxPostSize)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, uploadLimit())
+	err := r.ParseMultipartForm(maxPostSize)
+	if err == nil {
+		return true
+	}
+	reqLogger(r).Info("invalid form", "err", err)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		renderError(w, r, http.StatusRequestEntityTooLarge)
+	} else {
+		renderError(w, r, http.StatusBadRequest)
+	}
+	return false
+}
+
+// renderAdmin replies with status and the admin template name rendered
+// with data.
+func renderAdmin(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) {
+	b, err := adminTemplates.render(name, data)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("renderAdmin: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// adminLogin is the data of the login page. Users tells whether it asks
+// for a user name, which logging in with the -moderation-password doesn't,
+// and Providers are the logins with a provider users can use instead.
+type adminLogin struct {
+	adminPage
+	Users     bool
+	Providers []oauthLinkButton
+	Next      string
+	Error     string
+}
+
+// newAdminLogin returns the login page for us going on to next.
+func newAdminLogin(us Users, next string) adminLogin {
+	data := adminLogin{adminPage: adminPage{Title: "Log in"}, Users: len(us) > 0, Next: adminNext(next)}
+	if data.Users {
+		data.Providers = loginButtons(oauthAdmin, data.Next)
+	}
+	return data
+}
+
+// renderAdminLoginError replies with the login page showing msg, after a
+// failed login with a provider.
+func renderAdminLoginError(w http.ResponseWriter, r *http.Request, msg string) {
+	us, err := loadUsers(*flagUsers)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("renderAdminLoginError: %w", err))
+		return
+	}
+	data := newAdminLogin(us, "")
+	data.Error = msg
+	renderAdmin(w, r, http.StatusForbidden, "admin/login.tmpl.html", data)
+}
+
+// makeAdminLoginHandlerFunc serves /admin/login, where a POST with the
+// name and password of a user starts a session and goes on to next.
+func makeAdminLoginHandlerFunc() http.HandlerFunc {
+	_, err := adminTemplates.get("admin/login.tmpl.html")
+	if err != nil {
+		panic("makeAdminLoginHandlerFunc: could not parse admin/login.tmpl.html")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		us, err := loadUsers(*flagUsers)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeAdminLoginHandlerFunc: %w", err))
+			return
+		}
+		if len(us) == 0 && *flagModPassword == "" {
+			notFound(w, r)
+			return
+		}
+		data := newAdminLogin(us, r.URL.Query().Get("next"))
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			if _, as, ok := requestSession(r); ok && as.valid(us) {
+				http.Redirect(w, r, data.Next, http.StatusSeeOther)
+				return
+			}
+			renderAdmin(w, r, http.StatusOK, "admin/login.tmpl.html", data)
+			return
+		case http.MethodPost:
+		default:
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		data = newAdminLogin(us, r.PostFormValue("next"))
+		name := r.PostFormValue("name")
+		u, ok, err := checkAdminLogin(name, r.PostFormValue("password"))
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeAdminLoginHandlerFunc: %w", err))
+			return
+		}
+		if !ok {
+			reqLogger(r).Warn("admin login failed", "user", name)
+			data.Error = "Wrong user name or password."
+			if !data.Users {
+				data.Error = "Wrong password."
+			}
+			renderAdmin(w, r, http.StatusUnauthorized, "admin/login.tmpl.html", data)
+			return
+		}
+		token, as, err := adminSessions.create(u, "")
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeAdminLoginHandlerFunc: %w", err))
+			return
+		}
+		setSessionCookie(w, r, token, as.Expires)
+		reqLogger(r).Info("admin login", "user", as.User.Name)
+		http.Redirect(w, r, data.Next, http.StatusSeeOther)
+	}
+}
+
+// makeAdminHandlerFunc serves the admin area below /admin/ behind
+// requireAdmin: the dashboard at /admin/, the posts at /admin/posts, the
+// editor at /admin/new and /admin/edit with its preview at POST
+// /admin/preview and script at /admin/editor.js, uploading files at
+// /admin/upload, deleting posts at /admin/delete, the moderation queue at
+// /admin/comments, the provider accounts linked to the user at
+// /admin/account and POST /admin/logout. Moderators only get the
+// dashboard, the moderation queue and their accounts.
+func makeAdminHandlerFunc() http.HandlerFunc {
+	for _, name := range []string{"dashboard", "posts", "edit", "upload", "delete", "comments", "account"} {
+		_, err := adminTemplates.get("admin/" + name + ".tmpl.html")
+		if err != nil {
+			panic("makeAdminHandlerFunc: could not parse admin/" + name + ".tmpl.html")
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		get := r.Method == http.MethodGet || r.Method == http.MethodHead
+		post := r.Method == http.MethodPost
+		allowed := map[string]bool{
+			"/admin/":          get,
+			"/admin/posts":     get,
+			"/admin/new":       get,
+			"/admin/edit":      get || post,
+			"/admin/preview":   post,
+			"/admin/editor.js": get,
+			"/admin/upload":    get || post,
+			"/admin/delete":    get || post,
+			"/admin/comments":  get || post,
+			"/admin/account":   get || post,
+			"/admin/logout":    post,
+		}
+		ok, known := allowed[r.URL.Path]
+		if !known {
+			notFound(w, r)
+			return
+		}
+		if !ok {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		role := roleAdmin
+		switch r.URL.Path {
+		case "/admin/", "/admin/comments", "/admin/account", "/admin/logout":
+			role = roleModerator
+		}
+		if !currentSession(r).User.may(role) {
+			renderError(w, r, http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/admin/":
+			serveAdminDashboard(w, r)
+		case "/admin/posts":
+			serveAdminPosts(w, r)
+		case "/admin/new":
+			serveAdminEditor(w, r, "")
+		case "/admin/edit":
+			if post {
+				saveAdminPost(w, r)
+				return
+			}
+			serveAdminEditor(w, r, r.URL.Query().Get("file"))
+		case "/admin/preview":
+			serveAdminPreview(w, r)
+		case "/admin/editor.js":
+			serveEditorScript(w, r)
+		case "/admin/upload":
+			serveAdminUpload(w, r)
+		case "/admin/delete":
+			deleteAdminPost(w, r)
+		case "/admin/comments":
+			serveAdminComments(w, r)
+		case "/admin/account":
+			serveAdminAccount(w, r)
+		case "/admin/logout":
+			token, _, _ := requestSession(r)
+			adminSessions.remove(token)
+			setSessionCookie(w, r, "", time.Time{})
+			reqLogger(r).Info("admin logout", "user", currentSession(r).User.Name)
+			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+		}
+	}
+}
+
+// serveAdminDashboard shows the site stats and the most viewed posts.
+func serveAdminDashboard(w http.ResponseWriter, r *http.Request) {
+	list, err := adminPosts()
+	if err != nil {
+		serverError(w, r, fmt.Errorf("serveAdminDashboard: %w", err))
+		return
+	}
+	st, err := collectStats(list)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("serveAdminDashboard: %w", err))
+		return
+	}
+	var popular []adminPost
+	if st.Counting {
+		popular = append(popular, list...)
+		sort.SliceStable(popular, func(i, j int) bool { return popular[i].Views > popular[j].Views })
+		if len(popular) > adminPopular {
+			popular = popular[:adminPopular]
+		}
+	}
+	data := struct {
+		adminPage
+		Stats   adminStats
+		Popular []adminPost
+	}{newAdminPage(r, "Dashboard"), st, popular}
+	renderAdmin(w, r, http.StatusOK, "admin/dashboard.tmpl.html", data)
+}
+
+// serveAdminPosts lists all posts with links to edit and delete them.
+func serveAdminPosts(w http.ResponseWriter, r *http.Request) {
+	list, err := adminPosts()
+	if err != nil {
+		serverError(w, r, fmt.Errorf("serveAdminPosts: %w", err))
+		return
+	}
+	data := struct {
+		adminPage
+		Posts []adminPost
+	}{newAdminPage(r, "Posts"), list}
+	renderAdmin(w, r, http.StatusOK, "admin/posts.tmpl.html", data)
+}
+
+// adminEditor is the data of the editor. New is set for a post not
+// written yet, whose File may be left empty to name it after its date and
+// slug. Preview is the post as the source renders, if asked for.
+type adminEditor struct {
+	adminPage
+	File    string
+	Source  string
+	New     bool
+	Error   string
+	Preview *Page
+}
+
+// serveAdminEditor shows the source of the post file in the editor, or the
+// skeleton of a new post if file is "".
+func serveAdminEditor(w http.ResponseWriter, r *http.Request, file string) {
+	data := adminEditor{adminPage: newAdminPage(r, "New post"), Source: newPostSkeleton, New: true}
+	if !data.Writable {
+		notFound(w, r)
+		return
+	}
+	if file != "" {
+		if !strings.HasSuffix(file, ".md") {
+			notFound(w, r)
+			return
+		}
+		b, _, err := contentStore.Get(file)
+		if errors.Is(err, os.ErrNotExist) {
+			notFound(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, r, fmt.Errorf("serveAdminEditor: %w", err))
+			return
+		}
+		data.Title, data.File, data.Source, data.New = "Edit "+file, file, string(b), false
+	}
+	renderAdmin(w, r, http.StatusOK, "admin/edit.tmpl.html", data)
+}
+
+// saveAdminPost writes the post posted from the editor and goes back to
+// the posts. Posts that fail to render, like those with invalid front
+// matter, and taken file names show the editor again with the error.
+func saveAdminPost(w http.ResponseWriter, r *http.Request) {
+	data := adminEditor{
+		adminPage: newAdminPage(r, "New post"),
+		File:      strings.TrimSpace(r.PostFormValue("file")),
+		Source:    strings.ReplaceAll(r.PostFormValue("source"), "\r\n", "\n"),
+		New:       r.PostFormValue("new") != "",
+	}
+	if !data.Writable {
+		notFound(w, r)
+		return
+	}
+	if !data.New {
+		data.Title = "Edit " + data.File
+	}
+	fail := func(status int, msg string) {
+		data.Error = msg
+		renderAdmin(w, r, status, "admin/edit.tmpl.html", data)
+	}
+	if r.PostFormValue("preview") != "" {
+		p, err := previewPage(data.File, data.Source)
+		if err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		data.Preview = &p
+		renderAdmin(w, r, http.StatusOK, "admin/edit.tmpl.html", data)
+		return
+	}
+	b := []byte(data.Source)
+	_, err := previewPage(data.File, data.Source)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	name := data.File
+	if data.New {
+		name, err = newPostName(b, data.File)
+		if err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		_, _, err = contentStore.Get(name)
+		if err == nil {
+			fail(http.StatusConflict, name+" exists already.")
+			return
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			serverError(w, r, fmt.Errorf("saveAdminPost: %w", err))
+			return
+		}
+	} else if !strings.HasSuffix(name, ".md") {
+		notFound(w, r)
+		return
+	} else if _, _, err = contentStore.Get(name); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			notFound(w, r)
+			return
+		}
+		serverError(w, r, fmt.Errorf("saveAdminPost: %w", err))
+		return
+	}
+	err = contentStore.(writableStore).put(name, b)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("saveAdminPost: %w", err))
+		return
+	}
+	posts.refresh()
+	reqLogger(r).Info("post saved", "post", name, "user", data.User, "new", data.New)
+	http.Redirect(w, r, "/admin/posts", http.StatusSeeOther)
+}
+
+// previewPage renders the source of the post file like loadPage does, but
+// without caching it or loading comments. The name only matters for the
+// title of posts without one.
+func previewPage(file, source string) (Page, error) {
+	if file == "" {
+		file = "preview.md"
+	}
+	info := ContentInfo{Name: file, ModTime: time.Now(), Size: int64(len(source))}
+	p, err := parsePage(info, []byte(source))
+	if err != nil {
+		return p, fmt.Errorf("previewPage: %w", err)
+	}
+	return p, nil
+}
+
+// serveAdminPreview replies with the preview of the posted source as an
+// HTML fragment, which editor.js shows next to the editor. Sources that
+// fail to render get a 400 with the error as text.
+func serveAdminPreview(w http.ResponseWriter, r *http.Request) {
+	source := strings.ReplaceAll(r.PostFormValue("source"), "\r\n", "\n")
+	p, err := previewPage(strings.TrimSpace(r.PostFormValue("file")), source)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err := adminTemplates.get("admin/edit.tmpl.html")
+	if err != nil {
+		serverError(w, r, fmt.Errorf("serveAdminPreview: %w", err))
+		return
+	}
+	var buf bytes.Buffer
+	err = t.ExecuteTemplate(&buf, "preview", p)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("serveAdminPreview: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+// serveEditorScript serves the script updating the preview of the editor
+// while typing. It is a file of the template folders, so it can be
+// overridden like the templates, and not inline, as the -admin-csp allows
+// no inline scripts.
+func serveEditorScript(w http.ResponseWriter, r *http.Request) {
+	b, err := readTemplate("admin/editor.js")
+	if err != nil {
+		serverError(w, r, fmt.Errorf("serveEditorScript: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(b)
+}
+
+// deleteAdminPost asks to confirm deleting the post file given as form
+// value and deletes it on a POST.
+func deleteAdminPost(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		adminPage
+		Post Page
+	}{adminPage: newAdminPage(r, "Delete post")}
+	if !data.Writable {
+		notFound(w, r)
+		return
+	}
+	file := r.FormValue("file")
+	if !strings.HasSuffix(file, ".md") {
+		notFound(w, r)
+		return
+	}
+	p, err := sourcePage(contentStore, file)
+	if errors.Is(err, os.ErrNotExist) {
+		notFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, fmt.Errorf("deleteAdminPost: %w", err))
+		return
+	}
+	if r.Method != http.MethodPost {
+		data.Post = p
+		renderAdmin(w, r, http.StatusOK, "admin/delete.tmpl.html", data)
+		return
+	}
+	err = contentStore.(writableStore).remove(p.Name)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("deleteAdminPost: %w", err))
+		return
+	}
+	posts.refresh()
+	reqLogger(r).Info("post deleted", "post", p.Name, "user", data.User)
+	http.Redirect(w, r, "/admin/posts", http.StatusSeeOther)
+}
+
+// serveAdminComments shows the moderation queue. A POST approves or
+// deletes the comment id of post.
+func serveAdminComments(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		post, id, action := r.PostFormValue("post"), r.PostFormValue("id"), r.PostFormValue("action")
+		if action != moderateApprove && action != moderateDelete {
+			renderError(w, r, http.StatusBadRequest)
+			return
+		}
+		_, err := moderateComment(post, id, action)
+		if errors.Is(err, errNoComment) {
+			notFound(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, r, fmt.Errorf("serveAdminComments: %w", err))
+			return
+		}
+		reqLogger(r).Info("comment moderated", "post", post, "id", id, "action", action, "user", currentSession(r).User.Name)
+		http.Redirect(w, r, "/admin/comments", http.StatusSeeOther)
+		return
+	}
+	items, err := moderationQueue(contentStore)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("serveAdminComments: %w", err))
+		return
+	}
+	data := struct {
+		adminPage
+		Items []moderationItem
+	}{newAdminPage(r, "Comments"), items}
+	renderAdmin(w, r, http.StatusOK, "admin/comments.tmpl.html", data)
+}
+
+// serveAdminAccount lists the provider accounts linked to the user. A POST
+// with a provider links another one by logging in with it, one with an
+// account unlinks that. Logins with the -moderation-password have no user
+// to link accounts to.
+func serveAdminAccount(w http.ResponseWriter, r *http.Request) {
+	as := currentSession(r)
+	shared := as.User.Password == "" && as.Account == ""
+	if r.Method == http.MethodPost && !shared {
+		if p := findProvider(r.PostFormValue("provider")); p != nil {
+			u, err := startOAuth(w, r, p, oauthLink+as.User.Name, "/admin/account")
+			if err != nil {
+				serverError(w, r, fmt.Errorf("serveAdminAccount: %w", err))
+				return
+			}
+			continueAdmin(w, r, u)
+			return
+		}
+		account := r.PostFormValue("account")
+		us, err := loadUsers(*flagUsers)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("serveAdminAccount: %w", err))
+			return
+		}
+		u, ok := us[as.User.Name]
+		if !ok || !u.linked(account) {
+			notFound(w, r)
+			return
+		}
+		var keep []string
+		for _, a := range u.Accounts {
+			if a != account {
+				keep = append(keep, a)
+			}
+		}
+		u.Accounts = keep
+		us[u.Name] = u
+		err = saveUsers(*flagUsers, us)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("serveAdminAccount: %w", err))
+			return
+		}
+		reqLogger(r).Info("account unlinked", "user", u.Name, "account", account)
+		http.Redirect(w, r, "/admin/account", http.StatusSeeOther)
+		return
+	}
+	if r.Method == http.MethodPost {
+		renderError(w, r, http.StatusBadRequest)
+		return
+	}
+	type linkedAccount struct {
+		Account  string
+		Provider string
+	}
+	data := struct {
+		adminPage
+		Shared    bool
+		Accounts  []linkedAccount
+		Providers []*oauthProvider
+	}{adminPage: newAdminPage(r, "Account"), Shared: shared, Providers: oauthProviders}
+	if !shared {
+		us, err := loadUsers(*flagUsers)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("serveAdminAccount: %w", err))
+			return
+		}
+		for _, a := range us[as.User.Name].Accounts {
+			data.Accounts = append(data.Accounts, linkedAccount{a, providerTitle(a)})
+		}
+	}
+	renderAdmin(w, r, http.StatusOK, "admin/account.tmpl.html", data)
+}
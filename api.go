@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiMaxPerPage caps the per_page parameter of the post listing of the
+// API.
+const apiMaxPerPage = 100
+
+// apiDate is the layout of the since and until parameters.
+const apiDate = "2006-01-02"
+
+// apiAuthor is the author of a post in the API.
+type apiAuthor struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Avatar string `json:"avatar,omitempty"`
+	Link   string `json:"link,omitempty"`
+}
+
+// apiRef links a neighboring post in the API.
+type apiRef struct {
+	Slug  string `json:"slug"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+	API   string `json:"api_url"`
+}
+
+// apiPost is a post in the API. The listing leaves out the content and
+// the neighbors; only drafts and scheduled posts, which are visible with
+// -api-token, are Draft or Scheduled.
+type apiPost struct {
+	Slug        string     `json:"slug"`
+	File        string     `json:"file"`
+	Title       string     `json:"title"`
+	URL         string     `json:"url"`
+	API         string     `json:"api_url"`
+	CommentsAPI string     `json:"comments_url,omitempty"`
+	Published   time.Time  `json:"published"`
+	Updated     time.Time  `json:"updated"`
+	Author      *apiAuthor `json:"author,omitempty"`
+	Tags        []string   `json:"tags"`
+	Category    string     `json:"category,omitempty"`
+	Section     string     `json:"section,omitempty"`
+	Featured    bool       `json:"featured,omitempty"`
+	Summary     string     `json:"summary,omitempty"`
+	Image       string     `json:"image,omitempty"`
+	ReadingTime int        `json:"reading_time"`
+	Excerpt     string     `json:"excerpt_html"`
+	Content     string     `json:"content_html,omitempty"`
+	Comments    *int       `json:"comments,omitempty"`
+	Draft       bool       `json:"draft,omitempty"`
+	Scheduled   time.Time  `json:"scheduled,omitzero"`
+	Prev        *apiRef    `json:"prev,omitempty"`
+	Next        *apiRef    `json:"next,omitempty"`
+}
+
+// apiPostList is a page of the post listing of the API.
+type apiPostList struct {
+	Posts      []apiPost `json:"posts"`
+	Page       int       `json:"page"`
+	PerPage    int       `json:"per_page"`
+	Total      int       `json:"total"`
+	TotalPages int       `json:"total_pages"`
+	Prev       string    `json:"prev,omitempty"`
+	Next       string    `json:"next,omitempty"`
+}
+
+// apiComment is a visible comment in the API. Text is the markdown the
+// commenter wrote, HTML its rendering.
+type apiComment struct {
+	ID     string    `json:"id"`
+	Parent string    `json:"parent,omitempty"`
+	Name   string    `json:"name"`
+	Text   string    `json:"text"`
+	HTML   string    `json:"html"`
+	Time   time.Time `json:"time,omitzero"`
+	Avatar string    `json:"avatar,omitempty"`
+	Type   string    `json:"type,omitempty"`
+	Source string    `json:"source,omitempty"`
+}
+
+// apiPostURL returns the API URL of the post with slug.
+func apiPostURL(slug string) string {
+	return absURL("/api/v1/posts/" + url.PathEscape(slug))
+}
+
+func apiRefOf(r *PageRef) *apiRef {
+	if r == nil {
+		return nil
+	}
+	return &apiRef{Slug: r.Slug, Title: r.Title, URL: absURL("/page/" + r.Slug), API: apiPostURL(r.Slug)}
+}
+
+// postAPI returns p as listed by the API.
+func postAPI(p Page) apiPost {
+	ap := apiPost{
+		Slug:        p.Slug,
+		File:        p.Name,
+		Title:       p.Title,
+		URL:         absURL(p.URL()),
+		API:         apiPostURL(p.Slug),
+		Published:   p.PublishedAt().UTC(),
+		Updated:     postUpdated(p).UTC(),
+		Tags:        p.Tags,
+		Category:    p.Category,
+		Section:     p.Section.Path,
+		Featured:    p.Featured,
+		Summary:     p.Summary,
+		ReadingTime: p.ReadingTime,
+		Excerpt:     string(p.Excerpt),
+	}
+	if ap.Tags == nil {
+		ap.Tags = []string{}
+	}
+	if !p.CommentsOff {
+		ap.CommentsAPI = ap.API + "/comments"
+	}
+	if p.Image != "" {
+		ap.Image = absURL(p.Image)
+	}
+	if a := p.Author; a != nil {
+		ap.Author = &apiAuthor{ID: a.ID, Name: a.Name, URL: absURL(a.URL()), Link: a.Link}
+		if a.Avatar != "" {
+			ap.Author.Avatar = absURL(a.Avatar)
+		}
+	}
+	return ap
+}
+
+// commentAPI returns c as the API shows it.
+func commentAPI(c Comment) apiComment {
+	return apiComment{
+		ID:     c.ID,
+		Parent: c.ParentID,
+		Name:   c.Name,
+		Text:   c.Comment,
+		HTML:   string(c.HTML()),
+		Time:   c.Time.UTC(),
+		Avatar: c.Avatar(),
+		Type:   c.Type,
+		Source: c.Source,
+	}
+}
+
+// apiError replies with status and a JSON object describing it with msg.
+func apiError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// writeAPI replies with data as JSON, or a 304 if the client has the
+// version with etag.
+func writeAPI(w http.ResponseWriter, r *http.Request, data interface{}, etag string, modified time.Time) {
+	if notModified(w, r, etag, modified) {
+		return
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(data)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("writeAPI: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf.Bytes())
+}
+
+// postFilter selects the posts of the listing by the query parameters tag,
+// category (including its subcategories), author, section, featured, q
+// (in the title and summary), since and until (dates, both inclusive).
+type postFilter struct {
+	tag, category, author, section, query string
+	featured                              bool
+	since, until                          time.Time
+}
+
+// parsePostFilter returns the filter of the query q.
+func parsePostFilter(q url.Values) (postFilter, error) {
+	f := postFilter{
+		tag:      q.Get("tag"),
+		category: strings.Trim(q.Get("category"), "/"),
+		author:   q.Get("author"),
+		section:  strings.Trim(q.Get("section"), "/"),
+		query:    strings.ToLower(q.Get("q")),
+	}
+	var err error
+	if v := q.Get("featured"); v != "" {
+		f.featured, err = strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid featured %q", v)
+		}
+	}
+	if v := q.Get("since"); v != "" {
+		f.since, err = time.Parse(apiDate, v)
+		if err != nil {
+			return f, fmt.Errorf("invalid since %q, want YYYY-MM-DD", v)
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		f.until, err = time.Parse(apiDate, v)
+		if err != nil {
+			return f, fmt.Errorf("invalid until %q, want YYYY-MM-DD", v)
+		}
+		f.until = f.until.AddDate(0, 0, 1)
+	}
+	return f, nil
+}
+
+// match reports whether p passes f.
+func (f postFilter) match(p Page) bool {
+	if f.tag != "" && !containsFold(p.Tags, f.tag) {
+		return false
+	}
+	if f.category != "" && p.Category != f.category && !strings.HasPrefix(p.Category, f.category+"/") {
+		return false
+	}
+	if f.author != "" && (p.Author == nil || p.Author.ID != f.author) {
+		return false
+	}
+	if f.section != "" && p.Section.Path != f.section {
+		return false
+	}
+	if f.featured && !p.Featured {
+		return false
+	}
+	if f.query != "" && !strings.Contains(strings.ToLower(p.Title+"\n"+p.Summary), f.query) {
+		return false
+	}
+	t := p.PublishedAt()
+	if !f.since.IsZero() && t.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !t.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// containsFold reports whether ss contains s, ignoring case.
+func containsFold(ss []string, s string) bool {
+	for _, v := range ss {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiPageURL returns the URL of page n of the listing requested with r.
+func apiPageURL(r *http.Request, n int) string {
+	q := r.URL.Query()
+	q.Set("page", strconv.Itoa(n))
+	return absURL(r.URL.Path + "?" + q.Encode())
+}
+
+// serveAPIPosts replies with a page of the published posts passing the
+// filter of the query, ?per_page= (default -pagesize) newest first.
+func serveAPIPosts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := parsePostFilter(q)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	n, ok := pageNumber(r)
+	if !ok {
+		apiError(w, http.StatusBadRequest, "invalid page")
+		return
+	}
+	size := *flagPageSize
+	if v := q.Get("per_page"); v != "" {
+		size, err = strconv.Atoi(v)
+		if err != nil || size < 1 {
+			apiError(w, http.StatusBadRequest, "invalid per_page")
+			return
+		}
+	}
+	if size <= 0 || size > apiMaxPerPage {
+		size = apiMaxPerPage
+	}
+	var ps Pages
+	for _, p := range posts.published() {
+		if f.match(p) {
+			ps = append(ps, p)
+		}
+	}
+	pg, ok := paginate(ps, n, size, "")
+	if !ok {
+		apiError(w, http.StatusNotFound, "no such page")
+		return
+	}
+	list := apiPostList{
+		Posts:      []apiPost{},
+		Page:       pg.Number,
+		PerPage:    size,
+		Total:      len(ps),
+		TotalPages: pg.Total,
+	}
+	for _, p := range pg.Pages {
+		list.Posts = append(list.Posts, postAPI(p))
+	}
+	if pg.Prev != "" {
+		list.Prev = apiPageURL(r, n-1)
+	}
+	if pg.Next != "" {
+		list.Next = apiPageURL(r, n+1)
+	}
+	etag, modified := listValidators(pg.Pages, list)
+	writeAPI(w, r, list, etag, modified)
+}
+
+// splitAPIPost splits the path below /api/v1/posts/ into the post, given
+// by slug or file name, which may contain slashes, and what of it is asked
+// for, e.g. "comments".
+func splitAPIPost(rest string) (string, string) {
+	if i := strings.Index(rest+"/", "/comments/"); i >= 0 {
+		return rest[:i], strings.TrimSuffix(rest[i+1:], "/")
+	}
+	return strings.TrimSuffix(rest, "/"), ""
+}
+
+// makeAPIHandlerFunc serves version 1 of the read-only JSON API:
+// /api/v1/posts, the paginated and filterable listing of the published
+// posts, /api/v1/posts/<slug>, a post with its content, and
+// /api/v1/posts/<slug>/comments, its visible comments oldest first.
+// Posts can also be given by file name. The responses may be read from
+// any origin. Everything else needs -api-token and is left to
+// serveAPIWrite.
+func makeAPIHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		rest := strings.TrimPrefix(r.URL.Path, "/api/v1/")
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || rest == "drafts" || rest == "moderation" {
+			serveAPIWrite(w, r, rest)
+			return
+		}
+		if rest == "posts" || rest == "posts/" {
+			serveAPIPosts(w, r)
+			return
+		}
+		rest, ok := strings.CutPrefix(rest, "posts/")
+		if !ok {
+			apiError(w, http.StatusNotFound, "not found")
+			return
+		}
+		slug, sub := splitAPIPost(rest)
+		p, _, ok := findPage(posts.published(), slug)
+		if !ok || (sub != "" && sub != "comments") {
+			apiError(w, http.StatusNotFound, "not found")
+			return
+		}
+		p, err := withComments(p)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeAPIHandlerFunc: %w", err))
+			return
+		}
+		etag, modified := pageValidators(p)
+		if sub == "" {
+			ap := postAPI(p)
+			ap.Content = string(p.Content)
+			count := len(p.Comments)
+			ap.Comments = &count
+			ap.Prev, ap.Next = apiRefOf(p.Prev), apiRefOf(p.Next)
+			writeAPI(w, r, ap, etag, modified)
+			return
+		}
+		if p.CommentsOff {
+			apiError(w, http.StatusNotFound, "comments are off")
+			return
+		}
+		cs := append([]Comment(nil), p.Comments...)
+		sort.SliceStable(cs, func(i, j int) bool {
+			return cs[i].Time.Before(cs[j].Time)
+		})
+		list := struct {
+			Comments []apiComment `json:"comments"`
+		}{[]apiComment{}}
+		for _, c := range cs {
+			list.Comments = append(list.Comments, commentAPI(c))
+		}
+		writeAPI(w, r, list, etag, modified)
+	}
+}
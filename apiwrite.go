@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxPostSize caps the request body of posts written through the API.
+const maxPostSize = 4 << 20
+
+// apiPostInput is a post written through the API as JSON: its front
+// matter and the markdown Content. File names the file of a new post,
+// which otherwise is named after its date and slug.
+type apiPostInput struct {
+	File     string    `json:"file"`
+	Title    string    `json:"title"`
+	Slug     string    `json:"slug"`
+	Author   string    `json:"author"`
+	Date     time.Time `json:"date"`
+	Tags     []string  `json:"tags"`
+	Category string    `json:"category"`
+	Draft    bool      `json:"draft"`
+	Featured bool      `json:"featured"`
+	Publish  time.Time `json:"publish"`
+	Summary  string    `json:"summary"`
+	Image    string    `json:"image"`
+	Content  string    `json:"content"`
+}
+
+// apiModerationItem is a comment of the moderation queue in the API.
+type apiModerationItem struct {
+	Post    string     `json:"post"`
+	Title   string     `json:"title"`
+	Comment apiComment `json:"comment"`
+	Status  string     `json:"status,omitempty"`
+	Reports int        `json:"reports,omitempty"`
+}
+
+// apiWriter reports whether r carries -api-token as bearer token.
+func apiWriter(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(*flagAPIToken)) == 1
+}
+
+// readPostSource returns the source of the post in the body of r: either
+// the markdown file as it is, sent as text/markdown or text/plain, or an
+// apiPostInput as JSON. It also returns the file name asked for, if any.
+// Sources the post can't be rendered from are refused, so they are never
+// stored.
+func readPostSource(w http.ResponseWriter, r *http.Request) ([]byte, string, error) {
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPostSize))
+	if err != nil {
+		return nil, "", fmt.Errorf("readPostSource: %w", err)
+	}
+	file := r.URL.Query().Get("file")
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct != "text/markdown" && ct != "text/plain" {
+		b, file, err = jsonPostSource(r, b)
+		if err != nil {
+			return nil, "", fmt.Errorf("readPostSource: %w", err)
+		}
+	}
+	_, err = previewPage(file, string(b))
+	if err != nil {
+		return nil, "", fmt.Errorf("readPostSource: %w", err)
+	}
+	return b, file, nil
+}
+
+// jsonPostSource returns the source of the post given as apiPostInput b
+// in the body of r and the file name asked for, if any.
+func jsonPostSource(r *http.Request, b []byte) ([]byte, string, error) {
+	var in apiPostInput
+	err := json.Unmarshal(b, &in)
+	if err != nil {
+		return nil, "", fmt.Errorf("jsonPostSource: %w", err)
+	}
+	if in.Title == "" {
+		return nil, "", errors.New("jsonPostSource: a post needs a title")
+	}
+	fm := FrontMatter{
+		Title:    in.Title,
+		Slug:     in.Slug,
+		Author:   in.Author,
+		Date:     in.Date,
+		Tags:     in.Tags,
+		Category: in.Category,
+		Draft:    in.Draft,
+		Featured: in.Featured,
+		Publish:  in.Publish,
+		Summary:  in.Summary,
+		Image:    in.Image,
+	}
+	if fm.Date.IsZero() && r.Method == http.MethodPost {
+		fm.Date = time.Now().UTC().Truncate(time.Second)
+	}
+	b, err = postSource(fm, in.Content)
+	if err != nil {
+		return nil, "", fmt.Errorf("jsonPostSource: %w", err)
+	}
+	return b, in.File, nil
+}
+
+// newPostName returns the file name of the new post with the source b,
+// which is file if that is given.
+func newPostName(b []byte, file string) (string, error) {
+	if file != "" {
+		file = path.Clean(strings.TrimLeft(file, "/"))
+		if !strings.HasSuffix(file, ".md") || strings.HasPrefix(file, "../") || file == ".." {
+			return "", fmt.Errorf("newPostName: invalid file %q", file)
+		}
+		return file, nil
+	}
+	fm, _, err := parseFrontMatter(b)
+	if err != nil {
+		return "", fmt.Errorf("newPostName: %w", err)
+	}
+	slug := slugify(fm.Slug)
+	if slug == "" {
+		slug = slugify(fm.Title)
+	}
+	if slug == "" {
+		slug = "post"
+	}
+	t := fm.Date
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return freeName(contentStore, t, slug)
+}
+
+// findSource returns the post slug, given by slug or file name, among all
+// posts including drafts and scheduled ones.
+func findSource(slug string) (Page, bool, error) {
+	ps, err := readAllPages(contentStore)
+	if err != nil && !errors.Is(err, errBadPages) {
+		return Page{}, false, fmt.Errorf("findSource: %w", err)
+	}
+	p, _, ok := findPage(ps, slug)
+	return p, ok, nil
+}
+
+// writtenPost replies with status and the post name as the API shows it.
+func writtenPost(w http.ResponseWriter, r *http.Request, status int, name string) {
+	p, err := sourcePage(contentStore, name)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("writtenPost: %w", err))
+		return
+	}
+	ap := postAPI(p)
+	ap.Content = string(p.Content)
+	ap.Draft = p.Draft
+	if !p.Publish.IsZero() && p.Publish.After(time.Now()) {
+		ap.Scheduled = p.Publish.UTC()
+	}
+	w.Header().Set("Location", ap.API)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	enc.Encode(ap)
+}
+
+// serveAPIWrite serves the requests of the API needing -api-token:
+// creating posts with a POST to /api/v1/posts, replacing and deleting them
+// with a PUT and a DELETE to /api/v1/posts/<slug>, the drafts and
+// scheduled posts at /api/v1/drafts, the moderation queue at
+// /api/v1/moderation, and approving and deleting comments with a POST to
+// /api/v1/posts/<slug>/comments/<id>/approve and a DELETE to
+// /api/v1/posts/<slug>/comments/<id>. rest is the path below /api/v1/.
+func serveAPIWrite(w http.ResponseWriter, r *http.Request, rest string) {
+	if *flagAPIToken == "" {
+		apiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !apiWriter(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		apiError(w, http.StatusUnauthorized, "invalid or missing token")
+		return
+	}
+	rest = strings.TrimSuffix(rest, "/")
+	switch {
+	case rest == "drafts" && r.Method == http.MethodGet:
+		serveAPIDrafts(w, r)
+		return
+	case rest == "moderation" && r.Method == http.MethodGet:
+		serveAPIModeration(w, r)
+		return
+	case rest == "posts" && r.Method == http.MethodPost:
+		createAPIPost(w, r)
+		return
+	}
+	post, ok := strings.CutPrefix(rest, "posts/")
+	if !ok {
+		apiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	slug, sub := splitAPIPost(post)
+	parts := strings.Split(sub, "/")
+	switch {
+	case sub == "" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		writeAPIPost(w, r, slug)
+	case len(parts) == 2 && parts[0] == "comments" && r.Method == http.MethodDelete:
+		moderateAPIComment(w, r, slug, parts[1], moderateDelete)
+	case len(parts) == 3 && parts[0] == "comments" && parts[2] == moderateApprove && r.Method == http.MethodPost:
+		moderateAPIComment(w, r, slug, parts[1], moderateApprove)
+	default:
+		apiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// createAPIPost writes the post in the body of r to a new file.
+func createAPIPost(w http.ResponseWriter, r *http.Request) {
+	b, file, err := readPostSource(w, r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	name, err := newPostName(b, file)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	_, _, err = contentStore.Get(name)
+	if err == nil {
+		apiError(w, http.StatusConflict, name+" exists already")
+		return
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		serverError(w, r, fmt.Errorf("createAPIPost: %w", err))
+		return
+	}
+	err = contentStore.(writableStore).put(name, b)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("createAPIPost: %w", err))
+		return
+	}
+	posts.refresh()
+	reqLogger(r).Info("post created", "post", name)
+	writtenPost(w, r, http.StatusCreated, name)
+}
+
+// writeAPIPost replaces the post slug with the one in the body of r, or
+// deletes it.
+func writeAPIPost(w http.ResponseWriter, r *http.Request, slug string) {
+	p, ok, err := findSource(slug)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("writeAPIPost: %w", err))
+		return
+	}
+	if !ok {
+		apiError(w, http.StatusNotFound, "no post "+slug)
+		return
+	}
+	cs := contentStore.(writableStore)
+	if r.Method == http.MethodDelete {
+		err = cs.remove(p.Name)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("writeAPIPost: %w", err))
+			return
+		}
+		posts.refresh()
+		reqLogger(r).Info("post deleted", "post", p.Name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	b, _, err := readPostSource(w, r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = cs.put(p.Name, b)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("writeAPIPost: %w", err))
+		return
+	}
+	posts.refresh()
+	reqLogger(r).Info("post updated", "post", p.Name)
+	writtenPost(w, r, http.StatusOK, p.Name)
+}
+
+// serveAPIDrafts replies with the drafts and the scheduled posts, newest
+// first.
+func serveAPIDrafts(w http.ResponseWriter, r *http.Request) {
+	ps, err := readAllPages(contentStore)
+	if err != nil && !errors.Is(err, errBadPages) {
+		serverError(w, r, fmt.Errorf("serveAPIDrafts: %w", err))
+		return
+	}
+	now := time.Now()
+	list := struct {
+		Posts []apiPost `json:"posts"`
+	}{[]apiPost{}}
+	for _, p := range ps {
+		scheduled := !p.Publish.IsZero() && p.Publish.After(now)
+		if p.Static || (!p.Draft && !scheduled) {
+			continue
+		}
+		ap := postAPI(p)
+		ap.Draft = p.Draft
+		if scheduled {
+			ap.Scheduled = p.Publish.UTC()
+		}
+		list.Posts = append(list.Posts, ap)
+	}
+	etag, modified := listValidators(ps, list)
+	writeAPI(w, r, list, etag, modified)
+}
+
+// serveAPIModeration replies with the moderation queue.
+func serveAPIModeration(w http.ResponseWriter, r *http.Request) {
+	items, err := moderationQueue(contentStore)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("serveAPIModeration: %w", err))
+		return
+	}
+	list := struct {
+		Comments []apiModerationItem `json:"comments"`
+	}{[]apiModerationItem{}}
+	for _, it := range items {
+		list.Comments = append(list.Comments, apiModerationItem{
+			Post:    it.Post,
+			Title:   it.Title,
+			Comment: commentAPI(it.Comment),
+			Status:  it.Comment.Status,
+			Reports: it.Comment.Reports,
+		})
+	}
+	writeAPI(w, r, list, etagOf(list, startTime), startTime)
+}
+
+// moderateAPIComment approves or deletes the comment id of the post slug.
+func moderateAPIComment(w http.ResponseWriter, r *http.Request, slug, id, action string) {
+	p, ok, err := findSource(slug)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("moderateAPIComment: %w", err))
+		return
+	}
+	if !ok {
+		apiError(w, http.StatusNotFound, "no post "+slug)
+		return
+	}
+	c, err := moderateComment(p.Name, id, action)
+	if errors.Is(err, errNoComment) {
+		apiError(w, http.StatusNotFound, "no comment "+id)
+		return
+	}
+	if err != nil {
+		serverError(w, r, fmt.Errorf("moderateAPIComment: %w", err))
+		return
+	}
+	reqLogger(r).Info("comment moderated", "post", p.Name, "id", id, "action", action)
+	if action == moderateDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeAPI(w, r, commentAPI(c), etagOf(c, startTime), startTime)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ArchiveMonth struct {
+	Year  int
+	Month time.Month
+	Pages Pages
+}
+
+func (m ArchiveMonth) URL() string {
+	return fmt.Sprintf("/archive/%04d/%02d/", m.Year, int(m.Month))
+}
+
+type ArchiveYear struct {
+	Year   int
+	Months []ArchiveMonth
+}
+
+func (y ArchiveYear) URL() string {
+	return fmt.Sprintf("/archive/%04d/", y.Year)
+}
+
+// Pages returns all pages of the year, newest month first.
+func (y ArchiveYear) Pages() Pages {
+	var ps Pages
+	for _, m := range y.Months {
+		ps = append(ps, m.Pages...)
+	}
+	return ps
+}
+
+// Archive groups pages by year and month of publication, newest first.
+type Archive []ArchiveYear
+
+func buildArchive(ps Pages) Archive {
+	months := map[[2]int]*ArchiveMonth{}
+	for _, p := range ps {
+		t := p.PublishedAt()
+		key := [2]int{t.Year(), int(t.Month())}
+		m, ok := months[key]
+		if !ok {
+			m = &ArchiveMonth{Year: t.Year(), Month: t.Month()}
+			months[key] = m
+		}
+		m.Pages = append(m.Pages, p)
+	}
+	var ms []ArchiveMonth
+	for _, m := range months {
+		sort.SliceStable(m.Pages, func(i, j int) bool {
+			return m.Pages[i].PublishedAt().After(m.Pages[j].PublishedAt())
+		})
+		ms = append(ms, *m)
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].Year != ms[j].Year {
+			return ms[i].Year > ms[j].Year
+		}
+		return ms[i].Month > ms[j].Month
+	})
+	var a Archive
+	for _, m := range ms {
+		if len(a) == 0 || a[len(a)-1].Year != m.Year {
+			a = append(a, ArchiveYear{Year: m.Year})
+		}
+		y := &a[len(a)-1]
+		y.Months = append(y.Months, m)
+	}
+	return a
+}
+
+func (a Archive) lookup(year int, month time.Month) (Pages, bool) {
+	for _, y := range a {
+		if y.Year != year {
+			continue
+		}
+		if month == 0 {
+			return y.Pages(), true
+		}
+		for _, m := range y.Months {
+			if m.Month == month {
+				return m.Pages, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// parseArchivePath parses "", "2024/" or "2024/05/". year is 0 for the
+// whole archive and month is 0 for a whole year.
+func parseArchivePath(path string) (year int, month time.Month, ok bool) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return 0, 0, true
+	}
+	segs := strings.Split(path, "/")
+	if len(segs) > 2 || len(segs[0]) != 4 {
+		return 0, 0, false
+	}
+	year, err := strconv.Atoi(segs[0])
+	if err != nil || year < 1 {
+		return 0, 0, false
+	}
+	if len(segs) == 1 {
+		return year, 0, true
+	}
+	m, err := strconv.Atoi(segs[1])
+	if err != nil || len(segs[1]) != 2 || m < 1 || m > 12 {
+		return 0, 0, false
+	}
+	return year, time.Month(m), true
+}
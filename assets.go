@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/js"
+)
+
+// bundleTypes maps the bundle names templates ask for to the file
+// extension of their sources and their MIME type.
+var bundleTypes = map[string][2]string{
+	"site.css": {".css", "text/css; charset=utf-8"},
+	"site.js":  {".js", "text/javascript; charset=utf-8"},
+}
+
+type bundle struct {
+	name  string
+	mime  string
+	data  []byte
+	hash  string
+	built time.Time
+}
+
+// URL returns the fingerprinted path of the bundle.
+func (b *bundle) URL() string {
+	ext := path.Ext(b.name)
+	return "/assets/" + strings.TrimSuffix(b.name, ext) + "." + b.hash + ext
+}
+
+// assetPipeline concatenates and minifies the assets of the default
+// -assets folder and the theme's assets folder into one bundle per type.
+// A theme file replaces a default file with the same name.
+type assetPipeline struct {
+	mutex   sync.Mutex
+	bundles map[string]*bundle
+	byURL   map[string]*bundle
+	stamp   time.Time
+}
+
+var assets = &assetPipeline{}
+
+func assetDirs() []string {
+	dirs := []string{*flagAssetsFolder}
+	if dir := themeDir(); dir != "" {
+		dirs = append(dirs, filepath.Join(dir, "assets"))
+	}
+	return dirs
+}
+
+func (a *assetPipeline) build() error {
+	files := map[string]string{}
+	var stamp time.Time
+	for _, dir := range assetDirs() {
+		fs, err := ioutil.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("assetPipeline.build: %w", err)
+		}
+		for _, f := range fs {
+			if f.IsDir() {
+				continue
+			}
+			files[f.Name()] = filepath.Join(dir, f.Name())
+			if f.ModTime().After(stamp) {
+				stamp = f.ModTime()
+			}
+		}
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m := minify.New()
+	m.AddFunc("text/css", css.Minify)
+	m.AddFunc("text/javascript", js.Minify)
+	bundles := map[string]*bundle{}
+	byURL := map[string]*bundle{}
+	for bname, bt := range bundleTypes {
+		var src bytes.Buffer
+		for _, name := range names {
+			if path.Ext(name) != bt[0] {
+				continue
+			}
+			b, err := ioutil.ReadFile(files[name])
+			if err != nil {
+				return fmt.Errorf("assetPipeline.build: %w", err)
+			}
+			src.Write(b)
+			if bt[0] == ".js" {
+				// guard against files without a trailing semicolon
+				src.WriteString(";")
+			}
+			src.WriteString("\n")
+		}
+		if src.Len() == 0 {
+			continue
+		}
+		mime := strings.SplitN(bt[1], ";", 2)[0]
+		data, err := m.Bytes(mime, src.Bytes())
+		if err != nil {
+			return fmt.Errorf("assetPipeline.build: %s: %w", bname, err)
+		}
+		sum := sha256.Sum256(data)
+		b := &bundle{name: bname, mime: bt[1], data: data, hash: hex.EncodeToString(sum[:])[:12], built: time.Now()}
+		bundles[bname] = b
+		byURL[b.URL()] = b
+	}
+	a.mutex.Lock()
+	a.bundles, a.byURL, a.stamp = bundles, byURL, stamp
+	a.mutex.Unlock()
+	return nil
+}
+
+// refresh rebuilds the bundles in dev mode if a source changed.
+func (a *assetPipeline) refresh() {
+	if !*flagDev {
+		return
+	}
+	var stamp time.Time
+	for _, dir := range assetDirs() {
+		if t := latestChange(dir); t.After(stamp) {
+			stamp = t
+		}
+	}
+	a.mutex.Lock()
+	stale := stamp.After(a.stamp)
+	a.mutex.Unlock()
+	if stale {
+		err := a.build()
+		if err != nil {
+			slog.Error("building assets failed", "err", err)
+		}
+	}
+}
+
+// url returns the fingerprinted URL of the named bundle, or "" if there
+// are no sources for it. Templates call it as {{ asset "site.css" }}.
+func (a *assetPipeline) url(name string) string {
+	a.refresh()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	b, ok := a.bundles[name]
+	if !ok {
+		return ""
+	}
+	return b.URL()
+}
+
+// ServeHTTP serves the bundles. Their URLs change with their content, so
+// they may be cached forever.
+func (a *assetPipeline) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.refresh()
+	a.mutex.Lock()
+	b, ok := a.byURL[r.URL.Path]
+	a.mutex.Unlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", b.mime)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, b.name, b.built, bytes.NewReader(b.data))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// atomFeed is an Atom 1.0 document, RFC 4287.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomPerson  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published"`
+	Links      []atomLink     `xml:"link"`
+	Author     *atomPerson    `xml:"author"`
+	Categories []atomCategory `xml:"category"`
+	Summary    *atomText      `xml:"summary"`
+	Content    *atomText      `xml:"content"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// atomDate formats t for updated and published.
+func atomDate(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// postUpdated returns when p was updated last: when its source file
+// changed, but never before it was published.
+func postUpdated(p Page) time.Time {
+	if p.PublishedAt().After(p.LastChange) {
+		return p.PublishedAt()
+	}
+	return p.LastChange
+}
+
+// postEntry returns the Atom entry of p.
+func postEntry(p Page) atomEntry {
+	e := atomEntry{
+		Title:     p.Title,
+		ID:        postGUID(p),
+		Updated:   atomDate(postUpdated(p)),
+		Published: atomDate(p.PublishedAt()),
+		Links:     []atomLink{{Rel: "alternate", Type: "text/html", Href: absURL(p.URL())}},
+	}
+	if p.Author != nil && p.Author.Name != "" {
+		e.Author = &atomPerson{Name: p.Author.Name, URI: absURL(p.Author.URL())}
+	}
+	for _, t := range p.Tags {
+		e.Categories = append(e.Categories, atomCategory{Term: t})
+	}
+	text := &atomText{Type: "html", Body: string(feedHTML(p))}
+	if *flagFeedContent == feedFull {
+		e.Content = text
+	} else {
+		e.Summary = text
+	}
+	return e
+}
+
+// newAtomFeed returns the feed of ps titled title at self, listing the
+// page alternate as its HTML version.
+func newAtomFeed(title, self, alternate string, ps Pages) atomFeed {
+	f := atomFeed{
+		Title: title,
+		ID:    absURL(self),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: absURL(self)},
+			{Rel: "alternate", Type: "text/html", Href: absURL(alternate)},
+		},
+		Author: atomPerson{Name: *flagSiteName, URI: absURL("/")},
+	}
+	for _, l := range hubLinks(self) {
+		if l.Rel == "hub" {
+			f.Links = append(f.Links, l)
+		}
+	}
+	var updated time.Time
+	for _, p := range ps {
+		f.Entries = append(f.Entries, postEntry(p))
+		if t := postUpdated(p); t.After(updated) {
+			updated = t
+		}
+	}
+	if updated.IsZero() {
+		updated = startTime
+	}
+	f.Updated = atomDate(updated)
+	return f
+}
+
+// serveAtom replies with the Atom feed of ps, or a 304 if the client has
+// it already.
+func serveAtom(w http.ResponseWriter, r *http.Request, title, self, alternate string, ps Pages) {
+	ps = feedPages(ps)
+	f := newAtomFeed(title, self, alternate, ps)
+	etag, modified := listValidators(ps, f)
+	if notModified(w, r, etag, modified) {
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	err := enc.Encode(f)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("serveAtom: %w", err))
+		return
+	}
+	setHubLinks(w, self)
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// makeAtomHandlerFunc serves /atom.xml, the Atom feed of the -feed-items
+// newest posts.
+func makeAtomHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveAtom(w, r, *flagSiteName, "/atom.xml", "/", posts.published())
+	}
+}
+
+// tagFeedSuffix follows the name of a tag in the URL of its Atom feed.
+const tagFeedSuffix = "/atom.xml"
+
+// serveTagAtom replies with the Atom feed of the posts tagged t.
+func serveTagAtom(w http.ResponseWriter, r *http.Request, t Tag) {
+	tag := url.PathEscape(t.Name)
+	serveAtom(w, r, *flagSiteName+": "+t.Name, "/tag/"+tag+tagFeedSuffix, "/tag/"+tag, t.Pages)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+type Author struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Bio    string `json:"bio"`
+	Avatar string `json:"avatar"`
+	Link   string `json:"link"`
+	// Email receives comment notifications if -notify-authors is set. It
+	// is never published.
+	Email string `json:"email,omitempty"`
+}
+
+// MarshalJSON leaves out the email address, so the API doesn't expose it.
+func (a Author) MarshalJSON() ([]byte, error) {
+	type public Author
+	p := public(a)
+	p.Email = ""
+	return json.Marshal(p)
+}
+
+// URL returns the path of the author's listing page.
+func (a Author) URL() string {
+	return "/author/" + a.ID
+}
+
+type Authors map[string]Author
+
+// loadAuthors reads a JSON list of authors. A missing file yields no
+// authors so the blog runs without any configuration.
+func loadAuthors(fpath string) (Authors, error) {
+	as := Authors{}
+	f, err := os.Open(fpath)
+	if errors.Is(err, os.ErrNotExist) {
+		return as, nil
+	}
+	if err != nil {
+		return as, fmt.Errorf("loadAuthors: %w", err)
+	}
+	defer f.Close()
+	var list []Author
+	err = json.NewDecoder(f).Decode(&list)
+	if err != nil {
+		return as, fmt.Errorf("loadAuthors.Decode: %w", err)
+	}
+	for _, a := range list {
+		as[a.ID] = a
+	}
+	return as, nil
+}
+
+// lookup returns the author with id. Unknown ids still produce an author
+// named after the id, so a typo in the front matter doesn't hide the post.
+func (as Authors) lookup(id string) Author {
+	if a, ok := as[id]; ok {
+		return a
+	}
+	return Author{ID: id, Name: id}
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupManifest is the first entry of every backup and describes it.
+const backupManifest = "goblog-backup.json"
+
+// backupVersion is the layout of the backups written. Restoring refuses
+// backups of other versions.
+const backupVersion = 1
+
+// Folders of a backup: the files of the content store and of -static, the
+// comments of each post as JSON, the -files and -tmpl folders, and the
+// backupConfigs together with the counters of the bolt store and the
+// flags the backup was made with.
+const (
+	backupContent   = "content/"
+	backupStatic    = "static/"
+	backupComments  = "comments/"
+	backupFiles     = "files/"
+	backupTemplates = "templates/"
+	backupConfig    = "config/"
+)
+
+// unrecordedFlags are left out of the flags recorded in backups: the
+// secrets and the one-off commands.
+var unrecordedFlags = map[string]bool{
+	"postgres": true, "git": true, "git-secret": true, "moderation-password": true, "akismet-key": true,
+	"secret": true, "smtp-password": true, "webhook-secret": true, "backup": true, "restore": true,
+	"api-token": true, "add-user": true, "github-secret": true, "google-secret": true, "oidc-secret": true,
+}
+
+// manifest is the content of backupManifest.
+type manifest struct {
+	Version      int       `json:"version"`
+	Created      time.Time `json:"created"`
+	ContentStore string    `json:"content_store"`
+	CommentStore string    `json:"comment_store"`
+}
+
+// writeBackup writes a tar.gz of the posts, static pages, comments,
+// uploaded files, templates and configuration of the blog to w.
+func writeBackup(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	m, err := json.MarshalIndent(manifest{backupVersion, now.UTC(), *flagContentStore, *flagCommentStore}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("writeBackup: %w", err)
+	}
+	err = writeBackupFile(tw, backupManifest, m, now)
+	if err != nil {
+		return fmt.Errorf("writeBackup: %w", err)
+	}
+	for _, s := range []struct {
+		prefix string
+		cs     ContentStore
+	}{{backupContent, contentStore}, {backupStatic, staticStore}} {
+		err = backupStore(tw, s.prefix, s.cs, true)
+		if err != nil {
+			return fmt.Errorf("writeBackup: %w", err)
+		}
+	}
+	err = backupDir(tw, backupFiles, *flagFilesFolder)
+	if err == nil && *flagTmplFolder != "" {
+		err = backupDir(tw, backupTemplates, *flagTmplFolder)
+	}
+	if err == nil {
+		err = backupConfigFiles(tw, now)
+	}
+	if err != nil {
+		return fmt.Errorf("writeBackup: %w", err)
+	}
+	err = tw.Close()
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("writeBackup: %w", err)
+	}
+	return nil
+}
+
+func writeBackupFile(tw *tar.Writer, name string, b []byte, modified time.Time) error {
+	return writeBackupEntry(tw, name, b, 0o644, modified)
+}
+
+// writeBackupEntry writes b as the file name with mode to tw.
+func writeBackupEntry(tw *tar.Writer, name string, b []byte, mode int64, modified time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     mode,
+		Size:     int64(len(b)),
+		ModTime:  modified,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(b)
+	return err
+}
+
+// backupStore adds the files of cs below prefix and, with comments, the
+// comments of each of them below backupComments.
+func backupStore(tw *tar.Writer, prefix string, cs ContentStore, comments bool) error {
+	infos, err := cs.List()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		b, info, err := cs.Get(info.Name)
+		if err != nil {
+			return err
+		}
+		err = writeBackupFile(tw, prefix+info.Name, b, info.ModTime)
+		if err != nil {
+			return err
+		}
+		if !comments {
+			continue
+		}
+		cs, err := commentStore.Load(info.Name)
+		if err != nil {
+			return err
+		}
+		if len(cs) == 0 {
+			continue
+		}
+		b, err = json.MarshalIndent(cs, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = writeBackupFile(tw, backupComments+info.Name+".json", b, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupDir adds the files below dir below prefix. A missing dir is
+// skipped.
+func backupDir(tw *tar.Writer, prefix, dir string) error {
+	return backupStore(tw, prefix, newFileContentStore(dir), false)
+}
+
+// backupConfigs are the files of the configuration and the state of the
+// blog kept below backupConfig, by their name there. The private ones,
+// holding password hashes, addresses or the signing key, are written
+// readable by their owner only, in backups and when restored.
+var backupConfigs = []struct {
+	name    string
+	fpath   *string
+	private bool
+}{
+	{"authors.json", flagAuthorsFile, false},
+	{"users.json", flagUsers, true},
+	{"subscribers.json", flagSubscribers, true},
+	{"followers.json", flagAPFollowers, false},
+	{"activitypub.pem", flagAPKey, true},
+	{"blogroll.json", flagBlogroll, false},
+	{"announced.json", flagAnnounced, false},
+}
+
+// backupCounters is the name below backupConfig of the view counts and
+// reactions of the bolt comment store.
+const backupCounters = "counters.json"
+
+// backupConfigFiles adds the backupConfigs that exist, the counters of
+// the bolt comment store and the flags set on the command line, leaving
+// out unrecordedFlags.
+func backupConfigFiles(tw *tar.Writer, now time.Time) error {
+	for _, c := range backupConfigs {
+		b, err := os.ReadFile(*c.fpath)
+		if err == nil {
+			mode := int64(0o644)
+			if c.private {
+				mode = 0o600
+			}
+			err = writeBackupEntry(tw, backupConfig+c.name, b, mode, now)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if bs, ok := commentStore.(*boltStore); ok {
+		counters, err := bs.counters()
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(counters, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = writeBackupFile(tw, backupConfig+backupCounters, b, now)
+		if err != nil {
+			return err
+		}
+	}
+	flags := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		if !unrecordedFlags[f.Name] {
+			flags[f.Name] = f.Value.String()
+		}
+	})
+	b, err := json.MarshalIndent(flags, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeBackupFile(tw, backupConfig+"flags.json", b, now)
+}
+
+// restoreConfig restores the entry name below backupConfig holding b,
+// modified at modified. Unknown names, like the recorded flags, are
+// skipped; it reports whether name was restored.
+func restoreConfig(name string, b []byte, modified time.Time) (bool, error) {
+	if name == backupCounters {
+		bs, ok := commentStore.(*boltStore)
+		if !ok {
+			return false, nil
+		}
+		var counters boltCounters
+		err := json.Unmarshal(b, &counters)
+		if err != nil {
+			return false, err
+		}
+		return true, bs.setCounters(counters)
+	}
+	for _, c := range backupConfigs {
+		if c.name != name {
+			continue
+		}
+		err := writeFileAtomic(*c.fpath, b, modified)
+		if err == nil && c.private {
+			err = os.Chmod(*c.fpath, 0o600)
+		}
+		return err == nil, err
+	}
+	return false, nil
+}
+
+// writeBackupFlag writes a backup to the file fpath, or to stdout if it
+// is "-".
+func writeBackupFlag(fpath string) error {
+	if fpath == "-" {
+		return writeBackup(os.Stdout)
+	}
+	f, err := os.Create(fpath)
+	if err != nil {
+		return fmt.Errorf("writeBackupFlag: %w", err)
+	}
+	err = writeBackup(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fpath)
+		return fmt.Errorf("writeBackupFlag: %w", err)
+	}
+	return nil
+}
+
+// backupFileName is the name of a backup made at t.
+func backupFileName(t time.Time) string {
+	return "goblog-" + t.UTC().Format("20060102-150405") + ".tar.gz"
+}
+
+// backupTo writes a backup into the folder dir and returns its path. The
+// file only appears once it is complete.
+func backupTo(dir string) (string, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return "", fmt.Errorf("backupTo: %w", err)
+	}
+	f, err := os.CreateTemp(dir, ".backup-*")
+	if err != nil {
+		return "", fmt.Errorf("backupTo: %w", err)
+	}
+	err = writeBackup(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	fpath := filepath.Join(dir, backupFileName(time.Now()))
+	if err == nil {
+		err = os.Rename(f.Name(), fpath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("backupTo: %w", err)
+	}
+	return fpath, nil
+}
+
+// pruneBackups removes all but the newest keep backups in dir.
+func pruneBackups(dir string, keep int) error {
+	names, err := filepath.Glob(filepath.Join(dir, "goblog-*.tar.gz"))
+	if err != nil {
+		return fmt.Errorf("pruneBackups: %w", err)
+	}
+	sort.Strings(names)
+	for len(names) > keep {
+		err = os.Remove(names[0])
+		if err != nil {
+			return fmt.Errorf("pruneBackups: %w", err)
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// scheduledBackup makes a backup into -backup-dir, keeping the newest
+// -backup-keep, and uploads it to -backup-s3 if that is set.
+func scheduledBackup() error {
+	fpath, err := backupTo(*flagBackupDir)
+	if err != nil {
+		return fmt.Errorf("scheduledBackup: %w", err)
+	}
+	slog.Info("backup written", "path", fpath)
+	if *flagBackupKeep > 0 {
+		err = pruneBackups(*flagBackupDir, *flagBackupKeep)
+		if err != nil {
+			return fmt.Errorf("scheduledBackup: %w", err)
+		}
+	}
+	if *flagBackupS3 == "" {
+		return nil
+	}
+	c, prefix, err := parseS3URL(*flagBackupS3, *flagS3Region)
+	if err != nil {
+		return fmt.Errorf("scheduledBackup: %w", err)
+	}
+	b, err := os.ReadFile(fpath)
+	if err != nil {
+		return fmt.Errorf("scheduledBackup: %w", err)
+	}
+	err = c.put(prefix+filepath.Base(fpath), b)
+	if err != nil {
+		return fmt.Errorf("scheduledBackup: %w", err)
+	}
+	return nil
+}
+
+// backupEvery makes a scheduled backup every interval until the process
+// exits, logging failures.
+func backupEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := scheduledBackup()
+		if err != nil {
+			slog.Error("backup failed", "err", err)
+		}
+	}
+}
+
+// makeBackupHandlerFunc serves /backup, a download of a fresh backup,
+// behind requireRole for admins.
+func makeBackupHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+backupFileName(time.Now())+`"`)
+		err := writeBackup(w)
+		if err != nil {
+			// the headers are sent, the client sees a truncated archive
+			logError(r, fmt.Errorf("makeBackupHandlerFunc: %w", err))
+		}
+	}
+}
+
+// readBackup calls fn for every regular file of the backup at fpath,
+// after checking that it starts with a manifest of backupVersion.
+func readBackup(fpath string, fn func(h *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for first := true; ; first = false {
+		h, err := tr.Next()
+		if err == io.EOF {
+			if first {
+				return errors.New("empty backup")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if first {
+			var m manifest
+			if h.Name != backupManifest || json.NewDecoder(tr).Decode(&m) != nil {
+				return errors.New("not a goblog backup")
+			}
+			if m.Version != backupVersion {
+				return fmt.Errorf("backup version %d, want %d", m.Version, backupVersion)
+			}
+			continue
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		err = fn(h, tr)
+		if err != nil {
+			return fmt.Errorf("%s: %w", h.Name, err)
+		}
+	}
+}
+
+// checkBackupEntry makes sure the entry name of a backup stays inside the
+// folder it is restored to and, for comments, holds valid comments.
+func checkBackupEntry(name string, r io.Reader) error {
+	folder, rel, _ := strings.Cut(name, "/")
+	switch folder + "/" {
+	case backupContent, backupStatic, backupComments, backupFiles, backupTemplates, backupConfig:
+	default:
+		return errors.New("unknown folder")
+	}
+	if rel == "" || !filepath.IsLocal(filepath.FromSlash(rel)) || path.Clean(rel) != rel {
+		return errors.New("invalid name")
+	}
+	if folder+"/" == backupComments {
+		var cs []Comment
+		err := json.NewDecoder(r).Decode(&cs)
+		if err != nil {
+			return fmt.Errorf("invalid comments: %w", err)
+		}
+	}
+	return nil
+}
+
+// restoreBackup checks the backup at fpath and unpacks it: the posts into
+// -src, or through -import-pages' import for the SQL stores, the static
+// pages into -static, the comments into the comment store, the files into
+// -files, the templates into -tmpl, if set, and the backupConfigs and
+// counters with restoreConfig. Posts can't be restored into git and S3
+// content stores, which are read only, and the recorded flags are not
+// applied. It returns the number of files restored.
+func restoreBackup(fpath string) (int, error) {
+	err := readBackup(fpath, func(h *tar.Header, r io.Reader) error {
+		return checkBackupEntry(h.Name, r)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("restoreBackup: %w", err)
+	}
+	contentDir := *flagSrcFolder
+	sqlStore, isSQL := contentStore.(*sqlContentStore)
+	if isSQL {
+		contentDir, err = os.MkdirTemp("", "goblog-restore-")
+		if err != nil {
+			return 0, fmt.Errorf("restoreBackup: %w", err)
+		}
+		defer os.RemoveAll(contentDir)
+	} else if *flagContentStore != contentFiles {
+		contentDir = ""
+		slog.Warn("posts are not restored into a read only content store", "store", *flagContentStore)
+	}
+	dirs := map[string]string{
+		backupContent: contentDir,
+		backupStatic:  *flagStaticSrc,
+		backupFiles:   *flagFilesFolder,
+	}
+	if *flagTmplFolder != "" {
+		dirs[backupTemplates] = *flagTmplFolder
+	}
+	n := 0
+	err = readBackup(fpath, func(h *tar.Header, r io.Reader) error {
+		folder, rel, _ := strings.Cut(h.Name, "/")
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		switch folder + "/" {
+		case backupComments:
+			var cs []Comment
+			err = json.Unmarshal(b, &cs)
+			if err == nil {
+				err = commentStore.Update(strings.TrimSuffix(rel, ".json"), func([]Comment) ([]Comment, error) {
+					return cs, nil
+				})
+			}
+		case backupConfig:
+			var ok bool
+			ok, err = restoreConfig(rel, b, h.ModTime)
+			if err == nil && !ok {
+				return nil
+			}
+		default:
+			dir := dirs[folder+"/"]
+			if dir == "" {
+				return nil
+			}
+			err = writeFileAtomic(filepath.Join(dir, filepath.FromSlash(rel)), b, h.ModTime)
+		}
+		if err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, fmt.Errorf("restoreBackup: %w", err)
+	}
+	if isSQL {
+		_, err = importPages(contentDir, sqlStore)
+		if err != nil {
+			return n, fmt.Errorf("restoreBackup: %w", err)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// BlogrollEntry is a site listed in the blogroll. Feed is the URL of its
+// feed, if it has one.
+type BlogrollEntry struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Feed        string `json:"feed,omitempty"`
+	Description string `json:"description,omitempty"`
+	Category    string `json:"category,omitempty"`
+}
+
+// BlogrollCategory is a group of blogroll entries, in the order they
+// first appear in the file. Entries without a category have the name "".
+type BlogrollCategory struct {
+	Name    string
+	Entries []BlogrollEntry
+}
+
+// Blogroll is the blogroll file with the time it was last modified.
+type Blogroll struct {
+	Categories []BlogrollCategory
+	Modified   time.Time
+}
+
+// loadBlogroll reads a JSON list of blogroll entries. A missing file yields
+// an empty blogroll, which is served as a 404.
+func loadBlogroll(fpath string) (Blogroll, error) {
+	var br Blogroll
+	b, err := os.ReadFile(fpath)
+	if errors.Is(err, os.ErrNotExist) {
+		return br, nil
+	}
+	if err != nil {
+		return br, fmt.Errorf("loadBlogroll: %w", err)
+	}
+	var list []BlogrollEntry
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		return br, fmt.Errorf("loadBlogroll: %w", err)
+	}
+	if fi, err := os.Stat(fpath); err == nil {
+		br.Modified = fi.ModTime()
+	}
+	index := map[string]int{}
+	for _, e := range list {
+		if e.Name == "" || e.URL == "" {
+			return br, fmt.Errorf("loadBlogroll: entry %q without name or url", e.Name+e.URL)
+		}
+		i, ok := index[e.Category]
+		if !ok {
+			i = len(br.Categories)
+			index[e.Category] = i
+			br.Categories = append(br.Categories, BlogrollCategory{Name: e.Category})
+		}
+		br.Categories[i].Entries = append(br.Categories[i].Entries, e)
+	}
+	return br, nil
+}
+
+// blogrollOPML returns the URL of the OPML export of the blogroll, or "" if
+// there is no blogroll file. It is the blogroll template function.
+func blogrollOPML() string {
+	if _, err := os.Stat(*flagBlogroll); err != nil {
+		return ""
+	}
+	return absURL("/blogroll.opml")
+}
+
+// opml is an OPML 2.0 document listing subscriptions.
+type opml struct {
+	XMLName  xml.Name      `xml:"opml"`
+	Version  string        `xml:"version,attr"`
+	Title    string        `xml:"head>title"`
+	Modified string        `xml:"head>dateModified,omitempty"`
+	OwnerID  string        `xml:"head>ownerId,omitempty"`
+	Docs     string        `xml:"head>docs"`
+	Body     []opmlOutline `xml:"body>outline"`
+}
+
+// opmlOutline is a subscription of an OPML document, or a category of
+// them.
+type opmlOutline struct {
+	Text        string        `xml:"text,attr"`
+	Title       string        `xml:"title,attr,omitempty"`
+	Type        string        `xml:"type,attr,omitempty"`
+	XMLURL      string        `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL     string        `xml:"htmlUrl,attr,omitempty"`
+	URL         string        `xml:"url,attr,omitempty"`
+	Description string        `xml:"description,attr,omitempty"`
+	Outlines    []opmlOutline `xml:"outline"`
+}
+
+// opmlEntry returns the outline of e: a feed subscription if e has a feed,
+// a link otherwise.
+func opmlEntry(e BlogrollEntry) opmlOutline {
+	o := opmlOutline{Text: e.Name, Title: e.Name, Description: e.Description}
+	if e.Feed != "" {
+		o.Type, o.XMLURL, o.HTMLURL = "rss", e.Feed, e.URL
+	} else {
+		o.Type, o.URL = "link", e.URL
+	}
+	return o
+}
+
+// blogrollDoc returns br as OPML document. Categories become outlines
+// containing their entries.
+func blogrollDoc(br Blogroll) opml {
+	doc := opml{
+		Version: "2.0",
+		Title:   *flagSiteName + " blogroll",
+		OwnerID: absURL("/"),
+		Docs:    "http://opml.org/spec2.opml",
+	}
+	if !br.Modified.IsZero() {
+		doc.Modified = br.Modified.UTC().Format(time.RFC1123Z)
+	}
+	for _, c := range br.Categories {
+		var outlines []opmlOutline
+		for _, e := range c.Entries {
+			outlines = append(outlines, opmlEntry(e))
+		}
+		if c.Name == "" {
+			doc.Body = append(doc.Body, outlines...)
+			continue
+		}
+		doc.Body = append(doc.Body, opmlOutline{Text: c.Name, Title: c.Name, Outlines: outlines})
+	}
+	return doc
+}
+
+// makeBlogrollHandlerFunc serves the blogroll of -blogroll at /blogroll
+// and as OPML at /blogroll.opml, for importing it into feed readers.
+func makeBlogrollHandlerFunc() http.HandlerFunc {
+	_, err := templates.get("blogroll.tmpl.html")
+	if err != nil {
+		panic("makeBlogrollHandlerFunc: could not parse blogroll.tmpl.html")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		br, err := loadBlogroll(*flagBlogroll)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeBlogrollHandlerFunc: %w", err))
+			return
+		}
+		if len(br.Categories) == 0 {
+			notFound(w, r)
+			return
+		}
+		if r.URL.Path == "/blogroll" {
+			data := struct {
+				Title      string
+				Categories []BlogrollCategory
+				OPML       string
+			}{"Blogroll", br.Categories, absURL("/blogroll.opml")}
+			err = templates.execute(w, "blogroll.tmpl.html", data)
+			if err != nil {
+				serverError(w, r, fmt.Errorf("makeBlogrollHandlerFunc: %w", err))
+			}
+			return
+		}
+		doc := blogrollDoc(br)
+		if notModified(w, r, etagOf(doc, br.Modified), br.Modified) {
+			return
+		}
+		b, err := xml.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeBlogrollHandlerFunc: %w", err))
+			return
+		}
+		w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+		w.Write([]byte(xml.Header))
+		w.Write(b)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the bolt database. comments holds the JSON of the comments
+// of each post and views the number of views of each post; reactions
+// holds a bucket per post with the count of each reaction.
+var (
+	boltComments  = []byte("comments")
+	boltViews     = []byte("views")
+	boltReactions = []byte("reactions")
+)
+
+// boltStore keeps comments, view counts and reactions in a single bbolt
+// file. Every update runs in a transaction; bbolt serializes them.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// openBoltStore opens the database at fpath, creating it and its buckets
+// if needed. Only one process can have it open.
+func openBoltStore(fpath string) (*boltStore, error) {
+	db, err := bolt.Open(fpath, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("openBoltStore: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltComments, boltViews, boltReactions} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("openBoltStore: %w", err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+func loadBoltComments(tx *bolt.Tx, post string) ([]Comment, error) {
+	b := tx.Bucket(boltComments).Get([]byte(post))
+	if b == nil {
+		return nil, nil
+	}
+	var cs []Comment
+	err := json.Unmarshal(b, &cs)
+	return cs, err
+}
+
+func (s *boltStore) Load(post string) ([]Comment, error) {
+	var cs []Comment
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		cs, err = loadBoltComments(tx, post)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("boltStore.Load: %w", err)
+	}
+	return cs, nil
+}
+
+func (s *boltStore) Update(post string, fn func([]Comment) ([]Comment, error)) error {
+	var fnErr error
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		cs, err := loadBoltComments(tx, post)
+		if err != nil {
+			return err
+		}
+		cs, fnErr = fn(cs)
+		if fnErr != nil {
+			return fnErr
+		}
+		b, err := json.Marshal(cs)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltComments).Put([]byte(post), b)
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("boltStore.Update: %w", err)
+	}
+	return nil
+}
+
+func (s *boltStore) Ping() error {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltComments) == nil {
+			return fmt.Errorf("bucket %s missing", boltComments)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("boltStore.Ping: %w", err)
+	}
+	return nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// boltCounters are the view counts and reactions of a boltStore by post,
+// as backups keep them.
+type boltCounters struct {
+	Views     map[string]int64            `json:"views"`
+	Reactions map[string]map[string]int64 `json:"reactions"`
+}
+
+// counters returns the view counts and reactions of all posts.
+func (s *boltStore) counters() (boltCounters, error) {
+	c := boltCounters{Views: map[string]int64{}, Reactions: map[string]map[string]int64{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltViews).ForEach(func(k, v []byte) error {
+			c.Views[string(k)] = counterValue(v)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		reactions := tx.Bucket(boltReactions)
+		return reactions.ForEach(func(post, _ []byte) error {
+			counts := map[string]int64{}
+			c.Reactions[string(post)] = counts
+			return reactions.Bucket(post).ForEach(func(k, v []byte) error {
+				counts[string(k)] = counterValue(v)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return c, fmt.Errorf("boltStore.counters: %w", err)
+	}
+	return c, nil
+}
+
+// setCounters sets the view counts and reactions of the posts in c.
+// Counters of other posts are kept.
+func (s *boltStore) setCounters(c boltCounters) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for post, n := range c.Views {
+			err := tx.Bucket(boltViews).Put([]byte(post), binary.BigEndian.AppendUint64(nil, uint64(n)))
+			if err != nil {
+				return err
+			}
+		}
+		for post, counts := range c.Reactions {
+			b, err := tx.Bucket(boltReactions).CreateBucketIfNotExists([]byte(post))
+			if err != nil {
+				return err
+			}
+			for reaction, n := range counts {
+				err = b.Put([]byte(reaction), binary.BigEndian.AppendUint64(nil, uint64(n)))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("boltStore.setCounters: %w", err)
+	}
+	return nil
+}
+
+// increment adds one to the counter key of bucket b.
+func increment(b *bolt.Bucket, key []byte) error {
+	var n uint64
+	if v := b.Get(key); len(v) == 8 {
+		n = binary.BigEndian.Uint64(v)
+	}
+	return b.Put(key, binary.BigEndian.AppendUint64(nil, n+1))
+}
+
+func counterValue(v []byte) int64 {
+	if len(v) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+// countView counts a view of post. Views of concurrent requests share a
+// transaction, so they don't cost a sync to disk each.
+func (s *boltStore) countView(post string) error {
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		return increment(tx.Bucket(boltViews), []byte(post))
+	})
+	if err != nil {
+		return fmt.Errorf("boltStore.countView: %w", err)
+	}
+	return nil
+}
+
+func (s *boltStore) views(post string) (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		n = counterValue(tx.Bucket(boltViews).Get([]byte(post)))
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("boltStore.views: %w", err)
+	}
+	return n, nil
+}
+
+func (s *boltStore) react(post, reaction string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltReactions).CreateBucketIfNotExists([]byte(post))
+		if err != nil {
+			return err
+		}
+		return increment(b, []byte(reaction))
+	})
+	if err != nil {
+		return fmt.Errorf("boltStore.react: %w", err)
+	}
+	return nil
+}
+
+func (s *boltStore) reactions(post string) (map[string]int64, error) {
+	counts := map[string]int64{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltReactions).Bucket([]byte(post))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			counts[string(k)] = counterValue(v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("boltStore.reactions: %w", err)
+	}
+	return counts, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// sourceCache keeps pages rendered from their source files, so markdown is
+// only rendered again when a file changes. Nothing is kept with -dev.
+type sourceCache struct {
+	mutex sync.Mutex
+	pages map[sourceKey]cachedSource
+}
+
+// sourceKey identifies a source file by its store and name.
+type sourceKey struct {
+	store ContentStore
+	name  string
+}
+
+// cachedSource is a page together with the modification time and size of
+// the file it was rendered from.
+type cachedSource struct {
+	modTime time.Time
+	size    int64
+	page    Page
+}
+
+// sources holds the pages loadPage rendered.
+var sources = &sourceCache{pages: map[sourceKey]cachedSource{}}
+
+// get returns the page rendered from the file info of cs if the file
+// still has the modification time and size of info, asking cs if it is a
+// renderedStore and the page isn't held yet.
+func (c *sourceCache) get(cs ContentStore, info ContentInfo) (Page, bool) {
+	c.mutex.Lock()
+	src, ok := c.pages[sourceKey{cs, info.Name}]
+	c.mutex.Unlock()
+	if ok && src.modTime.Equal(info.ModTime) && src.size == info.Size {
+		return src.page, true
+	}
+	rs, ok := cs.(renderedStore)
+	if !ok || *flagDev {
+		return Page{}, false
+	}
+	p, ok := rs.loadRendered(info)
+	if ok {
+		c.keep(cs, info, p)
+	}
+	return p, ok
+}
+
+// put keeps p rendered from the file info of cs, also in cs if it is a
+// renderedStore.
+func (c *sourceCache) put(cs ContentStore, info ContentInfo, p Page) {
+	if *flagDev {
+		return
+	}
+	c.keep(cs, info, p)
+	if rs, ok := cs.(renderedStore); ok {
+		err := rs.storeRendered(info, p)
+		if err != nil {
+			slog.Warn("storing rendered page failed", "name", info.Name, "err", err)
+		}
+	}
+}
+
+// clear drops all pages, e.g. after the shortcodes changed.
+func (c *sourceCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pages = map[sourceKey]cachedSource{}
+}
+
+func (c *sourceCache) keep(cs ContentStore, info ContentInfo, p Page) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pages[sourceKey{cs, info.Name}] = cachedSource{modTime: info.ModTime, size: info.Size, page: p}
+}
+
+// renderCacheSize is the number of rendered pages renderCache keeps.
+const renderCacheSize = 500
+
+// renderCache keeps rendered pages by their ETag, which changes with
+// everything they are rendered from. Nothing is kept with -dev, as the
+// ETags don't cover the templates.
+type renderCache struct {
+	mutex sync.Mutex
+	pages map[string][]byte
+}
+
+// rendered holds the pages, posts and listings served recently.
+var rendered = &renderCache{pages: map[string][]byte{}}
+
+// render returns the page with etag, calling fn to render it if it isn't
+// cached yet. If the cache is full a random page is dropped.
+func (c *renderCache) render(etag string, fn func() ([]byte, error)) ([]byte, error) {
+	c.mutex.Lock()
+	b, ok := c.pages[etag]
+	c.mutex.Unlock()
+	if ok {
+		return b, nil
+	}
+	b, err := fn()
+	if err != nil || *flagDev {
+		return b, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.pages) >= renderCacheSize {
+		for k := range c.pages {
+			delete(c.pages, k)
+			break
+		}
+	}
+	c.pages[etag] = b
+	return b, nil
+}
+
+// clear drops all pages, e.g. after the templates changed.
+func (c *renderCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pages = map[string][]byte{}
+}
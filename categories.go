@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Crumb is one step of a category path, e.g. "web" in "go/web/templates".
+type Crumb struct {
+	Name string
+	Path string
+}
+
+// cleanCategory normalizes a category path by trimming slashes and empty
+// segments.
+func cleanCategory(category string) string {
+	var segs []string
+	for _, s := range strings.Split(category, "/") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			segs = append(segs, s)
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+func breadcrumbs(category string) []Crumb {
+	var cs []Crumb
+	if category == "" {
+		return cs
+	}
+	segs := strings.Split(category, "/")
+	for i, s := range segs {
+		cs = append(cs, Crumb{Name: s, Path: strings.Join(segs[:i+1], "/")})
+	}
+	return cs
+}
+
+type Category struct {
+	Name     string
+	Path     string
+	Pages    Pages
+	Children []*Category
+}
+
+// collectCategories builds the category tree of ps. The returned root has
+// an empty path and holds uncategorized pages.
+func collectCategories(ps Pages) *Category {
+	root := &Category{}
+	for _, p := range ps {
+		c := root
+		for _, cr := range p.Breadcrumbs {
+			c = c.child(cr)
+		}
+		c.Pages = append(c.Pages, p)
+	}
+	root.sort()
+	return root
+}
+
+func (c *Category) child(cr Crumb) *Category {
+	for _, ch := range c.Children {
+		if ch.Name == cr.Name {
+			return ch
+		}
+	}
+	ch := &Category{Name: cr.Name, Path: cr.Path}
+	c.Children = append(c.Children, ch)
+	return ch
+}
+
+func (c *Category) sort() {
+	sort.Slice(c.Children, func(i, j int) bool {
+		return c.Children[i].Name < c.Children[j].Name
+	})
+	for _, ch := range c.Children {
+		ch.sort()
+	}
+}
+
+// Lookup returns the category at path below c.
+func (c *Category) Lookup(path string) (*Category, bool) {
+	for _, cr := range breadcrumbs(cleanCategory(path)) {
+		var next *Category
+		for _, ch := range c.Children {
+			if ch.Name == cr.Name {
+				next = ch
+				break
+			}
+		}
+		if next == nil {
+			return nil, false
+		}
+		c = next
+	}
+	return c, true
+}
+
+// AllPages returns the pages of c and of all its subcategories.
+func (c *Category) AllPages() Pages {
+	ps := append(Pages{}, c.Pages...)
+	for _, ch := range c.Children {
+		ps = append(ps, ch.AllPages()...)
+	}
+	return ps
+}
+
+// Breadcrumbs returns the path from the root down to c.
+func (c *Category) Breadcrumbs() []Crumb {
+	return breadcrumbs(c.Path)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secret signs the tokens handed out with forms. It is set up in main from
+// -secret, or randomly if that is empty, which invalidates all forms on
+// restart.
+var secret []byte
+
+// newSecret returns the bytes of s, or random bytes if s is empty.
+func newSecret(s string) ([]byte, error) {
+	if s != "" {
+		return []byte(s), nil
+	}
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// sign returns the MAC of s under secret.
+func sign(s string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// honeypotField is the name of the comment form field that is hidden from
+// humans and only filled in by bots.
+const honeypotField = "website"
+
+// commentFormMaxAge is how long a comment form can be submitted after it
+// was rendered.
+const commentFormMaxAge = 24 * time.Hour
+
+var (
+	errHoneypot = errors.New("honeypot field filled in")
+	errBadToken = errors.New("invalid form token")
+	errTooFast  = errors.New("form submitted too fast")
+	errTooLate  = errors.New("form expired")
+	errNoWork   = errors.New("missing proof of work")
+	errSpent    = errors.New("form token already used")
+)
+
+// CommentChallenge is embedded into the comment form: the token and, if
+// -comment-pow is set, the number of leading zero bits the SHA-256 of
+// "<token>:<nonce>" must have.
+type CommentChallenge struct {
+	Token string
+	Bits  int
+}
+
+// commentTokenMark is the token of the comment form as rendered, so pages
+// can be kept in the render cache; fillCommentTokens puts a fresh token in
+// its place for every response.
+const commentTokenMark = "goblog-comment-token"
+
+func newCommentChallenge() CommentChallenge {
+	return CommentChallenge{Token: commentTokenMark, Bits: *flagCommentPoW}
+}
+
+// newCommentToken returns a token of the comment form of post: the time,
+// a random nonce making it unique and their MAC together with post.
+func newCommentToken(post string, now time.Time) string {
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	v := strconv.FormatInt(now.Unix(), 10) + "." + hex.EncodeToString(nonce)
+	return v + "." + sign(post+":"+v)
+}
+
+// fillCommentTokens returns the page of post rendered as b with a fresh
+// token in place of commentTokenMark.
+func fillCommentTokens(b []byte, post string) []byte {
+	if !bytes.Contains(b, []byte(commentTokenMark)) {
+		return b
+	}
+	return bytes.ReplaceAll(b, []byte(commentTokenMark), []byte(newCommentToken(post, time.Now())))
+}
+
+// spentTokens holds the comment tokens taken, with the time they were
+// handed out, until they expire, so every token is taken once.
+var spentTokens = struct {
+	sync.Mutex
+	tokens map[string]time.Time
+}{tokens: map[string]time.Time{}}
+
+// spendToken records token handed out at issued as taken, reporting false
+// if it was taken before.
+func spendToken(token string, issued, now time.Time) bool {
+	spentTokens.Lock()
+	defer spentTokens.Unlock()
+	for t, at := range spentTokens.tokens {
+		if now.Sub(at) > commentFormMaxAge {
+			delete(spentTokens.tokens, t)
+		}
+	}
+	if _, ok := spentTokens.tokens[token]; ok {
+		return false
+	}
+	spentTokens.tokens[token] = issued
+	return true
+}
+
+// checkCommentForm returns why the comment on post submitted with r looks
+// automated, or nil if it passes the honeypot, token, timing and proof of
+// work checks. The token has to be one handed out for post that was not
+// taken before.
+func checkCommentForm(r *http.Request, post string, now time.Time) error {
+	if r.FormValue(honeypotField) != "" {
+		return errHoneypot
+	}
+	token := r.FormValue("token")
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(sign(post+":"+token[:i]))) {
+		return errBadToken
+	}
+	ts, _, _ := strings.Cut(token, ".")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errBadToken
+	}
+	age := now.Sub(time.Unix(sec, 0))
+	if age < *flagCommentDelay {
+		return errTooFast
+	}
+	if age > commentFormMaxAge {
+		return errTooLate
+	}
+	if *flagCommentPoW > 0 && !validWork(token, r.FormValue("nonce"), *flagCommentPoW) {
+		return errNoWork
+	}
+	if !spendToken(token, time.Unix(sec, 0), now) {
+		return errSpent
+	}
+	return nil
+}
+
+// validWork reports whether the SHA-256 of "<challenge>:<nonce>" starts
+// with at least n zero bits.
+func validWork(challenge, nonce string, n int) bool {
+	if nonce == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(challenge + ":" + nonce))
+	zeros := 0
+	for _, b := range sum {
+		if b != 0 {
+			zeros += bits.LeadingZeros8(b)
+			break
+		}
+		zeros += 8
+	}
+	return zeros >= n
+}
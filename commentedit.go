@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// editCookiePrefix is followed by the comment ID in the name of the cookie
+// holding the edit token of a comment.
+const editCookiePrefix = "edit_"
+
+var errNoComment = errors.New("no such comment")
+
+// editToken returns the token allowing to edit comment id on post until
+// expiry.
+func editToken(post, id string, expiry time.Time) string {
+	exp := strconv.FormatInt(expiry.Unix(), 10)
+	return exp + "." + sign("edit|"+post+"|"+id+"|"+exp)
+}
+
+// validEditToken reports whether token allows editing comment id on post
+// at now.
+func validEditToken(token, post, id string, now time.Time) bool {
+	exp, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	sec, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.After(time.Unix(sec, 0)) {
+		return false
+	}
+	want := sign("edit|" + post + "|" + id + "|" + exp)
+	return hmac.Equal([]byte(sig), []byte(want))
+}
+
+// setEditCookie hands the commenter the token for editing c on post for
+// -comment-edit. The comment template shows the edit link to readers
+// having the cookie, which is only sent back over HTTPS if r came that way.
+func setEditCookie(w http.ResponseWriter, r *http.Request, post string, c Comment) {
+	if *flagCommentEdit <= 0 {
+		return
+	}
+	expiry := time.Now().Add(*flagCommentEdit)
+	http.SetCookie(w, &http.Cookie{
+		Name:     editCookiePrefix + c.ID,
+		Value:    editToken(post, c.ID, expiry),
+		Path:     "/",
+		Expires:  expiry,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// makeEditCommentHandlerFunc serves /editcomment/<post>?id=<id>: a form
+// to change or delete the comment for its author, who proves to be it
+// with the edit cookie. Changed comments are checked for spam again like
+// new ones.
+func makeEditCommentHandlerFunc() http.HandlerFunc {
+	_, err := templates.get("editcomment.tmpl.html")
+	if err != nil {
+		panic("makeEditCommentHandlerFunc: could not parse editcomment.tmpl.html")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		post := r.URL.Path[len("/editcomment/"):]
+		if !parseForm(w, r) {
+			return
+		}
+		id := r.FormValue("id")
+		cookie, err := r.Cookie(editCookiePrefix + id)
+		if err != nil || !validEditToken(cookie.Value, post, id, time.Now()) {
+			renderError(w, r, http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodGet {
+			cs, err := commentStore.Load(post)
+			if err != nil {
+				serverError(w, r, fmt.Errorf("makeEditCommentHandlerFunc: %w", err))
+				return
+			}
+			i := findComment(cs, id)
+			if i < 0 {
+				notFound(w, r)
+				return
+			}
+			data := struct {
+				Title   string
+				Post    string
+				Comment Comment
+			}{"Edit comment", post, cs[i]}
+			err = templates.execute(w, "editcomment.tmpl.html", data)
+			if err != nil {
+				serverError(w, r, fmt.Errorf("makeEditCommentHandlerFunc: %w", err))
+			}
+			return
+		}
+		if r.Method != http.MethodPost {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		del := r.FormValue("delete") != ""
+		text := r.FormValue("comment")
+		if !del {
+			if e := validateText("Comment", &text, maxCommentText); e != "" {
+				reqLogger(r).Info("invalid comment edit", "reason", e)
+				renderError(w, r, http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		held := false
+		if !del {
+			cs, err := commentStore.Load(post)
+			if err != nil {
+				serverError(w, r, fmt.Errorf("makeEditCommentHandlerFunc: %w", err))
+				return
+			}
+			i := findComment(cs, id)
+			if i < 0 {
+				notFound(w, r)
+				return
+			}
+			edited := cs[i]
+			edited.Comment = text
+			switch checkSpam(r, absURL("/page/"+post), edited) {
+			case spamBlatant:
+				renderError(w, r, http.StatusForbidden)
+				return
+			case spamSuspect:
+				if *flagSpamAction == spamReject {
+					renderError(w, r, http.StatusForbidden)
+					return
+				}
+				held = true
+			}
+		}
+		var deleted Comment
+		err = commentStore.Update(post, func(cs []Comment) ([]Comment, error) {
+			i := findComment(cs, id)
+			if i < 0 {
+				return nil, errNoComment
+			}
+			if del {
+				deleted = cs[i]
+				return append(cs[:i], cs[i+1:]...), nil
+			}
+			cs[i].Comment = text
+			if held {
+				cs[i].Status = commentHeld
+			}
+			return cs, nil
+		})
+		if errors.Is(err, errNoComment) {
+			notFound(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeEditCommentHandlerFunc: %w", err))
+			return
+		}
+		if del {
+			if webhooks != nil {
+				webhooks.fire(eventCommentDeleted, post, deleted)
+			}
+			http.SetCookie(w, &http.Cookie{Name: editCookiePrefix + id, Path: "/", MaxAge: -1})
+			http.Redirect(w, r, "/page/"+post, http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/page/"+post+"#comment-"+id, http.StatusFound)
+	}
+}
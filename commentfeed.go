@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// commentFeedSuffix follows the slug of a post in the URL of its comment
+// feed.
+const commentFeedSuffix = "/comments.xml"
+
+// recentComments is the number of comments in the site-wide feed.
+const recentComments = 20
+
+// commentItem returns the feed item of comment c on p.
+func commentItem(p Page, c Comment) rssItem {
+	link := absURL(p.URL()) + "#comment-" + c.ID
+	return rssItem{
+		Title:       fmt.Sprintf("Comment by %s on %s", c.Name, p.Title),
+		Link:        link,
+		GUID:        rssGUID{IsPermaLink: true, Value: link},
+		Description: string(c.HTML()),
+		PubDate:     rssDate(c.Time),
+	}
+}
+
+// serveCommentFeed replies with the feed of the comments on p.
+func serveCommentFeed(w http.ResponseWriter, r *http.Request, p Page) {
+	ch := rssChannel{
+		Title:       "Comments on " + p.Title,
+		Link:        absURL(p.URL()),
+		Description: "Comments on " + p.Title,
+	}
+	for _, c := range p.Comments {
+		ch.Items = append(ch.Items, commentItem(p, c))
+	}
+	err := writeRSS(w, ch)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("serveCommentFeed: %w", err))
+	}
+}
+
+// makeCommentFeedHandlerFunc serves the most recent comments on all posts.
+func makeCommentFeedHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ps, err := withAllComments(posts.published())
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		type pageComment struct {
+			p Page
+			c Comment
+		}
+		var pcs []pageComment
+		for _, p := range ps {
+			for _, c := range p.Comments {
+				pcs = append(pcs, pageComment{p, c})
+			}
+		}
+		sort.SliceStable(pcs, func(i, j int) bool {
+			return pcs[i].c.Time.After(pcs[j].c.Time)
+		})
+		if len(pcs) > recentComments {
+			pcs = pcs[:recentComments]
+		}
+		ch := rssChannel{
+			Title:       "Comments on " + *flagSiteName,
+			Link:        absURL("/"),
+			Description: "Recent comments on " + *flagSiteName,
+		}
+		for _, pc := range pcs {
+			ch.Items = append(ch.Items, commentItem(pc.p, pc.c))
+		}
+		err = writeRSS(w, ch)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeCommentFeedHandlerFunc: %w", err))
+		}
+	}
+}
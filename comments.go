@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// commentMarkdown renders comments. Raw HTML is not passed through and
+// commentPolicy removes everything but the allowed subset.
+var commentMarkdown = goldmark.New(
+	goldmark.WithExtensions(extension.Linkify, extension.Strikethrough),
+)
+
+// HTML returns the comment text rendered as markdown and sanitized with
+// commentPolicy.
+func (c Comment) HTML() template.HTML {
+	var buf bytes.Buffer
+	err := commentMarkdown.Convert([]byte(c.Comment), &buf)
+	if err != nil {
+		slog.Error("rendering comment failed", "id", c.ID, "err", err)
+		return template.HTML(template.HTMLEscapeString(c.Comment))
+	}
+	return template.HTML(commentPolicy.SanitizeBytes(buf.Bytes()))
+}
+
+// CommentNode is a comment with the replies to it, the shape the comment
+// template renders discussions in.
+type CommentNode struct {
+	Comment
+	Post    string
+	Replies []*CommentNode
+}
+
+var errUnknownParent = errors.New("reply to unknown comment")
+
+// Maximum lengths of the comment fields, in characters.
+const (
+	maxCommentName = 80
+	maxCommentText = 5000
+)
+
+// maxFormSize caps the request body of the comment forms, which is far
+// more than the longest comment needs even if URL-encoded.
+const maxFormSize = 128 << 10
+
+// parseForm parses the form sent with r, reading at most maxFormSize bytes
+// of its body. If that fails it replies with 413 or 400 and returns false.
+func parseForm(w http.ResponseWriter, r *http.Request) bool {
+	return parseFormMax(w, r, maxFormSize)
+}
+
+// parseFormMax is parseForm reading at most max bytes.
+func parseFormMax(w http.ResponseWriter, r *http.Request, max int64) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, max)
+	err := r.ParseForm()
+	if err == nil {
+		return true
+	}
+	reqLogger(r).Info("invalid form", "err", err)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		renderError(w, r, http.StatusRequestEntityTooLarge)
+	} else {
+		renderError(w, r, http.StatusBadRequest)
+	}
+	return false
+}
+
+// CommentForm is a rejected submission, shown again in the comment form
+// with the reader's input and what is wrong with it.
+type CommentForm struct {
+	Name    string
+	Email   string
+	Comment string
+	Parent  string
+	Errors  []string
+}
+
+// cleanText normalizes line breaks to \n, drops all other control
+// characters except tabs and trims surrounding space.
+func cleanText(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t':
+			return r
+		case r == '\r':
+			return '\n'
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+// validateText cleans *s and returns what is wrong with it as the field
+// called field, or "".
+func validateText(field string, s *string, max int) string {
+	if !utf8.ValidString(*s) {
+		return field + " is not valid UTF-8."
+	}
+	*s = cleanText(*s)
+	switch n := utf8.RuneCountInString(*s); {
+	case n == 0:
+		return field + " is required."
+	case n > max:
+		return fmt.Sprintf("%s is %d characters long, at most %d are allowed.", field, n, max)
+	}
+	return ""
+}
+
+// validateComment cleans the name and text of c and returns the problems
+// with them.
+func validateComment(c *Comment) []string {
+	var errs []string
+	if e := validateText("Name", &c.Name, maxCommentName); e != "" {
+		errs = append(errs, e)
+	}
+	if e := validateText("Comment", &c.Comment, maxCommentText); e != "" {
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// gravatarURL is the URL of the Gravatar images, followed by the hash.
+const gravatarURL = "https://www.gravatar.com/avatar/"
+
+// emailHash returns the hash Gravatar knows email by, or "" for no email.
+func emailHash(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(email))
+	return hex.EncodeToString(sum[:])
+}
+
+// Avatar returns the URL of the commenter's Gravatar, a generated image if
+// they have none, or "" if -gravatar is off or they gave no email.
+func (c Comment) Avatar() string {
+	if !*flagGravatar || c.EmailHash == "" {
+		return ""
+	}
+	return gravatarURL + c.EmailHash + "?s=80&d=identicon"
+}
+
+// Mention reports whether c was received from another site, like a
+// webmention, rather than left in the comment form.
+func (c Comment) Mention() bool {
+	return c.Type != ""
+}
+
+// Via returns the name of the provider the commenter signed in with, or
+// "".
+func (c Comment) Via() string {
+	if c.Account == "" {
+		return ""
+	}
+	return providerTitle(c.Account)
+}
+
+// newCommentID returns a random comment ID.
+func newCommentID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// fillCommentIDs gives comments stored before they had IDs their position
+// as ID, so they can be replied to.
+func fillCommentIDs(cs []Comment) {
+	for i := range cs {
+		if cs[i].ID == "" {
+			cs[i].ID = strconv.Itoa(i + 1)
+		}
+	}
+}
+
+// findComment returns the index of the comment id in cs, or -1.
+func findComment(cs []Comment, id string) int {
+	for i, c := range cs {
+		if c.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Orders of the comment threads, selected with -comment-order.
+const (
+	orderOldest = "oldest"
+	orderNewest = "newest"
+)
+
+// threadComments arranges the comments cs of post into trees of replies.
+// Comments whose parent is not in cs, e.g. because it is held, become
+// roots themselves. Replies are sorted oldest first, the roots as
+// -comment-order says; comments without a time count as older than all
+// others and otherwise keep the order of cs.
+func threadComments(post string, cs []Comment) []*CommentNode {
+	cs = append([]Comment(nil), cs...)
+	sort.SliceStable(cs, func(i, j int) bool {
+		return cs[i].Time.Before(cs[j].Time)
+	})
+	nodes := make(map[string]*CommentNode, len(cs))
+	for _, c := range cs {
+		nodes[c.ID] = &CommentNode{Comment: c, Post: post}
+	}
+	var roots []*CommentNode
+	for _, c := range cs {
+		n := nodes[c.ID]
+		parent, ok := nodes[c.ParentID]
+		if !ok || c.ParentID == "" || parent == n {
+			roots = append(roots, n)
+			continue
+		}
+		parent.Replies = append(parent.Replies, n)
+	}
+	if *flagCommentOrd == orderNewest {
+		for i, j := 0, len(roots)-1; i < j; i, j = i+1, j-1 {
+			roots[i], roots[j] = roots[j], roots[i]
+		}
+	}
+	return roots
+}
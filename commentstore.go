@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CommentStore keeps the comments of all posts, keyed by the name of the
+// post.
+type CommentStore interface {
+	// Load returns the comments of post in the order they were added.
+	Load(post string) ([]Comment, error)
+	// Update replaces the comments of post by the result of fn applied to
+	// them. Concurrent updates of the same post don't lose comments. If fn
+	// fails its error is returned unwrapped and nothing is changed.
+	Update(post string, fn func([]Comment) ([]Comment, error)) error
+	// Ping reports whether the store can be used.
+	Ping() error
+	// Close releases the store after the last update.
+	Close() error
+}
+
+// commentStore holds the comments of the blog. It is set up in main from
+// the -comment-store flag.
+var commentStore CommentStore
+
+// Comment storage backends, selected with -comment-store.
+const (
+	storeJSON     = "json"
+	storeSQLite   = "sqlite"
+	storePostgres = "postgres"
+	storeBolt     = "bolt"
+)
+
+func openCommentStore(kind string) (CommentStore, error) {
+	switch kind {
+	case storeJSON:
+		return newJSONCommentStore(*flagCommentDir), nil
+	case storeSQLite:
+		return openSQLiteCommentStore(*flagCommentDB)
+	case storePostgres:
+		return openPostgresCommentStore()
+	case storeBolt:
+		return openBoltStore(*flagBoltFile)
+	}
+	return nil, fmt.Errorf("openCommentStore: unknown comment store %q", kind)
+}
+
+// jsonCommentStore keeps the comments of each post in a JSON file named
+// after the post.
+type jsonCommentStore struct {
+	dir   string
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newJSONCommentStore(dir string) *jsonCommentStore {
+	return &jsonCommentStore{dir: dir, locks: map[string]*sync.Mutex{}}
+}
+
+func (s *jsonCommentStore) path(post string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(post)+".json")
+}
+
+// lock returns the mutex serializing the updates of post.
+func (s *jsonCommentStore) lock(post string) *sync.Mutex {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	l, ok := s.locks[post]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[post] = l
+	}
+	return l
+}
+
+// Ping checks that the comment folder, if it exists yet, is a folder.
+func (s *jsonCommentStore) Ping() error {
+	fi, err := os.Stat(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("jsonCommentStore.Ping: %w", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("jsonCommentStore.Ping: %s is not a folder", s.dir)
+	}
+	return nil
+}
+
+// Close waits for running updates; every update is written when it
+// returns.
+func (s *jsonCommentStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, l := range s.locks {
+		l.Lock()
+		l.Unlock()
+	}
+	return nil
+}
+
+func (s *jsonCommentStore) Update(post string, fn func([]Comment) ([]Comment, error)) error {
+	l := s.lock(post)
+	l.Lock()
+	defer l.Unlock()
+	cs, err := s.Load(post)
+	if err != nil {
+		return fmt.Errorf("jsonCommentStore.Update: %w", err)
+	}
+	cs, err = fn(cs)
+	if err != nil {
+		return err
+	}
+	return s.save(post, cs)
+}
+
+// save writes cs to a temporary file that then replaces the comment file,
+// so readers never see a partially written one.
+func (s *jsonCommentStore) save(post string, cs []Comment) error {
+	fpath := s.path(post)
+	err := os.MkdirAll(filepath.Dir(fpath), 0777)
+	if err != nil {
+		return fmt.Errorf("jsonCommentStore.save: %w", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(fpath), filepath.Base(fpath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("jsonCommentStore.save: %w", err)
+	}
+	err = json.NewEncoder(f).Encode(cs)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0666)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fpath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("jsonCommentStore.save: %w", err)
+	}
+	return nil
+}
+
+func (s *jsonCommentStore) Load(post string) ([]Comment, error) {
+	var cs []Comment
+	f, err := os.Open(s.path(post))
+	if errors.Is(err, os.ErrNotExist) {
+		return cs, nil
+	}
+	if err != nil {
+		return cs, fmt.Errorf("jsonCommentStore.Load: %w", err)
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&cs)
+	if err != nil {
+		return cs, fmt.Errorf("jsonCommentStore.Load: %w", err)
+	}
+	fillCommentIDs(cs)
+	return cs, nil
+}
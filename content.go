@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentStore holds the source files of pages and sections, keyed by
+// their slash separated name below the root of the store, e.g.
+// "go/generics.md".
+type ContentStore interface {
+	// List returns the files of the store in name order. Files and
+	// folders whose name starts with a dot are left out.
+	List() ([]ContentInfo, error)
+	// Get returns the content and info of the file name. A missing file
+	// gives an error wrapping os.ErrNotExist.
+	Get(name string) ([]byte, ContentInfo, error)
+	// Watch returns a channel that receives a value whenever files of the
+	// store may have changed.
+	Watch() <-chan struct{}
+}
+
+// ContentInfo describes a file of a ContentStore. A file with the same
+// name, modification time and size is taken to be unchanged.
+type ContentInfo struct {
+	Name    string
+	ModTime time.Time
+	Size    int64
+}
+
+// contentStore holds the posts of the blog and staticStore its static
+// pages. They are set up in main from -content-store and -static.
+var contentStore, staticStore ContentStore
+
+// renderedStore is implemented by content stores that keep the pages
+// rendered from their files, so they needn't be rendered again after a
+// restart. sources consults it for the pages it doesn't hold.
+type renderedStore interface {
+	loadRendered(info ContentInfo) (Page, bool)
+	storeRendered(info ContentInfo, p Page) error
+}
+
+// writableStore is implemented by content stores whose files goblog can
+// change itself, e.g. for Micropub. The git and S3 stores are read only.
+type writableStore interface {
+	// put creates or replaces the file name with b.
+	put(name string, b []byte) error
+	// remove deletes the file name; a missing file gives an error
+	// wrapping os.ErrNotExist.
+	remove(name string) error
+}
+
+// Content storage backends, selected with -content-store.
+const (
+	contentFiles    = "files"
+	contentSQLite   = "sqlite"
+	contentPostgres = "postgres"
+	contentS3       = "s3"
+	contentGit      = "git"
+)
+
+func openContentStore(kind string) (ContentStore, error) {
+	switch kind {
+	case contentFiles:
+		return newWatchedContentStore(*flagSrcFolder), nil
+	case contentSQLite:
+		return openSQLiteContentStore(*flagContentDB)
+	case contentPostgres:
+		return openPostgresContentStore()
+	case contentS3:
+		return openS3ContentStore()
+	case contentGit:
+		return openGitContentStore()
+	}
+	return nil, fmt.Errorf("openContentStore: unknown content store %q", kind)
+}
+
+// watchInterval is how often the content stores check for changes.
+const watchInterval = 5 * time.Second
+
+// fileContentStore keeps the source files in a folder of the file system.
+// Once it watches the folder, the listing and the files read are kept in
+// memory until the folder changes.
+type fileContentStore struct {
+	dir     string
+	watcher *dirWatcher
+
+	mutex sync.Mutex
+	gen   uint64
+	infos []ContentInfo
+	files map[string]cachedFile
+}
+
+// cachedFile is a file read by a watching fileContentStore.
+type cachedFile struct {
+	b    []byte
+	info ContentInfo
+}
+
+func newFileContentStore(dir string) *fileContentStore {
+	return &fileContentStore{dir: dir}
+}
+
+// watch starts watching the folder of s for changes.
+func (s *fileContentStore) watch() error {
+	w, err := watchDirs(s.dir)
+	if err != nil {
+		return fmt.Errorf("fileContentStore.watch: %w", err)
+	}
+	s.watcher = w
+	return nil
+}
+
+// remember calls keep under the lock of s unless the folder changed since
+// generation gen, dropping what was kept before an earlier change.
+func (s *fileContentStore) remember(gen uint64, keep func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if gen != s.watcher.generation() {
+		return
+	}
+	if gen != s.gen || s.files == nil {
+		s.gen = gen
+		s.infos = nil
+		s.files = map[string]cachedFile{}
+	}
+	keep()
+}
+
+func (s *fileContentStore) List() ([]ContentInfo, error) {
+	if s.watcher == nil {
+		return s.list()
+	}
+	gen := s.watcher.generation()
+	s.mutex.Lock()
+	infos := s.infos
+	if gen != s.gen {
+		infos = nil
+	}
+	s.mutex.Unlock()
+	if infos != nil {
+		return infos, nil
+	}
+	infos, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	s.remember(gen, func() { s.infos = infos })
+	return infos, nil
+}
+
+func (s *fileContentStore) list() ([]ContentInfo, error) {
+	var infos []ContentInfo
+	err := filepath.Walk(s.dir, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fpath != s.dir && strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, fpath)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, ContentInfo{Name: filepath.ToSlash(rel), ModTime: fi.ModTime(), Size: fi.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fileContentStore.List: %w", err)
+	}
+	return infos, nil
+}
+
+func (s *fileContentStore) Get(name string) ([]byte, ContentInfo, error) {
+	if s.watcher == nil {
+		return s.get(name)
+	}
+	gen := s.watcher.generation()
+	s.mutex.Lock()
+	f, ok := s.files[name]
+	ok = ok && gen == s.gen
+	s.mutex.Unlock()
+	if ok {
+		return f.b, f.info, nil
+	}
+	b, info, err := s.get(name)
+	if err != nil {
+		return nil, ContentInfo{}, err
+	}
+	s.remember(gen, func() { s.files[name] = cachedFile{b: b, info: info} })
+	return b, info, nil
+}
+
+func (s *fileContentStore) get(name string) ([]byte, ContentInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, ContentInfo{}, fmt.Errorf("fileContentStore.Get: %s: %w", name, os.ErrNotExist)
+	}
+	fpath := filepath.Join(s.dir, filepath.FromSlash(name))
+	fi, err := os.Stat(fpath)
+	if err == nil && fi.IsDir() {
+		err = fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, ContentInfo{}, fmt.Errorf("fileContentStore.Get: %w", err)
+	}
+	b, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, ContentInfo{}, fmt.Errorf("fileContentStore.Get: %w", err)
+	}
+	return b, ContentInfo{Name: name, ModTime: fi.ModTime(), Size: fi.Size()}, nil
+}
+
+func (s *fileContentStore) put(name string, b []byte) error {
+	if !fs.ValidPath(name) || name == "." {
+		return fmt.Errorf("fileContentStore.put: invalid name %q", name)
+	}
+	err := writeFileAtomic(filepath.Join(s.dir, filepath.FromSlash(name)), b, time.Now())
+	if err != nil {
+		return fmt.Errorf("fileContentStore.put: %w", err)
+	}
+	s.changed()
+	return nil
+}
+
+func (s *fileContentStore) remove(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return fmt.Errorf("fileContentStore.remove: %s: %w", name, os.ErrNotExist)
+	}
+	err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return fmt.Errorf("fileContentStore.remove: %w", err)
+	}
+	s.changed()
+	return nil
+}
+
+// changed drops what s keeps in memory after it changed a file itself,
+// without waiting for the watcher to notice.
+func (s *fileContentStore) changed() {
+	if s.watcher != nil {
+		s.watcher.notify()
+	}
+}
+
+func (s *fileContentStore) Watch() <-chan struct{} {
+	if s.watcher != nil {
+		return s.watcher.subscribe()
+	}
+	return pollChanges(s.List)
+}
+
+// pollChanges calls list every watchInterval and signals on the returned
+// channel when a file was added, removed or changed since the last time.
+func pollChanges(list func() ([]ContentInfo, error)) <-chan struct{} {
+	c := make(chan struct{}, 1)
+	go func() {
+		last, _ := list()
+		for range time.Tick(watchInterval) {
+			infos, err := list()
+			if err != nil || sameContent(last, infos) {
+				continue
+			}
+			last = infos
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return c
+}
+
+// sameContent reports whether a and b list the same files unchanged.
+func sameContent(a, b []ContentInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || !a[i].ModTime.Equal(b[i].ModTime) || a[i].Size != b[i].Size {
+			return false
+		}
+	}
+	return true
+}
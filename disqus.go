@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// disqusExport is the part of a Disqus XML export the importer uses.
+type disqusExport struct {
+	Threads []struct {
+		ID   string `xml:"http://disqus.com/disqus-internals id,attr"`
+		Link string `xml:"link"`
+	} `xml:"thread"`
+	Posts []struct {
+		ID        string    `xml:"http://disqus.com/disqus-internals id,attr"`
+		Message   string    `xml:"message"`
+		CreatedAt time.Time `xml:"createdAt"`
+		IsDeleted bool      `xml:"isDeleted"`
+		IsSpam    bool      `xml:"isSpam"`
+		Author    struct {
+			Name  string `xml:"name"`
+			Email string `xml:"email"`
+		} `xml:"author"`
+		Thread struct {
+			ID string `xml:"http://disqus.com/disqus-internals id,attr"`
+		} `xml:"thread"`
+		Parent struct {
+			ID string `xml:"http://disqus.com/disqus-internals id,attr"`
+		} `xml:"parent"`
+	} `xml:"post"`
+}
+
+// disqusIDPrefix is prepended to the IDs of imported comments, which keeps
+// them apart from native ones and makes importing the same export again
+// skip the comments already there.
+const disqusIDPrefix = "dsq"
+
+// importDisqus adds the comments of the Disqus export fpath to the posts
+// of src their threads link to. Deleted comments are skipped, spam is
+// held. It returns the number of imported comments.
+func importDisqus(fpath string, cs ContentStore) (int, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return 0, fmt.Errorf("importDisqus: %w", err)
+	}
+	defer f.Close()
+	var export disqusExport
+	err = xml.NewDecoder(f).Decode(&export)
+	if err != nil {
+		return 0, fmt.Errorf("importDisqus.Decode: %w", err)
+	}
+	ps, err := loadAllPages(cs)
+	if err != nil && !errors.Is(err, errBadPages) {
+		return 0, fmt.Errorf("importDisqus: %w", err)
+	}
+	posts := map[string]string{}
+	for _, t := range export.Threads {
+		u, err := url.Parse(t.Link)
+		if err != nil {
+			continue
+		}
+		if p, _, ok := findPage(ps, path.Base(strings.TrimSuffix(u.Path, "/"))); ok {
+			posts[t.ID] = p.Name
+		}
+	}
+	sort.SliceStable(export.Posts, func(i, j int) bool {
+		return export.Posts[i].CreatedAt.Before(export.Posts[j].CreatedAt)
+	})
+	byPost := map[string][]Comment{}
+	var order []string
+	for _, dp := range export.Posts {
+		name, ok := posts[dp.Thread.ID]
+		if !ok {
+			slog.Warn("no post for Disqus thread", "thread", dp.Thread.ID)
+			continue
+		}
+		if dp.IsDeleted {
+			continue
+		}
+		c := Comment{
+			ID:      disqusIDPrefix + dp.ID,
+			Name:    dp.Author.Name,
+			Comment: disqusMarkdown(dp.Message),
+			Time:    dp.CreatedAt,
+		}
+		if dp.Parent.ID != "" {
+			c.ParentID = disqusIDPrefix + dp.Parent.ID
+		}
+		if *flagGravatar {
+			c.EmailHash = emailHash(dp.Author.Email)
+		}
+		if dp.IsSpam {
+			c.Status = commentHeld
+		}
+		if _, ok := byPost[name]; !ok {
+			order = append(order, name)
+		}
+		byPost[name] = append(byPost[name], c)
+	}
+	n := 0
+	for _, name := range order {
+		err = commentStore.Update(name, func(cs []Comment) ([]Comment, error) {
+			for _, c := range byPost[name] {
+				if findComment(cs, c.ID) < 0 {
+					cs = append(cs, c)
+					n++
+				}
+			}
+			return cs, nil
+		})
+		if err != nil {
+			return n, fmt.Errorf("importDisqus: %w", err)
+		}
+	}
+	return n, nil
+}
+
+// disqusMarkdown converts the HTML of a Disqus comment to the markdown
+// comments are written in, keeping paragraphs, line breaks, emphasis,
+// code and links.
+func disqusMarkdown(s string) string {
+	var b strings.Builder
+	var links []string
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				slog.Warn("parsing Disqus comment failed", "err", z.Err())
+			}
+			break
+		}
+		t := z.Token()
+		switch tt {
+		case html.TextToken:
+			b.WriteString(t.Data)
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			start := tt != html.EndTagToken
+			switch t.Data {
+			case "p":
+				if !start {
+					b.WriteString("\n\n")
+				}
+			case "br":
+				b.WriteString("  \n")
+			case "b", "strong":
+				b.WriteString("**")
+			case "i", "em":
+				b.WriteString("_")
+			case "code":
+				b.WriteString("`")
+			case "a":
+				if start {
+					href := ""
+					for _, a := range t.Attr {
+						if a.Key == "href" {
+							href = a.Val
+						}
+					}
+					links = append(links, href)
+					b.WriteString("[")
+				} else if len(links) > 0 {
+					b.WriteString("](" + links[len(links)-1] + ")")
+					links = links[:len(links)-1]
+				}
+			}
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// ErrorPage is the data the error templates are executed with.
+type ErrorPage struct {
+	Title  string
+	Status int
+	Path   string
+}
+
+// renderError replies with status and the page of <status>.tmpl.html. If
+// there is no such template error.tmpl.html is used, and a plain text
+// message if that fails as well.
+func renderError(w http.ResponseWriter, r *http.Request, status int) {
+	data := ErrorPage{
+		Title:  http.StatusText(status),
+		Status: status,
+		Path:   r.URL.Path,
+	}
+	b, err := templates.render(strconv.Itoa(status)+".tmpl.html", data)
+	if err != nil {
+		b, err = templates.render("error.tmpl.html", data)
+	}
+	if err != nil {
+		reqLogger(r).Error("rendering error page failed", "status", status, "err", err)
+		http.Error(w, data.Title, status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// notFound replies with the 404 page.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	renderError(w, r, http.StatusNotFound)
+}
+
+// serverError logs err and replies with the 500 page. The error itself is
+// not shown to the reader.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	logError(r, err)
+	renderError(w, r, http.StatusInternalServerError)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// startTime is part of all validators, as templates and flags may have
+// changed since the last start.
+var startTime = time.Now()
+
+// etagOf returns a weak ETag of the JSON of data, which holds everything a
+// response is rendered from, and modified.
+func etagOf(data interface{}, modified time.Time) string {
+	h := sha256.New()
+	json.NewEncoder(h).Encode(data)
+	h.Write([]byte(modified.UTC().Format(time.RFC3339Nano)))
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// pageValidators returns the ETag and the Last-Modified time of the
+// rendered p: its source, its comments and, as the comment form carries a
+// token that expires, the current hour while comments are open.
+func pageValidators(p Page) (string, time.Time) {
+	modified := p.LastChange
+	for _, c := range p.Comments {
+		if c.Time.After(modified) {
+			modified = c.Time
+		}
+	}
+	if startTime.After(modified) {
+		modified = startTime
+	}
+	if p.CommentsOpen() {
+		if h := time.Now().Truncate(time.Hour); h.After(modified) {
+			modified = h
+		}
+	}
+	return etagOf(p, modified), modified
+}
+
+// listValidators returns the ETag and the Last-Modified time of a listing
+// of ps rendered from data.
+func listValidators(ps Pages, data interface{}) (string, time.Time) {
+	modified := startTime
+	for _, p := range ps {
+		if p.LastChange.After(modified) {
+			modified = p.LastChange
+		}
+	}
+	return etagOf(data, modified), modified
+}
+
+// notModified sets the ETag and Last-Modified headers and reports whether
+// the client already has this version according to If-None-Match or,
+// without it, If-Modified-Since. In that case it has answered 304.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatch(inm, etag) {
+			return false
+		}
+	} else {
+		ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || modified.Truncate(time.Second).After(ims) {
+			return false
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatch reports whether the If-None-Match header inm lists etag,
+// comparing weakly, or is "*".
+func etagMatch(inm, etag string) bool {
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
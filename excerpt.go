@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+var (
+	moreMarker = []byte("<!--more-->")
+	tagRe      = regexp.MustCompile(`<[^>]*>`)
+)
+
+// makeExcerpt returns the summary of a post for listings. An explicit
+// summary wins over the part above <!--more-->, which wins over the first
+// words words of the rendered text. smart is passed on to renderMarkdown.
+func makeExcerpt(summary string, body []byte, content template.HTML, words int, smart bool) (template.HTML, error) {
+	if summary != "" {
+		return template.HTML("<p>" + template.HTMLEscapeString(summary) + "</p>"), nil
+	}
+	if i := bytes.Index(body, moreMarker); i >= 0 {
+		return renderMarkdown(body[:i], smart)
+	}
+	fs := strings.Fields(plainText(content))
+	if len(fs) <= words {
+		return template.HTML("<p>" + template.HTMLEscapeString(strings.Join(fs, " ")) + "</p>"), nil
+	}
+	return template.HTML("<p>" + template.HTMLEscapeString(strings.Join(fs[:words], " ")) + " …</p>"), nil
+}
+
+// plainText strips the markup from rendered HTML.
+func plainText(content template.HTML) string {
+	return html.UnescapeString(tagRe.ReplaceAllString(string(content), " "))
+}
+
+// readingTime estimates the minutes needed to read content at wpm words
+// per minute, rounded up and at least one.
+func readingTime(content template.HTML, wpm int) int {
+	if wpm <= 0 {
+		wpm = 200
+	}
+	n := len(strings.Fields(plainText(content)))
+	m := (n + wpm - 1) / wpm
+	if m < 1 {
+		m = 1
+	}
+	return m
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportSeeds are the paths the static export starts from besides the
+// posts, static pages and archive of the index. Everything linked from
+// the pages is exported as well. Seeds that are not found, like the feeds
+// of features that are off, are left out quietly.
+var exportSeeds = []string{
+	"/", "/tag/", "/archive/", "/feed.xml", "/atom.xml", "/feed.json",
+	"/comments.xml", "/blogroll", "/blogroll.opml", "/robots.txt",
+	"/.well-known/security.txt",
+}
+
+// exportSkip are the prefixes of the paths needing the server, like the
+// forms and the admin area, which the static export does not follow.
+var exportSkip = []string{
+	"/admin/", "/oauth/", "/moderate/", "/newsletter/", "/backup",
+	"/comment/", "/editcomment/", "/reportcomment/", "/react/",
+	"/subscribe", "/unsubscribe", "/micropub", "/webmention", "/xmlrpc",
+	"/trackback/", "/hooks/", "/healthz", "/readyz", "/ap/",
+	"/.well-known/webfinger", "/api/v1/",
+}
+
+// exportMissing is requested for the 404.html of the export.
+const exportMissing = "/.goblog-export-missing"
+
+var (
+	exportAttrRe = regexp.MustCompile(`\b(href|src|srcset)="([^"]*)"`)
+	exportCSSRe  = regexp.MustCompile(`url\(\s*['"]?([^'")]+)['"]?\s*\)`)
+)
+
+// exportKey marks the requests of the static export in their context.
+type exportKey struct{}
+
+// exporting reports whether r is a request of the static export, which is
+// not counted as a view.
+func exporting(r *http.Request) bool {
+	ok, _ := r.Context().Value(exportKey{}).(bool)
+	return ok
+}
+
+// exportPath returns the path u is found at in the export, or "" if it
+// cannot be exported. Static hosts ignore the query, so the pages of a
+// listing move from ?page=2 to page-2/ below it.
+func exportPath(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	q := u.Query()
+	n, err := strconv.Atoi(q.Get("page"))
+	if len(q) != 1 || err != nil || n < 1 {
+		return ""
+	}
+	if n == 1 {
+		return u.Path
+	}
+	return strings.TrimSuffix(u.Path, "/") + "/page-" + strconv.Itoa(n) + "/"
+}
+
+// exportFile returns the file of the export in out serving the path p:
+// index.html of a folder for paths without extension, like the web
+// servers of static hosts expect.
+func exportFile(out, p string) string {
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") || path.Ext(clean) == "" {
+		clean = path.Join(clean, "index.html")
+	}
+	return filepath.Join(out, filepath.FromSlash(clean))
+}
+
+// exportItem is a path waiting to be exported. Optional paths may be
+// missing.
+type exportItem struct {
+	path     string
+	optional bool
+}
+
+// exporter writes the responses of h to the paths of the blog to files
+// below out, following the links of the pages.
+type exporter struct {
+	h     http.Handler
+	out   string
+	base  *url.URL
+	seen  map[string]bool
+	queue []exportItem
+	files int
+	fails int
+}
+
+// add queues the path p unless it was queued before.
+func (e *exporter) add(p string, optional bool) {
+	if e.seen[p] {
+		return
+	}
+	e.seen[p] = true
+	e.queue = append(e.queue, exportItem{p, optional})
+}
+
+// local returns the link raw found on the page at from resolved, if it
+// points to a page of the blog the export follows.
+func (e *exporter) local(from *url.URL, raw string) (*url.URL, bool) {
+	u, err := from.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Host != "" && u.Host != e.base.Host) || (u.Scheme != "" && u.Scheme != e.base.Scheme) {
+		return nil, false
+	}
+	for _, prefix := range exportSkip {
+		if strings.HasPrefix(u.Path, prefix) {
+			return nil, false
+		}
+	}
+	u.Fragment = ""
+	return u, true
+}
+
+// follow queues the link raw found on the page at from and returns what
+// to link instead in the export.
+func (e *exporter) follow(from *url.URL, raw string) string {
+	u, ok := e.local(from, raw)
+	if !ok {
+		return raw
+	}
+	p := exportPath(u)
+	if p == "" {
+		return raw
+	}
+	e.add(u.RequestURI(), false)
+	if u.RawQuery == "" {
+		return raw
+	}
+	_, frag, _ := strings.Cut(raw, "#")
+	if frag != "" {
+		p += "#" + frag
+	}
+	return p
+}
+
+// links queues the links of the page b at from of type ct and returns
+// it with the links of paginated listings moved to their export paths.
+func (e *exporter) links(from *url.URL, ct string, b []byte) []byte {
+	switch ct {
+	case "text/html":
+		return exportAttrRe.ReplaceAllFunc(b, func(m []byte) []byte {
+			sm := exportAttrRe.FindSubmatch(m)
+			attr, val := string(sm[1]), html.UnescapeString(string(sm[2]))
+			if attr == "srcset" {
+				var set []string
+				for _, c := range strings.Split(val, ",") {
+					src, size, _ := strings.Cut(strings.TrimSpace(c), " ")
+					set = append(set, strings.TrimSpace(e.follow(from, src)+" "+size))
+				}
+				val = strings.Join(set, ", ")
+			} else {
+				val = e.follow(from, val)
+			}
+			return []byte(attr + `="` + html.EscapeString(val) + `"`)
+		})
+	case "text/css":
+		for _, m := range exportCSSRe.FindAllSubmatch(b, -1) {
+			e.follow(from, string(m[1]))
+		}
+	}
+	return b
+}
+
+// get returns the response of e.h to a GET of p.
+func (e *exporter) get(p string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, p, nil)
+	r.Host = e.base.Host
+	r = r.WithContext(context.WithValue(r.Context(), exportKey{}, true))
+	w := httptest.NewRecorder()
+	e.h.ServeHTTP(w, r)
+	return w
+}
+
+// write writes b to the file of the exported path p, modified at the
+// Last-Modified time of the response if it has one.
+func (e *exporter) write(p string, b []byte, hs http.Header) error {
+	modified, err := http.ParseTime(hs.Get("Last-Modified"))
+	if err != nil {
+		modified = time.Now()
+	}
+	err = writeFileAtomic(exportFile(e.out, p), b, modified)
+	if err != nil {
+		return fmt.Errorf("exporter.write: %w", err)
+	}
+	e.files++
+	return nil
+}
+
+// export writes the path it of the queue, redirects as pages sending the
+// browser on.
+func (e *exporter) export(it exportItem) error {
+	from, err := url.Parse(it.path)
+	if err != nil {
+		return fmt.Errorf("exporter.export: %w", err)
+	}
+	p := exportPath(from)
+	w := e.get(it.path)
+	switch {
+	case w.Code == http.StatusOK:
+		ct, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		return e.write(p, e.links(from, ct, w.Body.Bytes()), w.Header())
+	case w.Code >= 300 && w.Code < 400 && path.Ext(p) == "":
+		to := e.follow(from, w.Header().Get("Location"))
+		b := []byte(`<!DOCTYPE html><meta charset="utf-8"><meta http-equiv="refresh" content="0; url=` +
+			html.EscapeString(to) + `"><link rel="canonical" href="` + html.EscapeString(to) + `">`)
+		return e.write(p, b, w.Header())
+	case it.optional && w.Code == http.StatusNotFound:
+		return nil
+	}
+	slog.Warn("not exported", "path", it.path, "status", w.Code)
+	e.fails++
+	return nil
+}
+
+// addFiles queues the files below dir, served below prefix.
+func (e *exporter) addFiles(dir, prefix string) error {
+	err := filepath.WalkDir(dir, func(fpath string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && fpath == dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && fpath != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		e.add((&url.URL{Path: prefix + filepath.ToSlash(rel)}).RequestURI(), false)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("exporter.addFiles: %w", err)
+	}
+	return nil
+}
+
+// exportSite writes the blog as served by h to the folder out: the posts
+// and static pages, the listings, the feeds and all files they link, the
+// -files and -static folders and a 404.html. It returns the number of
+// files written and of the links that failed.
+func exportSite(h http.Handler, out string) (int, int, error) {
+	base, err := url.Parse(*flagBaseURL)
+	if err != nil {
+		return 0, 0, fmt.Errorf("exportSite: %w", err)
+	}
+	e := &exporter{h: h, out: out, base: base, seen: map[string]bool{}}
+	for _, p := range exportSeeds {
+		e.add(p, true)
+	}
+	for _, p := range posts.published() {
+		e.add(p.URL(), false)
+	}
+	for _, y := range posts.fullArchive() {
+		e.add(y.URL(), false)
+		for _, m := range y.Months {
+			e.add(m.URL(), false)
+		}
+	}
+	statics, err := loadPages(staticStore)
+	if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, errBadPages) {
+		return 0, 0, fmt.Errorf("exportSite: %w", err)
+	}
+	for _, p := range statics {
+		e.add("/"+p.Slug, false)
+	}
+	dirs := [][2]string{{*flagFilesFolder, "/files/"}, {*flagStaticDir, "/static/"}}
+	if dir := themeDir(); dir != "" {
+		dirs = append(dirs, [2]string{filepath.Join(dir, "files"), "/files/"})
+	}
+	for _, d := range dirs {
+		err = e.addFiles(d[0], d[1])
+		if err != nil {
+			return e.files, e.fails, fmt.Errorf("exportSite: %w", err)
+		}
+	}
+	for len(e.queue) > 0 {
+		it := e.queue[0]
+		e.queue = e.queue[1:]
+		err = e.export(it)
+		if err != nil {
+			return e.files, e.fails, fmt.Errorf("exportSite: %w", err)
+		}
+	}
+	w := e.get(exportMissing)
+	err = writeFileAtomic(filepath.Join(out, "404.html"), w.Body.Bytes(), time.Now())
+	if err != nil {
+		return e.files, e.fails, fmt.Errorf("exportSite: %w", err)
+	}
+	return e.files + 1, e.fails, nil
+}
+
+// runBuild runs goblog build with the arguments following it: the -out
+// folder to export the blog to.
+func runBuild(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	out := fs.String("out", "./public/", "folder the static site is written to")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goblog [flags] build [-out folder]")
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	// the export is not rate limited
+	*flagRouteRates = ""
+	mux, err := routes()
+	if err != nil {
+		return err
+	}
+	n, fails, err := exportSite(mux, *out)
+	fmt.Println("exported", n, "files to", *out)
+	if fails > 0 {
+		fmt.Println(fails, "links could not be exported")
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Feed content modes, selected with -feed-content.
+const (
+	feedFull    = "full"
+	feedSummary = "summary"
+)
+
+// feedLink is a feed of the blog, announced in the head of every page.
+type feedLink struct {
+	Type  string
+	Title string
+	URL   string
+}
+
+// siteFeeds returns the feeds of the blog for the feeds template function.
+func siteFeeds() []feedLink {
+	return []feedLink{
+		{Type: "application/rss+xml", Title: *flagSiteName, URL: "/feed.xml"},
+		{Type: "application/atom+xml", Title: *flagSiteName, URL: "/atom.xml"},
+		{Type: "application/feed+json", Title: *flagSiteName, URL: "/feed.json"},
+	}
+}
+
+// feedPages returns the -feed-items newest of ps.
+func feedPages(ps Pages) Pages {
+	if *flagFeedItems > 0 && len(ps) > *flagFeedItems {
+		return ps[:*flagFeedItems]
+	}
+	return ps
+}
+
+// feedHTML returns the content of p for feeds, its whole content or, with
+// -feed-content summary, its excerpt, with site relative links made
+// absolute as feed readers resolve them against the feed, if at all.
+func feedHTML(p Page) template.HTML {
+	h := p.Excerpt
+	if *flagFeedContent == feedFull {
+		h = p.Content
+	}
+	return absLinks(h)
+}
+
+var rootLinkRe = regexp.MustCompile(`(\s(?:href|src)=")(/[^/"][^"]*|/)"`)
+
+// absLinks resolves the href and src attributes starting with a single
+// slash in h against -baseurl.
+func absLinks(h template.HTML) template.HTML {
+	return template.HTML(rootLinkRe.ReplaceAllStringFunc(string(h), func(m string) string {
+		sub := rootLinkRe.FindStringSubmatch(m)
+		return sub[1] + template.HTMLEscapeString(absURL(sub[2])) + `"`
+	}))
+}
+
+// postGUID returns the id of p in feeds. It is built from the file name,
+// which is kept when the slug changes, and resolves to the post.
+func postGUID(p Page) string {
+	return absURL("/page/" + p.Name)
+}
+
+// postItem returns the RSS item of p.
+func postItem(p Page) rssItem {
+	return rssItem{
+		Title:       p.Title,
+		Link:        absURL(p.URL()),
+		GUID:        rssGUID{IsPermaLink: false, Value: postGUID(p)},
+		Description: string(feedHTML(p)),
+		PubDate:     rssDate(p.PublishedAt()),
+		Categories:  p.Tags,
+	}
+}
+
+// makeFeedHandlerFunc serves /feed.xml, the RSS feed of the -feed-items
+// newest posts.
+func makeFeedHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ps := feedPages(posts.published())
+		ch := rssChannel{
+			Title:       *flagSiteName,
+			Link:        absURL("/"),
+			Description: *flagDescription,
+		}
+		if ch.Description == "" {
+			ch.Description = "Latest posts on " + *flagSiteName
+		}
+		var updated time.Time
+		for _, p := range ps {
+			ch.Items = append(ch.Items, postItem(p))
+			if p.LastChange.After(updated) {
+				updated = p.LastChange
+			}
+		}
+		ch.LastBuildDate = rssDate(updated)
+		ch.AtomLinks = hubLinks("/feed.xml")
+		etag, modified := listValidators(ps, ch)
+		if notModified(w, r, etag, modified) {
+			return
+		}
+		setHubLinks(w, "/feed.xml")
+		err := writeRSS(w, ch)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeFeedHandlerFunc: %w", err))
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var frontMatterDelim = []byte("---")
+
+type FrontMatter struct {
+	Title       string       `yaml:"title,omitempty"`
+	Slug        string       `yaml:"slug,omitempty"`
+	Author      string       `yaml:"author,omitempty"`
+	Date        time.Time    `yaml:"date,omitempty"`
+	Tags        []string     `yaml:"tags,omitempty"`
+	Category    string       `yaml:"category,omitempty"`
+	Template    string       `yaml:"template,omitempty"`
+	TOC         *bool        `yaml:"toc,omitempty"`
+	Math        *string      `yaml:"math,omitempty"`
+	Typographer *bool        `yaml:"typographer,omitempty"`
+	Draft       bool         `yaml:"draft,omitempty"`
+	Featured    bool         `yaml:"featured,omitempty"`
+	Publish     time.Time    `yaml:"publish,omitempty"`
+	Summary     string       `yaml:"summary,omitempty"`
+	Image       string       `yaml:"image,omitempty"`
+	Comments    *bool        `yaml:"comments,omitempty"`
+	CommentDays *int         `yaml:"commentdays,omitempty"`
+	Attachments []Attachment `yaml:"attachments,omitempty"`
+}
+
+// Attachment is a file belonging to a post, e.g. the audio of a podcast
+// episode, listed in the JSON feed. Without a type it is guessed from the
+// extension of the URL.
+type Attachment struct {
+	URL   string `yaml:"url,omitempty"`
+	Title string `yaml:"title,omitempty"`
+	Type  string `yaml:"type,omitempty"`
+}
+
+// postSource returns the source of a post with the front matter fm and
+// the markdown body. Only the fields that are set are written.
+func postSource(fm FrontMatter, body string) ([]byte, error) {
+	y, err := yaml.Marshal(fm)
+	if err != nil {
+		return nil, fmt.Errorf("postSource: %w", err)
+	}
+	var b bytes.Buffer
+	b.Write(frontMatterDelim)
+	b.WriteByte('\n')
+	b.Write(y)
+	b.Write(frontMatterDelim)
+	b.WriteByte('\n')
+	b.WriteString(body)
+	if body != "" && !strings.HasSuffix(body, "\n") {
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+// splitFrontMatter separates a leading YAML block delimited by "---" lines
+// from the markdown body. Files without front matter are returned unchanged.
+func splitFrontMatter(b []byte) ([]byte, []byte) {
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	if !bytes.HasPrefix(b, frontMatterDelim) {
+		return nil, b
+	}
+	rest := b[len(frontMatterDelim):]
+	nl := bytes.IndexByte(rest, '\n')
+	if nl < 0 || len(bytes.TrimSpace(rest[:nl])) != 0 {
+		return nil, b
+	}
+	rest = rest[nl+1:]
+	for off := 0; off < len(rest); {
+		end := bytes.IndexByte(rest[off:], '\n')
+		line := rest[off:]
+		next := len(rest)
+		if end >= 0 {
+			line = rest[off : off+end]
+			next = off + end + 1
+		}
+		if bytes.Equal(bytes.TrimRight(line, " \t\r"), frontMatterDelim) {
+			return rest[:off], rest[next:]
+		}
+		off = next
+	}
+	return nil, b
+}
+
+func parseFrontMatter(b []byte) (FrontMatter, []byte, error) {
+	var fm FrontMatter
+	head, body := splitFrontMatter(b)
+	if head == nil {
+		return fm, body, nil
+	}
+	err := yaml.Unmarshal(head, &fm)
+	if err != nil {
+		return fm, body, fmt.Errorf("parseFrontMatter: %w", err)
+	}
+	return fm, body, nil
+}
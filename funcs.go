@@ -0,0 +1,86 @@
+package main
+
+import (
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// dateLayout is the layout formatDate uses when none is given.
+const dateLayout = "02.01.2006"
+
+// templateFuncs are available in all templates, including shortcodes.
+// Functions registered with addTemplateFunc before the first template is
+// parsed are included as well.
+var templateFuncs = template.FuncMap{
+	"formatDate":  formatDate,
+	"markdownify": markdownify,
+	"truncate":    truncate,
+	"slugify":     slugify,
+	"absURL":      absURL,
+	"asset":       func(name string) string { return assets.url(name) },
+	"meta":        pageMeta,
+	"challenge":   newCommentChallenge,
+	"gravatar":    func() bool { return *flagGravatar },
+	"logins":      commentLogins,
+	"maxname":     func() int { return maxCommentName },
+	"maxcomment":  func() int { return maxCommentText },
+	"feeds":       siteFeeds,
+	"webmention":  mentionEndpoint,
+	"micropub":    micropubEndpoints,
+	"pingback":    pingbackEndpoint,
+	"newsletter":  newsletterOn,
+	"blogroll":    blogrollOPML,
+	"pathEscape":  url.PathEscape,
+}
+
+// addTemplateFunc makes fn available in templates as name. It must be
+// called before the templates are parsed, i.e. at the start of main.
+func addTemplateFunc(name string, fn interface{}) {
+	templateFuncs[name] = fn
+}
+
+// formatDate formats t with the given layout or dateLayout.
+func formatDate(t time.Time, layout ...string) string {
+	if len(layout) > 0 {
+		return t.Format(layout[0])
+	}
+	return t.Format(dateLayout)
+}
+
+// markdownify renders s as sanitized markdown.
+func markdownify(s string) (template.HTML, error) {
+	h, err := renderMarkdown([]byte(s), *flagTypographer)
+	if err != nil {
+		return "", err
+	}
+	return sanitize(h), nil
+}
+
+// truncate shortens s to at most n characters, cutting at a word boundary
+// where possible and appending an ellipsis.
+func truncate(n int, s string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	cut := string([]rune(s)[:n])
+	if i := strings.LastIndexAny(cut, " \t\n"); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " \t\n.,;:") + "…"
+}
+
+// absURL resolves path against -baseurl.
+func absURL(path string) string {
+	base, err := url.Parse(*flagBaseURL)
+	if err != nil {
+		return path
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return path
+	}
+	return base.ResolveReference(ref).String()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshotPrefix starts the names of the folders below -git-dir holding a
+// checked out revision.
+const snapshotPrefix = "snap-"
+
+// gitTimeout is how long a git command may run before it is killed, so a
+// hanging fetch doesn't stop all later pulls.
+const gitTimeout = 10 * time.Minute
+
+// gitContentStore serves the posts of a git repository. It keeps a clone
+// in -git-dir and checks out every new revision into a snapshot folder of
+// its own, swapping to it once it is complete, so readers never see a half
+// updated set of posts.
+type gitContentStore struct {
+	url, branch, subdir, dir string
+
+	mutex    sync.RWMutex
+	current  *fileContentStore
+	rev      string
+	snapshot string
+	previous string
+	seq      int
+	watchers []chan struct{}
+
+	pulls chan struct{}
+}
+
+// openGitContentStore clones -git into -git-dir, or reuses the clone of
+// an earlier run, checks out the newest revision and pulls every
+// -git-pull and whenever the webhook asks for it.
+func openGitContentStore() (*gitContentStore, error) {
+	// git resolves relative paths from the clone
+	dir, err := filepath.Abs(*flagGitDir)
+	if err != nil {
+		return nil, fmt.Errorf("openGitContentStore: %w", err)
+	}
+	s := &gitContentStore{
+		url:    *flagGitRepo,
+		branch: *flagGitBranch,
+		subdir: *flagGitPath,
+		dir:    dir,
+		pulls:  make(chan struct{}, 1),
+	}
+	err = s.clone()
+	if err != nil {
+		return nil, fmt.Errorf("openGitContentStore: %w", err)
+	}
+	err = s.pull()
+	if err != nil {
+		return nil, fmt.Errorf("openGitContentStore: %w", err)
+	}
+	go s.pullLoop(*flagGitPull)
+	return s, nil
+}
+
+// git runs git with args in the clone and returns its trimmed output.
+func (s *gitContentStore) git(args ...string) (string, error) {
+	return runGit(append([]string{"-C", filepath.Join(s.dir, "repo")}, args...)...)
+}
+
+// runGit runs git with args, killing it after gitTimeout, and returns its
+// trimmed output.
+func runGit(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", args...)
+	// helpers like ssh may keep the output open after git is killed
+	cmd.WaitDelay = 10 * time.Second
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// clone makes the clone unless it exists and drops the snapshots of an
+// earlier run.
+func (s *gitContentStore) clone() error {
+	repo := filepath.Join(s.dir, "repo")
+	_, err := os.Stat(filepath.Join(repo, ".git"))
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(s.dir, 0o755)
+		if err != nil {
+			return fmt.Errorf("gitContentStore.clone: %w", err)
+		}
+		args := []string{"clone", "--no-checkout"}
+		if s.branch != "" {
+			args = append(args, "--branch", s.branch)
+		}
+		_, err = runGit(append(args, s.url, repo)...)
+		if err != nil {
+			return fmt.Errorf("gitContentStore.clone: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("gitContentStore.clone: %w", err)
+	}
+	old, err := filepath.Glob(filepath.Join(s.dir, snapshotPrefix+"*"))
+	if err != nil {
+		return fmt.Errorf("gitContentStore.clone: %w", err)
+	}
+	for _, dir := range old {
+		os.RemoveAll(dir)
+	}
+	_, err = s.git("worktree", "prune")
+	if err != nil {
+		return fmt.Errorf("gitContentStore.clone: %w", err)
+	}
+	return nil
+}
+
+// pull fetches the branch and, if it moved, checks out its revision into
+// a new snapshot and swaps to it. The snapshot before the current one is
+// removed; the current one may still be read by running requests.
+// Snapshots are numbered, as a branch moved back to an earlier revision
+// checks it out again while the snapshot of before may still exist.
+func (s *gitContentStore) pull() error {
+	ref := "HEAD"
+	if s.branch != "" {
+		ref = s.branch
+	}
+	_, err := s.git("fetch", "--quiet", "origin", ref)
+	if err != nil {
+		return fmt.Errorf("gitContentStore.pull: %w", err)
+	}
+	rev, err := s.git("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return fmt.Errorf("gitContentStore.pull: %w", err)
+	}
+	s.mutex.RLock()
+	same := rev == s.rev
+	s.mutex.RUnlock()
+	if same {
+		return nil
+	}
+	s.seq++
+	snapshot := filepath.Join(s.dir, fmt.Sprintf("%s%d-%s", snapshotPrefix, s.seq, rev[:12]))
+	_, err = s.git("worktree", "add", "--detach", snapshot, rev)
+	if err != nil {
+		return fmt.Errorf("gitContentStore.pull: %w", err)
+	}
+	s.mutex.Lock()
+	stale := s.previous
+	s.previous = s.snapshot
+	s.snapshot = snapshot
+	s.rev = rev
+	s.current = newFileContentStore(filepath.Join(snapshot, filepath.FromSlash(s.subdir)))
+	for _, c := range s.watchers {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+	s.mutex.Unlock()
+	slog.Info("content updated", "rev", rev)
+	if stale != "" {
+		_, err = s.git("worktree", "remove", "--force", stale)
+		if err != nil {
+			slog.Warn("removing old snapshot failed", "err", err)
+		}
+	}
+	return nil
+}
+
+// pullLoop pulls every interval, if it is positive, and on requestPull.
+func (s *gitContentStore) pullLoop(interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.Tick(interval)
+	}
+	for {
+		select {
+		case <-tick:
+		case <-s.pulls:
+		}
+		err := s.pull()
+		if err != nil {
+			slog.Warn("pulling content failed", "err", err)
+		}
+	}
+}
+
+// requestPull makes pullLoop pull soon.
+func (s *gitContentStore) requestPull() {
+	select {
+	case s.pulls <- struct{}{}:
+	default:
+	}
+}
+
+func (s *gitContentStore) store() *fileContentStore {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.current
+}
+
+func (s *gitContentStore) List() ([]ContentInfo, error) {
+	return s.store().List()
+}
+
+func (s *gitContentStore) Get(name string) ([]byte, ContentInfo, error) {
+	return s.store().Get(name)
+}
+
+// Watch signals after every swap to a new revision.
+func (s *gitContentStore) Watch() <-chan struct{} {
+	c := make(chan struct{}, 1)
+	s.mutex.Lock()
+	s.watchers = append(s.watchers, c)
+	s.mutex.Unlock()
+	return c
+}
+
+// makeGitHookHandlerFunc serves POST /hooks/git, the push webhook of a
+// git host, which makes the git content store pull right away. The
+// request has to be signed with -git-secret like GitHub does in
+// X-Hub-Signature-256, or carry it in X-Gitlab-Token like GitLab does.
+// Without a git content store or secret every request gets a 404.
+func makeGitHookHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := contentStore.(*gitContentStore)
+		if !ok || *flagGitSecret == "" {
+			notFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxFormSize))
+		if err != nil {
+			renderError(w, r, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !validHookSignature(r, body, *flagGitSecret) {
+			renderError(w, r, http.StatusForbidden)
+			return
+		}
+		s.requestPull()
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// validHookSignature reports whether r with body is signed with secret,
+// as an HMAC-SHA256 in X-Hub-Signature-256 or as X-Gitlab-Token.
+func validHookSignature(r *http.Request, body []byte, secret string) bool {
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return hmac.Equal([]byte(token), []byte(secret))
+	}
+	sig, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	if !ok {
+		return false
+	}
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(body)
+	return hmac.Equal([]byte(sig), []byte(hex.EncodeToString(m.Sum(nil))))
+}
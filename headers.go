@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// defaultCSP is the default of -csp. It allows the inline scripts and
+// styles of the templates, the Bootstrap stylesheet, images from
+// anywhere, as posts and emoji may link them, and the videos of the
+// youtube shortcode.
+const defaultCSP = "default-src 'self'; script-src 'self' 'unsafe-inline'; " +
+	"style-src 'self' 'unsafe-inline' https://stackpath.bootstrapcdn.com; img-src 'self' https: data:; " +
+	"frame-src https://www.youtube-nocookie.com; frame-ancestors 'none'; base-uri 'self'; form-action 'self'"
+
+// defaultAdminCSP is the default of -admin-csp, a stricter policy for the
+// moderation pages and the admin area, which run no inline scripts. The
+// previews of the editor show images and highlighted code like posts, so
+// foreign images and inline styles stay allowed.
+const defaultAdminCSP = "default-src 'self'; script-src 'self'; " +
+	"style-src 'self' 'unsafe-inline' https://stackpath.bootstrapcdn.com; img-src 'self' https: data:; " +
+	"frame-ancestors 'none'; base-uri 'none'; form-action 'self'"
+
+// securityHeaders returns the headers set on every response from the
+// flags. Empty flags leave their header out.
+func securityHeaders() http.Header {
+	hs := http.Header{}
+	hs.Set("X-Content-Type-Options", "nosniff")
+	for name, v := range map[string]string{
+		"Content-Security-Policy": *flagCSP,
+		"Referrer-Policy":         *flagReferrer,
+		"X-Frame-Options":         *flagFrameOptions,
+	} {
+		if v != "" {
+			hs.Set(name, v)
+		}
+	}
+	return hs
+}
+
+// adminHeaders returns the headers overriding securityHeaders on the
+// moderation pages.
+func adminHeaders() http.Header {
+	return http.Header{
+		"Content-Security-Policy": {*flagAdminCSP},
+		"Referrer-Policy":         {"no-referrer"},
+		"X-Frame-Options":         {"DENY"},
+	}
+}
+
+// setHeaders sets hs on every response before h writes it, replacing
+// headers set by middleware further out. An empty value removes its
+// header. Placed around all routes it sets their defaults and around a
+// single route it overrides them.
+func setHeaders(hs http.Header) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, vs := range hs {
+				if len(vs) == 0 || vs[0] == "" {
+					w.Header().Del(name)
+					continue
+				}
+				w.Header()[name] = vs
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// strictTransport sets the Strict-Transport-Security header with max-age
+// on responses to requests that came over HTTPS, directly or through a
+// trusted proxy. A maxAge of 0 lets all responses pass unchanged.
+func strictTransport(maxAge int) Middleware {
+	return func(h http.Handler) http.Handler {
+		if maxAge <= 0 {
+			return h
+		}
+		v := "max-age=" + strconv.Itoa(maxAge)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requestScheme(r) == "https" {
+				w.Header().Set("Strict-Transport-Security", v)
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
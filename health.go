@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// readyTemplates are the templates /readyz checks to parse.
+var readyTemplates = []string{"index.tmpl.html", "page.tmpl.html", "error.tmpl.html"}
+
+// readiness reports for each dependency of the blog whether it works: the
+// content store, the templates and the comment store.
+func readiness() map[string]error {
+	checks := map[string]error{}
+	_, err := contentStore.List()
+	checks["content"] = err
+	checks["templates"] = nil
+	for _, name := range readyTemplates {
+		if _, err := templates.get(name); err != nil {
+			checks["templates"] = err
+			break
+		}
+	}
+	checks["comments"] = commentStore.Ping()
+	return checks
+}
+
+// makeHealthzHandlerFunc serves /healthz, which answers 200 as long as the
+// process serves requests.
+func makeHealthzHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// makeReadyzHandlerFunc serves /readyz, which answers 200 if all checks of
+// readiness pass and 503 otherwise, with the result of each check as
+// JSON.
+func makeReadyzHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		result := map[string]string{}
+		var errs []error
+		for name, err := range readiness() {
+			result[name] = "ok"
+			if err != nil {
+				result[name] = err.Error()
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				status = http.StatusServiceUnavailable
+			}
+		}
+		if len(errs) > 0 {
+			reqLogger(r).Warn("not ready", "err", errors.Join(errs...))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(result)
+	}
+}
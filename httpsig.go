@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// signatureSkew is how far the Date of a signed request may be off.
+const signatureSkew = 12 * time.Hour
+
+// loadSigningKey reads the PEM encoded RSA private key at fpath, creating
+// one if the file does not exist.
+func loadSigningKey(fpath string) (*rsa.PrivateKey, error) {
+	b, err := os.ReadFile(fpath)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, fmt.Errorf("loadSigningKey: %w", err)
+		}
+		b = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		err = os.WriteFile(fpath, b, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("loadSigningKey: %w", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loadSigningKey: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("loadSigningKey: no PEM data in %s", fpath)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("loadSigningKey: %w", err)
+	}
+	key, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("loadSigningKey: %s is no RSA key", fpath)
+	}
+	return key, nil
+}
+
+// publicKeyPEM returns the PEM encoding of the public part of key.
+func publicKeyPEM(key *rsa.PrivateKey) string {
+	b, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}))
+}
+
+// parsePublicKeyPEM returns the RSA key of the PEM encoded s.
+func parsePublicKeyPEM(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("parsePublicKeyPEM: no PEM data")
+	}
+	var k interface{}
+	k, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		k, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsePublicKeyPEM: %w", err)
+	}
+	key, ok := k.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("parsePublicKeyPEM: no RSA key")
+	}
+	return key, nil
+}
+
+// bodyDigest returns the Digest header of body.
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// signingString returns what the signature over headers of req covers,
+// as described in draft-cavage-http-signatures.
+func signingString(req *http.Request, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines[i] = h + ": " + strings.ToLower(req.Method) + " " + req.URL.RequestURI()
+		case "host":
+			host := req.Host
+			if host == "" {
+				host = req.URL.Host
+			}
+			lines[i] = h + ": " + host
+		default:
+			lines[i] = h + ": " + strings.Join(req.Header.Values(h), ", ")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// signRequest sets the Date, the Digest of body, if any, and the
+// Signature headers of req, signed with key under keyID.
+func signRequest(req *http.Request, keyID string, key *rsa.PrivateKey, body []byte) error {
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		req.Header.Set("Digest", bodyDigest(body))
+		headers = append(headers, "digest")
+	}
+	sum := sha256.Sum256([]byte(signingString(req, headers)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return fmt.Errorf("signRequest: %w", err)
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// requestSignature is the parsed Signature header of a request.
+type requestSignature struct {
+	keyID     string
+	headers   []string
+	signature []byte
+}
+
+// parseSignature returns the Signature header of r. It has to cover the
+// request target, the host, the date and, for requests with a body, the
+// digest.
+func parseSignature(r *http.Request) (requestSignature, error) {
+	var sig requestSignature
+	h := r.Header.Get("Signature")
+	if h == "" {
+		return sig, errors.New("parseSignature: no signature")
+	}
+	params := map[string]string{}
+	for _, part := range strings.Split(h, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			params[k] = strings.Trim(v, `"`)
+		}
+	}
+	sig.keyID = params["keyId"]
+	sig.headers = strings.Fields(strings.ToLower(params["headers"]))
+	if len(sig.headers) == 0 {
+		sig.headers = []string{"date"}
+	}
+	var err error
+	sig.signature, err = base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil || sig.keyID == "" {
+		return sig, errors.New("parseSignature: malformed signature")
+	}
+	required := []string{"(request-target)", "host", "date"}
+	if r.Method == http.MethodPost {
+		required = append(required, "digest")
+	}
+	for _, req := range required {
+		found := false
+		for _, h := range sig.headers {
+			found = found || h == req
+		}
+		if !found {
+			return sig, fmt.Errorf("parseSignature: %s not signed", req)
+		}
+	}
+	return sig, nil
+}
+
+// verifySignature checks sig of r against key, the Digest header against
+// body and the Date header against the clock.
+func verifySignature(r *http.Request, sig requestSignature, key *rsa.PublicKey, body []byte) error {
+	if body != nil && r.Header.Get("Digest") != bodyDigest(body) {
+		return errors.New("verifySignature: digest mismatch")
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return fmt.Errorf("verifySignature: %w", err)
+	}
+	if d := time.Since(date); d > signatureSkew || d < -signatureSkew {
+		return errors.New("verifySignature: date out of range")
+	}
+	sum := sha256.Sum256([]byte(signingString(r, sig.headers)))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig.signature)
+	if err != nil {
+		return fmt.Errorf("verifySignature: %w", err)
+	}
+	return nil
+}
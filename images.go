@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+var imgTagRe = regexp.MustCompile(`<img\s[^>]*>`)
+var imgSrcRe = regexp.MustCompile(`\ssrc="([^"]+)"`)
+
+// parseWidths parses the comma separated -imgwidths flag.
+func parseWidths(s string) ([]int, error) {
+	var ws []int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		w, err := strconv.Atoi(f)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("parseWidths: invalid width %q", f)
+		}
+		ws = append(ws, w)
+	}
+	sort.Ints(ws)
+	return ws, nil
+}
+
+// imageWidths are the widths resized variants are generated for. They are
+// set up in main from -imgwidths.
+var imageWidths []int
+
+func resizable(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	}
+	return false
+}
+
+// rewriteImages adds a srcset with the resized variants to every img tag
+// that points to a local image below /files/. With -lazyimages it also
+// marks images for lazy loading and adds the dimensions of local images so
+// the browser can reserve their space before they are loaded.
+func rewriteImages(content template.HTML) template.HTML {
+	if len(imageWidths) == 0 && !*flagLazyImages {
+		return content
+	}
+	return template.HTML(imgTagRe.ReplaceAllStringFunc(string(content), func(tag string) string {
+		m := imgSrcRe.FindStringSubmatch(tag)
+		if m == nil {
+			return tag
+		}
+		src := m[1]
+		name := strings.TrimPrefix(src, "/files/")
+		local := strings.HasPrefix(src, "/files/")
+		var attrs string
+		if len(imageWidths) > 0 && local && resizable(src) && !strings.Contains(tag, "srcset=") {
+			var set []string
+			for _, w := range imageWidths {
+				set = append(set, fmt.Sprintf("/img/%d/%s %dw", w, name, w))
+			}
+			attrs += fmt.Sprintf(` srcset="%s" sizes="(max-width: %dpx) 100vw, %dpx"`,
+				strings.Join(set, ", "), imageWidths[len(imageWidths)-1], imageWidths[len(imageWidths)-1])
+		}
+		if *flagLazyImages {
+			if !strings.Contains(tag, "loading=") {
+				attrs += ` loading="lazy"`
+			}
+			if local && resizable(src) && !strings.Contains(tag, "width=") && !strings.Contains(tag, "height=") {
+				if w, h, ok := imageSize(name); ok {
+					attrs += fmt.Sprintf(` width="%d" height="%d"`, w, h)
+				}
+			}
+		}
+		return strings.Replace(tag, m[0], m[0]+attrs, 1)
+	}))
+}
+
+// imageSize returns the dimensions of the image name in the files folder,
+// reading only its header.
+func imageSize(name string) (int, int, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	f, err := os.Open(filepath.Join(*flagFilesFolder, filepath.FromSlash(name)))
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, false
+	}
+	return cfg.Width, cfg.Height, true
+}
+
+// makeImageHandlerFunc serves /img/<width>/<name>, the image <name> of the
+// files folder scaled down to width. Variants are cached on disk in
+// -imgcache and only generated once.
+func makeImageHandlerFunc() http.HandlerFunc {
+	var mutex sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		rest := r.URL.Path[len("/img/"):]
+		ws, name, ok := strings.Cut(rest, "/")
+		width, err := strconv.Atoi(ws)
+		name = strings.TrimPrefix(path.Clean("/"+name), "/")
+		if !ok || err != nil || !allowedWidth(width) || !resizable(name) {
+			notFound(w, r)
+			return
+		}
+		src := filepath.Join(*flagFilesFolder, filepath.FromSlash(name))
+		cached := filepath.Join(*flagImageCache, ws, filepath.FromSlash(name))
+		mutex.Lock()
+		err = ensureResized(src, cached, width)
+		mutex.Unlock()
+		if errors.Is(err, os.ErrNotExist) {
+			notFound(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeImageHandlerFunc: %w", err))
+			return
+		}
+		http.ServeFile(w, r, cached)
+	}
+}
+
+// ensureResized generates cached from src unless it exists and is newer
+// than src.
+func ensureResized(src, cached string, width int) error {
+	si, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("ensureResized: %w", err)
+	}
+	ci, err := os.Stat(cached)
+	if err == nil && !ci.ModTime().Before(si.ModTime()) {
+		return nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ensureResized: %w", err)
+	}
+	return resizeImage(src, cached, width)
+}
+
+func allowedWidth(w int) bool {
+	for _, a := range imageWidths {
+		if a == w {
+			return true
+		}
+	}
+	return false
+}
+
+// resizeImage writes src scaled to width into dst, keeping the aspect
+// ratio and format. Images narrower than width are copied unscaled.
+func resizeImage(src, dst string, width int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("resizeImage: %w", err)
+	}
+	defer in.Close()
+	img, format, err := image.Decode(in)
+	if err != nil {
+		return fmt.Errorf("resizeImage.Decode: %w", err)
+	}
+	b := img.Bounds()
+	if b.Dx() > width {
+		h := b.Dy() * width / b.Dx()
+		if h < 1 {
+			h = 1
+		}
+		scaled := image.NewRGBA(image.Rect(0, 0, width, h))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, b, draw.Over, nil)
+		img = scaled
+	}
+	err = os.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		return fmt.Errorf("resizeImage: %w", err)
+	}
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("resizeImage: %w", err)
+	}
+	switch format {
+	case "png":
+		err = png.Encode(out, img)
+	case "gif":
+		err = gif.Encode(out, img, nil)
+	default:
+		err = jpeg.Encode(out, img, &jpeg.Options{Quality: 85})
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("resizeImage.Encode: %w", err)
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// postIndex holds the published posts of the content store together with
+// the tags, categories and archive built from them, so listings are served
+// from memory. The posts are kept without their comments, which change
+// far more often; handlers showing comments load them per post.
+type postIndex struct {
+	mutex      sync.RWMutex
+	pages      Pages
+	tags       Tags
+	categories *Category
+	archive    Archive
+	built      bool
+
+	// building serializes the builds, store and sched are those of the
+	// loop started by indexPosts, for refresh. Once stopped, builds do
+	// nothing.
+	building sync.Mutex
+	store    ContentStore
+	sched    *scheduler
+	stopped  bool
+
+	// announced are the URLs of the posts the publishHooks were called
+	// with, kept in -announced. It is loaded with the first build.
+	announced map[string]bool
+}
+
+// posts is the index of contentStore, set up in main with indexPosts.
+var posts = &postIndex{categories: collectCategories(nil)}
+
+// publishHooks are called with every post that enters the index after it
+// was first built, i.e. that is published while goblog runs. They must not
+// block, as the index waits for them.
+var publishHooks []func(Page)
+
+// onPublish adds fn to the publishHooks. It has to be called before
+// indexPosts.
+func onPublish(fn func(Page)) {
+	publishHooks = append(publishHooks, fn)
+}
+
+// indexPosts builds the index of cs and keeps it up to date in the
+// background: whenever cs or the templates change, a scheduled post is
+// due, and every 30 seconds as a fallback.
+func indexPosts(cs ContentStore) {
+	changed := cs.Watch()
+	sched := newScheduler()
+	posts.store, posts.sched = cs, sched
+	posts.build(cs, sched)
+	go func() {
+		for {
+			select {
+			case <-time.After(30 * time.Second):
+			case <-sched.C:
+			case <-changed:
+			case <-templatesChanged:
+			}
+			posts.build(cs, sched)
+		}
+	}()
+}
+
+// build replaces the index by the posts of cs published now, scheduling
+// a rebuild for the posts to be published later. Posts that fail to load
+// are left out, logged by readAllPages; if cs fails, the index is empty.
+func (ix *postIndex) build(cs ContentStore, sched *scheduler) {
+	ix.building.Lock()
+	defer ix.building.Unlock()
+	if ix.stopped {
+		return
+	}
+	all, err := readAllPages(cs)
+	if err != nil && !errors.Is(err, errBadPages) {
+		slog.Error("loading pages failed", "err", err)
+	}
+	now := time.Now()
+	for _, p := range all {
+		if !p.Draft && !p.published(now) {
+			sched.schedule(p.Publish)
+		}
+	}
+	ps := publishedPages(all, now)
+	tags := collectTags(ps)
+	categories := collectCategories(ps)
+	archive := buildArchive(ps)
+	ix.mutex.Lock()
+	old, built := ix.pages, ix.built
+	ix.pages, ix.tags, ix.categories, ix.archive = ps, tags, categories, archive
+	ix.built = true
+	ix.mutex.Unlock()
+	if len(publishHooks) > 0 {
+		ix.announce(old, ps, built)
+	}
+	slog.Debug("index loaded", "pages", len(ps))
+}
+
+// stop waits for a running build and keeps the index as it is from then
+// on, so the publishHooks are not called any more once their queues are
+// closed.
+func (ix *postIndex) stop() {
+	ix.building.Lock()
+	ix.stopped = true
+	ix.building.Unlock()
+}
+
+// refresh builds the index right away, e.g. after a post was written, so
+// the post can be found as soon as the request writing it is answered.
+func (ix *postIndex) refresh() {
+	if ix.store != nil {
+		ix.build(ix.store, ix.sched)
+	}
+}
+
+// announce calls the publishHooks with the posts of ps missing in old
+// that were not announced before, and records them in -announced. So a
+// post that is unpublished and published again, or drops out of the index
+// while its file can't be read, is announced only once, also across
+// restarts. The posts of the first build are recorded without calling the
+// hooks, they were published before goblog started.
+func (ix *postIndex) announce(old, ps Pages, built bool) {
+	if ix.announced == nil {
+		ix.announced = map[string]bool{}
+		b, err := os.ReadFile(*flagAnnounced)
+		if err == nil {
+			var urls []string
+			err = json.Unmarshal(b, &urls)
+			for _, u := range urls {
+				ix.announced[u] = true
+			}
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("loading announced posts failed", "err", err)
+		}
+	}
+	known := make(map[string]bool, len(old))
+	for _, p := range old {
+		known[p.Name] = true
+	}
+	added := false
+	for _, p := range ps {
+		if known[p.Name] || ix.announced[p.URL()] {
+			continue
+		}
+		ix.announced[p.URL()] = true
+		added = true
+		if !built {
+			continue
+		}
+		slog.Info("post published", "post", p.Name)
+		for _, fn := range publishHooks {
+			fn(p)
+		}
+	}
+	if added {
+		err := ix.saveAnnounced()
+		if err != nil {
+			slog.Error("saving announced posts failed", "err", err)
+		}
+	}
+}
+
+// saveAnnounced writes the announced posts to -announced.
+func (ix *postIndex) saveAnnounced() error {
+	urls := make([]string, 0, len(ix.announced))
+	for u := range ix.announced {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	b, err := json.MarshalIndent(urls, "", "  ")
+	if err != nil {
+		return fmt.Errorf("postIndex.saveAnnounced: %w", err)
+	}
+	err = writeFileAtomic(*flagAnnounced, b, time.Now())
+	if err != nil {
+		return fmt.Errorf("postIndex.saveAnnounced: %w", err)
+	}
+	return nil
+}
+
+// published returns the published posts, newest first, without comments.
+func (ix *postIndex) published() Pages {
+	ix.mutex.RLock()
+	defer ix.mutex.RUnlock()
+	return ix.pages
+}
+
+func (ix *postIndex) allTags() Tags {
+	ix.mutex.RLock()
+	defer ix.mutex.RUnlock()
+	return ix.tags
+}
+
+func (ix *postIndex) allCategories() *Category {
+	ix.mutex.RLock()
+	defer ix.mutex.RUnlock()
+	return ix.categories
+}
+
+func (ix *postIndex) fullArchive() Archive {
+	ix.mutex.RLock()
+	defer ix.mutex.RUnlock()
+	return ix.archive
+}
+
+// find returns the published post with slug like findPage, with its
+// comments and reactions loaded.
+func (ix *postIndex) find(slug string) (p Page, moved, ok bool, err error) {
+	p, moved, ok = findPage(ix.published(), slug)
+	if !ok {
+		return p, moved, ok, nil
+	}
+	p, err = withComments(p)
+	if err == nil {
+		p, err = withReactions(p)
+	}
+	return p, moved, ok, err
+}
+
+// withAllComments returns a copy of ps with the comments of every page
+// loaded.
+func withAllComments(ps Pages) (Pages, error) {
+	out := make(Pages, len(ps))
+	for i, p := range ps {
+		p, err := withComments(p)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = p
+	}
+	return out, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// jsonFeedVersion identifies the version of the JSON Feed spec followed.
+const jsonFeedVersion = "https://jsonfeed.org/version/1.1"
+
+// jsonFeed is a JSON Feed 1.1 document.
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Description string           `json:"description,omitempty"`
+	Icon        string           `json:"icon,omitempty"`
+	Authors     []jsonFeedAuthor `json:"authors"`
+	Hubs        []jsonFeedHub    `json:"hubs,omitempty"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+type jsonFeedHub struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type jsonFeedAuthor struct {
+	Name   string `json:"name"`
+	URL    string `json:"url,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+type jsonFeedItem struct {
+	ID            string               `json:"id"`
+	URL           string               `json:"url"`
+	Title         string               `json:"title"`
+	ContentHTML   string               `json:"content_html"`
+	Summary       string               `json:"summary,omitempty"`
+	Image         string               `json:"image,omitempty"`
+	DatePublished string               `json:"date_published"`
+	DateModified  string               `json:"date_modified"`
+	Authors       []jsonFeedAuthor     `json:"authors,omitempty"`
+	Tags          []string             `json:"tags,omitempty"`
+	Attachments   []jsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+type jsonFeedAttachment struct {
+	URL         string `json:"url"`
+	MimeType    string `json:"mime_type"`
+	Title       string `json:"title,omitempty"`
+	SizeInBytes int64  `json:"size_in_bytes,omitempty"`
+}
+
+// feedAttachment returns the JSON feed attachment of a. The size is only
+// known for files below /files/.
+func feedAttachment(a Attachment) jsonFeedAttachment {
+	fa := jsonFeedAttachment{URL: absURL(a.URL), MimeType: a.Type, Title: a.Title}
+	if fa.MimeType == "" {
+		fa.MimeType = mime.TypeByExtension(path.Ext(a.URL))
+	}
+	if fa.MimeType == "" {
+		fa.MimeType = "application/octet-stream"
+	}
+	if name, ok := strings.CutPrefix(a.URL, "/files/"); ok && filepath.IsLocal(filepath.FromSlash(name)) {
+		if fi, err := os.Stat(filepath.Join(*flagFilesFolder, filepath.FromSlash(name))); err == nil {
+			fa.SizeInBytes = fi.Size()
+		}
+	}
+	return fa
+}
+
+// postFeedItem returns the JSON feed item of p.
+func postFeedItem(p Page) jsonFeedItem {
+	it := jsonFeedItem{
+		ID:            postGUID(p),
+		URL:           absURL(p.URL()),
+		Title:         p.Title,
+		ContentHTML:   string(feedHTML(p)),
+		Summary:       p.Summary,
+		DatePublished: p.PublishedAt().UTC().Format(time.RFC3339),
+		DateModified:  postUpdated(p).UTC().Format(time.RFC3339),
+		Tags:          p.Tags,
+	}
+	if p.Image != "" {
+		it.Image = absURL(p.Image)
+	}
+	if a := p.Author; a != nil && a.Name != "" {
+		fa := jsonFeedAuthor{Name: a.Name, URL: absURL(a.URL())}
+		if a.Avatar != "" {
+			fa.Avatar = absURL(a.Avatar)
+		}
+		it.Authors = []jsonFeedAuthor{fa}
+	}
+	for _, a := range p.Attachments {
+		if a.URL != "" {
+			it.Attachments = append(it.Attachments, feedAttachment(a))
+		}
+	}
+	return it
+}
+
+// makeJSONFeedHandlerFunc serves /feed.json, the JSON feed of the
+// -feed-items newest posts.
+func makeJSONFeedHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ps := feedPages(posts.published())
+		f := jsonFeed{
+			Version:     jsonFeedVersion,
+			Title:       *flagSiteName,
+			HomePageURL: absURL("/"),
+			FeedURL:     absURL("/feed.json"),
+			Description: *flagDescription,
+			Authors:     []jsonFeedAuthor{{Name: *flagSiteName, URL: absURL("/")}},
+			Items:       []jsonFeedItem{},
+		}
+		if *flagSiteImage != "" {
+			f.Icon = absURL(*flagSiteImage)
+		}
+		if *flagWebSubHub != "" {
+			f.Hubs = []jsonFeedHub{{Type: "WebSub", URL: *flagWebSubHub}}
+		}
+		for _, p := range ps {
+			f.Items = append(f.Items, postFeedItem(p))
+		}
+		etag, modified := listValidators(ps, f)
+		if notModified(w, r, etag, modified) {
+			return
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(f)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeJSONFeedHandlerFunc: %w", err))
+			return
+		}
+		setHubLinks(w, "/feed.json")
+		w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+		w.Write(buf.Bytes())
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Listen modes of -listen besides a TCP address.
+const (
+	listenUnix    = "unix:"
+	listenSystemd = "systemd"
+)
+
+// systemdFirstFD is the first file descriptor passed by systemd socket
+// activation, after stdin, stdout and stderr.
+const systemdFirstFD = 3
+
+// listener returns the listener the server accepts connections on: a
+// unix domain socket for "unix:<path>", the socket passed by systemd for
+// "systemd", or otherwise a TCP listener on the address addr, e.g. ":8001".
+func listener(addr string) (net.Listener, error) {
+	switch {
+	case addr == listenSystemd:
+		l, err := systemdListener()
+		if err != nil {
+			return nil, fmt.Errorf("listener: %w", err)
+		}
+		return l, nil
+	case strings.HasPrefix(addr, listenUnix):
+		l, err := unixListener(strings.TrimPrefix(addr, listenUnix), *flagSocketMode)
+		if err != nil {
+			return nil, fmt.Errorf("listener: %w", err)
+		}
+		return l, nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listener: %w", err)
+	}
+	return l, nil
+}
+
+// unixListener listens on a unix domain socket at path with the octal
+// permissions mode, replacing the socket a previous run left behind. The
+// socket is removed again when the listener is closed.
+func unixListener(path, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unixListener: invalid mode %q", mode)
+	}
+	fi, err := os.Lstat(path)
+	if err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("unixListener: %s exists and is no socket", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("unixListener: %w", err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("unixListener: %w", err)
+	}
+	err = os.Chmod(path, os.FileMode(perm))
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("unixListener: %w", err)
+	}
+	return l, nil
+}
+
+// systemdListener returns the first socket systemd passed with socket
+// activation, as announced by the LISTEN_PID and LISTEN_FDS environment
+// variables. They are unset so child processes don't take the socket for
+// theirs.
+func systemdListener() (net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, errors.New("systemdListener: no socket passed by systemd")
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, errors.New("systemdListener: no socket passed by systemd")
+	}
+	f := os.NewFile(systemdFirstFD, "LISTEN_FD_3")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("systemdListener: %w", err)
+	}
+	return l, nil
+}
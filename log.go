@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Log formats, selected with -log-format.
+const (
+	logText = "text"
+	logJSON = "json"
+)
+
+// newLogger returns a logger writing records of level ("debug", "info",
+// "warn" or "error") and above to w in format.
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("newLogger: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case logText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case logJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("newLogger: unknown log format %q", format)
+}
+
+// requestLogKey is the context key of the *requestLog of a request.
+type requestLogKey struct{}
+
+// requestLog collects the error of a request to be logged when it is done.
+type requestLog struct {
+	err error
+}
+
+// statusWriter remembers the status code and the number of body bytes
+// written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logRequests logs every request to h with its method, path, status and
+// duration when it is done: at debug level, or as an error together with
+// the error passed to logError if it failed.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rl := &requestLog{}
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		level := slog.LevelDebug
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", sw.status),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if rl.err != nil || sw.status >= 500 {
+			level = slog.LevelError
+		}
+		if rl.err != nil {
+			attrs = append(attrs, slog.Any("err", rl.err))
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// logError records err as the reason request r failed, to be logged by
+// logRequests. Outside of it, err is logged right away.
+func logError(r *http.Request, err error) {
+	rl, ok := r.Context().Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		reqLogger(r).Error("request failed", "err", err)
+		return
+	}
+	rl.err = err
+}
+
+// reqLogger returns the default logger with the method and path of r.
+func reqLogger(r *http.Request) *slog.Logger {
+	return slog.With("method", r.Method, "path", r.URL.Path)
+}
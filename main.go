@@ -6,203 +6,1408 @@ import (
 	"flag"
 	"fmt"
 	"html/template"
-	"io/ioutil"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
-	"sync"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
 	"time"
-
-	"github.com/russross/blackfriday"
 )
 
 type Page struct {
-	Title      string
-	LastChange time.Time
-	Content    template.HTML
-	Comments   []Comment
+	Name        string
+	Slug        string
+	Title       string
+	Author      *Author
+	Date        time.Time
+	Tags        []string
+	Section     Section
+	Category    string
+	Breadcrumbs []Crumb
+	Template    string
+	Draft       bool
+	Featured    bool
+	Publish     time.Time
+	Summary     string
+	Image       string
+	Attachments []Attachment
+	Static      bool
+	LastChange  time.Time
+	Content     template.HTML
+	Excerpt     template.HTML
+	ReadingTime int
+	TOC         []*TOCEntry
+	Math        string
+	Diagrams    bool
+	CommentsOff bool
+	CommentsEnd time.Time
+	Comments    []Comment
+	Thread      []*CommentNode `json:"-"`
+	CommentForm *CommentForm   `json:"-"`
+	Reactions   []Reaction     `json:",omitempty"`
+	Views       int64          `json:",omitempty"`
+	Related     []PageRef
+	Prev        *PageRef
+	Next        *PageRef
 }
 
 type Pages []Page
 
 type Comment struct {
-	Name    string `json:"name"`
-	Comment string `json:"comment"`
+	ID       string    `json:"id"`
+	ParentID string    `json:"parent,omitempty"`
+	Name     string    `json:"name"`
+	Comment  string    `json:"comment"`
+	Status   string    `json:"status,omitempty"`
+	Time     time.Time `json:"time,omitzero"`
+	// EmailHash is the SHA-256 of the commenter's email address, which
+	// itself is not stored.
+	EmailHash string `json:"emailhash,omitempty"`
+	// Reports counts the readers who reported the comment for review.
+	// Reporters are the MACs of their IPs under the -secret, so each
+	// reader counts once.
+	Reports   int      `json:"reports,omitempty"`
+	Reporters []string `json:"reporters,omitempty"`
+	// Type tells comments left in the form, which have none, from those
+	// received from other sites, like webmentions. Source is the URL of
+	// the page that sent those.
+	Type   string `json:"type,omitempty"`
+	Source string `json:"source,omitempty"`
+	// Account is the provider account the commenter signed in with, like
+	// github:583231, which vouches for the name.
+	Account string `json:"account,omitempty"`
+}
+
+// Statuses of comments that wait for moderation and are not shown: held
+// ones were suspected spam, flagged ones were reported -comment-reports
+// times.
+const (
+	commentHeld    = "held"
+	commentFlagged = "flagged"
+)
+
+// visibleComments returns the comments of cs shown to readers.
+func visibleComments(cs []Comment) []Comment {
+	var vs []Comment
+	for _, c := range cs {
+		if c.Status != commentHeld && c.Status != commentFlagged {
+			vs = append(vs, c)
+		}
+	}
+	return vs
 }
 
 var (
-	flagSrcFolder   = flag.String("src", "./pages/", "blog folder")
-	flagTmplFolder  = flag.String("tmpl", "./templates/", "template folder")
-	flagFilesFolder = flag.String("files", "./files/", "path for the file server")
-	flagPort        = flag.String("port", "8001", "port of the webserver")
+	flagSrcFolder    = flag.String("src", "./pages/", "blog folder")
+	flagContentStore = flag.String("content-store", "files", "storage of the posts: files in -src, the sqlite database -content-db, the postgres database -postgres, the bucket -s3 or the git repository -git")
+	flagContentDB    = flag.String("content-db", "./content.db", "sqlite database of the posts, filled with -import-pages")
+	flagPostgres     = flag.String("postgres", "", "connection string of the postgres database of -comment-store and -content-store postgres, e.g. postgres://goblog@db/goblog")
+	flagPGConns      = flag.Int("postgres-conns", 10, "maximum number of open connections to -postgres")
+	flagS3URL        = flag.String("s3", "", "URL of the bucket and prefix of the posts for -content-store s3, e.g. https://s3.eu-central-1.amazonaws.com/bucket/pages/")
+	flagS3Region     = flag.String("s3-region", "us-east-1", "region of the bucket of -s3")
+	flagS3Cache      = flag.String("s3-cache", "./cache/s3/", "folder keeping the posts synced from -s3")
+	flagS3Sync       = flag.Duration("s3-sync", time.Minute, "how often the posts are synced from -s3")
+	flagS3Files      = flag.String("s3-files", "", "prefix of the files in the bucket of -s3 to sync into -files, empty to serve -files as it is")
+	flagGitRepo      = flag.String("git", "", "URL of the git repository of the posts for -content-store git")
+	flagGitBranch    = flag.String("git-branch", "", "branch of -git to publish, empty for its default branch")
+	flagGitPath      = flag.String("git-path", "", "folder of the posts within -git, empty for its root")
+	flagGitDir       = flag.String("git-dir", "./cache/git/", "folder keeping the clone of -git and the checked out posts")
+	flagGitPull      = flag.Duration("git-pull", 5*time.Minute, "how often -git is pulled, 0 to pull only on the webhook")
+	flagGitSecret    = flag.String("git-secret", "", "secret of the push webhook at /hooks/git, empty to disable it")
+	flagImportPages  = flag.String("import-pages", "", "import the files of a folder into -content-db, replacing all posts there, and exit")
+	flagBackup       = flag.String("backup", "", "write a backup of posts, comments, files and configuration to this tar.gz file, - for stdout, and exit")
+	flagRestore      = flag.String("restore", "", "restore the backup in this tar.gz file and exit")
+	flagBackupEvery  = flag.Duration("backup-every", 0, "how often a backup is written into -backup-dir, 0 for never")
+	flagBackupDir    = flag.String("backup-dir", "./backups/", "folder of the scheduled backups")
+	flagBackupKeep   = flag.Int("backup-keep", 7, "number of scheduled backups kept in -backup-dir, 0 to keep all")
+	flagBackupS3     = flag.String("backup-s3", "", "bucket URL and prefix the scheduled backups are uploaded to, like -s3")
+	flagStaticSrc    = flag.String("static", "./pages-static/", "folder of static pages like about or contact")
+	flagTmplFolder   = flag.String("tmpl", "", "folder with templates overriding the theme and defaults")
+	flagThemesFolder = flag.String("themes", "./themes/", "folder containing the themes")
+	flagTheme        = flag.String("theme", "", "name of the theme to use, empty for the default templates")
+	flagDev          = flag.Bool("dev", false, "reparse templates when they change, for template development")
+	flagWatch        = flag.Bool("watch", true, "watch -src, -static and the templates for changes instead of polling")
+	flagAssetsFolder = flag.String("assets", "./assets/", "folder of CSS and JS files that are bundled and served under /assets/")
+	flagFilesFolder  = flag.String("files", "./files/", "path for the file server")
+	flagStaticDir    = flag.String("static-dir", "./static/", "folder of CSS, JS, images and other files served under /static/")
+	flagStaticMaxAge = flag.Duration("static-maxage", time.Hour, "how long browsers may cache the files under /static/")
+	flagImageCache   = flag.String("imgcache", "./cache/img/", "folder for resized images")
+	flagImageWidths  = flag.String("imgwidths", "480,960,1440", "comma separated widths of resized images, empty to disable")
+	flagLazyImages   = flag.Bool("lazyimages", true, "lazy load images and add the dimensions of local images to avoid layout shifts")
+	flagBaseURL      = flag.String("baseurl", "http://localhost:8001/", "public URL of the blog, used for absolute links")
+	flagSiteName     = flag.String("sitename", "goblog", "name of the blog, the title of pages without their own")
+	flagDescription  = flag.String("description", "", "description of the blog for search engines and link previews")
+	flagSiteImage    = flag.String("image", "", "image shown in link previews of pages without their own")
+	flagTwitter      = flag.String("twitter", "", "Twitter handle of the blog, e.g. @goblog")
+	flagPort         = flag.String("port", "8001", "port of the webserver")
+	flagListen       = flag.String("listen", "", "where to listen instead of -port: unix:<path> for a unix domain socket or systemd for socket activation")
+	flagSocketMode   = flag.String("socket-mode", "0660", "permissions of the unix domain socket of -listen")
+	flagTLSCert      = flag.String("tls-cert", "", "certificate file to serve HTTPS on -port with, empty for plain HTTP")
+	flagTLSKey       = flag.String("tls-key", "", "key file of -tls-cert")
+	flagACMEDomains  = flag.String("acme-domains", "", "comma separated domains to get certificates for from Let's Encrypt, instead of -tls-cert")
+	flagACMECache    = flag.String("acme-cache", "./cache/acme/", "folder keeping the certificates from Let's Encrypt")
+	flagACMEEmail    = flag.String("acme-email", "", "contact email for the Let's Encrypt account, optional")
+	flagLogLevel     = flag.String("log-level", "info", "minimum level of log messages: debug, info, warn or error; requests are logged at debug level")
+	flagLogFormat    = flag.String("log-format", "text", "format of log messages: text or json")
+	flagAccessLog    = flag.String("access-log", "", "file to log every request to, - for stdout, empty for none")
+	flagAccessFormat = flag.String("access-log-format", "combined", "format of the access log: common, combined or json")
+	flagReadTimeout  = flag.Duration("read-timeout", 30*time.Second, "maximum time to read a request including its body")
+	flagWriteTimeout = flag.Duration("write-timeout", time.Minute, "maximum time to write a response")
+	flagIdleTimeout  = flag.Duration("idle-timeout", 2*time.Minute, "how long idle keep-alive connections are kept open")
+	flagShutdownWait = flag.Duration("shutdown-timeout", 10*time.Second, "how long running requests may take to finish on SIGINT or SIGTERM")
+	flagHTTPPort     = flag.String("http-port", "", "port redirecting plain HTTP to HTTPS when serving TLS, e.g. 80, empty for none")
+	flagMarkdown     = flag.String("markdown", "table,strikethrough,tasklist,linkify,emoji,footnote", "comma separated markdown extensions: table, strikethrough, tasklist, linkify, deflist, emoji, footnote")
+	flagHighlight    = flag.String("highlight", "github", "chroma style for code blocks, empty to disable highlighting")
+	flagEmojiSVG     = flag.String("emoji-svg", "", "URL prefix of SVG emoji images to use instead of Unicode characters")
+	flagTypographer  = flag.Bool("typographer", false, "convert quotes, dashes and ellipses to typographic characters unless a post's front matter disables it")
+	flagUnsafeHTML   = flag.Bool("unsafe-html", false, "pass raw HTML from the pages through without sanitizing it")
+	flagTOC          = flag.Bool("toc", false, "show a table of contents on posts unless their front matter disables it")
+	flagMath         = flag.String("math", "", "default math rendering: katex, mathml or empty for none")
+	flagMermaid      = flag.String("mermaid", "", "rendering of mermaid diagrams: client for mermaid.js, server for SVG generated with -mmdc, or empty for plain code blocks")
+	flagMmdc         = flag.String("mmdc", "mmdc", "mermaid CLI used to render diagrams in server mode")
+	flagDiagramCache = flag.String("diagramcache", "./cache/diagrams/", "folder for diagrams rendered in server mode")
+	flagFeedItems    = flag.Int("feed-items", 20, "number of posts in the feeds, 0 for all")
+	flagFeedContent  = flag.String("feed-content", "summary", "content of posts in the feeds: full or summary")
+	flagPageSize     = flag.Int("pagesize", 10, "posts per index page, 0 for all")
+	flagExcerptWords = flag.Int("excerptwords", 50, "length of generated excerpts in words")
+	flagWPM          = flag.Int("wpm", 200, "reading speed in words per minute for reading time estimates")
+	flagRelated      = flag.Int("related", 3, "number of related posts shown per page")
+	flagCommentStore = flag.String("comment-store", "json", "storage of comments: json files in -comment-dir, the sqlite database -comment-db, the postgres database -postgres or the bbolt file -bolt")
+	flagCommentDir   = flag.String("comment-dir", "./comments/", "folder of the json comment files")
+	flagCommentDB    = flag.String("comment-db", "./comments.db", "sqlite database of the comments")
+	flagBoltFile     = flag.String("bolt", "./goblog.bolt", "bbolt database of the comments, view counts and reactions for -comment-store bolt")
+	flagReactions    = flag.String("reactions", "👍,❤️,🎉", "comma separated reactions offered below posts with -comment-store bolt, empty for none")
+	flagCommentDays  = flag.Int("comment-days", 0, "days after publishing a post its comments close unless its front matter says otherwise, 0 to keep them open")
+	flagReportLimit  = flag.Int("comment-reports", 3, "reports after which a comment is hidden until a moderator approves it, 0 to never hide it")
+	flagModPassword  = flag.String("moderation-password", "", "password for the moderation queue at /moderate/, and for the admin area at /admin/ while there are no -users, empty to disable it")
+	flagAdminSession = flag.Duration("admin-session", 12*time.Hour, "how long a login to the admin area lasts")
+	flagUsers        = flag.String("users", "./users.json", "file of the users of the admin area with their bcrypt password hashes and roles")
+	flagGitHubID     = flag.String("github-id", "", "client ID of the GitHub OAuth app users log in with, empty for no GitHub logins")
+	flagGitHubSecret = flag.String("github-secret", "", "client secret of the GitHub OAuth app")
+	flagGoogleID     = flag.String("google-id", "", "OAuth client ID at Google users log in with, empty for no Google logins")
+	flagGoogleSecret = flag.String("google-secret", "", "OAuth client secret at Google")
+	flagOIDCIssuer   = flag.String("oidc-issuer", "", "issuer URL of an OpenID Connect provider users log in with, empty for none")
+	flagOIDCID       = flag.String("oidc-id", "", "client ID at -oidc-issuer")
+	flagOIDCSecret   = flag.String("oidc-secret", "", "client secret at -oidc-issuer")
+	flagOIDCName     = flag.String("oidc-name", "OpenID Connect", "name of -oidc-issuer on the login buttons")
+	flagOAuthComment = flag.Bool("oauth-comments", false, "let commenters sign in with the login providers, showing the name of their account with their comments")
+	flagUploadDir    = flag.String("upload-dir", "media", "folder below -files the admin area stores uploads in")
+	flagUploadMax    = flag.Int("upload-max", 10, "largest upload the admin area takes in MB")
+	flagArchetypes   = flag.String("archetypes", "./archetypes/", "folder of the archetypes goblog new creates posts from, named <kind>.md")
+	flagAddUser      = flag.String("add-user", "", "add the user name[:role] with the password read from stdin to -users, or change it, and exit")
+	flagCommentOrd   = flag.String("comment-order", "oldest", "order of the comment threads: oldest or newest first")
+	flagCommentEdit  = flag.Duration("comment-edit", 15*time.Minute, "how long commenters can edit or delete their comments, 0 to disable")
+	flagGravatar     = flag.Bool("gravatar", true, "ask commenters for an optional email address and show their Gravatar")
+	flagImportDisqus = flag.String("import-disqus", "", "import the comments of a Disqus XML export into the comment store and exit")
+	flagAkismetKey   = flag.String("akismet-key", "", "Akismet API key to check comments for spam, empty to accept all comments")
+	flagSpamAction   = flag.String("spam", "hold", "what to do with suspected spam: hold for moderation or reject")
+	flagSecret       = flag.String("secret", "", "key signing form tokens, random on every start if empty")
+	flagCommentDelay = flag.Duration("comment-mintime", 3*time.Second, "minimum time between rendering the comment form and submitting it")
+	flagCommentPoW   = flag.Int("comment-pow", 0, "leading zero bits of the proof of work the comment form has to compute, 0 to disable")
+	flagSMTP         = flag.String("smtp", "", "host:port of the mail server sending comment notifications, empty to disable them")
+	flagSMTPUser     = flag.String("smtp-user", "", "user name on the mail server")
+	flagSMTPPassword = flag.String("smtp-password", "", "password on the mail server")
+	flagMailFrom     = flag.String("mail-from", "goblog@localhost", "sender address of comment notifications")
+	flagNewsletter   = flag.String("newsletter", "off", "mail new posts to the subscribers of /subscribe: off, auto when they are published or manual from /newsletter/")
+	flagSubscribers  = flag.String("subscribers", "./subscribers.json", "file keeping the newsletter subscribers")
+	flagNotify       = flag.String("notify", "", "address notified about new comments")
+	flagNotifyAuthor = flag.Bool("notify-authors", false, "also notify the author of the post, if authors.json has an email for them")
+	flagClientRate   = flag.String("comment-iprate", "5/10m", "comments and reports allowed per client IP and period, e.g. 5/10m, empty for no limit")
+	flagLoginRate    = flag.String("login-iprate", "10/15m", "logins to the admin area and through OAuth, and failed basic auth logins, allowed per client IP and period, empty for no limit")
+	flagPostRate     = flag.String("post-iprate", "30/10m", "requests to /react/, /webmention, /xmlrpc, /trackback/, /subscribe and /micropub allowed per client IP and period, each, empty for no limit")
+	flagTrustedProxy = flag.String("trusted-proxies", "", "comma separated IPs and CIDR networks of reverse proxies whose X-Forwarded-For, -Proto and -Host headers are believed")
+	flagCanonical    = flag.Bool("canonical-redirect", false, "redirect requests for another scheme or host than that of -baseurl there")
+	flagCSP          = flag.String("csp", defaultCSP, "Content-Security-Policy header of all responses, empty for none")
+	flagAdminCSP     = flag.String("admin-csp", defaultAdminCSP, "Content-Security-Policy header of the moderation pages, empty for none")
+	flagHSTS         = flag.Duration("hsts", 0, "max-age of the Strict-Transport-Security header of HTTPS responses, e.g. 8760h, 0 for none")
+	flagReferrer     = flag.String("referrer-policy", "strict-origin-when-cross-origin", "Referrer-Policy header of all responses, empty for none")
+	flagFrameOptions = flag.String("frame-options", "DENY", "X-Frame-Options header of all responses: DENY, SAMEORIGIN or empty for none")
+	flagRate         = flag.String("rate", "", "requests allowed per client IP and period on all routes together, e.g. 600/1m, empty for no limit")
+	flagRouteRates   = flag.String("route-rates", "", "requests allowed per client IP and period on single routes, e.g. /=60/1m,/tag/=30/1m")
+	flagRateExempt   = flag.String("rate-exempt", "", "comma separated IPs and CIDR networks that are never rate limited")
+	flagSecContact   = flag.String("security-contact", "", "comma separated contacts of /.well-known/security.txt, e.g. mailto:security@example.com, empty to serve none")
+	flagSecPolicy    = flag.String("security-policy", "", "URL of the security policy named in /.well-known/security.txt")
+	flagCommentRate  = flag.String("comment-rate", "30/1h", "comments allowed per post and period, empty for no limit")
+	flagWebhooks     = flag.String("webhooks", "", "comma separated URLs that get comment events posted as JSON")
+	flagWebhookKey   = flag.String("webhook-secret", "", "key signing the webhook requests, empty for unsigned requests")
+	flagActivityPub  = flag.Bool("activitypub", false, "let fediverse accounts follow the blog and deliver new posts to them")
+	flagAPUser       = flag.String("ap-user", "blog", "user name of the ActivityPub actor, followed as @user@host of -baseurl")
+	flagAPKey        = flag.String("ap-key", "./activitypub.pem", "RSA private key signing ActivityPub requests, created if missing")
+	flagAPFollowers  = flag.String("ap-followers", "./followers.json", "file of the ActivityPub followers")
+	flagAnnounced    = flag.String("announced", "./announced.json", "file of the posts announced to followers, subscribers, hubs and linked sites, so each post is announced once")
+	flagWebmention   = flag.String("webmention", "off", "webmentions received at /webmention: off, hold for moderation or accept")
+	flagWebSubHub    = flag.String("websub-hub", "", "WebSub hub advertised in the feeds and notified of new posts, e.g. https://pubsubhubbub.appspot.com/")
+	flagMentionSend  = flag.Bool("webmention-send", false, "send webmentions to the pages linked from posts published while goblog runs")
+	flagPingback     = flag.String("pingback", "off", "pingbacks received at /xmlrpc and trackbacks at /trackback/<post>: off, hold for moderation or accept")
+	flagAPIToken     = flag.String("api-token", "", "bearer token allowing to write posts and moderate comments through /api/v1/, empty to disable that")
+	flagTokenURL     = flag.String("token-endpoint", "", "IndieAuth token endpoint checking the tokens of Micropub clients, empty to disable /micropub")
+	flagAuthURL      = flag.String("auth-endpoint", "https://indieauth.com/auth", "IndieAuth authorization endpoint announced to Micropub clients")
+	flagIndieMe      = flag.String("indieauth-me", "", "profile URL Micropub tokens have to be issued for, -baseurl if empty")
+	flagAuthorsFile  = flag.String("authors", "./authors.json", "JSON file describing the authors")
+	flagBlogroll     = flag.String("blogroll", "./blogroll.json", "JSON file listing the sites of the blogroll at /blogroll")
 )
 
-func loadPage(fpath string) (Page, error) {
+// loadPage loads the page name of cs. The rendered source is taken from
+// sources while the file is unchanged; the comments are always loaded
+// fresh.
+func loadPage(cs ContentStore, name string) (Page, error) {
+	p, err := sourcePage(cs, name)
+	if err != nil {
+		return p, err
+	}
+	return withComments(p)
+}
+
+// sourcePage returns the page rendered from the file name of cs, without
+// comments.
+func sourcePage(cs ContentStore, name string) (Page, error) {
+	b, info, err := cs.Get(name)
+	if err != nil {
+		return Page{}, fmt.Errorf("loadPage: %w", err)
+	}
+	p, ok := sources.get(cs, info)
+	if !ok {
+		p, err = parsePage(info, b)
+		if err != nil {
+			return p, err
+		}
+		sources.put(cs, info, p)
+	}
+	return p, nil
+}
+
+// withComments returns p with its visible comments loaded.
+func withComments(p Page) (Page, error) {
+	if p.CommentsOff {
+		return p, nil
+	}
+	cs, err := commentStore.Load(p.Name)
+	if err != nil {
+		return p, fmt.Errorf("withComments.Load: %w", err)
+	}
+	p.Comments = visibleComments(cs)
+	p.Thread = threadComments(p.Name, p.Comments)
+	return p, nil
+}
+
+// parsePage renders the source b of the page described by info.
+func parsePage(info ContentInfo, b []byte) (Page, error) {
 	var p Page
-	fi, err := os.Stat(fpath)
+	p.Name = info.Name
+	p.Title = path.Base(info.Name)
+	p.LastChange = info.ModTime
+	fm, body, err := parseFrontMatter(b)
 	if err != nil {
-		return p, fmt.Errorf("loadPage: %w", err)
+		return p, fmt.Errorf("parsePage.parseFrontMatter: %w", err)
 	}
-	p.Title = fi.Name()
-	p.LastChange = fi.ModTime()
-	p.Comments, err = loadComments(p.Title)
+	if fm.Title != "" {
+		p.Title = fm.Title
+	}
+	p.Slug = pageSlug(p, fm)
+	if fm.Author != "" {
+		p.Author = &Author{ID: fm.Author, Name: fm.Author}
+	}
+	p.Date = fm.Date
+	p.Tags = fm.Tags
+	p.Category = cleanCategory(fm.Category)
+	p.Breadcrumbs = breadcrumbs(p.Category)
+	p.Template = fm.Template
+	p.Draft = fm.Draft
+	p.Featured = fm.Featured
+	p.Publish = fm.Publish
+	p.Summary = fm.Summary
+	p.Image = fm.Image
+	p.Attachments = fm.Attachments
+	p.CommentsOff = fm.Comments != nil && !*fm.Comments
+	body, err = expandShortcodes(body)
+	if err != nil {
+		return p, fmt.Errorf("parsePage.expandShortcodes: %w", err)
+	}
+	p.Math = *flagMath
+	if fm.Math != nil {
+		p.Math = *fm.Math
+	}
+	if !validMath(p.Math) {
+		slog.Warn("unknown math mode, using -math", "page", info.Name, "math", p.Math)
+		p.Math = *flagMath
+	}
+	var diagrams []string
+	if *flagMermaid != mermaidOff {
+		body, diagrams = extractDiagrams(body)
+	}
+	p.Diagrams = len(diagrams) > 0 && *flagMermaid == mermaidClient
+	var maths []mathSpan
+	if p.Math != mathOff {
+		body, maths = extractMath(body)
+	}
+	smart := *flagTypographer
+	if fm.Typographer != nil {
+		smart = *fm.Typographer
+	}
+	p.Content, err = renderMarkdown(body, smart)
 	if err != nil {
-		return p, fmt.Errorf("loadPage.loadComments: %w", err)
+		return p, fmt.Errorf("parsePage.renderMarkdown: %w", err)
 	}
-	b, err := ioutil.ReadFile(fpath)
+	p.Content = insertMath(p.Content, maths, p.Math)
+	p.Content = insertDiagrams(p.Content, diagrams, *flagMermaid)
+	p.Content = sanitize(rewriteImages(p.Content))
+	p.ReadingTime = readingTime(p.Content, *flagWPM)
+	if (fm.TOC == nil && *flagTOC) || (fm.TOC != nil && *fm.TOC) {
+		p.TOC = buildTOC(p.Content)
+	}
+	p.Excerpt, err = makeExcerpt(p.Summary, body, p.Content, *flagExcerptWords, smart)
 	if err != nil {
-		return p, fmt.Errorf("loadPage.ReadFile: %w", err)
+		return p, fmt.Errorf("parsePage.makeExcerpt: %w", err)
+	}
+	p.Excerpt = insertMath(p.Excerpt, maths, p.Math)
+	p.Excerpt = insertDiagrams(p.Excerpt, diagrams, *flagMermaid)
+	p.Excerpt = sanitize(p.Excerpt)
+	days := *flagCommentDays
+	if fm.CommentDays != nil {
+		days = *fm.CommentDays
+	}
+	if days > 0 {
+		p.CommentsEnd = p.PublishedAt().AddDate(0, 0, days)
 	}
-	p.Content = template.HTML(blackfriday.MarkdownCommon(b))
 	return p, nil
 }
 
-func loadPages(src string) (Pages, error) {
+// CommentsOpen reports whether new comments are accepted on the page,
+// i.e. they are not off and it has no CommentsEnd or that is still to
+// come.
+func (p Page) CommentsOpen() bool {
+	if p.CommentsOff {
+		return false
+	}
+	return p.CommentsEnd.IsZero() || time.Now().Before(p.CommentsEnd)
+}
+
+// URL returns the path a page is served at.
+func (p Page) URL() string {
+	if p.Static {
+		return "/" + p.Slug
+	}
+	return "/page/" + p.Slug
+}
+
+// PublishedAt returns the date a page is shown and sorted by: the front
+// matter date, else its publish time, else the file's ModTime.
+func (p Page) PublishedAt() time.Time {
+	if !p.Date.IsZero() {
+		return p.Date
+	}
+	if !p.Publish.IsZero() {
+		return p.Publish
+	}
+	return p.LastChange
+}
+
+// published reports whether p is visible to readers at time now.
+func (p Page) published(now time.Time) bool {
+	return !p.Draft && !p.Publish.After(now)
+}
+
+// loadPages returns the pages of cs that are published right now. Like
+// readAllPages it returns the pages that could be read along with an
+// errBadPages error.
+func loadPages(cs ContentStore) (Pages, error) {
+	all, err := loadAllPages(cs)
+	if err != nil && !errors.Is(err, errBadPages) {
+		return nil, err
+	}
+	return publishedPages(all, time.Now()), err
+}
+
+// publishedPages filters all down to the pages visible at now and computes
+// the data that depends on the set of visible pages.
+func publishedPages(all Pages, now time.Time) Pages {
+	var ps Pages
+	for _, p := range all {
+		if p.published(now) {
+			ps = append(ps, p)
+		}
+	}
+	computeRelated(ps, *flagRelated)
+	linkNeighbors(ps)
+	return ps
+}
+
+// loadAllPages returns every page of cs including drafts and pages
+// scheduled for later publication, newest first.
+func loadAllPages(cs ContentStore) (Pages, error) {
+	ps, err := readAllPages(cs)
+	if err != nil && !errors.Is(err, errBadPages) {
+		return ps, err
+	}
+	ps, cerr := withAllComments(ps)
+	if cerr != nil {
+		return ps, fmt.Errorf("loadAllPages: %w", cerr)
+	}
+	return ps, err
+}
+
+// errBadPages is wrapped by the error of readAllPages if some of the pages
+// could not be read. They are left out, and the others are returned.
+var errBadPages = errors.New("some pages could not be read")
+
+// readAllPages returns the pages of cs like loadAllPages, without loading
+// their comments. Pages that fail to load are logged and skipped, so one
+// broken file doesn't hide all others; the error then wraps errBadPages
+// and the error of each of them.
+func readAllPages(cs ContentStore) (Pages, error) {
 	var ps Pages
-	fs, err := ioutil.ReadDir(src)
+	as, err := loadAuthors(*flagAuthorsFile)
+	if err != nil {
+		return ps, fmt.Errorf("readAllPages.loadAuthors: %w", err)
+	}
+	infos, err := cs.List()
 	if err != nil {
-		return ps, fmt.Errorf("loadPages.ReadDir: %w", err)
+		return ps, fmt.Errorf("readAllPages: %w", err)
 	}
-	for _, f := range fs {
-		if f.IsDir() {
+	var errs []error
+	sections := map[string]Section{}
+	for _, info := range infos {
+		if path.Base(info.Name) == sectionIndex {
 			continue
 		}
-		fpath := filepath.Join(src, f.Name())
-		p, err := loadPage(fpath)
-		if err != nil {
-			return ps, fmt.Errorf("loadPages.loadPage: %w", err)
+		p, ok := sources.get(cs, info)
+		if !ok {
+			p, err = sourcePage(cs, info.Name)
+			if err != nil {
+				slog.Error("skipping page", "file", info.Name, "err", err)
+				errs = append(errs, err)
+				continue
+			}
+		}
+		if p.Author != nil {
+			a := as.lookup(p.Author.ID)
+			p.Author = &a
+		}
+		if dir := path.Dir(info.Name); dir != "." {
+			s, ok := sections[dir]
+			if !ok {
+				s, err = loadSection(cs, dir)
+				if err != nil {
+					slog.Error("skipping page", "file", info.Name, "err", err)
+					errs = append(errs, err)
+					continue
+				}
+				sections[dir] = s
+			}
+			p.Section = s
 		}
 		ps = append(ps, p)
 	}
+	dedupSlugs(ps)
+	sort.SliceStable(ps, func(i, j int) bool {
+		return ps[i].PublishedAt().After(ps[j].PublishedAt())
+	})
+	if len(errs) > 0 {
+		return ps, fmt.Errorf("readAllPages: %w: %w", errBadPages, errors.Join(errs...))
+	}
 	return ps, nil
 }
 
 func main() {
-	http.HandleFunc("/page/", makePageHandlerFunc())
-	http.HandleFunc("/api/", makeHandleAPIHandlerFunc())
-	http.HandleFunc("/comment/", makeCommentHandlerFunc())
-	http.Handle("/files/", http.StripPrefix("/files/", http.FileServer(http.Dir(*flagFilesFolder))))
-	http.HandleFunc("/", makeIndexHandlerFunc())
-	fmt.Println("starting server on port", *flagPort)
-	err := http.ListenAndServe(":"+*flagPort, nil)
+	flag.Parse()
+	logger, err := newLogger(os.Stderr, *flagLogLevel, *flagLogFormat)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	mdConfig := markdownConfig{
+		Extensions:     strings.Split(*flagMarkdown, ","),
+		HighlightStyle: *flagHighlight,
+		EmojiSVG:       *flagEmojiSVG,
+	}
+	renderer, err = newGoldmarkRenderer(mdConfig)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	mdConfig.Typographer = true
+	smartRenderer, err = newGoldmarkRenderer(mdConfig)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if !validMath(*flagMath) {
+		fmt.Println("unknown math mode", *flagMath)
+		os.Exit(2)
+	}
+	if *flagMermaid != mermaidOff && *flagMermaid != mermaidClient && *flagMermaid != mermaidServer {
+		fmt.Println("unknown mermaid mode", *flagMermaid)
+		os.Exit(2)
+	}
+	if *flagMermaid == mermaidServer {
+		_, err = exec.LookPath(*flagMmdc)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+	if *flagSpamAction != spamHold && *flagSpamAction != spamReject {
+		fmt.Println("unknown spam action", *flagSpamAction)
+		os.Exit(2)
+	}
+	if (*flagTLSCert == "") != (*flagTLSKey == "") {
+		fmt.Println("-tls-cert and -tls-key have to be given together")
+		os.Exit(2)
+	}
+	if *flagACMEDomains != "" && *flagTLSCert != "" {
+		fmt.Println("-acme-domains and -tls-cert exclude each other")
+		os.Exit(2)
+	}
+	if *flagFeedContent != feedFull && *flagFeedContent != feedSummary {
+		fmt.Println("unknown feed content", *flagFeedContent)
+		os.Exit(2)
+	}
+	if *flagCommentOrd != orderOldest && *flagCommentOrd != orderNewest {
+		fmt.Println("unknown comment order", *flagCommentOrd)
+		os.Exit(2)
+	}
+	if *flagWebmention != mentionsOff && *flagWebmention != mentionsHold && *flagWebmention != mentionsAccept {
+		fmt.Println("unknown webmention mode", *flagWebmention)
+		os.Exit(2)
+	}
+	if *flagPingback != mentionsOff && *flagPingback != mentionsHold && *flagPingback != mentionsAccept {
+		fmt.Println("unknown pingback mode", *flagPingback)
+		os.Exit(2)
+	}
+	if *flagNewsletter != newsletterOff && *flagNewsletter != newsletterAuto && *flagNewsletter != newsletterManual {
+		fmt.Println("unknown newsletter mode", *flagNewsletter)
+		os.Exit(2)
+	}
+	if *flagNewsletter != newsletterOff && *flagSMTP == "" {
+		fmt.Println("-newsletter needs -smtp to send mails")
+		os.Exit(2)
+	}
+	if (*flagGitHubID == "") != (*flagGitHubSecret == "") || (*flagGoogleID == "") != (*flagGoogleSecret == "") {
+		fmt.Println("-github-id and -google-id need their -github-secret and -google-secret")
+		os.Exit(2)
+	}
+	if *flagOIDCIssuer != "" && (*flagOIDCID == "" || *flagOIDCSecret == "") {
+		fmt.Println("-oidc-issuer needs -oidc-id and -oidc-secret")
+		os.Exit(2)
+	}
+	oauthProviders = newOAuthProviders()
+	if *flagOAuthComment && len(oauthProviders) == 0 {
+		fmt.Println("-oauth-comments needs -github-id, -google-id or -oidc-issuer")
+		os.Exit(2)
+	}
+	if *flagAdminSession <= 0 {
+		fmt.Println("-admin-session has to be positive")
+		os.Exit(2)
+	}
+	if *flagUploadMax <= 0 {
+		fmt.Println("-upload-max has to be positive")
+		os.Exit(2)
+	}
+	if d := path.Clean(*flagUploadDir); d == "." || d == ".." || strings.HasPrefix(d, "../") || path.IsAbs(d) {
+		fmt.Println("-upload-dir has to be a folder below -files, not", *flagUploadDir)
+		os.Exit(2)
+	}
+	contentStore, err = openContentStore(*flagContentStore)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	staticStore = newWatchedContentStore(*flagStaticSrc)
+	if _, ok := contentStore.(writableStore); *flagTokenURL != "" && !ok {
+		fmt.Println("-token-endpoint needs a writable content store, not", *flagContentStore)
+		os.Exit(2)
+	}
+	if _, ok := contentStore.(writableStore); *flagAPIToken != "" && !ok {
+		fmt.Println("-api-token needs a writable content store, not", *flagContentStore)
+		os.Exit(2)
+	}
+	// the commands not touching comments run before the comment store is
+	// opened, so they work while a running server holds its lock
+	switch flag.Arg(0) {
+	case "", "build":
+	case "new":
+		err := runNew(flag.Args()[1:])
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	default:
+		fmt.Println("unknown command", flag.Arg(0))
+		os.Exit(2)
+	}
+	if *flagAddUser != "" {
+		err := addUser(*flagUsers, *flagAddUser, os.Stdin)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	commentStore, err = openCommentStore(*flagCommentStore)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if *flagImportPages != "" {
+		s, ok := contentStore.(*sqlContentStore)
+		if !ok {
+			fmt.Println("-import-pages needs -content-store sqlite or postgres")
+			os.Exit(2)
+		}
+		n, err := importPages(*flagImportPages, s)
+		fmt.Println("imported", n, "files")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *flagBackup != "" {
+		err := writeBackupFlag(*flagBackup)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *flagRestore != "" {
+		n, err := restoreBackup(*flagRestore)
+		fmt.Println("restored", n, "files")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *flagImportDisqus != "" {
+		n, err := importDisqus(*flagImportDisqus, contentStore)
+		fmt.Println("imported", n, "comments")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	secret, err = newSecret(*flagSecret)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if *flagSMTP != "" {
+		notifier = newMailer(*flagSMTP, *flagSMTPUser, *flagSMTPPassword, *flagMailFrom)
+	}
+	if *flagNewsletter != newsletterOff {
+		newsletter, err = newMailingList(*flagSubscribers)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		if *flagNewsletter == newsletterAuto {
+			onPublish(newsletter.publish)
+		}
+	}
+	if *flagWebhooks != "" {
+		webhooks = newWebhookSender(strings.Split(*flagWebhooks, ","), *flagWebhookKey)
+	}
+	if *flagActivityPub {
+		federation, err = newActivityPub(*flagAPKey, *flagAPFollowers)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		onPublish(federation.publish)
+	}
+	if *flagWebmention != mentionsOff || *flagPingback != mentionsOff || *flagMentionSend {
+		mentions = newMentionQueue()
+	}
+	if *flagMentionSend {
+		onPublish(mentions.announce)
+	}
+	if *flagWebSubHub != "" {
+		websub = newHubNotifier(*flagWebSubHub)
+		onPublish(websub.publish)
+	}
+	if *flagAkismetKey != "" {
+		spamChecker = newAkismet(*flagAkismetKey, *flagBaseURL)
+	}
+	imageWidths, err = parseWidths(*flagImageWidths)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	err = checkTheme()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if *flagMath == mathKaTeX {
+		err = checkKaTeX()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+	err = assets.build()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	err = setShortcodes()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if *flagWatch {
+		err = watchTemplates()
+		if err != nil {
+			slog.Warn("watching templates failed", "err", err)
+		}
+	}
+	templates.dev = *flagDev && templatesChanged == nil
+	adminTemplates.dev = templates.dev
+	indexPosts(contentStore)
+	if flag.Arg(0) == "build" {
+		err := runBuild(flag.Args()[1:])
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *flagBackupEvery > 0 {
+		go backupEvery(*flagBackupEvery)
+	}
+	mux, err := routes()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	ms := []Middleware{logRequests}
+	if *flagAccessLog != "" {
+		w, err := openAccessLog(*flagAccessLog)
+		var m Middleware
+		if err == nil {
+			m, err = newAccessLog(w, *flagAccessFormat)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		ms = append(ms, m)
+	}
+	trustedProxies, err = parseNets(*flagTrustedProxy)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	globalLimit, err := parseRate(*flagRate)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	rateExempt, err = parseNets(*flagRateExempt)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	ms = append(ms, recoverPanics, setHeaders(securityHeaders()), strictTransport(int(flagHSTS.Seconds())))
+	if *flagCanonical {
+		base, err := url.Parse(*flagBaseURL)
+		if err != nil || base.Scheme == "" || base.Host == "" {
+			fmt.Println("invalid -baseurl for -canonical-redirect:", *flagBaseURL)
+			os.Exit(2)
+		}
+		ms = append(ms, canonicalRedirect(base))
+	}
+	ms = append(ms, limitClients(globalLimit))
+	ms = append(ms, customMiddleware...)
+	ms = append(ms, compress)
+	addr := *flagListen
+	if addr == "" {
+		addr = ":" + *flagPort
+	}
+	l, err := listener(addr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	srv := newServer(l.Addr().String(), chain(mux, ms...))
+	listen := func() error { return srv.Serve(l) }
+	if *flagTLSCert != "" || *flagTLSKey != "" || *flagACMEDomains != "" {
+		slog.Info("starting HTTPS server", "addr", l.Addr().String())
+		listen = listenTLS(srv, l)
+	} else {
+		slog.Info("starting server", "addr", l.Addr().String())
+	}
+	err = serve(srv, listen)
+	if err != nil {
+		slog.Error("server failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+// routes returns the handlers of all paths of the blog, each wrapped in
+// the middleware of its route, including the rate limits of
+// -route-rates. Middleware for all routes is added in main.
+func routes() (*http.ServeMux, error) {
+	commentLimit, err := parseRate(*flagClientRate)
+	if err != nil {
+		return nil, fmt.Errorf("routes: %w", err)
+	}
+	reportLimit, err := parseRate(*flagClientRate)
 	if err != nil {
-		fmt.Println("ListenAndServe:", err)
+		return nil, fmt.Errorf("routes: %w", err)
 	}
+	reactLimit, err := parseRate(*flagPostRate)
+	if err != nil {
+		return nil, fmt.Errorf("routes: %w", err)
+	}
+	mentionLimit, err := parseRate(*flagPostRate)
+	if err != nil {
+		return nil, fmt.Errorf("routes: %w", err)
+	}
+	pingLimit, err := parseRate(*flagPostRate)
+	if err != nil {
+		return nil, fmt.Errorf("routes: %w", err)
+	}
+	subscribeLimit, err := parseRate(*flagPostRate)
+	if err != nil {
+		return nil, fmt.Errorf("routes: %w", err)
+	}
+	micropubLimit, err := parseRate(*flagPostRate)
+	if err != nil {
+		return nil, fmt.Errorf("routes: %w", err)
+	}
+	loginLimit, err := parseRate(*flagLoginRate)
+	if err != nil {
+		return nil, fmt.Errorf("routes: %w", err)
+	}
+	oauthLimit, err := parseRate(*flagLoginRate)
+	if err != nil {
+		return nil, fmt.Errorf("routes: %w", err)
+	}
+	limits, err := parseRouteRates(*flagRouteRates)
+	if err != nil {
+		return nil, fmt.Errorf("routes: %w", err)
+	}
+	mux := http.NewServeMux()
+	handle := func(pattern string, h http.Handler) {
+		mux.Handle(pattern, limitClients(limits[pattern])(h))
+		delete(limits, pattern)
+	}
+	handle("/page/", http.HandlerFunc(makePageHandlerFunc()))
+	handle("/api/", http.HandlerFunc(makeHandleAPIHandlerFunc()))
+	handle("/api/v1/", http.HandlerFunc(makeAPIHandlerFunc()))
+	handle("/comment/", limitClients(commentLimit)(makeCommentHandlerFunc()))
+	handle("/feed.xml", http.HandlerFunc(makeFeedHandlerFunc()))
+	handle("/atom.xml", http.HandlerFunc(makeAtomHandlerFunc()))
+	handle("/feed.json", http.HandlerFunc(makeJSONFeedHandlerFunc()))
+	handle("/comments.xml", http.HandlerFunc(makeCommentFeedHandlerFunc()))
+	handle("/editcomment/", http.HandlerFunc(makeEditCommentHandlerFunc()))
+	handle("/reportcomment/", limitClients(reportLimit)(makeReportCommentHandlerFunc()))
+	handle("/react/", limitClients(reactLimit)(makeReactHandlerFunc()))
+	handle("/micropub", limitClients(micropubLimit)(makeMicropubHandlerFunc()))
+	handle("/webmention", limitClients(mentionLimit)(makeWebmentionHandlerFunc()))
+	handle("/xmlrpc", limitClients(pingLimit)(makePingbackHandlerFunc()))
+	handle("/trackback/", limitClients(pingLimit)(makeTrackbackHandlerFunc()))
+	handle("/moderate/", setHeaders(adminHeaders())(requireRole(roleModerator, loginLimit)(makeModerateHandlerFunc())))
+	handle("/subscribe", limitClients(subscribeLimit)(makeSubscribeHandlerFunc()))
+	handle("/unsubscribe", http.HandlerFunc(makeUnsubscribeHandlerFunc()))
+	handle("/newsletter/", setHeaders(adminHeaders())(requireRole(roleAdmin, loginLimit)(makeNewsletterHandlerFunc())))
+	handle("/admin/login", setHeaders(adminHeaders())(limitClients(loginLimit)(makeAdminLoginHandlerFunc())))
+	handle("/admin/", setHeaders(adminHeaders())(requireAdmin(makeAdminHandlerFunc())))
+	handle("/oauth/", setHeaders(adminHeaders())(limitClients(oauthLimit)(makeOAuthHandlerFunc())))
+	handle("/tag/", http.HandlerFunc(makeTagHandlerFunc()))
+	handle("/category/", http.HandlerFunc(makeCategoryHandlerFunc()))
+	handle("/archive/", http.HandlerFunc(makeArchiveHandlerFunc()))
+	handle("/author/", http.HandlerFunc(makeAuthorHandlerFunc()))
+	blogroll := makeBlogrollHandlerFunc()
+	handle("/blogroll", blogroll)
+	handle("/blogroll.opml", blogroll)
+	handle("/img/", http.HandlerFunc(makeImageHandlerFunc()))
+	handle("/files/", makeFilesHandler())
+	handle("/assets/", assets)
+	handle("/static/", http.HandlerFunc(makeStaticFileHandler()))
+	handle("/diagrams/", makeDiagramHandler())
+	handle("/hooks/git", http.HandlerFunc(makeGitHookHandlerFunc()))
+	handle("/backup", setHeaders(adminHeaders())(requireRole(roleAdmin, loginLimit)(makeBackupHandlerFunc())))
+	handle("/.well-known/webfinger", http.HandlerFunc(makeWebfingerHandlerFunc()))
+	handle("/ap/", http.HandlerFunc(makeActorHandlerFunc()))
+	handle("/robots.txt", http.HandlerFunc(makeRobotsHandlerFunc()))
+	handle("/.well-known/security.txt", http.HandlerFunc(makeSecurityTxtHandlerFunc()))
+	handle("/healthz", http.HandlerFunc(makeHealthzHandlerFunc()))
+	handle("/readyz", http.HandlerFunc(makeReadyzHandlerFunc()))
+	handle("/", http.HandlerFunc(makeIndexHandlerFunc()))
+	for pattern := range limits {
+		return nil, fmt.Errorf("routes: no route %s to limit", pattern)
+	}
+	return mux, nil
 }
 
 func makeIndexHandlerFunc() func(w http.ResponseWriter, r *http.Request) {
-	tmpl, err := parseFiles("index.tmpl.html")
+	_, err := templates.get("index.tmpl.html")
 	if err != nil {
-		panic("makeIndexHandlerFunc: could not parse page.tmpl.html")
+		panic("makeIndexHandlerFunc: could not parse index.tmpl.html")
 	}
-	var ps Pages
-	go func() {
-		for {
-			ps, err = loadPages(*flagSrcFolder)
-			if err != nil {
-				fmt.Println(err)
+	var (
+		static  = makeStaticPageHandlerFunc()
+		section = makeSectionHandlerFunc()
+	)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") && r.URL.Path != "/" {
+			section(w, r)
+			return
+		}
+		if r.URL.Path != "/" {
+			static(w, r)
+			return
+		}
+		ps := posts.published()
+		var data struct {
+			Pagination
+			Featured Pages
+		}
+		var rest Pages
+		for _, p := range ps {
+			if p.Featured {
+				data.Featured = append(data.Featured, p)
+			} else {
+				rest = append(rest, p)
 			}
-			fmt.Println("index loaded/")
-			time.Sleep(30 * time.Second)
 		}
-	}()
-	return func(w http.ResponseWriter, r *http.Request) {
-		err = tmpl.ExecuteTemplate(w, "base", ps)
+		n, ok := pageNumber(r)
+		if !ok {
+			renderError(w, r, http.StatusBadRequest)
+			return
+		}
+		data.Pagination, ok = paginate(rest, n, *flagPageSize, "/")
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		if data.Number > 1 {
+			data.Featured = nil
+		}
+		etag, modified := listValidators(ps, data)
+		if notModified(w, r, etag, modified) {
+			return
+		}
+		b, err := rendered.render(etag, func() ([]byte, error) {
+			return templates.render("index.tmpl.html", data)
+		})
 		if err != nil {
-			fmt.Println("MakePageHandlerFunc: tmpl.ExecuteTemplate: %w", err)
+			serverError(w, r, fmt.Errorf("makeIndexHandlerFunc: %w", err))
+			return
 		}
+		w.Write(b)
 	}
 }
 
 func makePageHandlerFunc() func(w http.ResponseWriter, r *http.Request) {
-	tmpl, err := parseFiles("page.tmpl.html")
+	_, err := templates.get("page.tmpl.html")
 	if err != nil {
 		panic("makePageHandlerFunc: could not parse page.tmpl.html")
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		f := r.URL.Path[len("/page/"):]
-		fpath := filepath.Join(*flagSrcFolder, f)
-		p, err := loadPage(fpath)
+		slug := r.URL.Path[len("/page/"):]
+		feed := strings.HasSuffix(slug, commentFeedSuffix)
+		slug = strings.TrimSuffix(slug, commentFeedSuffix)
+		p, moved, ok, err := posts.find(slug)
 		if err != nil {
-			fmt.Println(err)
+			serverError(w, r, fmt.Errorf("makePageHandlerFunc: %w", err))
+			return
+		}
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		if feed {
+			if moved {
+				http.Redirect(w, r, "/page/"+p.Slug+commentFeedSuffix, http.StatusMovedPermanently)
+				return
+			}
+			serveCommentFeed(w, r, p)
+			return
 		}
-		err = tmpl.ExecuteTemplate(w, "base", p)
+		if moved {
+			http.Redirect(w, r, "/page/"+p.Slug, http.StatusMovedPermanently)
+			return
+		}
+		countView(r, p)
+		etag, modified := pageValidators(p)
+		if notModified(w, r, etag, modified) {
+			return
+		}
+		b, err := rendered.render(etag, func() ([]byte, error) {
+			return pageHTML(templates, "page.tmpl.html", p)
+		})
 		if err != nil {
-			fmt.Println("MakePageHandlerFunc: tmpl.ExecuteTemplate: %w", err)
+			serverError(w, r, fmt.Errorf("makePageHandlerFunc: %w", err))
+			return
 		}
+		w.Write(fillCommentTokens(b, p.Name))
 	}
 }
 
-func makeCommentHandlerFunc() http.HandlerFunc {
-	var mutex = &sync.Mutex{}
+// makeStaticPageHandlerFunc serves the pages of the static folder at
+// /<slug>. They are kept out of the index and all other listings.
+func makeStaticPageHandlerFunc() http.HandlerFunc {
+	_, err := templates.get("static.tmpl.html")
+	if err != nil {
+		panic("makeStaticPageHandlerFunc: could not parse static.tmpl.html")
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		title := r.URL.Path[len("/comment/"):]
-		name := r.FormValue("name")
-		comment := r.FormValue("comment")
-		c := Comment{Name: name, Comment: comment}
-		mutex.Lock()
-		cs, err := loadComments(title)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		slug := r.URL.Path[len("/"):]
+		ps, err := loadPages(staticStore)
+		if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, errBadPages) {
+			serverError(w, r, fmt.Errorf("makeStaticPageHandlerFunc: %w", err))
+			return
+		}
+		p, moved, ok := findPage(ps, slug)
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		if moved {
+			http.Redirect(w, r, "/"+p.Slug, http.StatusMovedPermanently)
+			return
+		}
+		p.Static = true
+		etag, modified := pageValidators(p)
+		if notModified(w, r, etag, modified) {
+			return
 		}
-		cs = append(cs, c)
-		err = saveComments(title, cs)
+		b, err := rendered.render(etag, func() ([]byte, error) {
+			return templates.render("static.tmpl.html", p)
+		})
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			serverError(w, r, fmt.Errorf("makeStaticPageHandlerFunc: %w", err))
+			return
 		}
-		mutex.Unlock()
-		http.Redirect(w, r, "/page/"+title, http.StatusFound)
+		w.Write(b)
 	}
 }
 
-func makeHandleAPIHandlerFunc() http.HandlerFunc {
+// makeSectionHandlerFunc lists the posts of a content subfolder at
+// /<section>/, including those of nested sections.
+func makeSectionHandlerFunc() http.HandlerFunc {
+	_, err := templates.get("section.tmpl.html")
+	if err != nil {
+		panic("makeSectionHandlerFunc: could not parse section.tmpl.html")
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		ps, err := loadPages(*flagSrcFolder)
+		name := strings.Trim(path.Clean(r.URL.Path), "/")
+		ps := posts.published()
+		var data struct {
+			Section Section
+			Pagination
+		}
+		var sps Pages
+		for _, p := range ps {
+			if p.Section.Path == name || strings.HasPrefix(p.Section.Path, name+"/") {
+				sps = append(sps, p)
+			}
+		}
+		if len(sps) == 0 {
+			notFound(w, r)
+			return
+		}
+		var err error
+		data.Section, err = loadSection(contentStore, name)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			serverError(w, r, err)
 			return
 		}
-		enc := json.NewEncoder(w)
-		enc.SetEscapeHTML(false)
-		enc.SetIndent("", "  ")
-		err = enc.Encode(ps)
+		n, ok := pageNumber(r)
+		if !ok {
+			renderError(w, r, http.StatusBadRequest)
+			return
+		}
+		data.Pagination, ok = paginate(sps, n, *flagPageSize, data.Section.URL())
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		err = templates.execute(w, "section.tmpl.html", data)
 		if err != nil {
-			fmt.Println("cannot encode page to json")
+			serverError(w, r, fmt.Errorf("makeSectionHandlerFunc: %w", err))
 		}
 	}
 }
 
-func parseFiles(content string) (*template.Template, error) {
-	return template.ParseFiles(
-		filepath.Join(*flagTmplFolder, "base.tmpl.html"),
-		filepath.Join(*flagTmplFolder, "header.tmpl.html"),
-		filepath.Join(*flagTmplFolder, "footer.tmpl.html"),
-		filepath.Join(*flagTmplFolder, "comment.tmpl.html"),
-		filepath.Join(*flagTmplFolder, content),
-	)
+func makeTagHandlerFunc() http.HandlerFunc {
+	_, err := templates.get("tags.tmpl.html")
+	if err != nil {
+		panic("makeTagHandlerFunc: could not parse tags.tmpl.html")
+	}
+	_, err = templates.get("tag.tmpl.html")
+	if err != nil {
+		panic("makeTagHandlerFunc: could not parse tag.tmpl.html")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[len("/tag/"):]
+		ts := posts.allTags()
+		if feed, ok := strings.CutSuffix(name, tagFeedSuffix); ok {
+			t, ok := ts.Lookup(feed)
+			if !ok {
+				notFound(w, r)
+				return
+			}
+			serveTagAtom(w, r, t)
+			return
+		}
+		if name == "" {
+			err := templates.execute(w, "tags.tmpl.html", struct{ Tags Tags }{ts})
+			if err != nil {
+				serverError(w, r, fmt.Errorf("makeTagHandlerFunc: %w", err))
+			}
+			return
+		}
+		t, ok := ts.Lookup(name)
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		data := struct {
+			Tag  Tag
+			Tags Tags
+		}{t, ts}
+		err := templates.execute(w, "tag.tmpl.html", data)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeTagHandlerFunc: %w", err))
+		}
+	}
 }
 
-func saveComments(title string, cs []Comment) error {
-	fpath := filepath.Join("comments", title+".json")
-	f, err := os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY, 0777)
+func makeCategoryHandlerFunc() http.HandlerFunc {
+	_, err := templates.get("category.tmpl.html")
 	if err != nil {
-		return fmt.Errorf("saveComments: %w", err)
+		panic("makeCategoryHandlerFunc: could not parse category.tmpl.html")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path[len("/category/"):]
+		c, ok := posts.allCategories().Lookup(path)
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		err := templates.execute(w, "category.tmpl.html", c)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeCategoryHandlerFunc: %w", err))
+		}
 	}
-	enc := json.NewEncoder(f)
-	return enc.Encode(cs)
 }
 
-func loadComments(title string) ([]Comment, error) {
-	var cs []Comment
-	fpath := filepath.Join("comments", title+".json")
-	f, err := os.Open(fpath)
-	if errors.Is(err, os.ErrNotExist) {
-		return cs, nil
+func makeArchiveHandlerFunc() http.HandlerFunc {
+	_, err := templates.get("archive.tmpl.html")
+	if err != nil {
+		panic("makeArchiveHandlerFunc: could not parse archive.tmpl.html")
 	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		year, month, ok := parseArchivePath(r.URL.Path[len("/archive/"):])
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		a := posts.fullArchive()
+		data := struct {
+			Title   string
+			Pages   Pages
+			Archive Archive
+		}{Title: "Archive", Archive: a}
+		if year > 0 {
+			data.Pages, ok = a.lookup(year, month)
+			if !ok {
+				notFound(w, r)
+				return
+			}
+			data.Title = fmt.Sprintf("Archive %04d", year)
+			if month > 0 {
+				data.Title = fmt.Sprintf("Archive %s %04d", month, year)
+			}
+		}
+		err := templates.execute(w, "archive.tmpl.html", data)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeArchiveHandlerFunc: %w", err))
+		}
+	}
+}
+
+func makeAuthorHandlerFunc() http.HandlerFunc {
+	_, err := templates.get("author.tmpl.html")
 	if err != nil {
-		return cs, fmt.Errorf("loadComments: %w", err)
+		panic("makeAuthorHandlerFunc: could not parse author.tmpl.html")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Path[len("/author/"):]
+		as, err := loadAuthors(*flagAuthorsFile)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		ps := posts.published()
+		var data struct {
+			Author *Author
+			Pages  Pages
+		}
+		for _, p := range ps {
+			if p.Author != nil && p.Author.ID == id {
+				data.Author = p.Author
+				data.Pages = append(data.Pages, p)
+			}
+		}
+		if a, ok := as[id]; ok {
+			data.Author = &a
+		}
+		if data.Author == nil {
+			notFound(w, r)
+			return
+		}
+		err = templates.execute(w, "author.tmpl.html", data)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeAuthorHandlerFunc: %w", err))
+		}
+	}
+}
+
+func makeCommentHandlerFunc() http.HandlerFunc {
+	postLimit, err := parseRate(*flagCommentRate)
+	if err != nil {
+		panic("makeCommentHandlerFunc: " + err.Error())
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		title := r.URL.Path[len("/comment/"):]
+		if !parseForm(w, r) {
+			return
+		}
+		name := r.FormValue("name")
+		comment := r.FormValue("comment")
+		c := Comment{ParentID: r.FormValue("parent"), Name: name, Comment: comment, Time: time.Now().UTC()}
+		if *flagGravatar {
+			c.EmailHash = emailHash(r.FormValue("email"))
+		}
+		if id, ok := commenterIdentity(r); ok {
+			c.Name, c.Account = id.Name, id.Account
+		}
+		err := checkCommentForm(r, title, time.Now())
+		if errors.Is(err, errHoneypot) {
+			reqLogger(r).Info("comment rejected", "err", err)
+			http.Redirect(w, r, "/page/"+title, http.StatusFound)
+			return
+		}
+		if err != nil {
+			reqLogger(r).Info("comment rejected", "err", err)
+			renderError(w, r, http.StatusForbidden)
+			return
+		}
+		p, _, ok, err := posts.find(title)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if !ok || p.Name != title {
+			notFound(w, r)
+			return
+		}
+		if !p.CommentsOpen() {
+			reqLogger(r).Info("comment rejected", "err", "comments closed")
+			renderError(w, r, http.StatusForbidden)
+			return
+		}
+		if errs := validateComment(&c); len(errs) > 0 {
+			p.CommentForm = &CommentForm{
+				Name:    c.Name,
+				Email:   r.FormValue("email"),
+				Comment: c.Comment,
+				Parent:  c.ParentID,
+				Errors:  errs,
+			}
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			err = renderPage(w, templates, "page.tmpl.html", p)
+			if err != nil {
+				logError(r, fmt.Errorf("makeCommentHandlerFunc: %w", err))
+			}
+			return
+		}
+		if postLimit != nil {
+			if ok, retry := postLimit.allow(title, time.Now()); !ok {
+				reqLogger(r).Warn("comment rate limited", "post", title)
+				tooManyRequests(w, r, retry)
+				return
+			}
+		}
+		switch checkSpam(r, absURL("/page/"+title), c) {
+		case spamBlatant:
+			renderError(w, r, http.StatusForbidden)
+			return
+		case spamSuspect:
+			if *flagSpamAction == spamReject {
+				renderError(w, r, http.StatusForbidden)
+				return
+			}
+			c.Status = commentHeld
+		}
+		c.ID, err = newCommentID()
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeCommentHandlerFunc: %w", err))
+			return
+		}
+		err = commentStore.Update(title, func(cs []Comment) ([]Comment, error) {
+			if c.ParentID != "" && findComment(cs, c.ParentID) < 0 {
+				return nil, errUnknownParent
+			}
+			return append(cs, c), nil
+		})
+		if errors.Is(err, errUnknownParent) {
+			renderError(w, r, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeCommentHandlerFunc: %w", err))
+			return
+		}
+		if notifier != nil {
+			notifier.notify(title, c)
+		}
+		if webhooks != nil {
+			webhooks.fire(eventCommentCreated, title, c)
+		}
+		setEditCookie(w, r, title, c)
+		http.Redirect(w, r, "/page/"+title, http.StatusFound)
+	}
+}
+
+func makeHandleAPIHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ps, err := withAllComments(posts.published())
+		if err == nil {
+			ps, err = withViews(ps)
+		}
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeHandleAPIHandlerFunc: %w", err))
+			return
+		}
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(ps)
+		if err != nil {
+			logError(r, fmt.Errorf("makeHandleAPIHandlerFunc: %w", err))
+		}
 	}
-	dec := json.NewDecoder(f)
-	err = dec.Decode(&cs)
-	return cs, err
 }
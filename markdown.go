@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/yuin/goldmark"
+	emoji "github.com/yuin/goldmark-emoji"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+// Renderer turns markdown source into HTML.
+type Renderer interface {
+	Render(src []byte) ([]byte, error)
+}
+
+// renderer is the markdown renderer used for all content, smartRenderer
+// the same with typographic replacements. Both are set up in main from the
+// -markdown flag.
+var renderer, smartRenderer Renderer
+
+// markdownExtensions are the goldmark extensions that can be enabled by
+// name.
+var markdownExtensions = map[string]goldmark.Extender{
+	"table":         extension.Table,
+	"strikethrough": extension.Strikethrough,
+	"tasklist":      extension.TaskList,
+	"linkify":       extension.Linkify,
+	"deflist":       extension.DefinitionList,
+	"emoji":         emoji.Emoji,
+	"footnote": extension.NewFootnote(
+		extension.WithFootnoteLinkTitle("Go to footnote ^^"),
+		extension.WithFootnoteBacklinkTitle("Back to text"),
+		extension.WithFootnoteBacklinkClass("footnote-backref"),
+	),
+}
+
+// markdownConfig selects the features of the markdown renderer.
+type markdownConfig struct {
+	Extensions []string
+	// HighlightStyle is the chroma style for fenced code blocks; empty
+	// disables highlighting.
+	HighlightStyle string
+	// EmojiSVG is the URL prefix of hosted SVG emoji images named by
+	// codepoint, e.g. 1f389.svg. Empty renders emoji as Unicode characters.
+	EmojiSVG string
+	// Typographer replaces straight quotes, dashes and ellipses with their
+	// typographic counterparts.
+	Typographer bool
+}
+
+type goldmarkRenderer struct {
+	md goldmark.Markdown
+}
+
+// newGoldmarkRenderer returns a CommonMark renderer with the configured
+// extensions enabled. Raw HTML in the source is passed through.
+func newGoldmarkRenderer(cfg markdownConfig) (*goldmarkRenderer, error) {
+	var extenders []goldmark.Extender
+	for _, name := range cfg.Extensions {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		e, ok := markdownExtensions[name]
+		if !ok {
+			return nil, fmt.Errorf("newGoldmarkRenderer: unknown extension %q", name)
+		}
+		if name == "emoji" && cfg.EmojiSVG != "" {
+			src := strings.ReplaceAll(template.HTMLEscapeString(cfg.EmojiSVG), "%", "%%")
+			e = emoji.New(
+				emoji.WithRenderingMethod(emoji.Twemoji),
+				emoji.WithTwemojiTemplate(`<img class="emoji" draggable="false" alt="%[1]s" src="`+src+`%[2]s.svg"%[3]s>`),
+			)
+		}
+		extenders = append(extenders, e)
+	}
+	if cfg.Typographer {
+		extenders = append(extenders, extension.Typographer)
+	}
+	if cfg.HighlightStyle != "" {
+		if styles.Get(cfg.HighlightStyle) == styles.Fallback && cfg.HighlightStyle != styles.Fallback.Name {
+			return nil, fmt.Errorf("newGoldmarkRenderer: unknown highlight style %q", cfg.HighlightStyle)
+		}
+		extenders = append(extenders, highlighting.NewHighlighting(
+			highlighting.WithStyle(cfg.HighlightStyle),
+			highlighting.WithGuessLanguage(false),
+		))
+	}
+	md := goldmark.New(
+		goldmark.WithExtensions(extenders...),
+		goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+		goldmark.WithRendererOptions(html.WithUnsafe()),
+	)
+	return &goldmarkRenderer{md: md}, nil
+}
+
+func (g *goldmarkRenderer) Render(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	err := g.md.Convert(src, &buf)
+	if err != nil {
+		return nil, fmt.Errorf("goldmarkRenderer.Render: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// renderMarkdown renders src with the configured renderer, converting
+// quotes and dashes if smart is set.
+func renderMarkdown(src []byte, smart bool) (template.HTML, error) {
+	r := renderer
+	if smart {
+		r = smartRenderer
+	}
+	b, err := r.Render(src)
+	return template.HTML(b), err
+}
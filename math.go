@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/wyatt915/treeblood"
+)
+
+// Math rendering modes, selected with -math and the math front matter
+// field.
+const (
+	mathOff    = ""
+	mathKaTeX  = "katex"
+	mathMathML = "mathml"
+)
+
+// katexFiles are the files of the KaTeX distribution math.tmpl.html loads
+// from /files/.
+var katexFiles = []string{"katex/katex.min.css", "katex/katex.min.js", "katex/contrib/auto-render.min.js"}
+
+// validMath reports whether mode is one of the math rendering modes.
+func validMath(mode string) bool {
+	return mode == mathOff || mode == mathKaTeX || mode == mathMathML
+}
+
+// checkKaTeX verifies that the KaTeX distribution is unpacked into the
+// -files folder or the files of the theme, as goblog does not ship it.
+func checkKaTeX() error {
+	dirs := []string{*flagFilesFolder}
+	if dir := themeDir(); dir != "" {
+		dirs = append(dirs, filepath.Join(dir, "files"))
+	}
+	for _, name := range katexFiles {
+		found := false
+		for _, dir := range dirs {
+			_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+			if err == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("checkKaTeX: %s is missing in %s, unpack the KaTeX distribution there", name, *flagFilesFolder)
+		}
+	}
+	return nil
+}
+
+type mathSpan struct {
+	tex     string
+	display bool
+}
+
+func mathPlaceholder(i int) string {
+	return fmt.Sprintf("GOBLOGMATH%dX", i)
+}
+
+// extractMath replaces $...$, $$...$$, \(...\) and \[...\] in markdown src
+// with placeholders so the markdown renderer leaves the TeX alone. Code
+// spans and fenced code blocks are skipped.
+func extractMath(src []byte) ([]byte, []mathSpan) {
+	var out bytes.Buffer
+	var spans []mathSpan
+	var text []byte
+	flush := func() {
+		out.WriteString(scanMath(string(text), &spans))
+		text = text[:0]
+	}
+	fence := ""
+	for _, line := range bytes.SplitAfter(src, []byte("\n")) {
+		trimmed := strings.TrimSpace(string(line))
+		switch {
+		case fence == "" && (strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")):
+			flush()
+			fence = trimmed[:3]
+			out.Write(line)
+		case fence != "":
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			out.Write(line)
+		default:
+			text = append(text, line...)
+		}
+	}
+	flush()
+	return out.Bytes(), spans
+}
+
+func scanMath(s string, spans *[]mathSpan) string {
+	var b strings.Builder
+	add := func(tex string, display bool) {
+		b.WriteString(mathPlaceholder(len(*spans)))
+		*spans = append(*spans, mathSpan{tex: strings.TrimSpace(tex), display: display})
+	}
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		switch {
+		case rest[0] == '`':
+			n := len(rest) - len(strings.TrimLeft(rest, "`"))
+			end := strings.Index(rest[n:], rest[:n])
+			if end < 0 {
+				b.WriteString(rest[:n])
+				i += n
+				continue
+			}
+			b.WriteString(rest[:2*n+end])
+			i += 2*n + end
+		case strings.HasPrefix(rest, `\$`):
+			b.WriteString(`\$`)
+			i += 2
+		case strings.HasPrefix(rest, `\[`) || strings.HasPrefix(rest, `\(`):
+			closing := `\]`
+			if rest[1] == '(' {
+				closing = `\)`
+			}
+			end := strings.Index(rest[2:], closing)
+			if end < 0 {
+				b.WriteString(rest[:2])
+				i += 2
+				continue
+			}
+			add(rest[2:2+end], rest[1] == '[')
+			i += 2 + end + 2
+		case strings.HasPrefix(rest, "$$"):
+			end := strings.Index(rest[2:], "$$")
+			if end < 0 {
+				b.WriteString("$$")
+				i += 2
+				continue
+			}
+			add(rest[2:2+end], true)
+			i += 2 + end + 2
+		case rest[0] == '$':
+			end := inlineMathEnd(rest)
+			if end < 0 {
+				b.WriteByte('$')
+				i++
+				continue
+			}
+			add(rest[1:end], false)
+			i += end + 1
+		default:
+			b.WriteByte(rest[0])
+			i++
+		}
+	}
+	return b.String()
+}
+
+// inlineMathEnd returns the index of the $ closing the inline math that
+// starts at s[0], or -1. Like pandoc, the opening $ must not be followed by
+// a space, the closing one not preceded by a space nor followed by a digit,
+// and the math must not span a blank line.
+func inlineMathEnd(s string) int {
+	if len(s) < 3 || s[1] == ' ' || s[1] == '\n' {
+		return -1
+	}
+	for j := 2; j < len(s); j++ {
+		switch {
+		case s[j] == '\\':
+			j++
+		case s[j] == '\n' && j+1 < len(s) && s[j+1] == '\n':
+			return -1
+		case s[j] == '$':
+			if s[j-1] == ' ' || (j+1 < len(s) && s[j+1] >= '0' && s[j+1] <= '9') {
+				return -1
+			}
+			return j
+		}
+	}
+	return -1
+}
+
+// insertMath puts the math back into the rendered content, as KaTeX
+// markup or converted to MathML depending on mode. TeX that cannot be
+// converted is logged and kept as it is.
+func insertMath(content template.HTML, spans []mathSpan, mode string) template.HTML {
+	if len(spans) == 0 {
+		return content
+	}
+	pairs := make([]string, 0, 2*len(spans))
+	for i, sp := range spans {
+		var html string
+		var err error
+		if mode == mathMathML {
+			if sp.display {
+				html, err = treeblood.DisplayStyle(sp.tex, nil)
+			} else {
+				html, err = treeblood.InlineStyle(sp.tex, nil)
+			}
+			if err != nil {
+				slog.Warn("converting math failed", "tex", sp.tex, "err", err)
+			}
+		}
+		if mode != mathMathML || err != nil {
+			tex := template.HTMLEscapeString(sp.tex)
+			if sp.display {
+				html = `<span class="math display">\[` + tex + `\]</span>`
+			} else {
+				html = `<span class="math inline">\(` + tex + `\)</span>`
+			}
+		}
+		pairs = append(pairs, mathPlaceholder(i), strings.TrimSpace(html))
+	}
+	return template.HTML(strings.NewReplacer(pairs...).Replace(string(content)))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Diagram rendering modes, selected with -mermaid.
+const (
+	mermaidOff    = ""
+	mermaidClient = "client"
+	mermaidServer = "server"
+)
+
+// mmdcTimeout is how long -mmdc may take for a diagram before it is
+// killed. The mermaid CLI starts a headless browser, which may hang.
+const mmdcTimeout = time.Minute
+
+// diagramRenders serializes the runs of -mmdc and remembers the diagrams
+// it failed on by the hash of their source, so a broken diagram is not
+// run again each time its page is rendered.
+var diagramRenders struct {
+	mutex  sync.Mutex
+	failed map[string]error
+}
+
+func diagramPlaceholder(i int) string {
+	return fmt.Sprintf("GOBLOGDIAGRAM%dX", i)
+}
+
+// extractDiagrams replaces fenced code blocks with the info string mermaid
+// in markdown src by placeholder paragraphs and returns their sources.
+func extractDiagrams(src []byte) ([]byte, []string) {
+	var out bytes.Buffer
+	var diagrams []string
+	var diagram *strings.Builder
+	fence := ""
+	for _, line := range bytes.SplitAfter(src, []byte("\n")) {
+		trimmed := strings.TrimSpace(string(line))
+		switch {
+		case fence == "" && (strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")):
+			fence = trimmed[:3]
+			if strings.TrimSpace(strings.TrimLeft(trimmed, fence[:1])) == "mermaid" {
+				diagram = &strings.Builder{}
+				continue
+			}
+			out.Write(line)
+		case fence != "" && strings.HasPrefix(trimmed, fence):
+			fence = ""
+			if diagram != nil {
+				fmt.Fprintf(&out, "\n%s\n\n", diagramPlaceholder(len(diagrams)))
+				diagrams = append(diagrams, diagram.String())
+				diagram = nil
+				continue
+			}
+			out.Write(line)
+		case diagram != nil:
+			diagram.Write(line)
+		default:
+			out.Write(line)
+		}
+	}
+	if diagram != nil {
+		// unterminated fence, keep it as code
+		out.WriteString(fence + "mermaid\n" + diagram.String())
+	}
+	return out.Bytes(), diagrams
+}
+
+// insertDiagrams puts the diagrams back into the rendered content: as
+// markup for mermaid.js in client mode, as an image of the SVG generated
+// by -mmdc in server mode. Diagrams -mmdc fails on are logged and put back
+// as the markup of client mode.
+func insertDiagrams(content template.HTML, diagrams []string, mode string) template.HTML {
+	if len(diagrams) == 0 {
+		return content
+	}
+	pairs := make([]string, 0, 2*len(diagrams))
+	for i, d := range diagrams {
+		html := `<pre class="mermaid">` + template.HTMLEscapeString(d) + `</pre>`
+		if mode == mermaidServer {
+			name, err := renderDiagram(d)
+			if err == nil {
+				html = `<img class="diagram" src="/diagrams/` + name + `" alt="diagram">`
+			} else {
+				slog.Warn("rendering diagram failed", "err", err)
+			}
+		}
+		pairs = append(pairs, "<p>"+diagramPlaceholder(i)+"</p>", html, diagramPlaceholder(i), html)
+	}
+	return template.HTML(strings.NewReplacer(pairs...).Replace(string(content)))
+}
+
+// renderDiagram converts the mermaid source src to SVG with the mermaid
+// CLI and returns the file name in -diagramcache. Diagrams are named by
+// the hash of their source, so each one is only rendered once, and the
+// SVG is only moved there once complete.
+func renderDiagram(src string) (string, error) {
+	sum := sha256.Sum256([]byte(src))
+	hash := hex.EncodeToString(sum[:8])
+	name := hash + ".svg"
+	out := filepath.Join(*flagDiagramCache, name)
+	diagramRenders.mutex.Lock()
+	defer diagramRenders.mutex.Unlock()
+	if err, ok := diagramRenders.failed[hash]; ok {
+		return "", fmt.Errorf("renderDiagram: %w", err)
+	}
+	_, err := os.Stat(out)
+	if err == nil {
+		return name, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("renderDiagram: %w", err)
+	}
+	err = runMmdc(src, out)
+	if err != nil {
+		if diagramRenders.failed == nil {
+			diagramRenders.failed = map[string]error{}
+		}
+		diagramRenders.failed[hash] = err
+		return "", fmt.Errorf("renderDiagram: %w", err)
+	}
+	return name, nil
+}
+
+// runMmdc runs -mmdc on the mermaid source src, killing it after
+// mmdcTimeout, and writes the SVG to out.
+func runMmdc(src, out string) error {
+	err := os.MkdirAll(*flagDiagramCache, 0755)
+	if err != nil {
+		return fmt.Errorf("runMmdc: %w", err)
+	}
+	in, err := ioutil.TempFile("", "goblog-*.mmd")
+	if err != nil {
+		return fmt.Errorf("runMmdc: %w", err)
+	}
+	defer os.Remove(in.Name())
+	_, err = in.WriteString(src)
+	if err == nil {
+		err = in.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("runMmdc: %w", err)
+	}
+	// mmdc picks the format by the extension
+	tmp := strings.TrimSuffix(out, ".svg") + ".tmp.svg"
+	defer os.Remove(tmp)
+	ctx, cancel := context.WithTimeout(context.Background(), mmdcTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, *flagMmdc, "-q", "-i", in.Name(), "-o", tmp)
+	// the browser started by mmdc may keep the output open
+	cmd.WaitDelay = 5 * time.Second
+	msg, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("runMmdc: %s: %w: %s", *flagMmdc, err, bytes.TrimSpace(msg))
+	}
+	err = os.Rename(tmp, out)
+	if err != nil {
+		return fmt.Errorf("runMmdc: %w", err)
+	}
+	return nil
+}
+
+// makeDiagramHandler serves the SVG files generated in server mode.
+func makeDiagramHandler() http.Handler {
+	return http.StripPrefix("/diagrams/", http.FileServer(http.Dir(*flagDiagramCache)))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+)
+
+// Meta is the description of a page for search engines and for the
+// previews of social networks, rendered as Open Graph and Twitter Card tags
+// by header.tmpl.html.
+type Meta struct {
+	SiteName    string
+	Title       string
+	Description string
+	URL         string
+	Image       string
+	Type        string
+	Twitter     string
+}
+
+// metaDescriptionLength is the number of characters of a post's excerpt
+// used as its description.
+const metaDescriptionLength = 200
+
+// pageMeta returns the metadata for the data a template is executed with.
+// Posts and static pages provide their own, everything else gets the site
+// defaults given with -sitename, -description, -image and -twitter.
+func pageMeta(data interface{}) Meta {
+	m := Meta{
+		SiteName:    *flagSiteName,
+		Title:       *flagSiteName,
+		Description: *flagDescription,
+		Type:        "website",
+		Twitter:     *flagTwitter,
+	}
+	if *flagSiteImage != "" {
+		m.Image = absURL(*flagSiteImage)
+	}
+	switch d := data.(type) {
+	case Page:
+		m.Title = d.Title
+		m.URL = absURL(d.URL())
+		if !d.Static {
+			m.Type = "article"
+		}
+		if desc := d.Summary; desc != "" {
+			m.Description = desc
+		} else if desc := strings.Join(strings.Fields(plainText(d.Excerpt)), " "); desc != "" {
+			m.Description = truncate(metaDescriptionLength, desc)
+		}
+		if img := d.Image; img != "" {
+			m.Image = absURL(img)
+		} else if img := firstImage(d.Content); img != "" {
+			m.Image = absURL(img)
+		}
+	case ErrorPage:
+		m.Title = d.Title
+	}
+	return m
+}
+
+// firstImage returns the src of the first img tag in content.
+func firstImage(content template.HTML) string {
+	tag := imgTagRe.FindString(string(content))
+	m := imgSrcRe.FindStringSubmatch(tag)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
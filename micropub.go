@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// micropubLinks are the endpoints announced for Micropub clients.
+type micropubLinks struct {
+	Endpoint      string
+	Authorization string
+	Token         string
+}
+
+// micropubEndpoints returns the endpoints for the micropub template
+// function, or nil if Micropub is off.
+func micropubEndpoints() *micropubLinks {
+	if *flagTokenURL == "" {
+		return nil
+	}
+	return &micropubLinks{Endpoint: absURL("/micropub"), Authorization: *flagAuthURL, Token: *flagTokenURL}
+}
+
+// micropubError replies with the Micropub error code and its description.
+func micropubError(w http.ResponseWriter, status int, code, desc string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": desc})
+}
+
+// indieToken is what the token endpoint tells about a token.
+type indieToken struct {
+	Me       string `json:"me"`
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+}
+
+// allows reports whether t grants scope. The legacy scope post allows
+// creating posts.
+func (t indieToken) allows(scope string) bool {
+	for _, s := range strings.Fields(t.Scope) {
+		if s == scope || (s == "post" && scope == "create") {
+			return true
+		}
+	}
+	return false
+}
+
+// sameMe reports whether the profile URLs a and b are the same, ignoring
+// the scheme and a trailing slash.
+func sameMe(a, b string) bool {
+	norm := func(s string) string {
+		u, err := url.Parse(strings.TrimSpace(s))
+		if err != nil {
+			return s
+		}
+		return strings.ToLower(u.Host) + strings.TrimSuffix(u.Path, "/")
+	}
+	return norm(a) == norm(b)
+}
+
+var tokenClient = &http.Client{Timeout: 10 * time.Second}
+
+// verifyToken asks -token-endpoint about token and checks that it was
+// issued for -indieauth-me.
+func verifyToken(token string) (indieToken, error) {
+	var t indieToken
+	req, err := http.NewRequest(http.MethodGet, *flagTokenURL, nil)
+	if err != nil {
+		return t, fmt.Errorf("verifyToken: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := tokenClient.Do(req)
+	if err != nil {
+		return t, fmt.Errorf("verifyToken: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return t, fmt.Errorf("verifyToken: token endpoint: %s", resp.Status)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxFormSize)).Decode(&t)
+	if err != nil {
+		return t, fmt.Errorf("verifyToken: %w", err)
+	}
+	me := *flagIndieMe
+	if me == "" {
+		me = *flagBaseURL
+	}
+	if !sameMe(t.Me, me) {
+		return t, fmt.Errorf("verifyToken: token of %s", t.Me)
+	}
+	return t, nil
+}
+
+// micropubRequest is a Micropub request, sent form encoded or as JSON.
+// Properties hold all values as strings; the HTML of content is kept as
+// is.
+type micropubRequest struct {
+	token      string
+	action     string
+	url        string
+	kind       string
+	properties map[string][]string
+}
+
+// parseMicropub reads the Micropub request of r.
+func parseMicropub(w http.ResponseWriter, r *http.Request) (micropubRequest, error) {
+	req := micropubRequest{properties: map[string][]string{}}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		req.token = strings.TrimSpace(h[len("Bearer "):])
+	}
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct != "application/json" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+		err := r.ParseForm()
+		if err != nil {
+			return req, err
+		}
+		for k, vs := range r.PostForm {
+			switch k = strings.TrimSuffix(k, "[]"); k {
+			case "access_token":
+				if req.token == "" && len(vs) > 0 {
+					req.token = vs[0]
+				}
+			case "action":
+				req.action = r.PostForm.Get("action")
+			case "url":
+				req.url = r.PostForm.Get("url")
+			case "h":
+				req.kind = "h-" + r.PostForm.Get("h")
+			default:
+				req.properties[k] = append(req.properties[k], vs...)
+			}
+		}
+		return req, nil
+	}
+	var body struct {
+		Type       []string                     `json:"type"`
+		Action     string                       `json:"action"`
+		URL        string                       `json:"url"`
+		Properties map[string][]json.RawMessage `json:"properties"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormSize)).Decode(&body)
+	if err != nil {
+		return req, err
+	}
+	req.action, req.url = body.Action, body.URL
+	if len(body.Type) > 0 {
+		req.kind = body.Type[0]
+	}
+	for k, vs := range body.Properties {
+		for _, v := range vs {
+			var s string
+			var html struct {
+				HTML  string `json:"html"`
+				Value string `json:"value"`
+			}
+			if json.Unmarshal(v, &s) != nil && json.Unmarshal(v, &html) == nil {
+				s = html.HTML
+				if s == "" {
+					s = html.Value
+				}
+			}
+			req.properties[k] = append(req.properties[k], s)
+		}
+	}
+	return req, nil
+}
+
+// first returns the first value of the property k, or "".
+func (req micropubRequest) first(k string) string {
+	if vs := req.properties[k]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// freeName returns the name of a file below the root of cs for a post
+// published at t with slug that is not taken yet.
+func freeName(cs ContentStore, t time.Time, slug string) (string, error) {
+	base := t.Format("2006-01-02") + "-" + slug
+	name := base + ".md"
+	for i := 2; ; i++ {
+		_, _, err := cs.Get(name)
+		if errors.Is(err, os.ErrNotExist) {
+			return name, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("freeName: %w", err)
+		}
+		name = fmt.Sprintf("%s-%d.md", base, i)
+	}
+}
+
+// micropubPost returns the front matter and the body of the post created
+// by req.
+func micropubPost(req micropubRequest) (FrontMatter, string, error) {
+	body := req.first("content")
+	fm := FrontMatter{
+		Title: req.first("name"),
+		Slug:  req.first("mp-slug"),
+		Tags:  req.properties["category"],
+		Draft: req.first("post-status") == "draft",
+	}
+	if fm.Title == "" {
+		// notes have no name; their first words stand in for it
+		line, _, _ := strings.Cut(strings.TrimSpace(body), "\n")
+		fm.Title = truncate(60, line)
+	}
+	fm.Date = time.Now().UTC().Truncate(time.Second)
+	if p := req.first("published"); p != "" {
+		t, err := time.Parse(time.RFC3339, p)
+		if err != nil {
+			return fm, "", fmt.Errorf("invalid published date %q", p)
+		}
+		fm.Date = t
+		if t.After(time.Now()) {
+			fm.Publish = t
+		}
+	}
+	if p := req.first("photo"); p != "" {
+		fm.Image = p
+		body = "![](" + p + ")\n\n" + body
+	}
+	if strings.TrimSpace(body) == "" && req.first("name") == "" {
+		return fm, "", errors.New("a post needs a name or content")
+	}
+	return fm, body, nil
+}
+
+// makeMicropubHandlerFunc serves /micropub, the Micropub endpoint. Clients
+// authenticate with tokens of -token-endpoint; they can create posts in
+// the content store, delete them and query the config and the source of
+// a post.
+func makeMicropubHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *flagTokenURL == "" {
+			notFound(w, r)
+			return
+		}
+		var req micropubRequest
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+				req.token = strings.TrimSpace(h[len("Bearer "):])
+			} else {
+				req.token = r.URL.Query().Get("access_token")
+			}
+		case http.MethodPost:
+			req, err = parseMicropub(w, r)
+			if err != nil {
+				micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+		default:
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		if req.token == "" {
+			micropubError(w, http.StatusUnauthorized, "unauthorized", "no access token")
+			return
+		}
+		token, err := verifyToken(req.token)
+		if err != nil {
+			reqLogger(r).Warn("micropub token rejected", "err", err)
+			micropubError(w, http.StatusForbidden, "forbidden", "invalid access token")
+			return
+		}
+		if r.Method == http.MethodGet {
+			micropubQuery(w, r)
+			return
+		}
+		cs := contentStore.(writableStore)
+		switch req.action {
+		case "":
+		case "delete":
+			if !token.allows("delete") {
+				micropubError(w, http.StatusForbidden, "insufficient_scope", "the token does not allow delete")
+				return
+			}
+			name := linkedPost(req.url)
+			if name == "" {
+				micropubError(w, http.StatusBadRequest, "invalid_request", "no post at "+req.url)
+				return
+			}
+			err = cs.remove(name)
+			if err != nil {
+				serverError(w, r, fmt.Errorf("makeMicropubHandlerFunc: %w", err))
+				return
+			}
+			posts.refresh()
+			reqLogger(r).Info("post deleted", "post", name, "client", token.ClientID)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			micropubError(w, http.StatusBadRequest, "invalid_request", "unsupported action "+req.action)
+			return
+		}
+		if !token.allows("create") {
+			micropubError(w, http.StatusForbidden, "insufficient_scope", "the token does not allow create")
+			return
+		}
+		if req.kind != "" && req.kind != "h-entry" {
+			micropubError(w, http.StatusBadRequest, "invalid_request", "only h-entry is supported")
+			return
+		}
+		fm, body, err := micropubPost(req)
+		if err != nil {
+			micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		slug := slugify(fm.Slug)
+		if slug == "" {
+			slug = slugify(fm.Title)
+		}
+		if slug == "" {
+			slug = "note"
+		}
+		name, err := freeName(contentStore, fm.Date, slug)
+		var b []byte
+		if err == nil {
+			b, err = postSource(fm, body)
+		}
+		if err == nil {
+			err = cs.put(name, b)
+		}
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeMicropubHandlerFunc: %w", err))
+			return
+		}
+		posts.refresh()
+		reqLogger(r).Info("post created", "post", name, "client", token.ClientID)
+		w.Header().Set("Location", absURL("/page/"+name))
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// micropubQuery answers the GET queries of Micropub clients: the config,
+// the syndication targets, of which there are none, and the source of a
+// post.
+func micropubQuery(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var v interface{}
+	switch q.Get("q") {
+	case "config":
+		v = map[string]interface{}{
+			"syndicate-to": []string{},
+			"post-types": []map[string]string{
+				{"type": "note", "name": "Note"},
+				{"type": "article", "name": "Article"},
+				{"type": "photo", "name": "Photo"},
+			},
+		}
+	case "syndicate-to":
+		v = map[string]interface{}{"syndicate-to": []string{}}
+	case "source":
+		name := linkedPost(q.Get("url"))
+		if name == "" {
+			micropubError(w, http.StatusBadRequest, "invalid_request", "no post at "+q.Get("url"))
+			return
+		}
+		b, _, err := contentStore.Get(name)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("micropubQuery: %w", err))
+			return
+		}
+		p, _, _ := findPage(posts.published(), name)
+		_, md := splitFrontMatter(b)
+		props := map[string][]string{
+			"name":      {p.Title},
+			"content":   {strings.TrimSpace(string(md))},
+			"published": {p.PublishedAt().Format(time.RFC3339)},
+			"url":       {absURL(p.URL())},
+		}
+		if len(p.Tags) > 0 {
+			props["category"] = p.Tags
+		}
+		v = map[string]interface{}{"type": []string{"h-entry"}, "properties": props}
+	default:
+		micropubError(w, http.StatusBadRequest, "invalid_request", "unknown query "+q.Get("q"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
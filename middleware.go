@@ -0,0 +1,180 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a handler with behaviour shared by many routes.
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps h in ms, the first one being the outermost.
+func chain(h http.Handler, ms ...Middleware) http.Handler {
+	for i := len(ms) - 1; i >= 0; i-- {
+		h = ms[i](h)
+	}
+	return h
+}
+
+// customMiddleware is added with addMiddleware.
+var customMiddleware []Middleware
+
+// addMiddleware makes every request pass m, inside of logging and panic
+// recovery and outside of compression and the per route middleware. It
+// must be called before the server is set up, i.e. at the start of main,
+// like addTemplateFunc. Middleware added first is outermost.
+func addMiddleware(m Middleware) {
+	customMiddleware = append(customMiddleware, m)
+}
+
+// recoverPanics turns a panicking handler into a 500 page and logs the
+// panic with its stack.
+func recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			serverError(w, r, fmt.Errorf("panic: %v\n%s", v, debug.Stack()))
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// limitClients answers requests with 429 once the client IP used up its
+// share of l. A nil l lets all requests pass, as does l for clients in
+// rateExempt.
+func limitClients(l *limiter) Middleware {
+	return func(h http.Handler) http.Handler {
+		if l == nil {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r)
+			if inNets(rateExempt, ip) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if ok, retry := l.allow(rateKey(ip), time.Now()); !ok {
+				reqLogger(r).Warn("rate limited", "ip", ip)
+				tooManyRequests(w, r, retry)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// gzipWriters are reused between responses.
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(io.Discard) }}
+
+// compressible reports whether responses of the content type ct are worth
+// compressing.
+func compressible(ct string) bool {
+	ct, _, _ = strings.Cut(ct, ";")
+	ct = strings.TrimSpace(ct)
+	return strings.HasPrefix(ct, "text/") ||
+		strings.HasSuffix(ct, "+xml") || strings.HasSuffix(ct, "+json") ||
+		ct == "application/json" || ct == "application/javascript" || ct == "application/xml"
+}
+
+// gzipWriter compresses the response if its content type is compressible.
+// The decision is taken when the header is written, sniffing the content
+// type from the first write if it isn't set.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (w *gzipWriter) decide(status int, ct string) {
+	w.decided = true
+	h := w.Header()
+	if ct == "" || !compressible(ct) || h.Get("Content-Encoding") != "" ||
+		status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		return
+	}
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	w.gz = gzipWriters.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.decide(status, w.Header().Get("Content-Type"))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		ct := w.Header().Get("Content-Type")
+		if ct == "" {
+			ct = http.DetectContentType(b)
+			w.Header().Set("Content-Type", ct)
+		}
+		w.decide(http.StatusOK, ct)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipWriter) close() error {
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	gzipWriters.Put(w.gz)
+	w.gz = nil
+	return err
+}
+
+// compress gzips responses with a textual content type for clients that
+// accept it. Range requests are passed through unchanged.
+func compress(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Header.Get("Range") != "" || !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer func() {
+			err := gw.close()
+			if err != nil && !errors.Is(err, http.ErrHandlerTimeout) {
+				reqLogger(r).Debug("finishing compressed response failed", "err", err)
+			}
+		}()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, q, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(name) == "gzip" {
+			return strings.ReplaceAll(q, " ", "") != "q=0"
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Moderation actions posted to /moderate/.
+const (
+	moderateApprove = "approve"
+	moderateDelete  = "delete"
+)
+
+// moderationItem is a comment waiting in the moderation queue.
+type moderationItem struct {
+	Post    string
+	Title   string
+	Comment Comment
+}
+
+// makeReportCommentHandlerFunc serves POST /reportcomment/<post> with the
+// id of the comment a reader reports for review. Once -comment-reports
+// reports came in, the comment is hidden until a moderator approves it.
+func makeReportCommentHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		post := r.URL.Path[len("/reportcomment/"):]
+		if !parseForm(w, r) {
+			return
+		}
+		p, _, ok := findPage(posts.published(), post)
+		if !ok || p.Name != post {
+			notFound(w, r)
+			return
+		}
+		id := r.FormValue("id")
+		reporter := sign("report:" + clientIP(r))[:16]
+		err := commentStore.Update(post, func(cs []Comment) ([]Comment, error) {
+			i := findComment(cs, id)
+			if i < 0 || cs[i].Status == commentHeld {
+				return nil, errNoComment
+			}
+			for _, rep := range cs[i].Reporters {
+				if rep == reporter {
+					return cs, nil
+				}
+			}
+			cs[i].Reporters = append(cs[i].Reporters, reporter)
+			cs[i].Reports++
+			if *flagReportLimit > 0 && cs[i].Reports >= *flagReportLimit {
+				cs[i].Status = commentFlagged
+			}
+			return cs, nil
+		})
+		if errors.Is(err, errNoComment) {
+			notFound(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeReportCommentHandlerFunc: %w", err))
+			return
+		}
+		reqLogger(r).Info("comment reported", "post", post, "id", id)
+		http.Redirect(w, r, "/page/"+post+"#comment-"+id, http.StatusFound)
+	}
+}
+
+// moderator reports whether r carries basic auth allowing role: the name
+// and password of a user of -users who may act as role or, as long as
+// there are no users, the -moderation-password with any user name.
+func moderator(r *http.Request, role string) bool {
+	name, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	u, ok, err := checkAdminLogin(name, pass)
+	if err != nil {
+		logError(r, fmt.Errorf("moderator: %w", err))
+		return false
+	}
+	return ok && u.may(role)
+}
+
+// requireRole lets only requests passing moderator for role through and
+// asks all others for a password. Every failed attempt takes from the
+// client's share of l; once it is used up, the client gets a 429 without
+// its password being checked. Without -moderation-password and users every
+// request gets a 404.
+func requireRole(role string, l *limiter) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !adminEnabled() {
+				notFound(w, r)
+				return
+			}
+			ip := clientIP(r)
+			limited := l != nil && !inNets(rateExempt, ip)
+			if limited {
+				if blocked, retry := l.blocked(rateKey(ip), time.Now()); blocked {
+					reqLogger(r).Warn("rate limited", "ip", ip)
+					tooManyRequests(w, r, retry)
+					return
+				}
+			}
+			if !moderator(r, role) {
+				if _, _, ok := r.BasicAuth(); ok && limited {
+					l.allow(rateKey(ip), time.Now())
+				}
+				w.Header().Set("WWW-Authenticate", `Basic realm="moderation"`)
+				renderError(w, r, http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// moderationQueue returns the held, flagged and reported comments of all
+// posts of cs.
+func moderationQueue(cs ContentStore) ([]moderationItem, error) {
+	ps, err := loadAllPages(cs)
+	if err != nil && !errors.Is(err, errBadPages) {
+		return nil, fmt.Errorf("moderationQueue: %w", err)
+	}
+	var items []moderationItem
+	for _, p := range ps {
+		cs, err := commentStore.Load(p.Name)
+		if err != nil {
+			return nil, fmt.Errorf("moderationQueue: %w", err)
+		}
+		for _, c := range cs {
+			if c.Status != "" || c.Reports > 0 {
+				items = append(items, moderationItem{Post: p.Name, Title: p.Title, Comment: c})
+			}
+		}
+	}
+	return items, nil
+}
+
+// makeModerateHandlerFunc serves /moderate/, the moderation queue, behind
+// requireRole. A POST approves or deletes the comment id of post.
+func makeModerateHandlerFunc() http.HandlerFunc {
+	_, err := templates.get("moderate.tmpl.html")
+	if err != nil {
+		panic("makeModerateHandlerFunc: could not parse moderate.tmpl.html")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			items, err := moderationQueue(contentStore)
+			if err != nil {
+				serverError(w, r, fmt.Errorf("makeModerateHandlerFunc: %w", err))
+				return
+			}
+			data := struct {
+				Title string
+				Token string
+				Items []moderationItem
+			}{"Moderation", sign("moderate"), items}
+			err = templates.execute(w, "moderate.tmpl.html", data)
+			if err != nil {
+				serverError(w, r, fmt.Errorf("makeModerateHandlerFunc: %w", err))
+			}
+			return
+		}
+		if r.Method != http.MethodPost {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		if !hmac.Equal([]byte(r.FormValue("token")), []byte(sign("moderate"))) {
+			renderError(w, r, http.StatusForbidden)
+			return
+		}
+		post, id, action := r.FormValue("post"), r.FormValue("id"), r.FormValue("action")
+		if action != moderateApprove && action != moderateDelete {
+			renderError(w, r, http.StatusBadRequest)
+			return
+		}
+		_, err := moderateComment(post, id, action)
+		if errors.Is(err, errNoComment) {
+			notFound(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeModerateHandlerFunc: %w", err))
+			return
+		}
+		http.Redirect(w, r, "/moderate/", http.StatusFound)
+	}
+}
+
+// moderateComment approves or deletes the comment id of post and fires
+// the matching webhook. Approving shows it again and clears its reports.
+// It returns the comment as it was approved or deleted, or errNoComment.
+func moderateComment(post, id, action string) (Comment, error) {
+	var c Comment
+	err := commentStore.Update(post, func(cs []Comment) ([]Comment, error) {
+		i := findComment(cs, id)
+		if i < 0 {
+			return nil, errNoComment
+		}
+		if action == moderateDelete {
+			c = cs[i]
+			return append(cs[:i], cs[i+1:]...), nil
+		}
+		cs[i].Status = ""
+		cs[i].Reports, cs[i].Reporters = 0, nil
+		c = cs[i]
+		return cs, nil
+	})
+	if err != nil {
+		return c, fmt.Errorf("moderateComment: %w", err)
+	}
+	if webhooks != nil {
+		event := eventCommentApproved
+		if action == moderateDelete {
+			event = eventCommentDeleted
+		}
+		webhooks.fire(event, post, c)
+	}
+	return c, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultArchetype is the archetype of new posts while -archetypes has no
+// default.md.
+const defaultArchetype = `---
+title: {{ yaml .Title }}
+slug: {{ .Slug }}
+date: {{ .Date }}
+draft: true
+tags: []
+---
+`
+
+// archetypeFuncs are the functions archetypes may use besides the ones of
+// text/template.
+var archetypeFuncs = template.FuncMap{
+	"yaml":    yamlScalar,
+	"slugify": slugify,
+}
+
+// archetypeData is what archetypes are executed with. Date is the time the
+// post was created in RFC 3339.
+type archetypeData struct {
+	Title string
+	Slug  string
+	Date  string
+	Kind  string
+}
+
+// yamlScalar returns s as YAML scalar, quoted if it needs to be.
+func yamlScalar(s string) (string, error) {
+	b, err := yaml.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(b), "\n"), nil
+}
+
+// readArchetype returns the archetype kind from the folder dir. Only the
+// default kind may be missing there and falls back to defaultArchetype.
+func readArchetype(dir, kind string) (string, error) {
+	if kind == "" || kind != filepath.Base(kind) || strings.HasPrefix(kind, ".") {
+		return "", fmt.Errorf("readArchetype: invalid kind %q", kind)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, kind+".md"))
+	if errors.Is(err, os.ErrNotExist) && kind == "default" {
+		return defaultArchetype, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("readArchetype: %w", err)
+	}
+	return string(b), nil
+}
+
+// scaffoldPost writes a new post titled title from the archetype kind to
+// cs and returns its file name, which is named after its date and slug
+// like the posts of the API.
+func scaffoldPost(cs ContentStore, kind, title string, now time.Time) (string, error) {
+	ws, ok := cs.(writableStore)
+	if !ok {
+		return "", fmt.Errorf("scaffoldPost: content store %s is not writable", *flagContentStore)
+	}
+	src, err := readArchetype(*flagArchetypes, kind)
+	if err != nil {
+		return "", fmt.Errorf("scaffoldPost: %w", err)
+	}
+	t, err := template.New(kind).Funcs(archetypeFuncs).Parse(src)
+	if err != nil {
+		return "", fmt.Errorf("scaffoldPost: %w", err)
+	}
+	data := archetypeData{
+		Title: title,
+		Slug:  slugify(title),
+		Date:  now.Format(time.RFC3339),
+		Kind:  kind,
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("scaffoldPost: %w", err)
+	}
+	b := buf.Bytes()
+	_, _, err = parseFrontMatter(b)
+	if err != nil {
+		return "", fmt.Errorf("scaffoldPost: archetype %s: %w", kind, err)
+	}
+	name, err := newPostName(b, "")
+	if err != nil {
+		return "", fmt.Errorf("scaffoldPost: %w", err)
+	}
+	err = ws.put(name, b)
+	if err != nil {
+		return "", fmt.Errorf("scaffoldPost: %w", err)
+	}
+	return name, nil
+}
+
+// runNew runs goblog new with the arguments following it: the -kind of
+// archetype and the title of the post.
+func runNew(args []string) error {
+	fs := flag.NewFlagSet("new", flag.ContinueOnError)
+	kind := fs.String("kind", "default", "archetype of the post, <kind>.md in -archetypes")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `usage: goblog [flags] new [-kind name] "Title"`)
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	title := strings.TrimSpace(strings.Join(fs.Args(), " "))
+	if title == "" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	name, err := scaffoldPost(contentStore, *kind, title, time.Now().Truncate(time.Second))
+	if err != nil {
+		return err
+	}
+	if *flagContentStore == contentFiles {
+		name = filepath.Join(*flagSrcFolder, name)
+	}
+	fmt.Println("created", name)
+	return nil
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Modes of -newsletter: new posts are mailed to the subscribers when they
+// are published, or only when sent from /newsletter/.
+const (
+	newsletterOff    = "off"
+	newsletterAuto   = "auto"
+	newsletterManual = "manual"
+)
+
+// Templates of the newsletter. The mails have a "subject" and a "body"
+// definition like the comment notifications.
+const (
+	confirmMailTemplate    = "mail/confirm.tmpl.txt"
+	newsletterMailTemplate = "mail/newsletter.tmpl.txt"
+	subscribeTemplate      = "subscribe.tmpl.html"
+	newsletterTemplate     = "newsletter.tmpl.html"
+)
+
+// subscribeMaxAge is how long a subscription can be confirmed before it
+// has to be requested again.
+const subscribeMaxAge = 48 * time.Hour
+
+// confirmMailInterval is how long subscribing a pending address again
+// sends no further confirmation mail, so the form can't flood a mailbox.
+const confirmMailInterval = time.Hour
+
+// subscriberTokenBytes is the number of random bytes of the tokens in the
+// links to confirm and cancel subscriptions.
+const subscriberTokenBytes = 16
+
+// subscriber is an address subscribed to the newsletter. Until it is
+// confirmed with the link mailed to it, it gets nothing else.
+type subscriber struct {
+	Email     string    `json:"email"`
+	Token     string    `json:"token"`
+	Confirmed bool      `json:"confirmed,omitempty"`
+	Since     time.Time `json:"since"`
+	Mailed    time.Time `json:"mailed,omitempty"`
+}
+
+// subscriberList is the content of the -subscribers file: the subscribers
+// and when each post was last mailed to them.
+type subscriberList struct {
+	Subscribers []subscriber         `json:"subscribers"`
+	Sent        map[string]time.Time `json:"sent,omitempty"`
+}
+
+// newsletterJob is a mail waiting to be sent: the confirmation request to
+// a new subscriber, or a post to all confirmed ones.
+type newsletterJob struct {
+	confirm subscriber
+	post    *Page
+}
+
+// mailingList keeps the subscribers of the newsletter in the -subscribers
+// file and mails them in the background through notifier.
+type mailingList struct {
+	fpath string
+	mutex sync.Mutex
+	list  subscriberList
+	queue chan newsletterJob
+	done  chan struct{}
+}
+
+// newsletter mails posts to its subscribers; nil disables the newsletter.
+// It is set up in main from -newsletter.
+var newsletter *mailingList
+
+func newMailingList(fpath string) (*mailingList, error) {
+	ml := &mailingList{
+		fpath: fpath,
+		queue: make(chan newsletterJob, mailQueueSize),
+		done:  make(chan struct{}),
+	}
+	b, err := os.ReadFile(fpath)
+	if err == nil {
+		err = json.Unmarshal(b, &ml.list)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("newMailingList: %w", err)
+	}
+	if ml.list.Sent == nil {
+		ml.list.Sent = map[string]time.Time{}
+	}
+	go ml.run()
+	return ml, nil
+}
+
+// newSubscriberToken returns a random token for a new subscriber.
+func newSubscriberToken() (string, error) {
+	b := make([]byte, subscriberTokenBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// find returns the index of the subscriber with the email or token, or -1.
+// The mutex has to be held.
+func (ml *mailingList) find(email, token string) int {
+	for i, s := range ml.list.Subscribers {
+		if (email != "" && strings.EqualFold(s.Email, email)) || (token != "" && hmac.Equal([]byte(s.Token), []byte(token))) {
+			return i
+		}
+	}
+	return -1
+}
+
+// prune drops the subscriptions that were not confirmed in time. The mutex
+// has to be held.
+func (ml *mailingList) prune(now time.Time) {
+	ss := ml.list.Subscribers[:0]
+	for _, s := range ml.list.Subscribers {
+		if s.Confirmed || now.Sub(s.Since) < subscribeMaxAge {
+			ss = append(ss, s)
+		}
+	}
+	ml.list.Subscribers = ss
+}
+
+// subscribe adds email as an unconfirmed subscriber and queues the mail
+// asking to confirm it. Confirmed subscribers are left alone, and pending
+// ones get the mail again once confirmMailInterval passed.
+func (ml *mailingList) subscribe(email string) error {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+	now := time.Now().UTC()
+	ml.prune(now)
+	i := ml.find(email, "")
+	if i >= 0 && ml.list.Subscribers[i].Confirmed {
+		return nil
+	}
+	if i < 0 {
+		token, err := newSubscriberToken()
+		if err != nil {
+			return fmt.Errorf("mailingList.subscribe: %w", err)
+		}
+		ml.list.Subscribers = append(ml.list.Subscribers, subscriber{Email: email, Token: token})
+		i = len(ml.list.Subscribers) - 1
+	}
+	s := &ml.list.Subscribers[i]
+	s.Since = now
+	due := now.Sub(s.Mailed) >= confirmMailInterval
+	if due {
+		s.Mailed = now
+	}
+	err := ml.save()
+	if err != nil {
+		return fmt.Errorf("mailingList.subscribe: %w", err)
+	}
+	if due {
+		ml.add(newsletterJob{confirm: *s})
+	}
+	return nil
+}
+
+// confirm confirms the subscription with token. It reports false if there
+// is none or it expired.
+func (ml *mailingList) confirm(token string) (bool, error) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+	now := time.Now().UTC()
+	ml.prune(now)
+	i := ml.find("", token)
+	if i < 0 {
+		return false, nil
+	}
+	if ml.list.Subscribers[i].Confirmed {
+		return true, nil
+	}
+	ml.list.Subscribers[i].Confirmed = true
+	ml.list.Subscribers[i].Since = now
+	err := ml.save()
+	if err != nil {
+		return false, fmt.Errorf("mailingList.confirm: %w", err)
+	}
+	slog.Info("newsletter subscribed", "subscribers", len(ml.confirmed()))
+	return true, nil
+}
+
+// unsubscribe removes the subscriber with token. It reports false if
+// there is none.
+func (ml *mailingList) unsubscribe(token string) (bool, error) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+	i := ml.find("", token)
+	if i < 0 {
+		return false, nil
+	}
+	ml.list.Subscribers = append(ml.list.Subscribers[:i], ml.list.Subscribers[i+1:]...)
+	err := ml.save()
+	if err != nil {
+		return false, fmt.Errorf("mailingList.unsubscribe: %w", err)
+	}
+	slog.Info("newsletter unsubscribed", "subscribers", len(ml.confirmed()))
+	return true, nil
+}
+
+// subscribed reports whether token belongs to a subscriber.
+func (ml *mailingList) subscribed(token string) bool {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+	return ml.find("", token) >= 0
+}
+
+// confirmed returns the confirmed subscribers. The mutex has to be held.
+func (ml *mailingList) confirmed() []subscriber {
+	var ss []subscriber
+	for _, s := range ml.list.Subscribers {
+		if s.Confirmed {
+			ss = append(ss, s)
+		}
+	}
+	return ss
+}
+
+// count returns the number of confirmed subscribers.
+func (ml *mailingList) count() int {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+	return len(ml.confirmed())
+}
+
+// sent returns when the post name was last mailed, or the zero time.
+func (ml *mailingList) sent(name string) time.Time {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+	return ml.list.Sent[name]
+}
+
+// send queues p to be mailed to all confirmed subscribers.
+func (ml *mailingList) send(p Page) error {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+	ml.list.Sent[p.Name] = time.Now().UTC()
+	err := ml.save()
+	if err != nil {
+		return fmt.Errorf("mailingList.send: %w", err)
+	}
+	ml.add(newsletterJob{post: &p})
+	return nil
+}
+
+// publish sends p unless it was sent before. It is the publish hook of
+// -newsletter auto.
+func (ml *mailingList) publish(p Page) {
+	if !ml.sent(p.Name).IsZero() {
+		return
+	}
+	err := ml.send(p)
+	if err != nil {
+		slog.Error("sending newsletter failed", "post", p.Name, "err", err)
+	}
+}
+
+// add queues job without waiting.
+func (ml *mailingList) add(job newsletterJob) {
+	select {
+	case ml.queue <- job:
+	default:
+		slog.Warn("newsletter queue full, dropping mail")
+	}
+}
+
+func (ml *mailingList) run() {
+	defer close(ml.done)
+	for job := range ml.queue {
+		if job.post == nil {
+			err := ml.mail(confirmMailTemplate, job.confirm, nil)
+			if err != nil {
+				slog.Error("sending confirmation failed", "err", err)
+			}
+			continue
+		}
+		ml.mutex.Lock()
+		ss := ml.confirmed()
+		ml.mutex.Unlock()
+		failed := 0
+		for _, s := range ss {
+			err := ml.mail(newsletterMailTemplate, s, job.post)
+			if err != nil {
+				failed++
+				slog.Error("sending newsletter failed", "post", job.post.Name, "err", err)
+			}
+		}
+		slog.Info("newsletter sent", "post", job.post.Name, "subscribers", len(ss), "failed", failed)
+	}
+}
+
+// close sends the queued mails and stops ml. Nothing may be queued
+// afterwards.
+func (ml *mailingList) close() {
+	close(ml.queue)
+	<-ml.done
+}
+
+// mail renders the mail template name for s, about the post p if it is
+// not nil, and sends it.
+func (ml *mailingList) mail(name string, s subscriber, p *Page) error {
+	unsubscribe := absURL("/unsubscribe?token=" + s.Token)
+	data := struct {
+		Blog        string
+		Page        *Page
+		URL         string
+		Text        string
+		Confirm     string
+		Unsubscribe string
+	}{
+		Blog:        absURL("/"),
+		Page:        p,
+		Confirm:     absURL("/subscribe?token=" + s.Token),
+		Unsubscribe: unsubscribe,
+	}
+	var headers []string
+	if p != nil {
+		data.URL = absURL(p.URL())
+		data.Text = strings.Join(strings.Fields(plainText(p.Excerpt)), " ")
+		headers = []string{
+			"List-Unsubscribe: <" + unsubscribe + ">",
+			"List-Unsubscribe-Post: List-Unsubscribe=One-Click",
+		}
+	}
+	msg, err := renderMail(name, *flagMailFrom, []string{s.Email}, headers, data)
+	if err != nil {
+		return fmt.Errorf("mailingList.mail: %w", err)
+	}
+	err = notifier.deliver([]string{s.Email}, msg)
+	if err != nil {
+		return fmt.Errorf("mailingList.mail: %w", err)
+	}
+	return nil
+}
+
+// save writes the subscribers to their file. The mutex has to be held.
+func (ml *mailingList) save() error {
+	b, err := json.MarshalIndent(ml.list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("mailingList.save: %w", err)
+	}
+	err = writeFileAtomic(ml.fpath, b, time.Now())
+	if err != nil {
+		return fmt.Errorf("mailingList.save: %w", err)
+	}
+	return nil
+}
+
+// newsletterOn reports whether the newsletter can be subscribed to. It is
+// the newsletter template function.
+func newsletterOn() bool {
+	return newsletter != nil
+}
+
+// subscribePage is the data of subscribeTemplate: a Message, the form to
+// subscribe if Form is set, the one to confirm the subscription with
+// Confirm, or the one to unsubscribe with Token.
+type subscribePage struct {
+	Title   string
+	Message string
+	Form    bool
+	Confirm string
+	Token   string
+}
+
+// renderSubscribe replies with status and subscribeTemplate rendered with
+// data.
+func renderSubscribe(w http.ResponseWriter, r *http.Request, status int, data subscribePage) {
+	b, err := templates.render(subscribeTemplate, data)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("renderSubscribe: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// makeSubscribeHandlerFunc serves /subscribe. A GET shows the form, or
+// with ?token=, the link of the confirmation mail, asks to confirm the
+// subscription, so link checkers don't confirm it. A POST with the token
+// confirms it; one with an email subscribes it and mails the link, and
+// whether it was subscribed already is not revealed.
+func makeSubscribeHandlerFunc() http.HandlerFunc {
+	_, err := templates.get(subscribeTemplate)
+	if err != nil {
+		panic("makeSubscribeHandlerFunc: could not parse " + subscribeTemplate)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if newsletter == nil {
+			notFound(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			token := r.URL.Query().Get("token")
+			if token == "" {
+				renderSubscribe(w, r, http.StatusOK, subscribePage{Title: "Newsletter", Form: true})
+				return
+			}
+			if !newsletter.subscribed(token) {
+				notFound(w, r)
+				return
+			}
+			renderSubscribe(w, r, http.StatusOK, subscribePage{Title: "Confirm", Message: "Do you want to get new posts by email?", Confirm: token})
+		case http.MethodPost:
+			if !parseForm(w, r) {
+				return
+			}
+			if token := r.FormValue("token"); token != "" {
+				ok, err := newsletter.confirm(token)
+				if err != nil {
+					serverError(w, r, fmt.Errorf("makeSubscribeHandlerFunc: %w", err))
+					return
+				}
+				if !ok {
+					notFound(w, r)
+					return
+				}
+				renderSubscribe(w, r, http.StatusOK, subscribePage{Title: "Subscribed", Message: "Your subscription is confirmed. New posts will be mailed to you."})
+				return
+			}
+			if r.FormValue(honeypotField) != "" {
+				renderError(w, r, http.StatusBadRequest)
+				return
+			}
+			email := strings.TrimSpace(r.FormValue("email"))
+			addr, err := mail.ParseAddress(email)
+			if err != nil || addr.Address != email {
+				renderSubscribe(w, r, http.StatusBadRequest, subscribePage{Title: "Newsletter", Message: "That is no valid email address.", Form: true})
+				return
+			}
+			err = newsletter.subscribe(email)
+			if err != nil {
+				serverError(w, r, fmt.Errorf("makeSubscribeHandlerFunc: %w", err))
+				return
+			}
+			renderSubscribe(w, r, http.StatusOK, subscribePage{Title: "Almost done", Message: "Please confirm your subscription with the link mailed to " + email + "."})
+		default:
+			renderError(w, r, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// makeUnsubscribeHandlerFunc serves /unsubscribe?token=, the link in every
+// newsletter. A GET asks to confirm, so link checkers don't unsubscribe
+// anyone; a POST, also the one-click one of RFC 8058, unsubscribes.
+func makeUnsubscribeHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if newsletter == nil {
+			notFound(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			token := r.URL.Query().Get("token")
+			if !newsletter.subscribed(token) {
+				notFound(w, r)
+				return
+			}
+			renderSubscribe(w, r, http.StatusOK, subscribePage{Title: "Unsubscribe", Message: "Do you want to stop getting new posts by email?", Token: token})
+		case http.MethodPost:
+			if !parseForm(w, r) {
+				return
+			}
+			ok, err := newsletter.unsubscribe(r.FormValue("token"))
+			if err != nil {
+				serverError(w, r, fmt.Errorf("makeUnsubscribeHandlerFunc: %w", err))
+				return
+			}
+			if !ok {
+				notFound(w, r)
+				return
+			}
+			renderSubscribe(w, r, http.StatusOK, subscribePage{Title: "Unsubscribed", Message: "You will get no more mails."})
+		default:
+			renderError(w, r, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// newsletterItem is a post listed on /newsletter/ with when it was sent.
+type newsletterItem struct {
+	Page Page
+	Sent time.Time
+}
+
+// makeNewsletterHandlerFunc serves /newsletter/ behind requireRole:
+// the number of subscribers and the published posts, each of which a POST
+// with its name mails to the subscribers.
+func makeNewsletterHandlerFunc() http.HandlerFunc {
+	_, err := templates.get(newsletterTemplate)
+	if err != nil {
+		panic("makeNewsletterHandlerFunc: could not parse " + newsletterTemplate)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if newsletter == nil {
+			notFound(w, r)
+			return
+		}
+		if r.Method == http.MethodGet {
+			var items []newsletterItem
+			for _, p := range posts.published() {
+				items = append(items, newsletterItem{Page: p, Sent: newsletter.sent(p.Name)})
+			}
+			data := struct {
+				Title       string
+				Token       string
+				Subscribers int
+				Auto        bool
+				Items       []newsletterItem
+			}{"Newsletter", sign("newsletter"), newsletter.count(), *flagNewsletter == newsletterAuto, items}
+			err := templates.execute(w, newsletterTemplate, data)
+			if err != nil {
+				serverError(w, r, fmt.Errorf("makeNewsletterHandlerFunc: %w", err))
+			}
+			return
+		}
+		if r.Method != http.MethodPost {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		if !hmac.Equal([]byte(r.FormValue("token")), []byte(sign("newsletter"))) {
+			renderError(w, r, http.StatusForbidden)
+			return
+		}
+		post := r.FormValue("post")
+		p, _, ok := findPage(posts.published(), post)
+		if !ok || p.Name != post {
+			notFound(w, r)
+			return
+		}
+		err := newsletter.send(p)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeNewsletterHandlerFunc: %w", err))
+			return
+		}
+		reqLogger(r).Info("newsletter queued", "post", post)
+		http.Redirect(w, r, "/newsletter/", http.StatusFound)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// commentMailTemplate is the template of comment notifications, with a
+// "subject" and a "body" definition.
+const commentMailTemplate = "mail/comment.tmpl.txt"
+
+// mailQueueSize is the number of notifications waiting to be sent before
+// new ones are dropped.
+const mailQueueSize = 100
+
+// commentEvent is a new comment on the post name.
+type commentEvent struct {
+	name    string
+	comment Comment
+}
+
+// mailer sends comment notifications in the background, so the comment
+// handler doesn't wait for the mail server.
+type mailer struct {
+	addr  string
+	auth  smtp.Auth
+	from  string
+	queue chan commentEvent
+	done  chan struct{}
+}
+
+// notifier mails new comments; nil disables notifications. It is set up in
+// main from the -smtp flags.
+var notifier *mailer
+
+func newMailer(addr, user, password, from string) *mailer {
+	m := &mailer{
+		addr:  addr,
+		from:  from,
+		queue: make(chan commentEvent, mailQueueSize),
+		done:  make(chan struct{}),
+	}
+	if user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", user, password, host)
+	}
+	go m.run()
+	return m
+}
+
+// notify queues a notification about comment c on the post name.
+func (m *mailer) notify(name string, c Comment) {
+	select {
+	case m.queue <- commentEvent{name: name, comment: c}:
+	default:
+		slog.Warn("mail queue full, dropping notification", "post", name)
+	}
+}
+
+func (m *mailer) run() {
+	defer close(m.done)
+	for ev := range m.queue {
+		err := m.send(ev)
+		if err != nil {
+			slog.Error("sending notification failed", "post", ev.name, "err", err)
+		}
+	}
+}
+
+// close sends the queued notifications and stops m. notify must not be
+// called afterwards.
+func (m *mailer) close() {
+	close(m.queue)
+	<-m.done
+}
+
+// send mails ev to -notify and, with -notify-authors, to the author of
+// the post.
+func (m *mailer) send(ev commentEvent) error {
+	p, err := loadPage(contentStore, ev.name)
+	if err != nil {
+		return fmt.Errorf("mailer.send: %w", err)
+	}
+	var to []string
+	if *flagNotify != "" {
+		to = append(to, *flagNotify)
+	}
+	if *flagNotifyAuthor && p.Author != nil {
+		as, err := loadAuthors(*flagAuthorsFile)
+		if err != nil {
+			return fmt.Errorf("mailer.send: %w", err)
+		}
+		if a := as.lookup(p.Author.ID); a.Email != "" && a.Email != *flagNotify {
+			to = append(to, a.Email)
+		}
+	}
+	if len(to) == 0 {
+		return nil
+	}
+	msg, err := commentMail(m.from, to, p, ev.comment)
+	if err != nil {
+		return fmt.Errorf("mailer.send: %w", err)
+	}
+	err = m.deliver(to, msg)
+	if err != nil {
+		return fmt.Errorf("mailer.send: %w", err)
+	}
+	return nil
+}
+
+// deliver sends msg to to right away.
+func (m *mailer) deliver(to []string, msg []byte) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, to, msg)
+}
+
+// commentMail renders the notification about c on p from
+// commentMailTemplate.
+func commentMail(from string, to []string, p Page, c Comment) ([]byte, error) {
+	data := struct {
+		Page    Page
+		Comment Comment
+		URL     string
+	}{p, c, absURL(p.URL()) + "#comment-" + c.ID}
+	msg, err := renderMail(commentMailTemplate, from, to, nil, data)
+	if err != nil {
+		return nil, fmt.Errorf("commentMail: %w", err)
+	}
+	return msg, nil
+}
+
+// renderMail renders the mail template name, which has a "subject" and a
+// "body" definition, with data into a message from from to to. headers
+// are added to the message header as they are.
+func renderMail(name, from string, to []string, headers []string, data interface{}) ([]byte, error) {
+	b, err := readTemplate(name)
+	if err != nil {
+		return nil, fmt.Errorf("renderMail: %w", err)
+	}
+	t, err := template.New(name).Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("renderMail: %w", err)
+	}
+	var subject, body bytes.Buffer
+	err = t.ExecuteTemplate(&subject, "subject", data)
+	if err == nil {
+		err = t.ExecuteTemplate(&body, "body", data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("renderMail: %w", err)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	for _, h := range headers {
+		msg.WriteString(h + "\r\n")
+	}
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+	return msg.Bytes(), nil
+}
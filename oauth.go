@@ -0,0 +1,625 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the login providers, which prefix the accounts linked to users
+// and comments, e.g. github:583231.
+const (
+	providerGitHub = "github"
+	providerGoogle = "google"
+	providerOIDC   = "oidc"
+)
+
+// googleIssuer is the OpenID Connect issuer of Google accounts.
+const googleIssuer = "https://accounts.google.com"
+
+// What a login with a provider is for: logging in to the admin area,
+// signing in to comment, or linking the account to the user following
+// oauthLink.
+const (
+	oauthAdmin   = "admin"
+	oauthComment = "comment"
+	oauthLink    = "link:"
+)
+
+// Cookies of the logins: the state of a login on its way through the
+// provider, the account a commenter signed in with, and the commenter's
+// name for the comment form's script.
+const (
+	oauthStateCookie    = "oauth_state"
+	commenterCookie     = "commenter"
+	commenterNameCookie = "commenter_name"
+)
+
+// oauthStateAge is how long a login may take at the provider, and
+// commenterAge how long commenters stay signed in.
+const (
+	oauthStateAge = 10 * time.Minute
+	commenterAge  = 30 * 24 * time.Hour
+)
+
+// oauthProvider is an OAuth 2.0 provider users log in with: GitHub, or an
+// OpenID Connect provider like Google, whose endpoints are discovered from
+// its issuer on first use.
+type oauthProvider struct {
+	Name         string
+	Title        string
+	clientID     string
+	clientSecret string
+	issuer       string
+
+	mutex    sync.Mutex
+	authURL  string
+	tokenURL string
+	userURL  string
+}
+
+// oauthIdentity is an account a provider vouched for. Account is the
+// provider name and the subject it identifies the account by.
+type oauthIdentity struct {
+	Account string `json:"account"`
+	Name    string `json:"name"`
+}
+
+// oauthState is kept in oauthStateCookie between sending the user to the
+// provider and the provider sending them back.
+type oauthState struct {
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+	Purpose  string `json:"purpose"`
+	Next     string `json:"next"`
+}
+
+// oauthLinkButton is a link starting a login with a provider.
+type oauthLinkButton struct {
+	Name  string
+	Title string
+	URL   string
+}
+
+// oauthProviders are the providers configured with -github-id, -google-id
+// and -oidc-issuer, set up in main.
+var oauthProviders []*oauthProvider
+
+var oauthClient = &http.Client{Timeout: 10 * time.Second}
+
+// newOAuthProviders returns the providers the flags configure.
+func newOAuthProviders() []*oauthProvider {
+	var ps []*oauthProvider
+	if *flagGitHubID != "" {
+		ps = append(ps, &oauthProvider{
+			Name:         providerGitHub,
+			Title:        "GitHub",
+			clientID:     *flagGitHubID,
+			clientSecret: *flagGitHubSecret,
+			authURL:      "https://github.com/login/oauth/authorize",
+			tokenURL:     "https://github.com/login/oauth/access_token",
+			userURL:      "https://api.github.com/user",
+		})
+	}
+	if *flagGoogleID != "" {
+		ps = append(ps, &oauthProvider{
+			Name:         providerGoogle,
+			Title:        "Google",
+			clientID:     *flagGoogleID,
+			clientSecret: *flagGoogleSecret,
+			issuer:       googleIssuer,
+		})
+	}
+	if *flagOIDCIssuer != "" {
+		ps = append(ps, &oauthProvider{
+			Name:         providerOIDC,
+			Title:        *flagOIDCName,
+			clientID:     *flagOIDCID,
+			clientSecret: *flagOIDCSecret,
+			issuer:       strings.TrimSuffix(*flagOIDCIssuer, "/"),
+		})
+	}
+	return ps
+}
+
+// findProvider returns the provider name, or nil.
+func findProvider(name string) *oauthProvider {
+	for _, p := range oauthProviders {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// providerTitle returns the title of the provider an account belongs to.
+func providerTitle(account string) string {
+	name, _, _ := strings.Cut(account, ":")
+	if p := findProvider(name); p != nil {
+		return p.Title
+	}
+	return name
+}
+
+// loginButtons returns the links starting a login for purpose with every
+// provider, going on to next afterwards.
+func loginButtons(purpose, next string) []oauthLinkButton {
+	var bs []oauthLinkButton
+	for _, p := range oauthProviders {
+		q := url.Values{"for": {purpose}, "next": {next}}
+		bs = append(bs, oauthLinkButton{Name: p.Name, Title: p.Title, URL: "/oauth/" + p.Name + "?" + q.Encode()})
+	}
+	return bs
+}
+
+// commentLogins returns the links signing in commenters on the page at
+// next, or nil without -oauth-comments. It is the logins template
+// function.
+func commentLogins(next string) []oauthLinkButton {
+	if !*flagOAuthComment {
+		return nil
+	}
+	return loginButtons(oauthComment, next)
+}
+
+// endpoints returns the authorization, token and user info endpoints of
+// p, discovering those of OpenID Connect providers once.
+func (p *oauthProvider) endpoints() (string, string, string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.authURL != "" {
+		return p.authURL, p.tokenURL, p.userURL, nil
+	}
+	resp, err := oauthClient.Get(p.issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", "", "", fmt.Errorf("oauthProvider.endpoints: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", "", fmt.Errorf("oauthProvider.endpoints: %s: %s", p.issuer, resp.Status)
+	}
+	var conf struct {
+		Issuer   string `json:"issuer"`
+		Auth     string `json:"authorization_endpoint"`
+		Token    string `json:"token_endpoint"`
+		UserInfo string `json:"userinfo_endpoint"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&conf)
+	if err != nil {
+		return "", "", "", fmt.Errorf("oauthProvider.endpoints: %w", err)
+	}
+	if strings.TrimSuffix(conf.Issuer, "/") != p.issuer || conf.Auth == "" || conf.Token == "" || conf.UserInfo == "" {
+		return "", "", "", fmt.Errorf("oauthProvider.endpoints: %s: incomplete configuration", p.issuer)
+	}
+	p.authURL, p.tokenURL, p.userURL = conf.Auth, conf.Token, conf.UserInfo
+	return p.authURL, p.tokenURL, p.userURL, nil
+}
+
+// redirectURI returns the URL p sends users back to, which has to be
+// registered with it.
+func (p *oauthProvider) redirectURI() string {
+	return absURL("/oauth/callback/" + p.Name)
+}
+
+// scope returns the scopes p is asked for: just enough to tell who the
+// user is.
+func (p *oauthProvider) scope() string {
+	if p.issuer == "" {
+		return "read:user"
+	}
+	return "openid profile email"
+}
+
+// exchange trades the authorization code for an access token.
+func (p *oauthProvider) exchange(code, verifier string) (string, error) {
+	_, tokenURL, _, err := p.endpoints()
+	if err != nil {
+		return "", fmt.Errorf("oauthProvider.exchange: %w", err)
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURI()},
+		"client_id":     {p.clientID},
+		"client_secret": {p.clientSecret},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("oauthProvider.exchange: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oauthProvider.exchange: %w", err)
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok)
+	if err != nil {
+		return "", fmt.Errorf("oauthProvider.exchange: %s: %w", resp.Status, err)
+	}
+	if tok.Error != "" || tok.AccessToken == "" {
+		return "", fmt.Errorf("oauthProvider.exchange: %s: %s %s", resp.Status, tok.Error, tok.Description)
+	}
+	return tok.AccessToken, nil
+}
+
+// identity asks p who the access token belongs to.
+func (p *oauthProvider) identity(token string) (oauthIdentity, error) {
+	_, _, userURL, err := p.endpoints()
+	if err != nil {
+		return oauthIdentity{}, fmt.Errorf("oauthProvider.identity: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, userURL, nil)
+	if err != nil {
+		return oauthIdentity{}, fmt.Errorf("oauthProvider.identity: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return oauthIdentity{}, fmt.Errorf("oauthProvider.identity: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return oauthIdentity{}, fmt.Errorf("oauthProvider.identity: %s", resp.Status)
+	}
+	var info struct {
+		// GitHub
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		// OpenID Connect
+		Sub      string `json:"sub"`
+		Username string `json:"preferred_username"`
+		Email    string `json:"email"`
+		// both
+		Name string `json:"name"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&info)
+	if err != nil {
+		return oauthIdentity{}, fmt.Errorf("oauthProvider.identity: %w", err)
+	}
+	subject, name := info.Sub, info.Name
+	if p.issuer == "" {
+		subject = ""
+		if info.ID != 0 {
+			subject = strconv.FormatInt(info.ID, 10)
+		}
+		if name == "" {
+			name = info.Login
+		}
+	}
+	for _, alt := range []string{info.Username, info.Email} {
+		if name == "" {
+			name = alt
+		}
+	}
+	if subject == "" {
+		return oauthIdentity{}, errors.New("oauthProvider.identity: no subject")
+	}
+	return oauthIdentity{Account: p.Name + ":" + subject, Name: name}, nil
+}
+
+// sealCookie returns v encoded and signed as value of the cookie name.
+func sealCookie(name string, v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("sealCookie: %w", err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + sign(name+"|"+payload), nil
+}
+
+// openCookie decodes the value of the cookie name sealed by sealCookie
+// into v and reports whether its signature holds.
+func openCookie(name, value string, v interface{}) bool {
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(sign(name+"|"+payload))) {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	return err == nil && json.Unmarshal(b, v) == nil
+}
+
+// localNext returns next if it is a path on this site, else "/".
+func localNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.ContainsAny(next, "\\\r\n") {
+		return "/"
+	}
+	return next
+}
+
+// startOAuth starts a login with p for purpose, which goes on to next
+// when it succeeded, and returns the URL at p to send the user to. The
+// state and the PKCE verifier of the login wait in oauthStateCookie for the
+// callback.
+func startOAuth(w http.ResponseWriter, r *http.Request, p *oauthProvider, purpose, next string) (string, error) {
+	authURL, _, _, err := p.endpoints()
+	if err != nil {
+		return "", fmt.Errorf("startOAuth: %w", err)
+	}
+	st := oauthState{Purpose: purpose, Next: next}
+	st.State, err = newSessionToken()
+	if err == nil {
+		st.Verifier, err = newSessionToken()
+	}
+	if err != nil {
+		return "", fmt.Errorf("startOAuth: %w", err)
+	}
+	value, err := sealCookie(oauthStateCookie, st)
+	if err != nil {
+		return "", fmt.Errorf("startOAuth: %w", err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    value,
+		Path:     "/oauth/",
+		MaxAge:   int(oauthStateAge / time.Second),
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {p.redirectURI()},
+		"scope":                 {p.scope()},
+		"state":                 {st.State},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(authURL, "?") {
+		sep = "&"
+	}
+	return authURL + sep + q.Encode(), nil
+}
+
+// commenterIdentity returns the account the commenter sending r signed in
+// with, if -oauth-comments is on.
+func commenterIdentity(r *http.Request) (oauthIdentity, bool) {
+	var id oauthIdentity
+	if !*flagOAuthComment {
+		return id, false
+	}
+	c, err := r.Cookie(commenterCookie)
+	if err != nil || !openCookie(commenterCookie, c.Value, &id) {
+		return id, false
+	}
+	return id, findProvider(strings.SplitN(id.Account, ":", 2)[0]) != nil
+}
+
+// setCommenterCookies signs the commenter in as id, or out if id is the
+// zero identity.
+func setCommenterCookies(w http.ResponseWriter, r *http.Request, id oauthIdentity) error {
+	value, name, maxAge := "", "", -1
+	if id.Account != "" {
+		var err error
+		value, err = sealCookie(commenterCookie, id)
+		if err != nil {
+			return fmt.Errorf("setCommenterCookies: %w", err)
+		}
+		name, maxAge = url.QueryEscape(id.Name), int(commenterAge/time.Second)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     commenterCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	// only for showing who is signed in, the comment handler ignores it
+	http.SetCookie(w, &http.Cookie{
+		Name:     commenterNameCookie,
+		Value:    name,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// makeOAuthHandlerFunc serves the logins with the -github-id, -google-id
+// and -oidc-issuer providers: GET /oauth/<provider>?for=admin|comment&next=
+// starts one, the provider sends the user back to
+// /oauth/callback/<provider>, and POST /oauth/signout signs commenters out.
+func makeOAuthHandlerFunc() http.HandlerFunc {
+	_, err := adminTemplates.get("admin/continue.tmpl.html")
+	if err != nil {
+		panic("makeOAuthHandlerFunc: could not parse admin/continue.tmpl.html")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		rest := r.URL.Path[len("/oauth/"):]
+		if rest == "signout" {
+			if r.Method != http.MethodPost {
+				renderError(w, r, http.StatusMethodNotAllowed)
+				return
+			}
+			if !parseForm(w, r) {
+				return
+			}
+			err := setCommenterCookies(w, r, oauthIdentity{})
+			if err != nil {
+				serverError(w, r, fmt.Errorf("makeOAuthHandlerFunc: %w", err))
+				return
+			}
+			http.Redirect(w, r, localNext(r.FormValue("next")), http.StatusSeeOther)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		if name, ok := strings.CutPrefix(rest, "callback/"); ok {
+			p := findProvider(name)
+			if p == nil {
+				notFound(w, r)
+				return
+			}
+			oauthCallback(w, r, p)
+			return
+		}
+		p := findProvider(rest)
+		if p == nil {
+			notFound(w, r)
+			return
+		}
+		purpose, next := r.URL.Query().Get("for"), r.URL.Query().Get("next")
+		switch {
+		case purpose == oauthAdmin && adminEnabled():
+			next = adminNext(next)
+		case purpose == oauthComment && *flagOAuthComment:
+			next = localNext(next)
+		default:
+			notFound(w, r)
+			return
+		}
+		u, err := startOAuth(w, r, p, purpose, next)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeOAuthHandlerFunc: %w", err))
+			return
+		}
+		http.Redirect(w, r, u, http.StatusFound)
+	}
+}
+
+// oauthCallback finishes a login with p once p sent the user back with
+// the authorization code, doing what the login was started for.
+func oauthCallback(w http.ResponseWriter, r *http.Request, p *oauthProvider) {
+	var st oauthState
+	c, err := r.Cookie(oauthStateCookie)
+	if err != nil || !openCookie(oauthStateCookie, c.Value, &st) {
+		reqLogger(r).Info("oauth login without state", "provider", p.Name)
+		renderError(w, r, http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/oauth/", MaxAge: -1})
+	q := r.URL.Query()
+	if !hmac.Equal([]byte(q.Get("state")), []byte(st.State)) {
+		reqLogger(r).Warn("oauth login with wrong state", "provider", p.Name)
+		renderError(w, r, http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		reqLogger(r).Info("oauth login refused", "provider", p.Name, "error", e)
+		if st.Purpose == oauthComment {
+			http.Redirect(w, r, st.Next, http.StatusFound)
+			return
+		}
+		renderAdminLoginError(w, r, "Logging in with "+p.Title+" was cancelled.")
+		return
+	}
+	token, err := p.exchange(q.Get("code"), st.Verifier)
+	if err != nil {
+		logError(r, fmt.Errorf("oauthCallback: %w", err))
+		renderError(w, r, http.StatusBadGateway)
+		return
+	}
+	id, err := p.identity(token)
+	if err != nil {
+		logError(r, fmt.Errorf("oauthCallback: %w", err))
+		renderError(w, r, http.StatusBadGateway)
+		return
+	}
+	switch {
+	case st.Purpose == oauthComment:
+		err = setCommenterCookies(w, r, id)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("oauthCallback: %w", err))
+			return
+		}
+		reqLogger(r).Info("commenter signed in", "account", id.Account)
+		http.Redirect(w, r, st.Next+"#commentform", http.StatusFound)
+	case st.Purpose == oauthAdmin:
+		oauthAdminLogin(w, r, p, id, st.Next)
+	case strings.HasPrefix(st.Purpose, oauthLink):
+		oauthLinkAccount(w, r, p, id, strings.TrimPrefix(st.Purpose, oauthLink))
+	default:
+		renderError(w, r, http.StatusBadRequest)
+	}
+}
+
+// continueAdmin sends the browser on to next with a page refreshing to
+// it. A redirect would do, but the session cookie is SameSite=Strict and
+// not sent with redirects coming from a provider, and the admin pages'
+// form-action policy forbids forms redirecting to one.
+func continueAdmin(w http.ResponseWriter, r *http.Request, next string) {
+	data := struct {
+		adminPage
+		URL string
+	}{adminPage{Title: "Continue"}, next}
+	renderAdmin(w, r, http.StatusOK, "admin/continue.tmpl.html", data)
+}
+
+// oauthAdminLogin logs the user linked to id in to the admin area.
+func oauthAdminLogin(w http.ResponseWriter, r *http.Request, p *oauthProvider, id oauthIdentity, next string) {
+	us, err := loadUsers(*flagUsers)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("oauthAdminLogin: %w", err))
+		return
+	}
+	u, ok := us.byAccount(id.Account)
+	if !ok {
+		reqLogger(r).Warn("admin login with unlinked account", "account", id.Account)
+		renderAdminLoginError(w, r, "No user is linked to this "+p.Title+" account.")
+		return
+	}
+	token, as, err := adminSessions.create(u, id.Account)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("oauthAdminLogin: %w", err))
+		return
+	}
+	setSessionCookie(w, r, token, as.Expires)
+	reqLogger(r).Info("admin login", "user", u.Name, "account", id.Account)
+	continueAdmin(w, r, next)
+}
+
+// oauthLinkAccount links id to the user name, unless another user has it.
+func oauthLinkAccount(w http.ResponseWriter, r *http.Request, p *oauthProvider, id oauthIdentity, name string) {
+	us, err := loadUsers(*flagUsers)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("oauthLinkAccount: %w", err))
+		return
+	}
+	u, ok := us[name]
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	if other, ok := us.byAccount(id.Account); ok && other.Name != name {
+		reqLogger(r).Warn("account linked to another user", "account", id.Account, "user", other.Name)
+		renderError(w, r, http.StatusConflict)
+		return
+	}
+	if !u.linked(id.Account) {
+		u.Accounts = append(u.Accounts, id.Account)
+		us[name] = u
+		err = saveUsers(*flagUsers, us)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("oauthLinkAccount: %w", err))
+			return
+		}
+	}
+	reqLogger(r).Info("account linked", "user", name, "account", id.Account, "provider", p.Name)
+	continueAdmin(w, r, "/admin/account")
+}
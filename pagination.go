@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Pagination is one page of a post listing together with the links to its
+// neighbors. Prev and Next are empty on the first and last page.
+type Pagination struct {
+	Pages  Pages
+	Number int
+	Total  int
+	Prev   string
+	Next   string
+}
+
+// paginate returns page n (starting at 1) of ps with size posts per page.
+// ok is false if n is out of range. An empty listing has a single page.
+func paginate(ps Pages, n, size int, base string) (Pagination, bool) {
+	if size <= 0 {
+		size = len(ps)
+	}
+	total := 1
+	if size > 0 && len(ps) > 0 {
+		total = (len(ps) + size - 1) / size
+	}
+	if n < 1 || n > total {
+		return Pagination{}, false
+	}
+	pg := Pagination{Number: n, Total: total}
+	start := (n - 1) * size
+	end := start + size
+	if end > len(ps) {
+		end = len(ps)
+	}
+	pg.Pages = ps[start:end]
+	if n > 1 {
+		pg.Prev = pageURL(base, n-1)
+	}
+	if n < total {
+		pg.Next = pageURL(base, n+1)
+	}
+	return pg, true
+}
+
+func pageURL(base string, n int) string {
+	if n == 1 {
+		return base
+	}
+	return base + "?page=" + strconv.Itoa(n)
+}
+
+// pageNumber reads the page query parameter, defaulting to 1. ok is false
+// for values that are no number; numbers out of range are left to
+// paginate.
+func pageNumber(r *http.Request) (n int, ok bool) {
+	v := r.URL.Query().Get("page")
+	if v == "" {
+		return 1, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Types of comments received as pingbacks and trackbacks.
+const (
+	commentPingback  = "pingback"
+	commentTrackback = "trackback"
+)
+
+// Fault codes of pingback.ping, as the Pingback 1.0 spec defines them,
+// and of XML-RPC itself.
+const (
+	pingbackError      = 0
+	pingbackNoSource   = 16
+	pingbackNoLink     = 17
+	pingbackNoTarget   = 32
+	pingbackRegistered = 48
+	xmlrpcNoMethod     = -32601
+)
+
+// Errors of receivePing answered as they are, whatever their cause: what
+// went wrong fetching the source or storing the ping stays in the log, as
+// it would tell callers about the network and the storage of the blog.
+var (
+	errPingSource = errors.New("the source could not be fetched")
+	errPingStore  = errors.New("the ping could not be stored")
+)
+
+// pingMessage returns the message the failed call err is answered with.
+func pingMessage(err error) string {
+	for _, e := range []error{errPingSource, errPingStore} {
+		if errors.Is(err, e) {
+			return e.Error()
+		}
+	}
+	return err.Error()
+}
+
+// pingbackEndpoint returns the URL of the pingback endpoint, or "" if
+// pingbacks are off. It is the pingback template function.
+func pingbackEndpoint() string {
+	if *flagPingback == mentionsOff {
+		return ""
+	}
+	return absURL("/xmlrpc")
+}
+
+// xmlrpcCall is an XML-RPC request with string parameters.
+type xmlrpcCall struct {
+	MethodName string        `xml:"methodName"`
+	Params     []xmlrpcValue `xml:"params>param>value"`
+}
+
+// xmlrpcValue is a string parameter, given with or without its type.
+type xmlrpcValue struct {
+	String string `xml:"string"`
+	Text   string `xml:",chardata"`
+}
+
+func (v xmlrpcValue) value() string {
+	if v.String != "" {
+		return strings.TrimSpace(v.String)
+	}
+	return strings.TrimSpace(v.Text)
+}
+
+// xmlEscape returns s escaped for XML text.
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// writeXMLRPC replies with the XML-RPC response msg, or with the fault
+// code and msg if code is not nil.
+func writeXMLRPC(w http.ResponseWriter, code *int, msg string) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	if code == nil {
+		fmt.Fprintf(w, "<methodResponse><params><param><value><string>%s</string></value></param></params></methodResponse>\n", xmlEscape(msg))
+		return
+	}
+	fmt.Fprintf(w, "<methodResponse><fault><value><struct>"+
+		"<member><name>faultCode</name><value><int>%d</int></value></member>"+
+		"<member><name>faultString</name><value><string>%s</string></value></member>"+
+		"</struct></value></fault></methodResponse>\n", *code, xmlEscape(msg))
+}
+
+// receivePing verifies that source links to the post at target and stores
+// the ping of type kind from the site name, titled title. It returns the
+// pingback fault code and an error if it fails. The source is fetched
+// by mentions, from public addresses only.
+func receivePing(kind, source, target, name, title string) (int, error) {
+	if _, err := webURL(source); err != nil {
+		return pingbackNoSource, err
+	}
+	post := linkedPost(target)
+	if post == "" {
+		return pingbackNoTarget, errors.New("target is no post")
+	}
+	info, _, err := mentions.fetch(source)
+	if err != nil {
+		return pingbackNoSource, fmt.Errorf("%w: %v", errPingSource, err)
+	}
+	m := webmention{source: source, target: target, post: post}
+	if !info.linksTo(m) {
+		return pingbackNoLink, errors.New("source does not link to target")
+	}
+	if name == "" {
+		name = mentionName(source)
+	}
+	if title == "" {
+		title = info.title
+	}
+	c := Comment{Type: kind, Source: source, Name: name, Comment: title}
+	err = storeMention(post, c, true, *flagPingback == mentionsHold, false)
+	if errors.Is(err, errMentioned) {
+		return pingbackRegistered, err
+	}
+	if err != nil {
+		return pingbackError, fmt.Errorf("%w: %v", errPingStore, err)
+	}
+	return 0, nil
+}
+
+// makePingbackHandlerFunc serves /xmlrpc, which takes the pingback.ping
+// XML-RPC calls of blogs linking to a post. The link is verified before
+// the call is answered.
+func makePingbackHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if mentions == nil || *flagPingback == mentionsOff {
+			notFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		var call xmlrpcCall
+		err := xml.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormSize)).Decode(&call)
+		if err != nil {
+			renderError(w, r, http.StatusBadRequest)
+			return
+		}
+		if call.MethodName != "pingback.ping" || len(call.Params) != 2 {
+			code := xmlrpcNoMethod
+			writeXMLRPC(w, &code, "only pingback.ping is supported")
+			return
+		}
+		source, target := call.Params[0].value(), call.Params[1].value()
+		code, err := receivePing(commentPingback, source, target, "", "")
+		if err != nil {
+			reqLogger(r).Info("pingback rejected", "source", source, "target", target, "err", err)
+			writeXMLRPC(w, &code, pingMessage(err))
+			return
+		}
+		writeXMLRPC(w, nil, "Pingback from "+source+" to "+target+" registered.")
+	}
+}
+
+// writeTrackback replies with the trackback response, an error if err is
+// not nil.
+func writeTrackback(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	if err == nil {
+		io.WriteString(w, "<response><error>0</error></response>\n")
+		return
+	}
+	fmt.Fprintf(w, "<response><error>1</error><message>%s</message></response>\n", xmlEscape(pingMessage(err)))
+}
+
+// makeTrackbackHandlerFunc serves POST /trackback/<post> with the url of
+// the linking page, its title, excerpt and blog_name. The link is
+// verified like that of pingbacks.
+func makeTrackbackHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if mentions == nil || *flagPingback == mentionsOff {
+			notFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		post := r.URL.Path[len("/trackback/"):]
+		if !parseForm(w, r) {
+			return
+		}
+		p, _, ok := findPage(posts.published(), post)
+		if !ok || p.Name != post {
+			notFound(w, r)
+			return
+		}
+		source := r.FormValue("url")
+		title := r.FormValue("title")
+		if excerpt := cleanText(r.FormValue("excerpt")); excerpt != "" {
+			title = strings.TrimSpace(title + ": " + excerpt)
+		}
+		_, err := receivePing(commentTrackback, source, absURL(p.URL()), cleanText(r.FormValue("blog_name")), cleanText(title))
+		if err != nil {
+			reqLogger(r).Info("trackback rejected", "source", source, "post", post, "err", err)
+		}
+		writeTrackback(w, err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresCommentMigrations and postgresContentMigrations create and
+// update the tables of the comment and the content store in PostgreSQL,
+// like sqliteMigrations.
+var (
+	postgresCommentMigrations = []string{
+		`CREATE TABLE comments (
+			post      TEXT NOT NULL,
+			seq       INTEGER NOT NULL,
+			id        TEXT NOT NULL,
+			parent    TEXT NOT NULL DEFAULT '',
+			name      TEXT NOT NULL,
+			comment   TEXT NOT NULL,
+			status    TEXT NOT NULL DEFAULT '',
+			emailhash TEXT NOT NULL DEFAULT '',
+			time      TIMESTAMPTZ,
+			reports   INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (post, seq)
+		);
+		CREATE UNIQUE INDEX comments_id ON comments (post, id);`,
+		`ALTER TABLE comments ADD COLUMN type TEXT NOT NULL DEFAULT '';
+		ALTER TABLE comments ADD COLUMN source TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE comments ADD COLUMN reporters TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE comments ADD COLUMN account TEXT NOT NULL DEFAULT '';`,
+	}
+	postgresContentMigrations = []string{
+		`CREATE TABLE files (
+			name    TEXT PRIMARY KEY,
+			modtime TIMESTAMPTZ NOT NULL,
+			size    BIGINT NOT NULL,
+			data    BYTEA NOT NULL
+		);
+		CREATE TABLE rendered (
+			name      TEXT PRIMARY KEY,
+			modtime   TIMESTAMPTZ NOT NULL,
+			size      BIGINT NOT NULL,
+			renderkey TEXT NOT NULL,
+			title     TEXT NOT NULL,
+			slug      TEXT NOT NULL,
+			published TIMESTAMPTZ NOT NULL,
+			draft     BOOLEAN NOT NULL,
+			tags      TEXT NOT NULL,
+			page      TEXT NOT NULL
+		);
+		CREATE INDEX rendered_published ON rendered (published);`,
+		`DROP TABLE rendered;
+		CREATE TABLE rendered (
+			name      TEXT PRIMARY KEY,
+			modtime   TIMESTAMPTZ NOT NULL,
+			size      BIGINT NOT NULL,
+			renderkey TEXT NOT NULL,
+			page      TEXT NOT NULL
+		);`,
+	}
+)
+
+// postgres is the connection pool to -postgres shared by the comment and
+// the content store.
+var postgres struct {
+	once sync.Once
+	db   *sql.DB
+	err  error
+}
+
+// openPostgres returns the pool of connections to the database -postgres,
+// keeping up to -postgres-conns of them open.
+func openPostgres() (*sql.DB, error) {
+	postgres.once.Do(func() {
+		db, err := sql.Open("postgres", *flagPostgres)
+		if err == nil {
+			err = db.Ping()
+		}
+		if err != nil {
+			postgres.err = fmt.Errorf("openPostgres: %w", err)
+			return
+		}
+		db.SetMaxOpenConns(*flagPGConns)
+		db.SetMaxIdleConns(*flagPGConns)
+		db.SetConnMaxIdleTime(5 * time.Minute)
+		postgres.db = db
+	})
+	return postgres.db, postgres.err
+}
+
+// migratePostgres applies the migrations of component the database hasn't
+// seen yet, each in a transaction of its own. The versions are kept in
+// the table schema_versions; an advisory lock keeps instances starting at
+// the same time from migrating twice.
+func migratePostgres(db *sql.DB, component string, migrations []string) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_versions (
+		component TEXT PRIMARY KEY,
+		version   INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("migratePostgres: %w", err)
+	}
+	for {
+		done, err := migratePostgresStep(db, component, migrations)
+		if err != nil {
+			return fmt.Errorf("migratePostgres: %w", err)
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// migratePostgresStep applies the next migration of component, if there
+// is one left, and reports whether all are applied.
+func migratePostgresStep(db *sql.DB, component string, migrations []string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext('schema_versions'))")
+	if err != nil {
+		return false, err
+	}
+	var version int
+	err = tx.QueryRow("SELECT version FROM schema_versions WHERE component = $1", component).Scan(&version)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	if version >= len(migrations) {
+		return true, nil
+	}
+	_, err = tx.Exec(migrations[version])
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO schema_versions (component, version) VALUES ($1, $2)
+			ON CONFLICT (component) DO UPDATE SET version = excluded.version`, component, version+1)
+	}
+	if err != nil {
+		return false, fmt.Errorf("migration %s %d: %w", component, version+1, err)
+	}
+	return false, tx.Commit()
+}
+
+// openPostgresCommentStore returns the comment store in -postgres,
+// applying the pending migrations.
+func openPostgresCommentStore() (*sqlCommentStore, error) {
+	db, err := openPostgres()
+	if err != nil {
+		return nil, fmt.Errorf("openPostgresCommentStore: %w", err)
+	}
+	err = migratePostgres(db, "comments", postgresCommentMigrations)
+	if err != nil {
+		return nil, fmt.Errorf("openPostgresCommentStore: %w", err)
+	}
+	return &sqlCommentStore{db: db, pg: true}, nil
+}
+
+// openPostgresContentStore returns the content store in -postgres,
+// applying the pending migrations.
+func openPostgresContentStore() (*sqlContentStore, error) {
+	db, err := openPostgres()
+	if err != nil {
+		return nil, fmt.Errorf("openPostgresContentStore: %w", err)
+	}
+	err = migratePostgres(db, "content", postgresContentMigrations)
+	if err != nil {
+		return nil, fmt.Errorf("openPostgresContentStore: %w", err)
+	}
+	return &sqlContentStore{db: db, pg: true, renderKey: flagsKey()}, nil
+}
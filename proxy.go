@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// trustedProxies holds the networks of the reverse proxies whose
+// X-Forwarded-* headers are believed. It is set up in main from
+// -trusted-proxies.
+var trustedProxies []*net.IPNet
+
+// peerIP returns the IP address of the peer that sent r, which is the
+// proxy if there is one.
+func peerIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// trustedPeer reports whether r was sent by a trusted proxy: a peer in
+// trustedProxies or, with -trusted-proxies set, any peer of the unix domain
+// socket of -listen, which only local processes can reach.
+func trustedPeer(r *http.Request) bool {
+	if len(trustedProxies) == 0 {
+		return false
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return true
+	}
+	return inNets(trustedProxies, peerIP(r))
+}
+
+// firstValue returns the first of the comma separated values of the
+// header name of r.
+func firstValue(r *http.Request, name string) string {
+	v, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(v)
+}
+
+// clientIP returns the IP address r was sent from. Behind trusted proxies
+// it is the address the last of them got the request from, following
+// X-Forwarded-For from the right until an untrusted address.
+func clientIP(r *http.Request) string {
+	ip := peerIP(r)
+	if !trustedPeer(r) {
+		return ip
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !inNets(trustedProxies, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// requestScheme returns the scheme the client used for r, "https" or
+// "http", as told by X-Forwarded-Proto behind a trusted proxy.
+func requestScheme(r *http.Request) string {
+	if trustedPeer(r) {
+		if p := strings.ToLower(firstValue(r, "X-Forwarded-Proto")); p == "http" || p == "https" {
+			return p
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestHost returns the host the client sent r to, as told by
+// X-Forwarded-Host behind a trusted proxy.
+func requestHost(r *http.Request) string {
+	if trustedPeer(r) {
+		if h := firstValue(r, "X-Forwarded-Host"); h != "" {
+			return h
+		}
+	}
+	return r.Host
+}
+
+// canonicalRedirect redirects requests the client sent to another scheme
+// or host than that of base to the same path there. The health checks are
+// left alone for monitoring reaching the server directly.
+func canonicalRedirect(base *url.URL) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" ||
+				(requestScheme(r) == base.Scheme && strings.EqualFold(requestHost(r), base.Host)) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			http.Redirect(w, r, base.Scheme+"://"+base.Host+r.URL.RequestURI(), http.StatusMovedPermanently)
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// nonPublicNets are the networks besides the private, loopback, link-local
+// and multicast ones that are not reachable on the internet.
+var nonPublicNets = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// publicAddr reports whether ip is an address of the internet.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublic is the Control of the dialer of publicClient. It runs once
+// the host is resolved, for every address tried, so names resolving to an
+// address of the blog's own network are turned down as well.
+func dialPublic(network, address string, c syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("dialPublic: %w", err)
+	}
+	if !publicAddr(ap.Addr()) {
+		return fmt.Errorf("dialPublic: %s is not a public address", ap.Addr())
+	}
+	return nil
+}
+
+// publicClient returns a client for the URLs others give the blog, like
+// the actors of ActivityPub or the sources of webmentions. It connects to
+// public addresses only, also when redirected, so these URLs can't make
+// the blog reach services of its own network. Proxies of the environment
+// are not used, as they would connect in its place.
+func publicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second, Control: dialPublic}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: t}
+}
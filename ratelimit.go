@@ -0,0 +1,217 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket: it holds up to the limiter's burst tokens and
+// is refilled at its rate.
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// limiter rate limits by key, e.g. client IP, with a token bucket each.
+// The buckets are kept in the order they were last used, so full ones and,
+// past maxBuckets, the least recently used ones are dropped from the back
+// without going through all of them.
+type limiter struct {
+	mutex   sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*list.Element
+	used    *list.List
+}
+
+// maxBuckets is the number of buckets a limiter keeps at most.
+const maxBuckets = 10000
+
+// newLimiter returns a limiter allowing n events per period, all of them at
+// once if the bucket is full.
+func newLimiter(n int, period time.Duration) *limiter {
+	return &limiter{
+		rate:    float64(n) / period.Seconds(),
+		burst:   float64(n),
+		buckets: map[string]*list.Element{},
+		used:    list.New(),
+	}
+}
+
+// allow takes a token from the bucket of key. If it is empty, allow
+// returns false and how long until the next token is available.
+func (l *limiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for e := l.used.Back(); e != nil && l.refill(e.Value.(*bucket), now) >= l.burst; e = l.used.Back() {
+		l.drop(e)
+	}
+	var b *bucket
+	if e, ok := l.buckets[key]; ok {
+		l.used.MoveToFront(e)
+		b = e.Value.(*bucket)
+	} else {
+		if len(l.buckets) >= maxBuckets {
+			l.drop(l.used.Back())
+		}
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.used.PushFront(b)
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// blocked reports whether the bucket of key is empty, without taking a
+// token, and how long until the next token is available.
+func (l *limiter) blocked(key string, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	e, ok := l.buckets[key]
+	if !ok {
+		return false, 0
+	}
+	if tokens := l.refill(e.Value.(*bucket), now); tokens < 1 {
+		return true, time.Duration((1 - tokens) / l.rate * float64(time.Second))
+	}
+	return false, 0
+}
+
+func (l *limiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+// drop removes the bucket of e. The mutex has to be held.
+func (l *limiter) drop(e *list.Element) {
+	l.used.Remove(e)
+	delete(l.buckets, e.Value.(*bucket).key)
+}
+
+// rateKey returns the key the client at the IP address ip is limited by.
+// IPv6 clients get a /64 each, so a host can't dodge the limits by using
+// the other addresses of its network.
+func rateKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	if addr = addr.Unmap(); addr.Is4() {
+		return addr.String()
+	}
+	p, err := addr.Prefix(64)
+	if err != nil {
+		return ip
+	}
+	return p.String()
+}
+
+// parseRate parses a limit like "5/10m", five events per ten minutes. An
+// empty string or a count of 0 disables the limit and returns nil.
+func parseRate(s string) (*limiter, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ns, ps, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(ns)
+	if !ok || err != nil || n < 0 {
+		return nil, fmt.Errorf("parseRate: invalid rate %q", s)
+	}
+	period, err := time.ParseDuration(ps)
+	if err != nil || period <= 0 {
+		return nil, fmt.Errorf("parseRate: invalid period in %q", s)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	return newLimiter(n, period), nil
+}
+
+// parseRouteRates parses comma separated route=rate pairs like
+// "/=60/1m,/tag/=30/1m" into a limiter per route pattern.
+func parseRouteRates(s string) (map[string]*limiter, error) {
+	limits := map[string]*limiter{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		route, rate, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("parseRouteRates: missing rate in %q", pair)
+		}
+		l, err := parseRate(rate)
+		if err != nil {
+			return nil, fmt.Errorf("parseRouteRates: %w", err)
+		}
+		limits[route] = l
+	}
+	return limits, nil
+}
+
+// rateExempt holds the networks whose clients are never rate limited,
+// e.g. monitoring or a proxy that doesn't pass on client addresses. It is
+// set up in main from -rate-exempt.
+var rateExempt []*net.IPNet
+
+// parseNets parses a comma separated list of IP addresses and CIDR
+// networks.
+func parseNets(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, fmt.Errorf("parseNets: invalid IP address %q", f)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, fmt.Errorf("parseNets: %w", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// inNets reports whether the IP address ip is in one of nets.
+func inNets(nets []*net.IPNet, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// tooManyRequests replies with the 429 page, telling the client when to
+// retry.
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retry time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	renderError(w, r, http.StatusTooManyRequests)
+}
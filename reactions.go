@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// counterStore is implemented by comment stores that also count the views
+// of posts and the reactions readers leave on them. Without one neither
+// is counted.
+type counterStore interface {
+	countView(post string) error
+	views(post string) (int64, error)
+	react(post, reaction string) error
+	reactions(post string) (map[string]int64, error)
+}
+
+// counters returns commentStore as a counterStore, or nil if it counts
+// nothing.
+func counters() counterStore {
+	cs, _ := commentStore.(counterStore)
+	return cs
+}
+
+// Reaction is a reaction offered below a post with the number of readers
+// who chose it.
+type Reaction struct {
+	Emoji string
+	Count int64
+}
+
+// reactionChoices returns the reactions of -reactions.
+func reactionChoices() []string {
+	var rs []string
+	for _, r := range strings.Split(*flagReactions, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+// withReactions returns p with the counts of all -reactions, if the comment
+// store counts them.
+func withReactions(p Page) (Page, error) {
+	cs := counters()
+	choices := reactionChoices()
+	if cs == nil || len(choices) == 0 {
+		return p, nil
+	}
+	counts, err := cs.reactions(p.Name)
+	if err != nil {
+		return p, fmt.Errorf("withReactions: %w", err)
+	}
+	p.Reactions = nil
+	for _, r := range choices {
+		p.Reactions = append(p.Reactions, Reaction{Emoji: r, Count: counts[r]})
+	}
+	return p, nil
+}
+
+// withViews returns ps with the views of every page, if the comment store
+// counts them. Page views are not part of rendered pages, so they don't
+// change their ETags.
+func withViews(ps Pages) (Pages, error) {
+	cs := counters()
+	if cs == nil {
+		return ps, nil
+	}
+	for i := range ps {
+		n, err := cs.views(ps[i].Name)
+		if err != nil {
+			return nil, fmt.Errorf("withViews: %w", err)
+		}
+		ps[i].Views = n
+	}
+	return ps, nil
+}
+
+// countView counts a view of the post p requested with r, logging
+// failures. The static export does not count.
+func countView(r *http.Request, p Page) {
+	cs := counters()
+	if cs == nil || r.Method != http.MethodGet || exporting(r) {
+		return
+	}
+	err := cs.countView(p.Name)
+	if err != nil {
+		logError(r, err)
+	}
+}
+
+// makeReactHandlerFunc serves POST /react/<post> with one of -reactions as
+// reaction and adds it to the post.
+func makeReactHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cs := counters()
+		if cs == nil || len(reactionChoices()) == 0 {
+			notFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		post := r.URL.Path[len("/react/"):]
+		if !parseForm(w, r) {
+			return
+		}
+		p, _, ok := findPage(posts.published(), post)
+		if !ok || p.Name != post {
+			notFound(w, r)
+			return
+		}
+		reaction := r.FormValue("reaction")
+		valid := false
+		for _, choice := range reactionChoices() {
+			valid = valid || choice == reaction
+		}
+		if !valid {
+			renderError(w, r, http.StatusBadRequest)
+			return
+		}
+		err := cs.react(post, reaction)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeReactHandlerFunc: %w", err))
+			return
+		}
+		http.Redirect(w, r, "/page/"+p.Slug+"#reactions", http.StatusFound)
+	}
+}
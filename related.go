@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// PageRef is a lightweight reference to another page, used where
+// embedding the full page would be wasteful or cyclic.
+type PageRef struct {
+	Slug  string
+	Title string
+}
+
+func (p Page) ref() PageRef {
+	return PageRef{Slug: p.Slug, Title: p.Title}
+}
+
+// linkNeighbors sets Prev to the next older and Next to the next newer
+// page. ps must be sorted newest first.
+func linkNeighbors(ps Pages) {
+	for i := range ps {
+		ps[i].Prev, ps[i].Next = nil, nil
+		if i+1 < len(ps) {
+			ref := ps[i+1].ref()
+			ps[i].Prev = &ref
+		}
+		if i > 0 {
+			ref := ps[i-1].ref()
+			ps[i].Next = &ref
+		}
+	}
+}
+
+// tagWeight is the score a single shared tag adds on top of the text
+// similarity, which itself ranges from 0 to 1.
+const tagWeight = 0.5
+
+// computeRelated fills Page.Related with the n most similar other pages,
+// scored by shared tags and TF-IDF cosine similarity of their text.
+func computeRelated(ps Pages, n int) {
+	if n <= 0 || len(ps) < 2 {
+		return
+	}
+	vecs := tfidf(ps)
+	for i := range ps {
+		type scored struct {
+			idx   int
+			score float64
+		}
+		var cands []scored
+		for j := range ps {
+			if i == j {
+				continue
+			}
+			s := cosine(vecs[i], vecs[j]) + tagWeight*float64(sharedTags(ps[i].Tags, ps[j].Tags))
+			if s > 0 {
+				cands = append(cands, scored{j, s})
+			}
+		}
+		sort.SliceStable(cands, func(a, b int) bool {
+			return cands[a].score > cands[b].score
+		})
+		ps[i].Related = nil
+		for k := 0; k < len(cands) && k < n; k++ {
+			ps[i].Related = append(ps[i].Related, ps[cands[k].idx].ref())
+		}
+	}
+}
+
+func sharedTags(a, b []string) int {
+	n := 0
+	for _, x := range a {
+		for _, y := range b {
+			if strings.EqualFold(x, y) {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// pageWords returns the lowercase words of a page's rendered text.
+func pageWords(p Page) []string {
+	return strings.FieldsFunc(strings.ToLower(plainText(p.Content)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func tfidf(ps Pages) []map[string]float64 {
+	df := map[string]int{}
+	tfs := make([]map[string]float64, len(ps))
+	for i, p := range ps {
+		tf := map[string]float64{}
+		for _, w := range pageWords(p) {
+			if len([]rune(w)) < 3 {
+				continue
+			}
+			tf[w]++
+		}
+		for w := range tf {
+			df[w]++
+		}
+		tfs[i] = tf
+	}
+	for _, tf := range tfs {
+		for w, c := range tf {
+			tf[w] = c * math.Log(float64(len(ps))/float64(df[w]))
+		}
+	}
+	return tfs
+}
+
+func cosine(a, b map[string]float64) float64 {
+	var dot, na, nb float64
+	for w, x := range a {
+		na += x * x
+		dot += x * b[w]
+	}
+	for _, y := range b {
+		nb += y * y
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
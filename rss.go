@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// rssFeed is an RSS 2.0 document.
+type rssFeed struct {
+	XMLName   xml.Name   `xml:"rss"`
+	Version   string     `xml:"version,attr"`
+	XMLNSAtom string     `xml:"xmlns:atom,attr,omitempty"`
+	Channel   rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string `xml:"title"`
+	Link          string `xml:"link"`
+	Description   string `xml:"description"`
+	LastBuildDate string `xml:"lastBuildDate,omitempty"`
+	// AtomLinks are the WebSub links to the hub and the feed itself.
+	AtomLinks []atomLink `xml:"atom:link"`
+	Items     []rssItem  `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        rssGUID  `xml:"guid"`
+	Description string   `xml:"description"`
+	PubDate     string   `xml:"pubDate,omitempty"`
+	Categories  []string `xml:"category"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// rssDate formats t for pubDate, or returns "" for the zero time.
+func rssDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC1123Z)
+}
+
+// writeRSS replies with the feed with channel c.
+func writeRSS(w http.ResponseWriter, c rssChannel) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	f := rssFeed{Version: "2.0", Channel: c}
+	if len(c.AtomLinks) > 0 {
+		f.XMLNSAtom = "http://www.w3.org/2005/Atom"
+	}
+	err := enc.Encode(f)
+	if err != nil {
+		return fmt.Errorf("writeRSS: %w", err)
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
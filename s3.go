@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3Client talks to a bucket of S3 or a compatible object storage like
+// MinIO, addressing it path style and signing requests with AWS
+// Signature Version 4.
+type s3Client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// s3Object is an entry of a bucket listing.
+type s3Object struct {
+	Key          string
+	LastModified time.Time
+	Size         int64
+}
+
+// parseS3URL splits a URL like https://s3.eu-central-1.amazonaws.com/bucket/blog/
+// into the client of the bucket and the key prefix, here "blog/". The
+// credentials are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func parseS3URL(raw, region string) (*s3Client, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, "", fmt.Errorf("parseS3URL: %w", err)
+	}
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if u.Host == "" || bucket == "" {
+		return nil, "", fmt.Errorf("parseS3URL: no bucket in %q", raw)
+	}
+	c := &s3Client{
+		endpoint:  &url.URL{Scheme: u.Scheme, Host: u.Host},
+		bucket:    bucket,
+		region:    region,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		client:    &http.Client{Timeout: time.Minute},
+	}
+	return c, prefix, nil
+}
+
+// list returns all objects whose key starts with prefix.
+func (c *s3Client) list(prefix string) ([]s3Object, error) {
+	var objs []s3Object
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		body, err := c.do(http.MethodGet, "", q, nil)
+		if err != nil {
+			return nil, fmt.Errorf("s3Client.list: %w", err)
+		}
+		var res struct {
+			Contents              []s3Object
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.Unmarshal(body, &res)
+		if err != nil {
+			return nil, fmt.Errorf("s3Client.list: %w", err)
+		}
+		objs = append(objs, res.Contents...)
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return objs, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// get returns the content of the object key.
+func (c *s3Client) get(key string) ([]byte, error) {
+	b, err := c.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("s3Client.get: %w", err)
+	}
+	return b, nil
+}
+
+// put stores b as the object key.
+func (c *s3Client) put(key string, b []byte) error {
+	_, err := c.do(http.MethodPut, key, nil, b)
+	if err != nil {
+		return fmt.Errorf("s3Client.put: %w", err)
+	}
+	return nil
+}
+
+// do sends a signed request with body for the object key, or the bucket
+// if key is empty, and returns the body of the response.
+func (c *s3Client) do(method, key string, q url.Values, body []byte) ([]byte, error) {
+	u := *c.endpoint
+	u.Path = "/" + c.bucket + "/" + key
+	u.RawPath = awsEscape(u.Path, true)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := emptySHA256
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	c.sign(req, payloadHash, time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, u.Path, resp.Status, b)
+	}
+	return b, nil
+}
+
+// emptySHA256 is the hex SHA-256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign adds the headers of AWS Signature Version 4 to req, whose payload
+// has the hex SHA-256 payloadHash, signing the host and all headers set.
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headers := map[string]string{"host": req.URL.Host}
+	for name, vs := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	canonical := strings.Join([]string{
+		req.Method, awsEscape(req.URL.Path, true), strings.Join(params, "&"),
+		canonHeaders.String(), signed, payloadHash,
+	}, "\n")
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{day, c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// awsEscape percent encodes everything but unreserved characters and,
+// with keepSlash, slashes, as AWS signatures require.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z' || '0' <= ch && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || ch == '/' && keepSlash {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+// s3Mirror keeps a local folder in sync with the objects below a prefix
+// of a bucket. Local files get the modification time of their object, so
+// unchanged objects are not downloaded again. The names of the files it
+// wrote are kept in the folder in s3Synced, so files put there by other
+// means are left alone.
+type s3Mirror struct {
+	client *s3Client
+	prefix string
+	dir    string
+	// mutex serializes syncs and puts, so a file put while the bucket is
+	// listed is not taken for one whose object is gone.
+	mutex sync.Mutex
+}
+
+// s3Synced is the file of a mirror's folder listing the files it wrote.
+const s3Synced = ".s3-synced.json"
+
+// filesMirror mirrors -files from the bucket with -s3-files, nil without.
+// Uploads are stored through it.
+var filesMirror *s3Mirror
+
+// loadSynced returns the names of the files m wrote, relative to its
+// folder with slashes.
+func (m *s3Mirror) loadSynced() (map[string]bool, error) {
+	synced := map[string]bool{}
+	b, err := os.ReadFile(filepath.Join(m.dir, s3Synced))
+	if errors.Is(err, os.ErrNotExist) {
+		return synced, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	err = json.Unmarshal(b, &names)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		synced[name] = true
+	}
+	return synced, nil
+}
+
+// saveSynced writes the names of the files m wrote to s3Synced.
+func (m *s3Mirror) saveSynced(synced map[string]bool) error {
+	names := make([]string, 0, len(synced))
+	for name := range synced {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b, err := json.MarshalIndent(names, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(m.dir, s3Synced), b, time.Now())
+}
+
+// sync downloads the objects that are new or changed since the last sync
+// and removes the files it wrote whose objects are gone.
+func (m *s3Mirror) sync() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	synced, err := m.loadSynced()
+	if err != nil {
+		return fmt.Errorf("s3Mirror.sync: %w", err)
+	}
+	objs, err := m.client.list(m.prefix)
+	if err != nil {
+		return fmt.Errorf("s3Mirror.sync: %w", err)
+	}
+	keep := map[string]bool{}
+	for _, o := range objs {
+		name := strings.TrimPrefix(o.Key, m.prefix)
+		if name == "" || strings.HasSuffix(name, "/") || name == s3Synced || !filepath.IsLocal(filepath.FromSlash(name)) {
+			continue
+		}
+		keep[name] = true
+		fpath := filepath.Join(m.dir, filepath.FromSlash(name))
+		fi, err := os.Stat(fpath)
+		if err == nil && fi.Size() == o.Size && fi.ModTime().Equal(o.LastModified) {
+			continue
+		}
+		b, err := m.client.get(o.Key)
+		if err != nil {
+			return fmt.Errorf("s3Mirror.sync: %w", err)
+		}
+		err = writeFileAtomic(fpath, b, o.LastModified)
+		if err != nil {
+			return fmt.Errorf("s3Mirror.sync: %w", err)
+		}
+		synced[name] = true
+	}
+	for name := range synced {
+		if keep[name] {
+			continue
+		}
+		err = os.Remove(filepath.Join(m.dir, filepath.FromSlash(name)))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("s3Mirror.sync: %w", err)
+		}
+		delete(synced, name)
+	}
+	err = m.saveSynced(synced)
+	if err != nil {
+		return fmt.Errorf("s3Mirror.sync: %w", err)
+	}
+	return nil
+}
+
+// put stores b as the file name of m, relative to its folder with
+// slashes: as object in the bucket, so the next sync keeps it, and in the
+// folder right away.
+func (m *s3Mirror) put(name string, b []byte, modified time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	err := m.client.put(m.prefix+name, b)
+	if err != nil {
+		return fmt.Errorf("s3Mirror.put: %w", err)
+	}
+	err = writeFileAtomic(filepath.Join(m.dir, filepath.FromSlash(name)), b, modified)
+	if err != nil {
+		return fmt.Errorf("s3Mirror.put: %w", err)
+	}
+	synced, err := m.loadSynced()
+	if err == nil {
+		synced[name] = true
+		err = m.saveSynced(synced)
+	}
+	if err != nil {
+		return fmt.Errorf("s3Mirror.put: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes b to fpath through a temporary file, so readers
+// never see it half written, and sets its modification time.
+func writeFileAtomic(fpath string, b []byte, modified time.Time) error {
+	err := os.MkdirAll(filepath.Dir(fpath), 0o755)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(fpath), ".sync-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Chtimes(f.Name(), modified, modified)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fpath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// syncEvery syncs m every interval until the process exits, logging
+// failures; the files of the last successful sync stay in place.
+func (m *s3Mirror) syncEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := m.sync()
+		if err != nil {
+			slog.Warn("syncing from S3 failed", "prefix", m.prefix, "err", err)
+		}
+	}
+}
+
+// openS3ContentStore mirrors the posts below the bucket URL -s3 into
+// -s3-cache and serves them from there, syncing every -s3-sync. If the
+// first sync fails the posts of an earlier run are served, if there are
+// any. With -s3-files the files folder is mirrored the same way, as
+// filesMirror.
+func openS3ContentStore() (ContentStore, error) {
+	c, prefix, err := parseS3URL(*flagS3URL, *flagS3Region)
+	if err != nil {
+		return nil, fmt.Errorf("openS3ContentStore: %w", err)
+	}
+	mirrors := []*s3Mirror{{client: c, prefix: prefix, dir: *flagS3Cache}}
+	if *flagS3Files != "" {
+		filesMirror = &s3Mirror{client: c, prefix: *flagS3Files, dir: *flagFilesFolder}
+		mirrors = append(mirrors, filesMirror)
+	}
+	for _, m := range mirrors {
+		err = m.sync()
+		if err != nil {
+			if _, serr := os.Stat(m.dir); serr != nil {
+				return nil, fmt.Errorf("openS3ContentStore: %w", err)
+			}
+			slog.Warn("syncing from S3 failed, serving the last copy", "prefix", m.prefix, "err", err)
+		}
+		go m.syncEvery(*flagS3Sync)
+	}
+	return newWatchedContentStore(*flagS3Cache), nil
+}
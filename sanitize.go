@@ -0,0 +1,79 @@
+package main
+
+import (
+	"html/template"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// contentPolicy is applied to all rendered page content. It starts from
+// bluemonday's UGC policy and admits the markup goblog itself generates:
+// highlighted code, math, footnotes, responsive images and the builtin
+// shortcodes. Operators who add shortcodes emitting other markup extend it
+// here.
+var contentPolicy = newContentPolicy()
+
+var mathMLElements = []string{
+	"math", "semantics", "annotation", "mrow", "mi", "mn", "mo", "ms",
+	"mtext", "mspace", "msup", "msub", "msubsup", "mfrac", "msqrt", "mroot",
+	"mover", "munder", "munderover", "mtable", "mtr", "mtd", "mstyle",
+	"mpadded", "mphantom", "menclose", "merror", "mprescripts",
+	"mmultiscripts", "none",
+}
+
+func newContentPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("id").Globally()
+	p.AllowAttrs("class").Globally()
+	p.AllowAttrs("role").Matching(regexp.MustCompile(`^doc-[a-z]+$`)).Globally()
+	p.AllowAttrs("title").Globally()
+	p.AllowElements("figure", "figcaption", "section")
+	p.AllowAttrs("srcset", "sizes", "loading", "width", "height").OnElements("img")
+	p.AllowAttrs("draggable").OnElements("img")
+	p.AllowAttrs("type", "checked", "disabled").OnElements("input")
+	p.AllowElements("input")
+
+	// inline styles emitted by the syntax highlighter
+	p.AllowStyles("color", "background-color", "font-weight", "font-style",
+		"text-decoration", "display", "width", "margin", "padding", "border",
+		"-webkit-text-size-adjust", "font-feature-settings").OnElements("span", "pre", "code", "math")
+
+	p.AllowIFrames(bluemonday.SandboxAllowScripts, bluemonday.SandboxAllowSameOrigin,
+		bluemonday.SandboxAllowPresentation, bluemonday.SandboxAllowPopups)
+	p.AllowAttrs("src").Matching(regexp.MustCompile(`^https://www\.youtube-nocookie\.com/embed/[\w-]+$`)).OnElements("iframe")
+	p.AllowAttrs("width", "height", "frameborder", "allowfullscreen").OnElements("iframe")
+
+	p.AllowNoAttrs().OnElements(mathMLElements...)
+	p.AllowAttrs("xmlns", "display", "encoding", "mathvariant", "stretchy",
+		"fence", "separator", "lspace", "rspace", "accent", "accentunder",
+		"linethickness", "columnalign", "rowalign", "columnspacing", "rowspacing",
+		"displaystyle", "scriptlevel", "largeop", "movablelimits", "symmetric",
+		"minsize", "maxsize", "form", "notation", "width", "height", "depth").OnElements(mathMLElements...)
+	return p
+}
+
+// commentPolicy is applied to comments. Unlike contentPolicy it only
+// admits the markdown subset commenters may use: paragraphs, emphasis,
+// links, code, quotes and lists. Links are marked nofollow.
+var commentPolicy = newCommentPolicy()
+
+func newCommentPolicy() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements("p", "br", "em", "strong", "del", "code", "pre",
+		"blockquote", "ul", "ol", "li")
+	p.AllowStandardURLs()
+	p.AllowAttrs("href").OnElements("a")
+	p.RequireNoFollowOnLinks(true)
+	p.RequireNoReferrerOnLinks(true)
+	return p
+}
+
+// sanitize runs rendered content through contentPolicy unless the
+// operator disabled it with -unsafe-html.
+func sanitize(content template.HTML) template.HTML {
+	if *flagUnsafeHTML {
+		return content
+	}
+	return template.HTML(contentPolicy.Sanitize(string(content)))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// scheduler signals on C when the earliest scheduled publish time is
+// reached, so the index can be reloaded without waiting for the next
+// regular refresh.
+type scheduler struct {
+	C chan struct{}
+
+	mutex sync.Mutex
+	next  time.Time
+	timer *time.Timer
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{C: make(chan struct{}, 1)}
+}
+
+// schedule arms the scheduler for t unless an earlier time is already
+// pending. Times in the past are ignored.
+func (s *scheduler) schedule(t time.Time) {
+	d := time.Until(t)
+	if d <= 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.next.IsZero() && !t.Before(s.next) {
+		return
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.next = t
+	s.timer = time.AfterFunc(d, s.fire)
+}
+
+func (s *scheduler) fire() {
+	s.mutex.Lock()
+	s.next = time.Time{}
+	s.timer = nil
+	s.mutex.Unlock()
+	select {
+	case s.C <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"path"
+)
+
+// sectionIndex is the optional file inside a section folder carrying the
+// section's title and description. It is not listed as a post.
+const sectionIndex = "_index.md"
+
+// Section is a subfolder of the content folder, e.g. notes or reviews.
+// Pages in the top level folder have the zero Section.
+type Section struct {
+	Path    string
+	Title   string
+	Content template.HTML
+}
+
+func (s Section) URL() string {
+	return "/" + s.Path + "/"
+}
+
+func loadSection(cs ContentStore, name string) (Section, error) {
+	s := Section{Path: name, Title: path.Base(name)}
+	b, _, err := cs.Get(path.Join(name, sectionIndex))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("loadSection: %w", err)
+	}
+	fm, body, err := parseFrontMatter(b)
+	if err != nil {
+		return s, fmt.Errorf("loadSection.parseFrontMatter: %w", err)
+	}
+	if fm.Title != "" {
+		s.Title = fm.Title
+	}
+	s.Content, err = renderMarkdown(body, *flagTypographer)
+	if err != nil {
+		return s, fmt.Errorf("loadSection.renderMarkdown: %w", err)
+	}
+	s.Content = sanitize(s.Content)
+	return s, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// headerTimeout is the time a client has to send the request headers,
+// which stops connections that never finish them from piling up.
+const headerTimeout = 10 * time.Second
+
+// newServer returns a server for handler on addr with the timeouts from
+// the flags.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: headerTimeout,
+		ReadTimeout:       *flagReadTimeout,
+		WriteTimeout:      *flagWriteTimeout,
+		IdleTimeout:       *flagIdleTimeout,
+	}
+}
+
+// serve runs listen, which starts srv on its listener, until SIGINT or
+// SIGTERM. Then srv stops accepting connections and running requests get
+// -shutdown-timeout to finish. After that the index stops, the queued
+// mails, webhooks, activities and webmentions are sent, and the stores
+// are closed. It returns an error only if srv could not be started.
+func serve(srv *http.Server, listen func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- listen()
+	}()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		return fmt.Errorf("serve: %w", err)
+	case sig := <-sigs:
+		slog.Info("shutting down", "signal", sig.String())
+	}
+	signal.Stop(sigs)
+	ctx, cancel := context.WithTimeout(context.Background(), *flagShutdownWait)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		slog.Error("shutdown failed", "err", err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("server failed", "err", err)
+	}
+	posts.stop()
+	if newsletter != nil {
+		newsletter.close()
+	}
+	if notifier != nil {
+		notifier.close()
+	}
+	if webhooks != nil {
+		webhooks.close()
+	}
+	if federation != nil {
+		federation.close()
+	}
+	if mentions != nil {
+		mentions.close()
+	}
+	if websub != nil {
+		websub.close()
+	}
+	err = commentStore.Close()
+	if err != nil {
+		slog.Error("closing comment store failed", "err", err)
+	}
+	if c, ok := contentStore.(io.Closer); ok {
+		err = c.Close()
+		if err != nil {
+			slog.Error("closing content store failed", "err", err)
+		}
+	}
+	return nil
+}
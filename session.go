@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionCookie is the cookie carrying the token of an admin session.
+const sessionCookie = "goblog_session"
+
+// sessionTokenBytes is the length of session and CSRF tokens before hex
+// encoding.
+const sessionTokenBytes = 32
+
+// adminSession is a login to the admin area. Account is the provider
+// account the user logged in with, if they did. CSRF is the token the
+// forms of the admin area send along, so other sites cannot post them.
+type adminSession struct {
+	User    User
+	Account string
+	CSRF    string
+	Expires time.Time
+}
+
+// valid reports whether the user of as is still the one of us that logged
+// in, so changing the password or role of a user, removing them or
+// unlinking the account they logged in with ends their sessions. Sessions
+// started with the -moderation-password last as long as there are no
+// users.
+func (as adminSession) valid(us Users) bool {
+	if as.User.Password == "" && as.Account == "" {
+		return len(us) == 0 && *flagModPassword != ""
+	}
+	u, ok := us[as.User.Name]
+	if !ok || u.Password != as.User.Password || u.Role != as.User.Role {
+		return false
+	}
+	return as.Account == "" || u.linked(as.Account)
+}
+
+// sessionStore keeps the admin sessions by token in memory, so a restart
+// logs everyone out.
+type sessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string]adminSession
+}
+
+var adminSessions = &sessionStore{sessions: map[string]adminSession{}}
+
+// newSessionToken returns a random token for a session.
+func newSessionToken() (string, error) {
+	b := make([]byte, sessionTokenBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// create starts a session of user, logged in with the provider account if
+// not "", lasting -admin-session and returns its token.
+func (s *sessionStore) create(user User, account string) (string, adminSession, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", adminSession{}, err
+	}
+	csrf, err := newSessionToken()
+	if err != nil {
+		return "", adminSession{}, err
+	}
+	now := time.Now()
+	as := adminSession{User: user, Account: account, CSRF: csrf, Expires: now.Add(*flagAdminSession)}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for t, old := range s.sessions {
+		if now.After(old.Expires) {
+			delete(s.sessions, t)
+		}
+	}
+	s.sessions[token] = as
+	return token, as, nil
+}
+
+// get returns the session of token unless it expired.
+func (s *sessionStore) get(token string) (adminSession, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	as, ok := s.sessions[token]
+	if !ok {
+		return as, false
+	}
+	if time.Now().After(as.Expires) {
+		delete(s.sessions, token)
+		return as, false
+	}
+	return as, true
+}
+
+// remove ends the session of token.
+func (s *sessionStore) remove(token string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, token)
+}
+
+// secureCookies reports whether cookies set in reply to r need HTTPS.
+func secureCookies(r *http.Request) bool {
+	return requestScheme(r) == "https" || strings.HasPrefix(*flagBaseURL, "https://")
+}
+
+// setSessionCookie sets the cookie of the session token, which only the
+// admin area gets. An empty token removes it.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	c := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/admin/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteStrictMode,
+	}
+	if token == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+// requestSession returns the session token and the session r belongs to.
+func requestSession(r *http.Request) (string, adminSession, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return "", adminSession{}, false
+	}
+	as, ok := adminSessions.get(c.Value)
+	return c.Value, as, ok
+}
+
+// sessionKey is the context key of the admin session of a request.
+type sessionKey struct{}
+
+// withSession returns r carrying the session as.
+func withSession(r *http.Request, as adminSession) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionKey{}, as))
+}
+
+// currentSession returns the session requireAdmin found for r.
+func currentSession(r *http.Request) adminSession {
+	as, _ := r.Context().Value(sessionKey{}).(adminSession)
+	return as
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var shortcodeRe = regexp.MustCompile(`\{\{<\s*([\w-]+)((?:[^>]|>[^}])*?)\s*>\}\}`)
+
+// builtinShortcodes are available without any configuration. Shortcodes in
+// the template folder with the same name replace them.
+var builtinShortcodes = map[string]string{
+	"youtube": `<div class="video"><iframe src="https://www.youtube-nocookie.com/embed/{{ .Get 0 "id" }}" ` +
+		`width="560" height="315" frameborder="0" allowfullscreen ` +
+		`sandbox="allow-scripts allow-same-origin allow-presentation allow-popups"></iframe></div>`,
+	"figure": `<figure><img src="{{ .Get 0 "src" }}" alt="{{ .Get 1 "caption" }}">` +
+		`{{ with .Get 1 "caption" }}<figcaption>{{ . }}</figcaption>{{ end }}</figure>`,
+}
+
+// shortcodes is the registry used while loading pages. It is set up in
+// main with setShortcodes and replaced when the templates change.
+var (
+	shortcodeMutex sync.RWMutex
+	shortcodes     = map[string]*template.Template{}
+)
+
+// setShortcodes loads the shortcodes of the template folders, the site's
+// taking precedence over the theme's. On failure the ones loaded before
+// are kept.
+func setShortcodes() error {
+	dirs := templateDirs()
+	var scDirs []string
+	for i := len(dirs) - 1; i >= 0; i-- {
+		scDirs = append(scDirs, filepath.Join(dirs[i], "shortcodes"))
+	}
+	scs, err := loadShortcodes(scDirs...)
+	if err != nil {
+		return fmt.Errorf("setShortcodes: %w", err)
+	}
+	shortcodeMutex.Lock()
+	shortcodes = scs
+	shortcodeMutex.Unlock()
+	return nil
+}
+
+// Shortcode is the data a shortcode template is executed with.
+type Shortcode struct {
+	Name   string
+	Args   []string
+	Params map[string]string
+}
+
+// Get returns the named parameter key, or else the positional argument i.
+func (s Shortcode) Get(i int, key string) string {
+	if v, ok := s.Params[key]; ok {
+		return v
+	}
+	if i >= 0 && i < len(s.Args) {
+		return s.Args[i]
+	}
+	return ""
+}
+
+// loadShortcodes returns the builtin shortcodes plus every
+// <name>.tmpl.html in the shortcodes folder of the compiled in templates
+// and of dirs, later dirs taking precedence. Missing dirs are not an
+// error.
+func loadShortcodes(dirs ...string) (map[string]*template.Template, error) {
+	scs := map[string]*template.Template{}
+	for name, src := range builtinShortcodes {
+		scs[name] = template.Must(template.New(name).Funcs(templateFuncs).Parse(src))
+	}
+	err := loadShortcodeDir(scs, defaultTemplates, "shortcodes")
+	if err != nil {
+		return scs, err
+	}
+	for _, dir := range dirs {
+		err := loadShortcodeDir(scs, os.DirFS(dir), ".")
+		if err != nil {
+			return scs, err
+		}
+	}
+	return scs, nil
+}
+
+func loadShortcodeDir(scs map[string]*template.Template, fsys fs.FS, dir string) error {
+	fs, err := fs.ReadDir(fsys, dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loadShortcodes: %w", err)
+	}
+	for _, f := range fs {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".tmpl.html") {
+			continue
+		}
+		name := strings.TrimSuffix(f.Name(), ".tmpl.html")
+		t, err := template.New(f.Name()).Funcs(templateFuncs).ParseFS(fsys, path.Join(dir, f.Name()))
+		if err != nil {
+			return fmt.Errorf("loadShortcodes: %w", err)
+		}
+		scs[name] = t
+	}
+	return nil
+}
+
+// expandShortcodes replaces every {{< name args >}} in the markdown src
+// with the output of its template. Fenced code blocks are left alone, as
+// are unknown shortcodes.
+func expandShortcodes(src []byte) ([]byte, error) {
+	var out bytes.Buffer
+	fence := ""
+	for _, line := range bytes.SplitAfter(src, []byte("\n")) {
+		trimmed := strings.TrimSpace(string(line))
+		switch {
+		case fence == "" && (strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")):
+			fence = trimmed[:3]
+		case fence != "" && strings.HasPrefix(trimmed, fence):
+			fence = ""
+		case fence == "":
+			var err error
+			line, err = expandLine(line)
+			if err != nil {
+				return nil, err
+			}
+		}
+		out.Write(line)
+	}
+	return out.Bytes(), nil
+}
+
+func expandLine(line []byte) ([]byte, error) {
+	var err error
+	res := shortcodeRe.ReplaceAllFunc(line, func(m []byte) []byte {
+		sub := shortcodeRe.FindSubmatch(m)
+		shortcodeMutex.RLock()
+		t, ok := shortcodes[string(sub[1])]
+		shortcodeMutex.RUnlock()
+		if !ok || err != nil {
+			return m
+		}
+		sc := Shortcode{Name: string(sub[1]), Params: map[string]string{}}
+		for _, a := range splitArgs(string(sub[2])) {
+			if k, v, ok := strings.Cut(a, "="); ok && !strings.HasPrefix(a, `"`) {
+				sc.Params[k] = strings.Trim(v, `"`)
+				continue
+			}
+			sc.Args = append(sc.Args, strings.Trim(a, `"`))
+		}
+		var buf bytes.Buffer
+		if e := t.Execute(&buf, sc); e != nil {
+			err = fmt.Errorf("expandShortcodes: %s: %w", sc.Name, e)
+			return m
+		}
+		return buf.Bytes()
+	})
+	return res, err
+}
+
+// splitArgs splits s at spaces outside of double quotes.
+func splitArgs(s string) []string {
+	var args []string
+	var cur strings.Builder
+	quoted := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			cur.WriteRune(r)
+		case r == ' ' && !quoted:
+			if cur.Len() > 0 {
+				args = append(args, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		args = append(args, cur.String())
+	}
+	return args
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// translit maps common non-ASCII letters to their ASCII spelling.
+var translit = map[rune]string{
+	'ä': "ae", 'ö': "oe", 'ü': "ue", 'ß': "ss",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'å': "a", 'æ': "ae",
+	'ç': "c", 'č': "c", 'ć': "c",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ě': "e",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+	'ñ': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ø': "o", 'œ': "oe",
+	'ř': "r", 'š': "s", 'ś': "s", 'ť': "t",
+	'ù': "u", 'ú': "u", 'û': "u", 'ů': "u",
+	'ý': "y", 'ÿ': "y", 'ž': "z", 'ź': "z", 'ż': "z",
+	'ł': "l", 'đ': "d", 'ð': "d", 'þ': "th",
+}
+
+// slugify turns s into a lowercase, hyphen separated URL segment.
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			b.WriteRune(r)
+			dash = false
+		case translit[r] != "":
+			b.WriteString(translit[r])
+			dash = false
+		case b.Len() > 0 && !dash:
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// pageSlug returns the slug a page asks for: the front matter slug, its
+// title or, if neither is set, the file name without extension.
+func pageSlug(p Page, fm FrontMatter) string {
+	s := slugify(fm.Slug)
+	if s == "" {
+		s = slugify(fm.Title)
+	}
+	if s == "" {
+		base := path.Base(p.Name)
+		s = slugify(strings.TrimSuffix(base, path.Ext(base)))
+	}
+	if s == "" {
+		s = "page"
+	}
+	return s
+}
+
+// dedupSlugs appends -2, -3, ... to slugs that are already taken so every
+// page has a unique URL.
+func dedupSlugs(ps Pages) {
+	seen := map[string]bool{}
+	for i := range ps {
+		s := ps[i].Slug
+		for n := 2; seen[s]; n++ {
+			s = ps[i].Slug + "-" + strconv.Itoa(n)
+		}
+		seen[s] = true
+		ps[i].Slug = s
+	}
+}
+
+// findPage looks up a page by slug. If only the legacy file name matches,
+// the page is returned with moved set so callers can redirect.
+func findPage(ps Pages, name string) (p Page, moved bool, ok bool) {
+	for _, p := range ps {
+		if p.Slug == name {
+			return p, false, true
+		}
+	}
+	for _, p := range ps {
+		if p.Name == name {
+			return p, true, true
+		}
+	}
+	return Page{}, false, false
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SpamVerdict is the outcome of a spam check.
+type SpamVerdict int
+
+const (
+	// spamHam comments are published right away.
+	spamHam SpamVerdict = iota
+	// spamSuspect comments are held or rejected depending on -spam.
+	spamSuspect
+	// spamBlatant comments are rejected without being stored.
+	spamBlatant
+)
+
+func (v SpamVerdict) String() string {
+	switch v {
+	case spamSuspect:
+		return "spam"
+	case spamBlatant:
+		return "blatant spam"
+	}
+	return "ham"
+}
+
+// SpamChecker decides whether a comment submitted with r to the post at
+// permalink is spam.
+type SpamChecker interface {
+	Check(r *http.Request, permalink string, c Comment) (SpamVerdict, error)
+}
+
+// spamChecker checks all new comments; nil accepts every comment. It is
+// set up in main from the -akismet-key flag.
+var spamChecker SpamChecker
+
+// Actions for suspected spam, selected with -spam.
+const (
+	spamHold   = "hold"
+	spamReject = "reject"
+)
+
+// checkSpam runs c through spamChecker and logs the decision. Comments
+// that cannot be checked are treated as suspected spam.
+func checkSpam(r *http.Request, permalink string, c Comment) SpamVerdict {
+	if spamChecker == nil {
+		return spamHam
+	}
+	v, err := spamChecker.Check(r, permalink, c)
+	if err != nil {
+		reqLogger(r).Error("spam check failed", "err", err)
+		v = spamSuspect
+	}
+	reqLogger(r).Info("spam check", "name", c.Name, "post", permalink, "verdict", v.String())
+	return v
+}
+
+// akismet checks comments with the Akismet API.
+type akismet struct {
+	key    string
+	blog   string
+	client *http.Client
+}
+
+func newAkismet(key, blog string) *akismet {
+	return &akismet{
+		key:    key,
+		blog:   blog,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Check implements SpamChecker. Akismet marks comments it is sure about
+// with a discard hint, those are blatant spam.
+func (a *akismet) Check(r *http.Request, permalink string, c Comment) (SpamVerdict, error) {
+	form := url.Values{
+		"blog":            {a.blog},
+		"user_ip":         {clientIP(r)},
+		"user_agent":      {r.UserAgent()},
+		"referrer":        {r.Referer()},
+		"permalink":       {permalink},
+		"comment_type":    {"comment"},
+		"comment_author":  {c.Name},
+		"comment_content": {c.Comment},
+		"blog_charset":    {"UTF-8"},
+	}
+	resp, err := a.client.PostForm("https://"+a.key+".rest.akismet.com/1.1/comment-check", form)
+	if err != nil {
+		return spamHam, fmt.Errorf("akismet.Check: %w", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return spamHam, fmt.Errorf("akismet.Check: %w", err)
+	}
+	switch strings.TrimSpace(string(b)) {
+	case "false":
+		return spamHam, nil
+	case "true":
+		if resp.Header.Get("X-akismet-pro-tip") == "discard" {
+			return spamBlatant, nil
+		}
+		return spamSuspect, nil
+	}
+	return spamHam, fmt.Errorf("akismet.Check: unexpected response %q: %s", b, resp.Header.Get("X-akismet-debug-help"))
+}
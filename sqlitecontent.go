@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// sqliteContentMigrations create and update the schema of the content
+// database, like sqliteMigrations. files holds the sources, rendered the
+// pages rendered from them. rendered is a cache, so its metadata columns,
+// which nothing queried, are dropped by recreating it.
+var sqliteContentMigrations = []string{
+	`CREATE TABLE files (
+		name    TEXT PRIMARY KEY,
+		modtime TIMESTAMP NOT NULL,
+		size    INTEGER NOT NULL,
+		data    BLOB NOT NULL
+	);
+	CREATE TABLE rendered (
+		name      TEXT PRIMARY KEY,
+		modtime   TIMESTAMP NOT NULL,
+		size      INTEGER NOT NULL,
+		renderkey TEXT NOT NULL,
+		title     TEXT NOT NULL,
+		slug      TEXT NOT NULL,
+		published TIMESTAMP NOT NULL,
+		draft     INTEGER NOT NULL,
+		tags      TEXT NOT NULL,
+		page      TEXT NOT NULL
+	);
+	CREATE INDEX rendered_published ON rendered (published);`,
+	`DROP TABLE rendered;
+	CREATE TABLE rendered (
+		name      TEXT PRIMARY KEY,
+		modtime   TIMESTAMP NOT NULL,
+		size      INTEGER NOT NULL,
+		renderkey TEXT NOT NULL,
+		page      TEXT NOT NULL
+	);`,
+}
+
+// sqlContentStore keeps the source files and the pages rendered from them
+// in an SQLite or, with pg set, a PostgreSQL database, filled with
+// -import-pages.
+type sqlContentStore struct {
+	db *sql.DB
+	pg bool
+	// renderKey identifies the flags pages were rendered with; pages
+	// rendered with others are rendered again.
+	renderKey string
+}
+
+// openSQLiteContentStore opens the database at fpath, creating it if
+// needed, and applies the pending migrations.
+func openSQLiteContentStore(fpath string) (*sqlContentStore, error) {
+	db, err := sql.Open("sqlite", fpath+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("openSQLiteContentStore: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	err = migrate(db, sqliteContentMigrations)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("openSQLiteContentStore: %w", err)
+	}
+	return &sqlContentStore{db: db, renderKey: flagsKey()}, nil
+}
+
+// renderFlags are the flags rendering a page depends on.
+var renderFlags = []string{
+	"markdown", "highlight", "emoji-svg", "typographer", "unsafe-html", "toc", "math", "mermaid", "mmdc",
+	"files", "imgwidths", "lazyimages", "excerptwords", "wpm", "comment-days",
+}
+
+// flagsKey hashes the values of renderFlags. Changes of the shortcode
+// templates are not covered.
+func flagsKey() string {
+	h := sha256.New()
+	for _, name := range renderFlags {
+		fmt.Fprintf(h, "%s=%s\n", name, flag.Lookup(name).Value)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *sqlContentStore) List() ([]ContentInfo, error) {
+	rows, err := s.db.Query("SELECT name, modtime, size FROM files ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("sqlContentStore.List: %w", err)
+	}
+	defer rows.Close()
+	var infos []ContentInfo
+	for rows.Next() {
+		var info ContentInfo
+		err = rows.Scan(&info.Name, &info.ModTime, &info.Size)
+		if err != nil {
+			return nil, fmt.Errorf("sqlContentStore.List: %w", err)
+		}
+		infos = append(infos, info)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("sqlContentStore.List: %w", err)
+	}
+	return infos, nil
+}
+
+func (s *sqlContentStore) Get(name string) ([]byte, ContentInfo, error) {
+	info := ContentInfo{Name: name}
+	var b []byte
+	err := s.db.QueryRow(rebind(s.pg, "SELECT modtime, size, data FROM files WHERE name = ?"), name).Scan(&info.ModTime, &info.Size, &b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ContentInfo{}, fmt.Errorf("sqlContentStore.Get: %s: %w", name, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, ContentInfo{}, fmt.Errorf("sqlContentStore.Get: %w", err)
+	}
+	return b, info, nil
+}
+
+func (s *sqlContentStore) put(name string, b []byte) error {
+	_, err := s.db.Exec(rebind(s.pg, `INSERT INTO files (name, modtime, size, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET modtime = excluded.modtime, size = excluded.size, data = excluded.data`),
+		name, time.Now().UTC(), len(b), b)
+	if err != nil {
+		return fmt.Errorf("sqlContentStore.put: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlContentStore) remove(name string) error {
+	res, err := s.db.Exec(rebind(s.pg, "DELETE FROM files WHERE name = ?"), name)
+	if err == nil {
+		var n int64
+		n, err = res.RowsAffected()
+		if err == nil && n == 0 {
+			err = fmt.Errorf("%s: %w", name, os.ErrNotExist)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("sqlContentStore.remove: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlContentStore) Watch() <-chan struct{} {
+	return pollChanges(s.List)
+}
+
+func (s *sqlContentStore) Close() error {
+	return s.db.Close()
+}
+
+// loadRendered returns the page rendered from the file info, if it was
+// rendered from the file as it is now and with the current flags.
+func (s *sqlContentStore) loadRendered(info ContentInfo) (Page, bool) {
+	var src ContentInfo
+	var key, data string
+	err := s.db.QueryRow(rebind(s.pg, "SELECT modtime, size, renderkey, page FROM rendered WHERE name = ?"), info.Name).Scan(&src.ModTime, &src.Size, &key, &data)
+	if err != nil || !src.ModTime.Equal(info.ModTime) || src.Size != info.Size || key != s.renderKey {
+		return Page{}, false
+	}
+	var p Page
+	if json.Unmarshal([]byte(data), &p) != nil {
+		return Page{}, false
+	}
+	return p, true
+}
+
+// storeRendered keeps p, rendered from the file info, for loadRendered.
+func (s *sqlContentStore) storeRendered(info ContentInfo, p Page) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("sqlContentStore.storeRendered: %w", err)
+	}
+	_, err = s.db.Exec(rebind(s.pg, `INSERT INTO rendered (name, modtime, size, renderkey, page) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET modtime = excluded.modtime, size = excluded.size, renderkey = excluded.renderkey,
+			page = excluded.page`),
+		info.Name, info.ModTime, info.Size, s.renderKey, string(b))
+	if err != nil {
+		return fmt.Errorf("sqlContentStore.storeRendered: %w", err)
+	}
+	return nil
+}
+
+// importPages replaces the files of s by those of the folder dir and
+// renders all of them again. It returns the number of imported files.
+func importPages(dir string, s *sqlContentStore) (int, error) {
+	src := newFileContentStore(dir)
+	infos, err := src.List()
+	if err != nil {
+		return 0, fmt.Errorf("importPages: %w", err)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("importPages: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM files")
+	if err != nil {
+		return 0, fmt.Errorf("importPages: %w", err)
+	}
+	for _, info := range infos {
+		b, _, err := src.Get(info.Name)
+		if err != nil {
+			return 0, fmt.Errorf("importPages: %w", err)
+		}
+		_, err = tx.Exec(rebind(s.pg, "INSERT INTO files (name, modtime, size, data) VALUES (?, ?, ?, ?)"), info.Name, info.ModTime, info.Size, b)
+		if err != nil {
+			return 0, fmt.Errorf("importPages: %w", err)
+		}
+	}
+	_, err = tx.Exec("DELETE FROM rendered")
+	if err != nil {
+		return 0, fmt.Errorf("importPages: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("importPages: %w", err)
+	}
+	_, err = loadAllPages(s)
+	if err != nil {
+		slog.Warn("rendering imported pages failed", "err", err)
+	}
+	return len(infos), nil
+}
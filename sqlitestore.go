@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations create and update the schema of the comment database.
+// Migration i brings the database from user_version i to i+1; new ones
+// are only ever appended.
+var sqliteMigrations = []string{
+	`CREATE TABLE comments (
+		post    TEXT NOT NULL,
+		seq     INTEGER NOT NULL,
+		id      TEXT NOT NULL,
+		parent  TEXT NOT NULL DEFAULT '',
+		name    TEXT NOT NULL,
+		comment TEXT NOT NULL,
+		status  TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (post, seq)
+	);
+	CREATE UNIQUE INDEX comments_id ON comments (post, id);`,
+	`ALTER TABLE comments ADD COLUMN emailhash TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE comments ADD COLUMN time TIMESTAMP;`,
+	`ALTER TABLE comments ADD COLUMN reports INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE comments ADD COLUMN type TEXT NOT NULL DEFAULT '';
+	ALTER TABLE comments ADD COLUMN source TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE comments ADD COLUMN reporters TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE comments ADD COLUMN account TEXT NOT NULL DEFAULT '';`,
+}
+
+// sqlCommentStore keeps all comments in one table of an SQLite or, with
+// pg set, a PostgreSQL database.
+type sqlCommentStore struct {
+	db *sql.DB
+	pg bool
+}
+
+// rebind turns the ? placeholders of query into the $1, $2, ... of
+// PostgreSQL if pg is set.
+func rebind(pg bool, query string) string {
+	if !pg {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// openSQLiteCommentStore opens the database at fpath, creating it if
+// needed, and applies the pending migrations.
+func openSQLiteCommentStore(fpath string) (*sqlCommentStore, error) {
+	db, err := sql.Open("sqlite", fpath+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("openSQLiteCommentStore: %w", err)
+	}
+	// a single connection serializes the writers
+	db.SetMaxOpenConns(1)
+	err = migrate(db, sqliteMigrations)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("openSQLiteCommentStore: %w", err)
+	}
+	return &sqlCommentStore{db: db}, nil
+}
+
+// migrate applies the migrations the database hasn't seen yet, each in a
+// transaction of its own.
+func migrate(db *sql.DB, migrations []string) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+		_, err = tx.Exec(migrations[i])
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrate: migration %d: %w", i+1, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+	}
+	return nil
+}
+
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func loadSQLComments(q querier, pg bool, post string) ([]Comment, error) {
+	rows, err := q.Query(rebind(pg, `SELECT id, parent, name, comment, status, emailhash, time, reports, type, source, reporters, account
+		FROM comments WHERE post = ? ORDER BY seq`), post)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cs []Comment
+	for rows.Next() {
+		var c Comment
+		var t sql.NullTime
+		var reporters string
+		err = rows.Scan(&c.ID, &c.ParentID, &c.Name, &c.Comment, &c.Status, &c.EmailHash, &t, &c.Reports, &c.Type, &c.Source, &reporters, &c.Account)
+		if err != nil {
+			return nil, err
+		}
+		c.Time = t.Time
+		if reporters != "" {
+			c.Reporters = strings.Split(reporters, ",")
+		}
+		cs = append(cs, c)
+	}
+	return cs, rows.Err()
+}
+
+func (s *sqlCommentStore) Load(post string) ([]Comment, error) {
+	cs, err := loadSQLComments(s.db, s.pg, post)
+	if err != nil {
+		return nil, fmt.Errorf("sqlCommentStore.Load: %w", err)
+	}
+	return cs, nil
+}
+
+func (s *sqlCommentStore) Ping() error {
+	err := s.db.Ping()
+	if err != nil {
+		return fmt.Errorf("sqlCommentStore.Ping: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlCommentStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlCommentStore) Update(post string, fn func([]Comment) ([]Comment, error)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("sqlCommentStore.Update: %w", err)
+	}
+	defer tx.Rollback()
+	if s.pg {
+		// other instances may update the post at the same time
+		_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", post)
+		if err != nil {
+			return fmt.Errorf("sqlCommentStore.Update: %w", err)
+		}
+	}
+	cs, err := loadSQLComments(tx, s.pg, post)
+	if err != nil {
+		return fmt.Errorf("sqlCommentStore.Update: %w", err)
+	}
+	cs, err = fn(cs)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(rebind(s.pg, "DELETE FROM comments WHERE post = ?"), post)
+	if err != nil {
+		return fmt.Errorf("sqlCommentStore.Update: %w", err)
+	}
+	for i, c := range cs {
+		t := sql.NullTime{Time: c.Time, Valid: !c.Time.IsZero()}
+		_, err = tx.Exec(rebind(s.pg, `INSERT INTO comments (post, seq, id, parent, name, comment, status, emailhash, time, reports, type, source, reporters, account)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			post, i, c.ID, c.ParentID, c.Name, c.Comment, c.Status, c.EmailHash, t, c.Reports, c.Type, c.Source,
+			strings.Join(c.Reporters, ","), c.Account)
+		if err != nil {
+			return fmt.Errorf("sqlCommentStore.Update: %w", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("sqlCommentStore.Update: %w", err)
+	}
+	return nil
+}
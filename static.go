@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// staticTypes are MIME types of files commonly served from /static/ that
+// the system's MIME table may lack.
+var staticTypes = map[string]string{
+	".ico":         "image/x-icon",
+	".otf":         "font/otf",
+	".ttf":         "font/ttf",
+	".webmanifest": "application/manifest+json",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+}
+
+func init() {
+	for ext, typ := range staticTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, typ)
+		}
+	}
+}
+
+// makeStaticFileHandler serves the files of -static-dir under /static/,
+// cacheable for -static-maxage. Folders and hidden files are not served.
+func makeStaticFileHandler() http.HandlerFunc {
+	dir := http.Dir(*flagStaticDir)
+	cacheControl := "public, max-age=" + strconv.Itoa(int(flagStaticMaxAge.Seconds()))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/static/"))
+		if strings.Contains(name, "/.") {
+			notFound(w, r)
+			return
+		}
+		f, err := dir.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			notFound(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeStaticFileHandler: %w", err))
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			serverError(w, r, fmt.Errorf("makeStaticFileHandler: %w", err))
+			return
+		}
+		if fi.IsDir() {
+			notFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	}
+}
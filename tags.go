@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+type Tag struct {
+	Name  string
+	Pages Pages
+}
+
+// Count returns the number of pages carrying the tag, for sizing tag clouds.
+func (t Tag) Count() int {
+	return len(t.Pages)
+}
+
+type Tags []Tag
+
+// collectTags groups ps by tag. Tags are compared case-insensitively and
+// sorted by name; the spelling of the first occurrence wins.
+func collectTags(ps Pages) Tags {
+	idx := map[string]int{}
+	var ts Tags
+	for _, p := range ps {
+		for _, name := range p.Tags {
+			key := strings.ToLower(name)
+			i, ok := idx[key]
+			if !ok {
+				i = len(ts)
+				idx[key] = i
+				ts = append(ts, Tag{Name: name})
+			}
+			ts[i].Pages = append(ts[i].Pages, p)
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		return strings.ToLower(ts[i].Name) < strings.ToLower(ts[j].Name)
+	})
+	return ts
+}
+
+// Lookup returns the tag called name, ignoring case.
+func (ts Tags) Lookup(name string) (Tag, bool) {
+	for _, t := range ts {
+		if strings.EqualFold(t.Name, name) {
+			return t, true
+		}
+	}
+	return Tag{}, false
+}
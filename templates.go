@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partials are the templates parsed together with every content template
+// of the site.
+var partials = []string{
+	"base.tmpl.html",
+	"header.tmpl.html",
+	"meta.tmpl.html",
+	"footer.tmpl.html",
+	"comment.tmpl.html",
+	"tagcloud.tmpl.html",
+	"archivelist.tmpl.html",
+	"byline.tmpl.html",
+	"toc.tmpl.html",
+	"math.tmpl.html",
+	"diagrams.tmpl.html",
+}
+
+// adminPartials are the templates parsed together with every content
+// template of the admin area, which has a layout of its own. The table of
+// contents is shared with the site for the previews of the editor.
+var adminPartials = []string{
+	"admin/base.tmpl.html",
+	"toc.tmpl.html",
+}
+
+// defaultTemplates are compiled into the binary so the blog runs without
+// a template folder. Files on disk take precedence, see readTemplate.
+//
+//go:embed templates
+var embeddedTemplates embed.FS
+
+var defaultTemplates, _ = fs.Sub(embeddedTemplates, "templates")
+
+// readTemplate returns the template file name from the first template
+// folder containing it, else from the compiled in defaults.
+func readTemplate(name string) ([]byte, error) {
+	for _, dir := range templateDirs() {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return b, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("readTemplate: %w", err)
+		}
+	}
+	b, err := fs.ReadFile(defaultTemplates, name)
+	if err != nil {
+		return nil, fmt.Errorf("readTemplate: %w", err)
+	}
+	return b, nil
+}
+
+// parseFiles parses the content template together with the partials.
+func parseFiles(partials []string, content string) (*template.Template, error) {
+	t := template.New(content).Funcs(templateFuncs)
+	for _, name := range append(partials[:len(partials):len(partials)], content) {
+		b, err := readTemplate(name)
+		if err != nil {
+			return nil, fmt.Errorf("parseFiles: %w", err)
+		}
+		tt := t
+		if name != content {
+			tt = t.New(name)
+		}
+		_, err = tt.Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("parseFiles: %s: %w", name, err)
+		}
+	}
+	return t, nil
+}
+
+// templates is the cache all handlers of the site render through, and
+// adminTemplates the one of the admin area.
+var (
+	templates      = newTemplateCache(partials)
+	adminTemplates = newTemplateCache(adminPartials)
+)
+
+// templateCache parses content templates on first use and keeps them. In
+// dev mode the cache is dropped whenever a file in the template folders
+// changes, so edits show up on the next request.
+type templateCache struct {
+	partials []string
+
+	mutex sync.Mutex
+	tmpls map[string]*template.Template
+	dev   bool
+	stamp time.Time
+}
+
+func newTemplateCache(partials []string) *templateCache {
+	return &templateCache{partials: partials, tmpls: map[string]*template.Template{}}
+}
+
+func (c *templateCache) get(content string) (*template.Template, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.dev {
+		var stamp time.Time
+		for _, dir := range templateDirs() {
+			if t := latestChange(dir); t.After(stamp) {
+				stamp = t
+			}
+		}
+		if stamp.After(c.stamp) {
+			c.tmpls = map[string]*template.Template{}
+			c.stamp = stamp
+		}
+	}
+	if t, ok := c.tmpls[content]; ok {
+		return t, nil
+	}
+	t, err := parseFiles(c.partials, content)
+	if err != nil {
+		return nil, fmt.Errorf("templateCache.get: %w", err)
+	}
+	c.tmpls[content] = t
+	return t, nil
+}
+
+// reset drops the parsed templates, so they are parsed again on next use.
+func (c *templateCache) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.tmpls = map[string]*template.Template{}
+}
+
+// execute renders the content template with the base layout. Nothing is
+// written to w if the template fails, so the caller can still reply with
+// an error page.
+func (c *templateCache) execute(w io.Writer, content string, data interface{}) error {
+	b, err := c.render(content, data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// render returns the content template rendered with the base layout.
+func (c *templateCache) render(content string, data interface{}) ([]byte, error) {
+	t, err := c.get(content)
+	if err != nil {
+		return nil, err
+	}
+	return executeBase(t, data)
+}
+
+func executeBase(t *template.Template, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := t.ExecuteTemplate(&buf, "base", data)
+	if err != nil {
+		return nil, fmt.Errorf("executeBase: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// latestChange returns the newest modification time below dir.
+func latestChange(dir string) time.Time {
+	var latest time.Time
+	filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+		return nil
+	})
+	return latest
+}
+
+// validTemplateName reports whether name refers to a content template in
+// the template folder rather than to an arbitrary file.
+func validTemplateName(name string) bool {
+	return name != "" && name == filepath.Base(name) && strings.HasSuffix(name, ".tmpl.html")
+}
+
+// renderPage renders p with the content template from its front matter,
+// falling back to def if none is set or it cannot be parsed, and a fresh
+// comment form token.
+func renderPage(w http.ResponseWriter, c *templateCache, def string, p Page) error {
+	b, err := pageHTML(c, def, p)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(fillCommentTokens(b, p.Name))
+	return err
+}
+
+// pageHTML returns p rendered like renderPage does.
+func pageHTML(c *templateCache, def string, p Page) ([]byte, error) {
+	name := def
+	if p.Template != "" {
+		if validTemplateName(p.Template) {
+			name = p.Template
+		} else {
+			slog.Warn("invalid template name", "page", p.Name, "template", p.Template)
+		}
+	}
+	tmpl, err := c.get(name)
+	if err != nil && name != def {
+		slog.Warn("content template failed, using default", "page", p.Name, "err", err)
+		tmpl, err = c.get(def)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pageHTML: %w", err)
+	}
+	b, err := executeBase(tmpl, p)
+	if err != nil {
+		return nil, fmt.Errorf("pageHTML: %w", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,101 @@
+// editor.js shows the preview of the admin editor while typing, rendered
+// by /admin/preview like the published post, and uploads files dropped or
+// pasted into the source to /admin/upload, inserting their markdown.
+(function () {
+    var form = document.getElementById("editor");
+    var preview = document.getElementById("preview");
+    if (!form || !preview || !window.fetch) {
+        return;
+    }
+    var delay = 500, timer, seq = 0;
+
+    function show(cls, text) {
+        var div = document.createElement("div");
+        div.className = "alert " + cls;
+        div.textContent = text;
+        preview.replaceChildren(div);
+    }
+
+    function update() {
+        var n = ++seq;
+        fetch("/admin/preview", {
+            method: "POST",
+            body: new URLSearchParams(new FormData(form)),
+            credentials: "same-origin"
+        }).then(function (res) {
+            return res.text().then(function (text) {
+                if (n !== seq) {
+                    return;
+                }
+                if (res.redirected) {
+                    show("alert-warning", "The session ended. Log in again in another tab before saving.");
+                } else if (res.ok) {
+                    preview.innerHTML = text;
+                } else {
+                    show("alert-danger", text);
+                }
+            });
+        }).catch(function (err) {
+            if (n === seq) {
+                show("alert-danger", "No preview: " + err);
+            }
+        });
+    }
+
+    function insert(text) {
+        var source = form.elements.source;
+        var start = source.selectionStart, end = source.selectionEnd;
+        source.value = source.value.slice(0, start) + text + source.value.slice(end);
+        source.selectionStart = source.selectionEnd = start + text.length;
+        source.dispatchEvent(new Event("input", {bubbles: true}));
+    }
+
+    function upload(files) {
+        Array.prototype.forEach.call(files, function (file) {
+            var body = new FormData();
+            body.append("csrf", form.elements.csrf.value);
+            body.append("file", file);
+            fetch("/admin/upload", {
+                method: "POST",
+                body: body,
+                headers: {"Accept": "application/json"},
+                credentials: "same-origin"
+            }).then(function (res) {
+                if (!res.ok) {
+                    return res.text().then(function (text) {
+                        var plain = (res.headers.get("Content-Type") || "").indexOf("text/plain") === 0;
+                        throw new Error(plain ? text : res.status + " " + res.statusText);
+                    });
+                }
+                return res.json();
+            }).then(function (u) {
+                insert(u.markdown + "\n");
+            }).catch(function (err) {
+                show("alert-danger", file.name + " was not uploaded: " + err.message);
+            });
+        });
+    }
+
+    form.elements.source.addEventListener("dragover", function (e) {
+        if (e.dataTransfer.types.indexOf("Files") >= 0) {
+            e.preventDefault();
+        }
+    });
+    form.elements.source.addEventListener("drop", function (e) {
+        if (e.dataTransfer.files.length > 0) {
+            e.preventDefault();
+            upload(e.dataTransfer.files);
+        }
+    });
+    form.elements.source.addEventListener("paste", function (e) {
+        if (e.clipboardData && e.clipboardData.files.length > 0) {
+            e.preventDefault();
+            upload(e.clipboardData.files);
+        }
+    });
+    form.addEventListener("input", function () {
+        clearTimeout(timer);
+        timer = setTimeout(update, delay);
+    });
+    update();
+})();
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// themeDir returns the folder of the selected theme, or "" if none is
+// selected. A theme folder holds a templates and a files subfolder, each
+// of them optional.
+func themeDir() string {
+	if *flagTheme == "" {
+		return ""
+	}
+	return filepath.Join(*flagThemesFolder, *flagTheme)
+}
+
+// checkTheme verifies that the selected theme exists.
+func checkTheme() error {
+	dir := themeDir()
+	if dir == "" {
+		return nil
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("checkTheme: %w", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("checkTheme: %s is not a folder", dir)
+	}
+	return nil
+}
+
+// templateDirs returns the folders templates are looked up in, the first
+// one containing a file wins: the site's -tmpl folder, then the theme.
+// Files found in neither are taken from the compiled in defaults, so a
+// site can override a single template without copying the whole set.
+func templateDirs() []string {
+	var dirs []string
+	if *flagTmplFolder != "" {
+		dirs = append(dirs, *flagTmplFolder)
+	}
+	if dir := themeDir(); dir != "" {
+		dirs = append(dirs, filepath.Join(dir, "templates"))
+	}
+	return dirs
+}
+
+// makeFilesHandler serves /files/ from the theme's files folder, falling
+// back to the -files folder for anything the theme doesn't provide.
+func makeFilesHandler() http.Handler {
+	site := http.FileServer(http.Dir(*flagFilesFolder))
+	dir := themeDir()
+	if dir == "" {
+		return http.StripPrefix("/files/", site)
+	}
+	theme := http.Dir(filepath.Join(dir, "files"))
+	themeServer := http.FileServer(theme)
+	return http.StripPrefix("/files/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := theme.Open(path.Clean("/" + r.URL.Path))
+		if err == nil {
+			fi, err := f.Stat()
+			f.Close()
+			if err == nil && !fi.IsDir() {
+				themeServer.ServeHTTP(w, r)
+				return
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			reqLogger(r).Error("opening theme file failed", "err", err)
+		}
+		site.ServeHTTP(w, r)
+	}))
+}
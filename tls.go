@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsConfig returns the TLS settings of the HTTPS server: TLS 1.2 or
+// newer, and for 1.2 only forward secret AEAD cipher suites.
+func tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
+
+// redirectToHTTPS redirects every request to the same URL with https on
+// port.
+func redirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// certManager returns the autocert manager getting certificates for the
+// comma separated domains from Let's Encrypt and keeping them in cache.
+func certManager(domains, cache, email string) *autocert.Manager {
+	var hosts []string
+	for _, d := range strings.Split(domains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			hosts = append(hosts, d)
+		}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(cache),
+		Email:      email,
+	}
+}
+
+// listenTLS sets srv up for HTTPS and returns the function starting it on
+// l, using the certificate -tls-cert and its key -tls-key or, with
+// -acme-domains, certificates obtained and renewed automatically. With
+// -http-port a second listener redirects plain HTTP requests there and
+// answers ACME HTTP challenges; it stops together with srv.
+func listenTLS(srv *http.Server, l net.Listener) func() error {
+	cfg := tlsConfig()
+	redirect := redirectToHTTPS(*flagPort)
+	if *flagACMEDomains != "" {
+		m := certManager(*flagACMEDomains, *flagACMECache, *flagACMEEmail)
+		cfg.GetCertificate = m.GetCertificate
+		cfg.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		redirect = m.HTTPHandler(redirect)
+	}
+	srv.TLSConfig = cfg
+	return func() error {
+		if *flagHTTPPort != "" {
+			rs := newServer(":"+*flagHTTPPort, redirect)
+			srv.RegisterOnShutdown(func() { rs.Shutdown(context.Background()) })
+			go func() {
+				err := rs.ListenAndServe()
+				if err != nil && !errors.Is(err, http.ErrServerClosed) {
+					slog.Error("redirect server failed", "err", err)
+				}
+			}()
+		}
+		return srv.ServeTLS(l, *flagTLSCert, *flagTLSKey)
+	}
+}
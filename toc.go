@@ -0,0 +1,41 @@
+package main
+
+import (
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var headingRe = regexp.MustCompile(`(?s)<h([1-6]) id="([^"]+)"[^>]*>(.*?)</h[1-6]>`)
+
+// TOCEntry is a heading of a page with the headings nested below it.
+type TOCEntry struct {
+	ID       string
+	Title    string
+	Level    int
+	Children []*TOCEntry
+}
+
+// buildTOC collects the headings of rendered content into a tree. A
+// heading becomes the child of the closest preceding heading with a lower
+// level.
+func buildTOC(content template.HTML) []*TOCEntry {
+	var roots []*TOCEntry
+	var stack []*TOCEntry
+	for _, m := range headingRe.FindAllStringSubmatch(string(content), -1) {
+		level, _ := strconv.Atoi(m[1])
+		e := &TOCEntry{ID: m[2], Title: strings.Join(strings.Fields(plainText(template.HTML(m[3]))), " "), Level: level}
+		for len(stack) > 0 && stack[len(stack)-1].Level >= level {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			roots = append(roots, e)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, e)
+		}
+		stack = append(stack, e)
+	}
+	return roots
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uploadTypes maps the types of files the admin area takes, as sniffed
+// from their content, to the extension they are stored with. SVG is left
+// out, as it can carry scripts.
+var uploadTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+	"audio/mpeg":      ".mp3",
+	"application/ogg": ".ogg",
+	"video/mp4":       ".mp4",
+	"video/webm":      ".webm",
+}
+
+// Errors of storeUpload for files it does not take: errUploadType for a
+// type not in uploadTypes, errUploadInvalid for images it cannot parse.
+var (
+	errUploadType    = errors.New("unsupported file type")
+	errUploadInvalid = errors.New("invalid file")
+)
+
+// upload is a stored upload as the admin area shows it: its URL and the
+// markdown linking it, an image for images.
+type upload struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Markdown string `json:"markdown"`
+	Size     int    `json:"size"`
+}
+
+// uploadLimit is the largest request body an upload may come in.
+func uploadLimit() int64 {
+	return int64(*flagUploadMax)<<20 + 64<<10
+}
+
+// maxUploadPixels is the largest image, in pixels, stripMetadata decodes
+// to turn it. Decoding needs some bytes per pixel, so a small upload
+// claiming huge dimensions could otherwise take all the memory.
+const maxUploadPixels = 50_000_000
+
+// storeUpload stores the file b uploaded as name below -upload-dir in a
+// folder of the month now. Its name is the slug of name followed by a hash
+// of the stored content, so the same file uploaded twice is stored once.
+// Images are stored without the metadata of the camera. With -s3-files
+// the file is stored in the bucket too, like the other files.
+func storeUpload(name string, b []byte, now time.Time) (upload, error) {
+	ct := http.DetectContentType(b)
+	ext, ok := uploadTypes[ct]
+	if !ok {
+		return upload{}, fmt.Errorf("storeUpload: %w %s", errUploadType, ct)
+	}
+	b, err := stripMetadata(ct, b)
+	if err != nil {
+		return upload{}, fmt.Errorf("storeUpload: %w: %v", errUploadInvalid, err)
+	}
+	base := strings.TrimSuffix(path.Base(filepath.ToSlash(name)), path.Ext(name))
+	slug := slugify(base)
+	if slug == "" {
+		slug = "file"
+	}
+	sum := sha256.Sum256(b)
+	rel := path.Join(*flagUploadDir, now.Format("2006/01"), slug+"-"+hex.EncodeToString(sum[:6])+ext)
+	fpath := filepath.Join(*flagFilesFolder, filepath.FromSlash(rel))
+	_, err = os.Stat(fpath)
+	if errors.Is(err, os.ErrNotExist) && filesMirror != nil {
+		err = filesMirror.put(rel, b, now)
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = writeFileAtomic(fpath, b, now)
+	}
+	if err != nil {
+		return upload{}, fmt.Errorf("storeUpload: %w", err)
+	}
+	u := upload{Name: rel, URL: "/files/" + rel, Size: len(b)}
+	alt := strings.NewReplacer("[", "", "]", "").Replace(base)
+	if strings.HasPrefix(ct, "image/") {
+		u.Markdown = "![" + alt + "](" + u.URL + ")"
+	} else {
+		u.Markdown = "[" + alt + "](" + u.URL + ")"
+	}
+	return u, nil
+}
+
+// stripMetadata returns the image b of type ct without its EXIF, XMP and
+// text metadata, which may tell where and with what a photo was taken.
+// JPEGs turned by their EXIF orientation are turned for real first. Other
+// files are returned as they are.
+func stripMetadata(ct string, b []byte) ([]byte, error) {
+	switch ct {
+	case "image/jpeg":
+		return stripJPEG(b)
+	case "image/png":
+		return stripPNG(b)
+	case "image/webp":
+		return stripWebP(b)
+	}
+	return b, nil
+}
+
+// stripJPEG drops the APP1 (EXIF, XMP), APP13 (IPTC) and comment segments
+// of the JPEG b. The ICC color profile in APP2 is kept, also in JPEGs that
+// are encoded again to turn them.
+func stripJPEG(b []byte) ([]byte, error) {
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return nil, errors.New("stripJPEG: not a JPEG")
+	}
+	out := append([]byte(nil), b[:2]...)
+	var icc []byte
+	orientation := 1
+	i := 2
+	for {
+		if i+4 > len(b) || b[i] != 0xff {
+			return nil, errors.New("stripJPEG: invalid segment")
+		}
+		marker := b[i+1]
+		if marker == 0xda {
+			out = append(out, b[i:]...)
+			break
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return nil, errors.New("stripJPEG: invalid segment length")
+		}
+		seg := b[i : i+2+n]
+		switch marker {
+		case 0xe1:
+			if o := exifOrientation(seg[4:]); o > 1 {
+				orientation = o
+			}
+		case 0xed, 0xfe:
+		case 0xe2:
+			if bytes.HasPrefix(seg[4:], []byte("ICC_PROFILE\x00")) {
+				icc = append(icc, seg...)
+			}
+			out = append(out, seg...)
+		default:
+			out = append(out, seg...)
+		}
+		i += 2 + n
+	}
+	if orientation <= 1 {
+		return out, nil
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		return nil, fmt.Errorf("stripJPEG: %w", err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxUploadPixels {
+		return nil, fmt.Errorf("stripJPEG: image of %dx%d pixels is too large", cfg.Width, cfg.Height)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		return nil, fmt.Errorf("stripJPEG: %w", err)
+	}
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, orient(img, orientation), &jpeg.Options{Quality: 90})
+	if err != nil {
+		return nil, fmt.Errorf("stripJPEG: %w", err)
+	}
+	// the encoder writes no APP segments, so the profile follows the SOI
+	enc := buf.Bytes()
+	return append(append(enc[:2:2], icc...), enc[2:]...), nil
+}
+
+// exifOrientation returns the orientation tag of the APP1 payload p, or
+// 0 if it has none.
+func exifOrientation(p []byte) int {
+	tiff, ok := bytes.CutPrefix(p, []byte("Exif\x00\x00"))
+	if !ok || len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if string(tiff[:2]) == "II" {
+		order = binary.LittleEndian
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 0
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for e := ifd + 2; e+12 <= len(tiff) && n > 0; e, n = e+12, n-1 {
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			return int(order.Uint16(tiff[e+8:]))
+		}
+	}
+	return 0
+}
+
+// orient returns img turned and flipped as the EXIF orientation o says
+// it is to be shown.
+func orient(img image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := x, y
+			switch o {
+			case 2:
+				sx = w - 1 - x
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sy = h - 1 - y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// stripPNG drops the eXIf, text and time chunks of the PNG b.
+func stripPNG(b []byte) ([]byte, error) {
+	const sig = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(b, []byte(sig)) {
+		return nil, errors.New("stripPNG: not a PNG")
+	}
+	out := append([]byte(nil), sig...)
+	for i := len(sig); i < len(b); {
+		if i+12 > len(b) {
+			return nil, errors.New("stripPNG: invalid chunk")
+		}
+		n := int(binary.BigEndian.Uint32(b[i:]))
+		if n < 0 || i+12+n > len(b) {
+			return nil, errors.New("stripPNG: invalid chunk length")
+		}
+		switch string(b[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out = append(out, b[i:i+12+n]...)
+		}
+		i += 12 + n
+	}
+	return out, nil
+}
+
+// stripWebP drops the EXIF and XMP chunks of the WebP b and clears their
+// flags in its VP8X header.
+func stripWebP(b []byte) ([]byte, error) {
+	if len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return nil, errors.New("stripWebP: not a WebP")
+	}
+	out := append([]byte(nil), b[:12]...)
+	for i := 12; i < len(b); {
+		if i+8 > len(b) {
+			return nil, errors.New("stripWebP: invalid chunk")
+		}
+		n := int(binary.LittleEndian.Uint32(b[i+4:]))
+		end := i + 8 + n + n%2
+		if n < 0 || end > len(b) {
+			return nil, errors.New("stripWebP: invalid chunk length")
+		}
+		switch string(b[i : i+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			start := len(out)
+			out = append(out, b[i:end]...)
+			if n > 0 {
+				out[start+8] &^= 0x08 | 0x04
+			}
+		default:
+			out = append(out, b[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// serveAdminUpload shows the upload form and stores the file posted as
+// file. Clients asking for JSON, like editor.js, get the upload as JSON
+// and errors as text; others the form again with the markdown to paste.
+func serveAdminUpload(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		adminPage
+		Max    int
+		Upload *upload
+		Error  string
+	}{adminPage: newAdminPage(r, "Upload"), Max: *flagUploadMax}
+	api := strings.Contains(r.Header.Get("Accept"), "application/json")
+	fail := func(status int, msg string) {
+		if api {
+			http.Error(w, msg, status)
+			return
+		}
+		data.Error = msg
+		renderAdmin(w, r, status, "admin/upload.tmpl.html", data)
+	}
+	if r.Method != http.MethodPost {
+		renderAdmin(w, r, http.StatusOK, "admin/upload.tmpl.html", data)
+		return
+	}
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		fail(http.StatusBadRequest, "No file was sent.")
+		return
+	}
+	defer f.Close()
+	if fh.Size > int64(*flagUploadMax)<<20 {
+		fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("The file is larger than %d MB.", *flagUploadMax))
+		return
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("serveAdminUpload: %w", err))
+		return
+	}
+	u, err := storeUpload(fh.Filename, b, time.Now())
+	if errors.Is(err, errUploadType) {
+		fail(http.StatusUnsupportedMediaType, "Files of type "+http.DetectContentType(b)+" cannot be uploaded.")
+		return
+	}
+	if errors.Is(err, errUploadInvalid) {
+		fail(http.StatusBadRequest, "The file is damaged: "+err.Error())
+		return
+	}
+	if err != nil {
+		serverError(w, r, fmt.Errorf("serveAdminUpload: %w", err))
+		return
+	}
+	reqLogger(r).Info("file uploaded", "file", u.Name, "size", u.Size, "user", data.User)
+	if api {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(u)
+		return
+	}
+	data.Upload = &u
+	renderAdmin(w, r, http.StatusCreated, "admin/upload.tmpl.html", data)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles of users. Admins may do everything in the admin area, moderators
+// only see the dashboard and moderate comments.
+const (
+	roleAdmin     = "admin"
+	roleModerator = "moderator"
+)
+
+// User is an account of the users file. Password is the bcrypt hash of
+// the password, empty for users only logging in with a provider. Accounts
+// are the provider accounts linked to the user, like github:583231.
+type User struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password,omitempty"`
+	Role     string   `json:"role"`
+	Accounts []string `json:"accounts,omitempty"`
+}
+
+// Users are the accounts of the users file by name.
+type Users map[string]User
+
+// dummyHash is compared against when a user name is unknown, so a login
+// takes as long as one with a wrong password.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("goblog"), bcrypt.DefaultCost)
+
+// loadUsers reads the JSON list of users in fpath. A missing file yields
+// no users.
+func loadUsers(fpath string) (Users, error) {
+	us := Users{}
+	f, err := os.Open(fpath)
+	if errors.Is(err, os.ErrNotExist) {
+		return us, nil
+	}
+	if err != nil {
+		return us, fmt.Errorf("loadUsers: %w", err)
+	}
+	defer f.Close()
+	var list []User
+	err = json.NewDecoder(f).Decode(&list)
+	if err != nil {
+		return us, fmt.Errorf("loadUsers.Decode: %w", err)
+	}
+	for _, u := range list {
+		if u.Role != roleAdmin && u.Role != roleModerator {
+			return us, fmt.Errorf("loadUsers: user %q has unknown role %q", u.Name, u.Role)
+		}
+		us[u.Name] = u
+	}
+	return us, nil
+}
+
+// may reports whether u has role or one including it.
+func (u User) may(role string) bool {
+	return u.Role == roleAdmin || u.Role == role
+}
+
+// linked reports whether account is linked to u.
+func (u User) linked(account string) bool {
+	for _, a := range u.Accounts {
+		if a == account {
+			return true
+		}
+	}
+	return false
+}
+
+// byAccount returns the user the provider account is linked to.
+func (us Users) byAccount(account string) (User, bool) {
+	for _, u := range us {
+		if u.linked(account) {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+// login returns the user name if pass is its password.
+func (us Users) login(name, pass string) (User, bool) {
+	u, ok := us[name]
+	hash := []byte(u.Password)
+	if !ok {
+		hash = dummyHash
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(pass))
+	return u, ok && err == nil
+}
+
+// adminEnabled reports whether anyone can log in: there are users in
+// -users or a -moderation-password. A users file that fails to load
+// counts as users, so logins fail instead of the routes disappearing.
+func adminEnabled() bool {
+	if *flagModPassword != "" {
+		return true
+	}
+	us, err := loadUsers(*flagUsers)
+	return err != nil || len(us) > 0
+}
+
+// checkAdminLogin returns the user logging in to the admin area with name
+// and pass: a user of -users, or as long as there are none, an admin named
+// admin with the -moderation-password and any name.
+func checkAdminLogin(name, pass string) (User, bool, error) {
+	us, err := loadUsers(*flagUsers)
+	if err != nil {
+		return User{}, false, fmt.Errorf("checkAdminLogin: %w", err)
+	}
+	if len(us) > 0 {
+		u, ok := us.login(name, pass)
+		return u, ok, nil
+	}
+	ok := *flagModPassword != "" && subtle.ConstantTimeCompare([]byte(pass), []byte(*flagModPassword)) == 1
+	return User{Name: "admin", Role: roleAdmin}, ok, nil
+}
+
+// saveUsers writes us to fpath, sorted by name.
+func saveUsers(fpath string, us Users) error {
+	list := make([]User, 0, len(us))
+	for _, u := range us {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("saveUsers: %w", err)
+	}
+	err = writeFileAtomic(fpath, append(b, '\n'), time.Now())
+	if err != nil {
+		return fmt.Errorf("saveUsers: %w", err)
+	}
+	err = os.Chmod(fpath, 0o600)
+	if err != nil {
+		return fmt.Errorf("saveUsers: %w", err)
+	}
+	return nil
+}
+
+// addUser adds the user given as name or name:role to the users file with
+// the password read as first line of r, or changes the password and role
+// of an existing one. The role defaults to admin for new users.
+func addUser(fpath, spec string, r io.Reader) error {
+	name, role, _ := strings.Cut(spec, ":")
+	if name == "" {
+		return errors.New("addUser: no user name")
+	}
+	us, err := loadUsers(fpath)
+	if err != nil {
+		return fmt.Errorf("addUser: %w", err)
+	}
+	if role == "" {
+		role = roleAdmin
+		if u, ok := us[name]; ok {
+			role = u.Role
+		}
+	}
+	if role != roleAdmin && role != roleModerator {
+		return fmt.Errorf("addUser: unknown role %q", role)
+	}
+	pass, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("addUser: %w", err)
+	}
+	pass = strings.TrimRight(pass, "\r\n")
+	if len(pass) < 8 {
+		return errors.New("addUser: the password needs at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("addUser: %w", err)
+	}
+	u := us[name]
+	u.Name, u.Password, u.Role = name, string(hash), role
+	us[name] = u
+	return saveUsers(fpath, us)
+}
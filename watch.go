@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// settleDelay is how long a watched folder has to stay quiet after a
+// change before subscribers are told, so saving or syncing many files at
+// once gives a single signal.
+const settleDelay = 100 * time.Millisecond
+
+// dirWatcher watches folders and everything below them for changes. It
+// counts the bursts of changes it has seen, so readers can tell whether
+// what they read earlier is still current.
+type dirWatcher struct {
+	watcher *fsnotify.Watcher
+
+	mutex sync.Mutex
+	gen   uint64
+	subs  []chan struct{}
+}
+
+// watchDirs starts watching dirs and their subfolders. Folders that don't
+// exist are skipped.
+func watchDirs(dirs ...string) (*dirWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("watchDirs: %w", err)
+	}
+	dw := &dirWatcher{watcher: w}
+	for _, dir := range dirs {
+		err = dw.add(dir)
+		if err != nil {
+			w.Close()
+			return nil, fmt.Errorf("watchDirs: %w", err)
+		}
+	}
+	go dw.run()
+	return dw, nil
+}
+
+// add watches dir and the folders below it, fsnotify not being recursive.
+// Dot folders are left out like in content listings.
+func (dw *dirWatcher) add(dir string) error {
+	return filepath.Walk(dir, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if fpath != dir && strings.HasPrefix(fi.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return dw.watcher.Add(fpath)
+	})
+}
+
+func (dw *dirWatcher) run() {
+	var settled <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-dw.watcher.Events:
+			if !ok {
+				return
+			}
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+			if ev.Has(fsnotify.Create) {
+				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+					err = dw.add(ev.Name)
+					if err != nil {
+						slog.Warn("watching new folder failed", "dir", ev.Name, "err", err)
+					}
+				}
+			}
+			settled = time.After(settleDelay)
+		case err, ok := <-dw.watcher.Errors:
+			if !ok {
+				return
+			}
+			// events may have been lost, so assume everything changed
+			slog.Warn("watching files failed", "err", err)
+			settled = time.After(settleDelay)
+		case <-settled:
+			settled = nil
+			dw.notify()
+		}
+	}
+}
+
+func (dw *dirWatcher) notify() {
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+	dw.gen++
+	for _, c := range dw.subs {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// generation returns the number of bursts of changes seen so far.
+func (dw *dirWatcher) generation() uint64 {
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+	return dw.gen
+}
+
+// subscribe returns a channel that receives a value after every burst of
+// changes.
+func (dw *dirWatcher) subscribe() <-chan struct{} {
+	c := make(chan struct{}, 1)
+	dw.mutex.Lock()
+	dw.subs = append(dw.subs, c)
+	dw.mutex.Unlock()
+	return c
+}
+
+// newWatchedContentStore returns the file content store of dir, watching
+// it with -watch. If watching fails, e.g. because the inotify limits are
+// reached, the store falls back to polling.
+func newWatchedContentStore(dir string) *fileContentStore {
+	s := newFileContentStore(dir)
+	if *flagWatch {
+		err := s.watch()
+		if err != nil {
+			slog.Warn("watching content failed, polling instead", "dir", dir, "err", err)
+		}
+	}
+	return s
+}
+
+// templatesChanged receives a value whenever watchTemplates reloaded the
+// templates. It is nil without -watch.
+var templatesChanged <-chan struct{}
+
+// watchTemplates watches the template folders. On changes the parsed
+// templates and all pages rendered with them are dropped and the
+// shortcodes are loaded again.
+func watchTemplates() error {
+	dirs := templateDirs()
+	if len(dirs) == 0 {
+		return nil
+	}
+	w, err := watchDirs(dirs...)
+	if err != nil {
+		return fmt.Errorf("watchTemplates: %w", err)
+	}
+	changes := w.subscribe()
+	reloaded := make(chan struct{}, 1)
+	go func() {
+		for range changes {
+			templates.reset()
+			adminTemplates.reset()
+			err := setShortcodes()
+			if err != nil {
+				slog.Warn("loading shortcodes failed, keeping the old ones", "err", err)
+			}
+			sources.clear()
+			rendered.clear()
+			slog.Info("templates reloaded")
+			select {
+			case reloaded <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	templatesChanged = reloaded
+	return nil
+}
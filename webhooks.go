@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Comment events webhooks are fired for.
+const (
+	eventCommentCreated  = "comment.created"
+	eventCommentApproved = "comment.approved"
+	eventCommentDeleted  = "comment.deleted"
+)
+
+// webhookAttempts is how often the delivery of an event to a URL is tried.
+const webhookAttempts = 3
+
+// webhookEvent is the JSON body posted to the webhook URLs.
+type webhookEvent struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Post    string    `json:"post"`
+	URL     string    `json:"url"`
+	Comment Comment   `json:"comment"`
+}
+
+// webhookSender posts comment events to the configured URLs in the
+// background. With a secret the body is signed, the X-Goblog-Signature
+// header holds "sha256=" and the hex HMAC-SHA256 of the body.
+type webhookSender struct {
+	urls   []string
+	secret []byte
+	client *http.Client
+	queue  chan webhookEvent
+	done   chan struct{}
+}
+
+// webhooks fires the comment events; nil disables them. It is set up in
+// main from -webhooks.
+var webhooks *webhookSender
+
+func newWebhookSender(urls []string, secret string) *webhookSender {
+	h := &webhookSender{
+		secret: []byte(secret),
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan webhookEvent, 100),
+		done:   make(chan struct{}),
+	}
+	for _, u := range urls {
+		if u = strings.TrimSpace(u); u != "" {
+			h.urls = append(h.urls, u)
+		}
+	}
+	go h.run()
+	return h
+}
+
+// fire queues event about comment c on post.
+func (h *webhookSender) fire(event, post string, c Comment) {
+	ev := webhookEvent{
+		Event:   event,
+		Time:    time.Now().UTC(),
+		Post:    post,
+		URL:     absURL("/page/"+post) + "#comment-" + c.ID,
+		Comment: c,
+	}
+	select {
+	case h.queue <- ev:
+	default:
+		slog.Warn("webhook queue full, dropping event", "event", event, "post", post)
+	}
+}
+
+func (h *webhookSender) run() {
+	defer close(h.done)
+	for ev := range h.queue {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			slog.Error("encoding webhook event failed", "err", err)
+			continue
+		}
+		for _, u := range h.urls {
+			err = h.deliver(u, body)
+			if err != nil {
+				slog.Error("delivering webhook failed", "event", ev.Event, "err", err)
+			}
+		}
+	}
+}
+
+// close delivers the queued events and stops h. fire must not be called
+// afterwards.
+func (h *webhookSender) close() {
+	close(h.queue)
+	<-h.done
+}
+
+// deliver posts body to u, retrying with growing pauses if it fails.
+func (h *webhookSender) deliver(u string, body []byte) error {
+	var err error
+	for i := 0; i < webhookAttempts; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i*i) * time.Second)
+		}
+		err = h.post(u, body)
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("webhookSender.deliver: %w", err)
+}
+
+func (h *webhookSender) post(u string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "goblog")
+	if len(h.secret) > 0 {
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(body)
+		req.Header.Set("X-Goblog-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return nil
+}
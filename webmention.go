@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Modes of -webmention for incoming webmentions.
+const (
+	mentionsOff    = "off"
+	mentionsHold   = "hold"
+	mentionsAccept = "accept"
+)
+
+// commentWebmention is the Type of comments received as webmentions.
+const commentWebmention = "webmention"
+
+// maxMentionPage caps what is read of the pages mentions are verified
+// against and endpoints are discovered on.
+const maxMentionPage = 1 << 20
+
+// webmention is a mention of target on source. Incoming mentions carry
+// the post they target, outgoing ones don't.
+type webmention struct {
+	source string
+	target string
+	post   string
+}
+
+// mentionQueue verifies incoming and sends outgoing webmentions in the
+// background.
+type mentionQueue struct {
+	client *http.Client
+	queue  chan webmention
+	done   chan struct{}
+}
+
+// mentions handles webmentions; nil disables receiving and sending them.
+// It is set up in main from -webmention and -webmention-send.
+var mentions *mentionQueue
+
+func newMentionQueue() *mentionQueue {
+	q := &mentionQueue{
+		client: publicClient(10 * time.Second),
+		queue:  make(chan webmention, 100),
+		done:   make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// add queues m.
+func (q *mentionQueue) add(m webmention) bool {
+	select {
+	case q.queue <- m:
+		return true
+	default:
+		slog.Warn("webmention queue full, dropping mention", "source", m.source, "target", m.target)
+		return false
+	}
+}
+
+func (q *mentionQueue) run() {
+	defer close(q.done)
+	for m := range q.queue {
+		var err error
+		if m.post != "" {
+			err = q.verify(m)
+		} else {
+			err = q.send(m)
+		}
+		if err != nil {
+			slog.Error("processing webmention failed", "source", m.source, "target", m.target, "err", err)
+		}
+	}
+}
+
+// close processes the queued mentions and stops q. add must not be called
+// afterwards.
+func (q *mentionQueue) close() {
+	close(q.queue)
+	<-q.done
+}
+
+// mentionEndpoint returns the URL of the webmention endpoint, or "" if
+// receiving webmentions is off. It is the webmention template function.
+func mentionEndpoint() string {
+	if *flagWebmention == mentionsOff {
+		return ""
+	}
+	return absURL("/webmention")
+}
+
+// htmlInfo is what a page tells about itself for webmentions.
+type htmlInfo struct {
+	title    string
+	links    []string
+	endpoint string
+}
+
+// scanHTML returns the title of the HTML page read from r, the absolute
+// URLs of its links, images and media and its webmention endpoint,
+// resolved against base.
+func scanHTML(r io.Reader, base *url.URL) htmlInfo {
+	var info htmlInfo
+	z := html.NewTokenizer(r)
+	inTitle := false
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			info.title = strings.Join(strings.Fields(info.title), " ")
+			return info
+		case html.TextToken:
+			if inTitle {
+				info.title += string(z.Text())
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "title" {
+				inTitle = false
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			tag := string(name)
+			if tag == "title" && info.title == "" {
+				inTitle = true
+			}
+			var href, rel string
+			for hasAttr {
+				var k, v []byte
+				k, v, hasAttr = z.TagAttr()
+				switch string(k) {
+				case "href", "src":
+					href = string(v)
+				case "rel":
+					rel = string(v)
+				}
+			}
+			ref, err := base.Parse(strings.TrimSpace(href))
+			if err != nil || (tag != "link" && href == "") {
+				continue
+			}
+			if (tag == "a" || tag == "link") && info.endpoint == "" && hasRel(rel, "webmention") {
+				info.endpoint = ref.String()
+			}
+			if href != "" {
+				info.links = append(info.links, ref.String())
+			}
+		}
+	}
+}
+
+// hasRel reports whether the space separated rel values contain want.
+func hasRel(rel, want string) bool {
+	for _, r := range strings.Fields(strings.ToLower(rel)) {
+		if r == want {
+			return true
+		}
+	}
+	return false
+}
+
+// linkEndpoint returns the webmention endpoint in the Link headers h,
+// resolved against base, or "".
+func linkEndpoint(h http.Header, base *url.URL) string {
+	for _, v := range h.Values("Link") {
+		for _, link := range strings.Split(v, ",") {
+			target, params, ok := strings.Cut(link, ";")
+			target = strings.TrimSpace(target)
+			if !ok || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, p := range strings.Split(params, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+				if strings.EqualFold(k, "rel") && hasRel(strings.Trim(v, `"`), "webmention") {
+					ref, err := base.Parse(target[1 : len(target)-1])
+					if err == nil {
+						return ref.String()
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// webURL parses s as an absolute http or https URL.
+func webURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is no http or https URL", s)
+	}
+	return u, nil
+}
+
+// errGone means that the source of a mention is deleted.
+var errGone = errors.New("source gone")
+
+// fetch gets the page u and returns what it tells about itself. Like all
+// requests of q, it only connects to public addresses, as u and the
+// endpoints found come from others.
+func (q *mentionQueue) fetch(u string) (htmlInfo, *http.Response, error) {
+	resp, err := q.client.Get(u)
+	if err != nil {
+		return htmlInfo{}, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return htmlInfo{}, resp, errGone
+	}
+	if resp.StatusCode/100 != 2 {
+		return htmlInfo{}, resp, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return scanHTML(io.LimitReader(resp.Body, maxMentionPage), resp.Request.URL), resp, nil
+}
+
+// linksTo reports whether the page described by info links to the target
+// of m or another URL of its post.
+func (info htmlInfo) linksTo(m webmention) bool {
+	for _, l := range info.links {
+		if l == m.target || linkedPost(l) == m.post {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks that the source of the incoming m links to its target and
+// adds it to the comments of its post, or updates the mention already
+// there. If the source is gone or no longer links to the target, an
+// earlier mention from it is removed.
+func (q *mentionQueue) verify(m webmention) error {
+	info, _, err := q.fetch(m.source)
+	if err != nil && !errors.Is(err, errGone) {
+		return fmt.Errorf("mentionQueue.verify: %w", err)
+	}
+	c := Comment{Type: commentWebmention, Source: m.source, Name: mentionName(m.source), Comment: info.title}
+	err = storeMention(m.post, c, info.linksTo(m), *flagWebmention == mentionsHold, true)
+	if errors.Is(err, errNoComment) {
+		slog.Info("webmention not verified", "source", m.source, "target", m.target)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("mentionQueue.verify: %w", err)
+	}
+	return nil
+}
+
+// errMentioned means that a source mentioned a post already.
+var errMentioned = errors.New("already mentioned")
+
+// storeMention adds the mention c of post from its Source to the comments
+// of post, held for moderation if hold is set. An earlier mention of the
+// same type from the same source is updated if update is set, else
+// errMentioned is returned. If the source does not link to the post, i.e.
+// linked is false, the earlier mention is removed; without one the
+// result is errNoComment.
+func storeMention(post string, c Comment, linked, hold, update bool) error {
+	c.Name = truncate(maxCommentName, c.Name)
+	c.Comment = truncate(maxCommentText, c.Comment)
+	var added *Comment
+	err := commentStore.Update(post, func(cs []Comment) ([]Comment, error) {
+		i := -1
+		for j, old := range cs {
+			if old.Type == c.Type && old.Source == c.Source {
+				i = j
+			}
+		}
+		switch {
+		case !linked && i < 0:
+			return nil, errNoComment
+		case !linked:
+			slog.Info("mention removed", "type", c.Type, "source", c.Source, "post", post)
+			return append(cs[:i], cs[i+1:]...), nil
+		case i >= 0 && !update:
+			return nil, errMentioned
+		case i >= 0:
+			cs[i].Name, cs[i].Comment = c.Name, c.Comment
+			return cs, nil
+		}
+		id, err := newCommentID()
+		if err != nil {
+			return nil, err
+		}
+		c.ID, c.Time = id, time.Now().UTC()
+		if hold {
+			c.Status = commentHeld
+		}
+		added = &c
+		return append(cs, c), nil
+	})
+	if err != nil {
+		return fmt.Errorf("storeMention: %w", err)
+	}
+	if added != nil {
+		slog.Info("mention received", "type", c.Type, "source", c.Source, "post", post)
+		if notifier != nil {
+			notifier.notify(post, *added)
+		}
+		if webhooks != nil {
+			webhooks.fire(eventCommentCreated, post, *added)
+		}
+	}
+	return nil
+}
+
+// linkedPost returns the name of the published post at the URL l, or "".
+// Posts are found by slug, former slug and file name.
+func linkedPost(l string) string {
+	base, err := url.Parse(*flagBaseURL)
+	u, uerr := url.Parse(l)
+	if err != nil || uerr != nil || u.Host != base.Host {
+		return ""
+	}
+	slug, ok := strings.CutPrefix(u.Path, "/page/")
+	p, _, found := findPage(posts.published(), slug)
+	if !ok || !found {
+		return ""
+	}
+	return p.Name
+}
+
+// mentionName returns the name a mention from source is shown with, the
+// host of its URL.
+func mentionName(source string) string {
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return source
+	}
+	return strings.TrimPrefix(u.Host, "www.")
+}
+
+// send discovers the endpoint of the target of the outgoing m and posts
+// the mention there. Targets without an endpoint are skipped.
+func (q *mentionQueue) send(m webmention) error {
+	info, resp, err := q.fetch(m.target)
+	if err != nil {
+		return fmt.Errorf("mentionQueue.send: %w", err)
+	}
+	endpoint := linkEndpoint(resp.Header, resp.Request.URL)
+	if endpoint == "" {
+		endpoint = info.endpoint
+	}
+	if endpoint == "" {
+		return nil
+	}
+	if _, err := webURL(endpoint); err != nil {
+		return fmt.Errorf("mentionQueue.send: %w", err)
+	}
+	resp, err = q.client.PostForm(endpoint, url.Values{"source": {m.source}, "target": {m.target}})
+	if err != nil {
+		return fmt.Errorf("mentionQueue.send: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("mentionQueue.send: %s: %s", endpoint, resp.Status)
+	}
+	slog.Info("webmention sent", "source", m.source, "target", m.target)
+	return nil
+}
+
+// announce queues a webmention for every external page linked from p.
+// It is a publish hook.
+func (q *mentionQueue) announce(p Page) {
+	base, err := url.Parse(*flagBaseURL)
+	if err != nil {
+		return
+	}
+	source := absURL(p.URL())
+	seen := map[string]bool{}
+	for _, l := range scanHTML(strings.NewReader(string(p.Content)), base).links {
+		u, err := webURL(l)
+		if err != nil || u.Host == base.Host || seen[l] {
+			continue
+		}
+		seen[l] = true
+		q.add(webmention{source: source, target: l})
+	}
+}
+
+// makeWebmentionHandlerFunc serves POST /webmention with the source and
+// the target of a mention. Targets have to be published posts; the
+// mention is verified in the background.
+func makeWebmentionHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if mentions == nil || *flagWebmention == mentionsOff {
+			notFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		source, target := r.FormValue("source"), r.FormValue("target")
+		_, err := webURL(source)
+		var t *url.URL
+		if err == nil {
+			t, err = webURL(target)
+		}
+		if err == nil && source == target {
+			err = errors.New("source is target")
+		}
+		post := ""
+		if err == nil {
+			post = linkedPost(t.String())
+			if post == "" {
+				err = errors.New("target is no post")
+			}
+		}
+		if err != nil {
+			reqLogger(r).Info("webmention rejected", "source", source, "target", target, "err", err)
+			renderError(w, r, http.StatusBadRequest)
+			return
+		}
+		if !mentions.add(webmention{source: source, target: target, post: post}) {
+			renderError(w, r, http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "Accepted, the mention is verified shortly.")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// websubAttempts is how often notifying the hub of a topic is tried.
+const websubAttempts = 3
+
+// hubNotifier tells the WebSub hub of -websub-hub in the background which
+// feeds changed, so it can push them to their subscribers.
+type hubNotifier struct {
+	hub    string
+	client *http.Client
+	queue  chan string
+	done   chan struct{}
+}
+
+// websub notifies the hub; nil disables WebSub. It is set up in main from
+// -websub-hub.
+var websub *hubNotifier
+
+func newHubNotifier(hub string) *hubNotifier {
+	h := &hubNotifier{
+		hub:    hub,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan string, 100),
+		done:   make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+// postTopics returns the feeds p appears in: the feeds of the blog and the
+// Atom feeds of its tags.
+func postTopics(p Page) []string {
+	var ts []string
+	for _, f := range siteFeeds() {
+		ts = append(ts, absURL(f.URL))
+	}
+	for _, t := range p.Tags {
+		ts = append(ts, absURL("/tag/"+url.PathEscape(t)+tagFeedSuffix))
+	}
+	return ts
+}
+
+// publish queues the topics of p. It is the publish hook of -websub-hub.
+func (h *hubNotifier) publish(p Page) {
+	for _, t := range postTopics(p) {
+		select {
+		case h.queue <- t:
+		default:
+			slog.Warn("websub queue full, dropping topic", "topic", t)
+		}
+	}
+}
+
+func (h *hubNotifier) run() {
+	defer close(h.done)
+	for t := range h.queue {
+		err := h.notify(t)
+		if err != nil {
+			slog.Error("notifying websub hub failed", "topic", t, "err", err)
+		}
+	}
+}
+
+// close notifies the hub of the queued topics and stops h. publish must
+// not be called afterwards.
+func (h *hubNotifier) close() {
+	close(h.queue)
+	<-h.done
+}
+
+// notify tells the hub that topic changed, retrying with growing pauses
+// if it fails.
+func (h *hubNotifier) notify(topic string) error {
+	var err error
+	for i := 0; i < websubAttempts; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i*i) * time.Second)
+		}
+		err = h.ping(topic)
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("hubNotifier.notify: %w", err)
+}
+
+func (h *hubNotifier) ping(topic string) error {
+	form := url.Values{"hub.mode": {"publish"}, "hub.url": {topic}}
+	req, err := http.NewRequest(http.MethodPost, h.hub, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "goblog")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("hub answered %s", resp.Status)
+	}
+	return nil
+}
+
+// hubLinks returns the links of the feed at self to it and the hub, in
+// the form of Atom links, or nil without -websub-hub.
+func hubLinks(self string) []atomLink {
+	if *flagWebSubHub == "" {
+		return nil
+	}
+	return []atomLink{{Rel: "hub", Href: *flagWebSubHub}, {Rel: "self", Href: absURL(self)}}
+}
+
+// setHubLinks sets the Link header of the response with the feed at self
+// to what hubLinks returns, which is where subscribers look for the hub
+// first.
+func setHubLinks(w http.ResponseWriter, self string) {
+	for _, l := range hubLinks(self) {
+		w.Header().Add("Link", "<"+l.Href+">; rel=\""+l.Rel+"\"")
+	}
+}
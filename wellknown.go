@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Templates of the plain text files served at fixed paths. Like all
+// templates they can be replaced in the template folder.
+const (
+	robotsTemplate   = "robots.tmpl.txt"
+	securityTemplate = "security.tmpl.txt"
+)
+
+// securityTxtDays is how long a security.txt is valid, RFC 9116 asks for
+// less than a year.
+const securityTxtDays = 180
+
+// renderText renders the text template name with data.
+func renderText(name string, data interface{}) ([]byte, error) {
+	b, err := readTemplate(name)
+	if err != nil {
+		return nil, fmt.Errorf("renderText: %w", err)
+	}
+	t, err := template.New(name).Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("renderText: %w", err)
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return nil, fmt.Errorf("renderText: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// serveText replies with the text template name rendered with data, or a
+// 304 if the client has it already.
+func serveText(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	b, err := renderText(name, data)
+	if err != nil {
+		serverError(w, r, fmt.Errorf("serveText: %w", err))
+		return
+	}
+	if notModified(w, r, etagOf(string(b), startTime), startTime) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(b)
+}
+
+// makeRobotsHandlerFunc serves /robots.txt from robotsTemplate.
+func makeRobotsHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := struct {
+			BaseURL string
+		}{absURL("/")}
+		serveText(w, r, robotsTemplate, data)
+	}
+}
+
+// securityContacts returns the contacts of -security-contact as URIs:
+// plain email addresses become mailto: URIs, paths are resolved against
+// -baseurl.
+func securityContacts() []string {
+	var cs []string
+	for _, c := range strings.Split(*flagSecContact, ",") {
+		c = strings.TrimSpace(c)
+		switch {
+		case c == "":
+			continue
+		case strings.HasPrefix(c, "/"):
+			c = absURL(c)
+		case !strings.Contains(c, ":") && strings.Contains(c, "@"):
+			c = "mailto:" + c
+		}
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+// makeSecurityTxtHandlerFunc serves /.well-known/security.txt from
+// securityTemplate if -security-contact is set.
+func makeSecurityTxtHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contacts := securityContacts()
+		if len(contacts) == 0 {
+			notFound(w, r)
+			return
+		}
+		day := time.Now().UTC().Truncate(24 * time.Hour)
+		data := struct {
+			Contacts  []string
+			Expires   string
+			Policy    string
+			Canonical string
+		}{
+			Contacts:  contacts,
+			Expires:   day.AddDate(0, 0, securityTxtDays).Format(time.RFC3339),
+			Canonical: absURL("/.well-known/security.txt"),
+		}
+		if *flagSecPolicy != "" {
+			data.Policy = absURL(*flagSecPolicy)
+		}
+		serveText(w, r, securityTemplate, data)
+	}
+}